@@ -15,59 +15,293 @@
 package libcni
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
 
 	"github.com/appc/cni/pkg/invoke"
+	"github.com/appc/cni/pkg/ns"
 	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
 )
 
+// RuntimeConf describes the container a network is added to or removed
+// from. Args are passed to the plugin as CNI_ARGS, in order; see
+// types.EncodeArgs for the characters they may not contain.
+//
+// The netns is given either as a path in NetNS or, by runtimes that
+// keep it open themselves, as NetNSHandle. The plugin then inherits the
+// open namespace rather than a path that might be replaced in the
+// meantime. NetNSHandle takes precedence when both are set.
+//
+// CapabilityArgs holds data for plugins, such as port mappings, keyed by
+// capability. The plugin receives an entry in the "runtimeConfig" of
+// its config only if the config declares the capability in its
+// "capabilities"; other entries are dropped.
 type RuntimeConf struct {
-	ContainerID string
-	NetNS       string
-	IfName      string
-	Args        [][2]string
+	ContainerID    string
+	NetNS          string
+	NetNSHandle    ns.NetNS
+	IfName         string
+	Args           [][2]string
+	CapabilityArgs map[string]interface{}
 }
 
+// NetworkConfig is a network configuration: the parsed common fields
+// along with the raw JSON handed to the plugin on stdin.
 type NetworkConfig struct {
 	Network *types.NetConf
 	Bytes   []byte
 }
 
+// NetworkConfigList is a chain of plugins that together set up one
+// network. Each entry of Plugins is the config of one plugin, to which
+// the list's name and cniVersion are added when it is run.
+type NetworkConfigList struct {
+	Name       string
+	CNIVersion string
+	Plugins    []*NetworkConfig
+	Bytes      []byte
+}
+
 type CNI interface {
-	AddNetwork(net *NetworkConfig, rt *RuntimeConf) (*types.Result, error)
+	AddNetworkList(net *NetworkConfigList, rt *RuntimeConf) (types.Result, error)
+	DelNetworkList(net *NetworkConfigList, rt *RuntimeConf) error
+
+	AddNetwork(net *NetworkConfig, rt *RuntimeConf) (types.Result, error)
 	DelNetwork(net *NetworkConfig, rt *RuntimeConf) error
 }
 
+// CNIConfig implements CNI by executing plugin binaries found in Path.
+//
+// If LockDir is set, the Add and Del methods hold a file lock there,
+// named after the network, while the plugins run. Invocations for the
+// same network are thus serialized, also across processes sharing
+// LockDir, which keeps them from racing e.g. in host-local IPAM.
 type CNIConfig struct {
-	Path []string
+	Path    []string
+	LockDir string
+}
+
+// AddNetworkList runs the plugins of list in order to add the container
+// described by rt to the network. Every plugin after the first gets
+// the result of the one before it as "prevResult" in its config. The
+// result of the last plugin is returned, converted to the cniVersion of
+// the list.
+//
+// If a plugin fails, the plugins that already succeeded are run again
+// with DEL, in reverse order, before its error is returned. Errors
+// during this rollback are ignored. A list with a plugin config that
+// fails ValidateConfig is refused without running any plugin.
+func (c *CNIConfig) AddNetworkList(list *NetworkConfigList, rt *RuntimeConf) (types.Result, error) {
+	confs := make([]*NetworkConfig, 0, len(list.Plugins))
+	for _, plugin := range list.Plugins {
+		net, err := buildOneConfig(list, plugin, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := ValidateConfig(net); err != nil {
+			return nil, err
+		}
+		confs = append(confs, net)
+	}
+
+	unlock, err := c.lockNetwork(list.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var prevResult types.Result
+	for i, plugin := range list.Plugins {
+		net := confs[i]
+		if prevResult != nil {
+			if net, err = buildOneConfig(list, plugin, prevResult); err != nil {
+				c.rollback(confs[:i], rt)
+				return nil, err
+			}
+		}
+
+		result, err := c.addNetwork(net, rt)
+		if err != nil {
+			c.rollback(confs[:i], rt)
+			return nil, err
+		}
+		prevResult = result
+	}
+	return prevResult, nil
 }
 
-func (c *CNIConfig) AddNetwork(net *NetworkConfig, rt *RuntimeConf) (*types.Result, error) {
+// rollback runs DEL for the plugins of confs in reverse order,
+// ignoring errors, to undo a partially applied list.
+func (c *CNIConfig) rollback(confs []*NetworkConfig, rt *RuntimeConf) {
+	for i := len(confs) - 1; i >= 0; i-- {
+		c.delNetwork(confs[i], rt)
+	}
+}
+
+// DelNetworkList runs the plugins of list with DEL, in the reverse of
+// the order AddNetworkList runs them, to remove the container described
+// by rt from the network. It stops at the first plugin that fails.
+func (c *CNIConfig) DelNetworkList(list *NetworkConfigList, rt *RuntimeConf) error {
+	unlock, err := c.lockNetwork(list.Name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for i := len(list.Plugins) - 1; i >= 0; i-- {
+		net, err := buildOneConfig(list, list.Plugins[i], nil)
+		if err != nil {
+			return err
+		}
+		if err := c.delNetwork(net, rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddNetwork executes the plugin named by the network's type to add the
+// container described by rt to the network, and returns its result,
+// converted to the cniVersion of the network configuration. A
+// configuration that fails ValidateConfig is refused without running
+// the plugin.
+func (c *CNIConfig) AddNetwork(net *NetworkConfig, rt *RuntimeConf) (types.Result, error) {
+	if err := ValidateConfig(net); err != nil {
+		return nil, err
+	}
+
+	unlock, err := c.lockNetwork(net.Network.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return c.addNetwork(net, rt)
+}
+
+func (c *CNIConfig) addNetwork(net *NetworkConfig, rt *RuntimeConf) (types.Result, error) {
 	pluginPath, err := invoke.FindInPath(net.Network.Type, c.Path)
 	if err != nil {
 		return nil, err
 	}
 
-	return invoke.ExecPluginWithResult(pluginPath, net.Bytes, c.args("ADD", rt))
+	args, err := c.args("ADD", rt)
+	if err != nil {
+		return nil, err
+	}
+
+	confVersion, err := version.ConfigVersion(net.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	netconf, err := injectRuntimeConfig(net, rt)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := invoke.ExecPluginWithResult(pluginPath, netconf, args)
+	if err != nil {
+		return nil, err
+	}
+	return result.GetAsVersion(confVersion)
 }
 
+// DelNetwork executes the plugin named by the network's type to remove
+// the container described by rt from the network.
 func (c *CNIConfig) DelNetwork(net *NetworkConfig, rt *RuntimeConf) error {
+	unlock, err := c.lockNetwork(net.Network.Name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return c.delNetwork(net, rt)
+}
+
+func (c *CNIConfig) delNetwork(net *NetworkConfig, rt *RuntimeConf) error {
 	pluginPath, err := invoke.FindInPath(net.Network.Type, c.Path)
 	if err != nil {
 		return err
 	}
 
-	return invoke.ExecPluginWithoutResult(pluginPath, net.Bytes, c.args("DEL", rt))
+	args, err := c.args("DEL", rt)
+	if err != nil {
+		return err
+	}
+
+	netconf, err := injectRuntimeConfig(net, rt)
+	if err != nil {
+		return err
+	}
+
+	return invoke.ExecPluginWithoutResult(pluginPath, netconf, args)
+}
+
+// buildOneConfig returns the config to run plugin of list with: its own
+// config with the name and cniVersion of the list and, unless nil,
+// prevResult added.
+func buildOneConfig(list *NetworkConfigList, plugin *NetworkConfig, prevResult types.Result) (*NetworkConfig, error) {
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal(plugin.Bytes, &conf); err != nil {
+		return nil, fmt.Errorf("error parsing configuration: %s", err)
+	}
+
+	conf["name"] = list.Name
+	if list.CNIVersion != "" {
+		conf["cniVersion"] = list.CNIVersion
+	}
+	if prevResult != nil {
+		conf["prevResult"] = prevResult
+	}
+
+	bytes, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	return ConfFromBytes(bytes)
 }
 
 // =====
-func (c *CNIConfig) args(action string, rt *RuntimeConf) *invoke.Args {
-	return &invoke.Args{
-		Command:     action,
-		ContainerID: rt.ContainerID,
-		NetNS:       rt.NetNS,
-		PluginArgs:  rt.Args,
-		IfName:      rt.IfName,
-		Path:        strings.Join(c.Path, ":"),
+// injectRuntimeConfig returns the config to hand the plugin: net.Bytes,
+// with a "runtimeConfig" object holding the CapabilityArgs of rt that the
+// network declares in its capabilities. It is net.Bytes unchanged if
+// there are none.
+func injectRuntimeConfig(net *NetworkConfig, rt *RuntimeConf) ([]byte, error) {
+	runtimeConfig := map[string]interface{}{}
+	for capability, arg := range rt.CapabilityArgs {
+		if net.Network.Capabilities[capability] {
+			runtimeConfig[capability] = arg
+		}
 	}
+	if len(runtimeConfig) == 0 {
+		return net.Bytes, nil
+	}
+
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal(net.Bytes, &conf); err != nil {
+		return nil, fmt.Errorf("error parsing configuration: %s", err)
+	}
+	conf["runtimeConfig"] = runtimeConfig
+	return json.Marshal(conf)
+}
+
+func (c *CNIConfig) args(action string, rt *RuntimeConf) (*invoke.Args, error) {
+	pluginArgsStr, err := types.EncodeArgs(rt.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &invoke.Args{
+		Command:       action,
+		ContainerID:   rt.ContainerID,
+		NetNS:         rt.NetNS,
+		NetNSHandle:   rt.NetNSHandle,
+		PluginArgs:    rt.Args,
+		PluginArgsStr: pluginArgsStr,
+		IfName:        rt.IfName,
+		Path:          strings.Join(c.Path, ":"),
+	}, nil
 }
@@ -0,0 +1,581 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libcni_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/cni/libcni"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/skel"
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/plugins/test/noop/debug"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Invoking the plugin", func() {
+	var (
+		nsName    string
+		netNS     *os.File
+		cniConfig *libcni.CNIConfig
+		netConfig *libcni.NetworkConfig
+		rt        *libcni.RuntimeConf
+	)
+
+	loUp := func() bool {
+		var up bool
+		err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+			link, err := netlink.LinkByName("lo")
+			if err != nil {
+				return err
+			}
+			up = link.Attrs().Flags&net.FlagUp != 0
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return up
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		nsName = fmt.Sprintf("test-libcni-%d", rand.Int())
+		netNS, err = ns.CreateNetNS(nsName)
+		Expect(err).NotTo(HaveOccurred())
+
+		cniConfig = &libcni.CNIConfig{Path: []string{"/no/such/dir", cniPath}}
+
+		netConfig, err = libcni.ConfFromBytes([]byte(`{"cniVersion": "0.1.0", "name": "lo", "type": "loopback"}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		rt = &libcni.RuntimeConf{
+			ContainerID: "some-container-id",
+			NetNS:       netNS.Name(),
+			IfName:      "lo",
+			Args:        [][2]string{{"IgnoreUnknown", "1"}},
+		}
+	})
+
+	AfterEach(func() {
+		Expect(netNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(nsName)).To(Succeed())
+	})
+
+	Describe("AddNetwork", func() {
+		It("executes the plugin with the ADD command and returns its result", func() {
+			Expect(loUp()).To(BeFalse())
+
+			result, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Version()).To(Equal("0.1.0"))
+			res := result.(*types.Result010)
+			Expect(res.IP4).NotTo(BeNil())
+			Expect(res.IP4.IP.String()).To(Equal("127.0.0.1/8"))
+
+			Expect(loUp()).To(BeTrue())
+		})
+
+		It("returns an error when the plugin cannot be found", func() {
+			cniConfig.Path = []string{"/no/such/dir"}
+
+			_, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).To(MatchError(`failed to find plugin "loopback" in path [/no/such/dir]`))
+		})
+
+		It("refuses args containing reserved characters", func() {
+			rt.Args = [][2]string{{"IP", "10.0.0.5;IgnoreUnknown=1"}}
+
+			_, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).To(MatchError(ContainSubstring("must not contain ';' or '='")))
+			Expect(loUp()).To(BeFalse())
+		})
+
+		It("refuses an invalid config without running the plugin", func() {
+			netConfig, err := libcni.ConfFromBytes([]byte(`{"name": "lo", "type": "loopback", "ipam": {}}`))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).To(MatchError(`invalid network configuration: missing "cniVersion"; missing "ipam.type"`))
+			Expect(loUp()).To(BeFalse())
+		})
+
+		It("returns the error reported by the plugin", func() {
+			rt.NetNS = "/no/such/netns"
+
+			_, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).To(BeAssignableToTypeOf(&types.Error{}))
+			Expect(err).To(MatchError(ContainSubstring("/no/such/netns")))
+		})
+	})
+
+	Context("when the netns is given as a handle", func() {
+		var handle ns.NetNS
+
+		BeforeEach(func() {
+			var err error
+			handle, err = ns.GetNS(netNS.Name())
+			Expect(err).NotTo(HaveOccurred())
+
+			rt.NetNS = ""
+			rt.NetNSHandle = handle
+		})
+
+		AfterEach(func() {
+			Expect(handle.Close()).To(Succeed())
+		})
+
+		It("lets the plugin enter the namespace through the inherited handle", func() {
+			Expect(loUp()).To(BeFalse())
+
+			_, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loUp()).To(BeTrue())
+
+			Expect(cniConfig.DelNetwork(netConfig, rt)).To(Succeed())
+			Expect(loUp()).To(BeFalse())
+		})
+
+		It("prefers the handle over the path", func() {
+			rt.NetNS = "/no/such/netns"
+
+			_, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loUp()).To(BeTrue())
+		})
+
+		It("keeps the handle usable", func() {
+			_, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(handle.Do(func(ns.NetNS) error {
+				_, err := netlink.LinkByName("lo")
+				return err
+			})).To(Succeed())
+		})
+
+		It("fails when the handle is closed", func() {
+			Expect(handle.Close()).To(Succeed())
+
+			_, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).To(MatchError(fmt.Sprintf("netns handle %q is closed", netNS.Name())))
+		})
+	})
+
+	Describe("the invocation", func() {
+		var (
+			dir       string
+			debugFile string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "libcni-test")
+			Expect(err).NotTo(HaveOccurred())
+			debugFile = filepath.Join(dir, "debug.json")
+
+			netConfig, err = libcni.ConfFromBytes([]byte(fmt.Sprintf(
+				`{"cniVersion": "0.1.0", "name": "noopnet", "type": "noop", "debugFile": %q}`, debugFile)))
+			Expect(err).NotTo(HaveOccurred())
+
+			cniConfig.Path = []string{noopPath}
+			rt.IfName = "eth0"
+			rt.Args = [][2]string{{"IgnoreUnknown", "1"}, {"FOO", "bar"}}
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("passes the runtime config in the CNI_* variables and the network config on stdin", func() {
+			for command, invoke := range map[string]func() error{
+				"ADD": func() error {
+					_, err := cniConfig.AddNetwork(netConfig, rt)
+					return err
+				},
+				"DEL": func() error {
+					return cniConfig.DelNetwork(netConfig, rt)
+				},
+			} {
+				Expect(invoke()).To(Succeed())
+
+				d, err := debug.ReadDebug(debugFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(d.Command).To(Equal(command))
+				Expect(d.CmdArgs).To(Equal(skel.CmdArgs{
+					ContainerID: "some-container-id",
+					Netns:       netNS.Name(),
+					IfName:      "eth0",
+					Args:        "IgnoreUnknown=1;FOO=bar",
+					Path:        noopPath,
+					StdinData:   netConfig.Bytes,
+				}))
+			}
+		})
+
+		It("passes a netns handle as a path to the inherited descriptor", func() {
+			handle, err := ns.GetNS(netNS.Name())
+			Expect(err).NotTo(HaveOccurred())
+			defer handle.Close()
+			rt.NetNSHandle = handle
+
+			_, err = cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).NotTo(HaveOccurred())
+
+			d, err := debug.ReadDebug(debugFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(d.CmdArgs.Netns).To(Equal("/proc/self/fd/3"))
+		})
+
+		Context("with capability args", func() {
+			BeforeEach(func() {
+				var err error
+				netConfig, err = libcni.ConfFromBytes([]byte(fmt.Sprintf(`{
+					"cniVersion": "0.1.0",
+					"name": "noopnet",
+					"type": "noop",
+					"debugFile": %q,
+					"capabilities": {"portMappings": true, "bandwidth": false}
+				}`, debugFile)))
+				Expect(err).NotTo(HaveOccurred())
+
+				rt.CapabilityArgs = map[string]interface{}{
+					"portMappings": []map[string]interface{}{
+						{"hostPort": 8080, "containerPort": 80, "protocol": "tcp"},
+					},
+					"bandwidth": map[string]interface{}{"ingressRate": 1000},
+					"ipRanges":  []string{"10.1.2.0/24"},
+				}
+			})
+
+			It("injects only the declared capabilities into the runtimeConfig", func() {
+				for command, invoke := range map[string]func() error{
+					"ADD": func() error {
+						_, err := cniConfig.AddNetwork(netConfig, rt)
+						return err
+					},
+					"DEL": func() error {
+						return cniConfig.DelNetwork(netConfig, rt)
+					},
+				} {
+					Expect(invoke()).To(Succeed())
+
+					d, err := debug.ReadDebug(debugFile)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(d.Command).To(Equal(command))
+					Expect(d.CmdArgs.StdinData).To(MatchJSON(fmt.Sprintf(`{
+						"cniVersion": "0.1.0",
+						"name": "noopnet",
+						"type": "noop",
+						"debugFile": %q,
+						"capabilities": {"portMappings": true, "bandwidth": false},
+						"runtimeConfig": {
+							"portMappings": [
+								{"hostPort": 8080, "containerPort": 80, "protocol": "tcp"}
+							]
+						}
+					}`, debugFile)))
+				}
+			})
+
+			It("passes the config unchanged when no declared capability has args", func() {
+				delete(rt.CapabilityArgs, "portMappings")
+
+				_, err := cniConfig.AddNetwork(netConfig, rt)
+				Expect(err).NotTo(HaveOccurred())
+
+				d, err := debug.ReadDebug(debugFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(d.CmdArgs.StdinData).To(Equal(netConfig.Bytes))
+			})
+		})
+	})
+
+	Describe("with a LockDir", func() {
+		var (
+			dir     string
+			logFile string
+		)
+
+		// runConcurrently invokes the plugin n times at once and waits
+		// for all of them
+		runConcurrently := func(n int, invoke func() error) {
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				go func() {
+					defer GinkgoRecover()
+					errs <- invoke()
+				}()
+			}
+			for i := 0; i < n; i++ {
+				Expect(<-errs).NotTo(HaveOccurred())
+			}
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "libcni-lock-test")
+			Expect(err).NotTo(HaveOccurred())
+			logFile = filepath.Join(dir, "log")
+
+			netConfig, err = libcni.ConfFromBytes([]byte(fmt.Sprintf(
+				`{"cniVersion": "0.1.0", "name": "noopnet", "type": "noop", "logFile": %q, "delay": "100ms"}`, logFile)))
+			Expect(err).NotTo(HaveOccurred())
+
+			cniConfig.Path = []string{noopPath}
+			cniConfig.LockDir = filepath.Join(dir, "locks")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("serializes invocations for the same network", func() {
+			runConcurrently(3, func() error {
+				_, err := cniConfig.AddNetwork(netConfig, rt)
+				return err
+			})
+			runConcurrently(3, func() error {
+				return cniConfig.DelNetwork(netConfig, rt)
+			})
+
+			log, err := ioutil.ReadFile(logFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(log)).To(Equal(strings.Repeat("ADD start\nADD end\n", 3) +
+				strings.Repeat("DEL start\nDEL end\n", 3)))
+			Expect(filepath.Join(cniConfig.LockDir, "noopnet")).To(BeAnExistingFile())
+		})
+
+		It("releases the lock when the plugin fails", func() {
+			cniConfig.Path = []string{"/no/such/dir"}
+			_, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).To(HaveOccurred())
+
+			cniConfig.Path = []string{noopPath}
+			_, err = cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("refuses network names that are not plain file names", func() {
+			netConfig.Network.Name = "../noopnet"
+
+			_, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).To(MatchError(`network name "../noopnet" cannot be used to name a lock file`))
+		})
+	})
+
+	Describe("the result", func() {
+		addWith := func(conf string) (types.Result, error) {
+			netConfig, err := libcni.ConfFromBytes([]byte(conf))
+			Expect(err).NotTo(HaveOccurred())
+
+			cniConfig.Path = []string{noopPath}
+			return cniConfig.AddNetwork(netConfig, rt)
+		}
+
+		It("is converted to the version of the network config", func() {
+			result, err := addWith(`{
+				"cniVersion": "0.2.0",
+				"name": "noopnet",
+				"type": "noop",
+				"result": { "ip4": { "ip": "10.1.2.3/24", "gateway": "10.1.2.1" } }
+			}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Version()).To(Equal("0.2.0"))
+
+			res := result.(*types.Result020)
+			Expect(res.IPs).To(HaveLen(1))
+			Expect(res.IPs[0].Version).To(Equal("4"))
+			Expect(res.IPs[0].Address.String()).To(Equal("10.1.2.3/24"))
+			Expect(res.IPs[0].Gateway.String()).To(Equal("10.1.2.1"))
+		})
+
+		It("is converted to 0.1.0 for 0.1.0 configs", func() {
+			result, err := addWith(`{
+				"cniVersion": "0.1.0",
+				"name": "noopnet",
+				"type": "noop",
+				"result": {
+					"cniVersion": "0.2.0",
+					"ips": [ { "version": "4", "address": "10.1.2.3/24", "gateway": "10.1.2.1" } ]
+				}
+			}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Version()).To(Equal("0.1.0"))
+
+			res := result.(*types.Result010)
+			Expect(res.IP4.IP.String()).To(Equal("10.1.2.3/24"))
+			Expect(res.IP4.Gateway.String()).To(Equal("10.1.2.1"))
+		})
+
+		It("fails when the plugin prints a result of an unknown version", func() {
+			_, err := addWith(`{
+				"cniVersion": "0.1.0",
+				"name": "noopnet",
+				"type": "noop",
+				"result": { "cniVersion": "0.9.0" }
+			}`)
+			Expect(err).To(MatchError(`unsupported result version "0.9.0"`))
+		})
+	})
+
+	Describe("DelNetwork", func() {
+		It("executes the plugin with the DEL command", func() {
+			_, err := cniConfig.AddNetwork(netConfig, rt)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(cniConfig.DelNetwork(netConfig, rt)).To(Succeed())
+			Expect(loUp()).To(BeFalse())
+		})
+	})
+
+	Describe("with a network configuration list", func() {
+		var (
+			dir        string
+			debugFiles [2]string
+		)
+
+		// newList returns a list of two noop plugins, the first adding
+		// to the net config of the first and the second to the second
+		newList := func(first, second string) *libcni.NetworkConfigList {
+			list, err := libcni.ConfListFromBytes([]byte(fmt.Sprintf(`{
+				"cniVersion": "0.2.0",
+				"name": "chain",
+				"plugins": [
+					{"type": "noop", "debugFile": %q %s},
+					{"type": "noop", "debugFile": %q %s}
+				]
+			}`, debugFiles[0], first, debugFiles[1], second)))
+			Expect(err).NotTo(HaveOccurred())
+			return list
+		}
+
+		// stdin returns the config the plugin recorded in debugFile
+		// was last run with
+		stdin := func(debugFile string) map[string]interface{} {
+			d, err := debug.ReadDebug(debugFile)
+			Expect(err).NotTo(HaveOccurred())
+			conf := map[string]interface{}{}
+			Expect(json.Unmarshal(d.CmdArgs.StdinData, &conf)).To(Succeed())
+			return conf
+		}
+
+		command := func(debugFile string) string {
+			d, err := debug.ReadDebug(debugFile)
+			Expect(err).NotTo(HaveOccurred())
+			return d.Command
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "libcni-test")
+			Expect(err).NotTo(HaveOccurred())
+			debugFiles = [2]string{filepath.Join(dir, "first.json"), filepath.Join(dir, "second.json")}
+
+			cniConfig.Path = []string{noopPath}
+			rt.IfName = "eth0"
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		Describe("AddNetworkList", func() {
+			It("passes each plugin the result of the one before as prevResult", func() {
+				list := newList(
+					`, "result": {"ip4": {"ip": "10.0.0.2/24"}}`,
+					`, "result": {"cniVersion": "0.2.0", "ips": [{"version": "4", "address": "10.0.0.3/24"}]}`)
+
+				result, err := cniConfig.AddNetworkList(list, rt)
+				Expect(err).NotTo(HaveOccurred())
+
+				first := stdin(debugFiles[0])
+				Expect(first).NotTo(HaveKey("prevResult"))
+				Expect(first["name"]).To(Equal("chain"))
+				Expect(first["cniVersion"]).To(Equal("0.2.0"))
+
+				// the 0.1.0 result of the first plugin is converted to
+				// the list's version
+				second := stdin(debugFiles[1])
+				Expect(second["name"]).To(Equal("chain"))
+				prevResult, err := json.Marshal(second["prevResult"])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(prevResult).To(MatchJSON(`{
+					"cniVersion": "0.2.0",
+					"ips": [{"version": "4", "address": "10.0.0.2/24"}],
+					"dns": {}
+				}`))
+
+				Expect(result.Version()).To(Equal("0.2.0"))
+				res := result.(*types.Result020)
+				Expect(res.IPs).To(HaveLen(1))
+				Expect(res.IPs[0].Address.String()).To(Equal("10.0.0.3/24"))
+			})
+
+			It("rolls back the plugins that succeeded when one fails", func() {
+				list := newList("", `, "error": {"code": 11, "msg": "try again"}`)
+
+				_, err := cniConfig.AddNetworkList(list, rt)
+				Expect(err).To(MatchError("try again"))
+
+				Expect(command(debugFiles[0])).To(Equal("DEL"))
+				Expect(command(debugFiles[1])).To(Equal("ADD"))
+			})
+
+			It("refuses a list with an invalid plugin config without running any plugin", func() {
+				list := newList("", `, "ipam": {}`)
+
+				_, err := cniConfig.AddNetworkList(list, rt)
+				Expect(err).To(MatchError(`invalid network configuration: missing "ipam.type"`))
+
+				_, err = os.Stat(debugFiles[0])
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+
+		Describe("DelNetworkList", func() {
+			It("runs every plugin with DEL in reverse order", func() {
+				// both plugins record to the first debug file, so it
+				// holds whichever ran last
+				debugFiles[1] = debugFiles[0]
+				list := newList(`, "tag": "first"`, `, "tag": "second"`)
+
+				Expect(cniConfig.DelNetworkList(list, rt)).To(Succeed())
+
+				Expect(command(debugFiles[0])).To(Equal("DEL"))
+				Expect(stdin(debugFiles[0])["tag"]).To(Equal("first"))
+			})
+
+			It("stops at the first plugin that fails", func() {
+				list := newList("", `, "error": {"code": 11, "msg": "try again"}`)
+
+				Expect(cniConfig.DelNetworkList(list, rt)).To(MatchError("try again"))
+
+				_, err := os.Stat(debugFiles[0])
+				Expect(os.IsNotExist(err)).To(BeTrue())
+				Expect(command(debugFiles[1])).To(Equal("DEL"))
+			})
+		})
+	})
+})
@@ -23,6 +23,8 @@ import (
 	"sort"
 )
 
+// ConfFromBytes parses a network configuration, keeping the raw bytes
+// so they can be passed on to the plugin unchanged.
 func ConfFromBytes(bytes []byte) (*NetworkConfig, error) {
 	conf := &NetworkConfig{Bytes: bytes}
 	if err := json.Unmarshal(bytes, &conf.Network); err != nil {
@@ -31,14 +33,69 @@ func ConfFromBytes(bytes []byte) (*NetworkConfig, error) {
 	return conf, nil
 }
 
+// ConfFromFile reads and parses the network configuration in filename.
 func ConfFromFile(filename string) (*NetworkConfig, error) {
 	bytes, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("error reading %s: %s", filename, err)
 	}
-	return ConfFromBytes(bytes)
+	conf, err := ConfFromBytes(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return conf, nil
+}
+
+// ConfListFromBytes parses a network configuration list: an object with
+// a "name", an optional "cniVersion" and a non-empty "plugins" array of
+// plugin configs, each kept as raw bytes as ConfFromBytes does.
+func ConfListFromBytes(bytes []byte) (*NetworkConfigList, error) {
+	var raw struct {
+		Name       string            `json:"name"`
+		CNIVersion string            `json:"cniVersion"`
+		Plugins    []json.RawMessage `json:"plugins"`
+	}
+	if err := json.Unmarshal(bytes, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing configuration list: %s", err)
+	}
+	if raw.Name == "" {
+		return nil, fmt.Errorf("error parsing configuration list: missing \"name\"")
+	}
+	if len(raw.Plugins) == 0 {
+		return nil, fmt.Errorf("error parsing configuration list: no plugins in list")
+	}
+
+	list := &NetworkConfigList{
+		Name:       raw.Name,
+		CNIVersion: raw.CNIVersion,
+		Bytes:      bytes,
+	}
+	for i, plugin := range raw.Plugins {
+		conf, err := ConfFromBytes(plugin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse plugin %d of list: %s", i, err)
+		}
+		list.Plugins = append(list.Plugins, conf)
+	}
+	return list, nil
+}
+
+// ConfListFromFile reads and parses the network configuration list in
+// filename.
+func ConfListFromFile(filename string) (*NetworkConfigList, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", filename, err)
+	}
+	list, err := ConfListFromBytes(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return list, nil
 }
 
+// ConfFiles returns the paths of the .conf files in dir, sorted by name.
+// A missing dir yields no files rather than an error.
 func ConfFiles(dir string) ([]string, error) {
 	// In part, adapted from rkt/networking/podenv.go#listFiles
 	files, err := ioutil.ReadDir(dir)
@@ -59,18 +116,21 @@ func ConfFiles(dir string) ([]string, error) {
 			confFiles = append(confFiles, filepath.Join(dir, f.Name()))
 		}
 	}
+	sort.Strings(confFiles)
 	return confFiles, nil
 }
 
+// LoadConf returns the network configuration in dir whose "name" field
+// is name, regardless of the file it is in. Files are searched in sorted
+// order, so should several declare the same name, the first one wins.
 func LoadConf(dir, name string) (*NetworkConfig, error) {
 	files, err := ConfFiles(dir)
 	switch {
 	case err != nil:
 		return nil, err
 	case len(files) == 0:
-		return nil, fmt.Errorf("no net configurations found")
+		return nil, fmt.Errorf("no net configurations found in %s", dir)
 	}
-	sort.Strings(files)
 
 	for _, confFile := range files {
 		conf, err := ConfFromFile(confFile)
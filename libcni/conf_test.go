@@ -0,0 +1,150 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libcni_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/appc/cni/libcni"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Loading configuration from disk", func() {
+	var configDir string
+
+	writeConf := func(fileName, contents string) {
+		Expect(ioutil.WriteFile(filepath.Join(configDir, fileName), []byte(contents), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		configDir, err = ioutil.TempDir("", "cni-conf")
+		Expect(err).NotTo(HaveOccurred())
+
+		writeConf("30-bridge.conf", `{"name": "mybridge", "type": "bridge"}`)
+		writeConf("10-ptp.conf", `{"name": "myptp", "type": "ptp"}`)
+		writeConf("20-ignored.json", `{"name": "myjson", "type": "bridge"}`)
+		Expect(os.Mkdir(filepath.Join(configDir, "40-dir.conf"), 0700)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(configDir)).To(Succeed())
+	})
+
+	Describe("ConfFiles", func() {
+		It("returns the .conf files in sorted order", func() {
+			files, err := libcni.ConfFiles(configDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(Equal([]string{
+				filepath.Join(configDir, "10-ptp.conf"),
+				filepath.Join(configDir, "30-bridge.conf"),
+			}))
+		})
+
+		It("returns no files for a missing directory", func() {
+			files, err := libcni.ConfFiles(filepath.Join(configDir, "missing"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+	})
+
+	Describe("LoadConf", func() {
+		It("selects the configuration by its name field, not its file name", func() {
+			conf, err := libcni.LoadConf(configDir, "mybridge")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.Network.Name).To(Equal("mybridge"))
+			Expect(conf.Network.Type).To(Equal("bridge"))
+			Expect(conf.Bytes).To(MatchJSON(`{"name": "mybridge", "type": "bridge"}`))
+
+			_, err = libcni.LoadConf(configDir, "30-bridge")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns the first file in sorted order when names collide", func() {
+			writeConf("00-dup.conf", `{"name": "mybridge", "type": "macvlan"}`)
+
+			conf, err := libcni.LoadConf(configDir, "mybridge")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.Network.Type).To(Equal("macvlan"))
+		})
+
+		It("returns an error naming the directory when no configuration matches", func() {
+			_, err := libcni.LoadConf(configDir, "missing")
+			Expect(err).To(MatchError(`no net configuration with name "missing" in ` + configDir))
+		})
+
+		It("returns an error when the directory holds no configuration", func() {
+			emptyDir := filepath.Join(configDir, "empty")
+			Expect(os.Mkdir(emptyDir, 0700)).To(Succeed())
+
+			_, err := libcni.LoadConf(emptyDir, "mybridge")
+			Expect(err).To(MatchError("no net configurations found in " + emptyDir))
+		})
+
+		It("returns an error naming a file that cannot be parsed", func() {
+			writeConf("00-broken.conf", `{"name": `)
+
+			_, err := libcni.LoadConf(configDir, "mybridge")
+			Expect(err).To(MatchError(ContainSubstring(filepath.Join(configDir, "00-broken.conf"))))
+		})
+	})
+
+	Describe("ConfListFromFile", func() {
+		It("parses the name, version and each plugin config", func() {
+			writeConf("10-chain.conflist", `{
+				"cniVersion": "0.2.0",
+				"name": "chain",
+				"plugins": [
+					{"type": "bridge", "bridge": "cni0"},
+					{"type": "tuning", "mtu": 1400}
+				]
+			}`)
+
+			list, err := libcni.ConfListFromFile(filepath.Join(configDir, "10-chain.conflist"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(list.Name).To(Equal("chain"))
+			Expect(list.CNIVersion).To(Equal("0.2.0"))
+			Expect(list.Plugins).To(HaveLen(2))
+			Expect(list.Plugins[0].Network.Type).To(Equal("bridge"))
+			Expect(list.Plugins[0].Bytes).To(MatchJSON(`{"type": "bridge", "bridge": "cni0"}`))
+			Expect(list.Plugins[1].Network.Type).To(Equal("tuning"))
+		})
+
+		It("refuses a list without a name", func() {
+			writeConf("10-chain.conflist", `{"plugins": [{"type": "bridge"}]}`)
+
+			_, err := libcni.ConfListFromFile(filepath.Join(configDir, "10-chain.conflist"))
+			Expect(err).To(MatchError(ContainSubstring(`missing "name"`)))
+		})
+
+		It("refuses a list without plugins", func() {
+			writeConf("10-chain.conflist", `{"name": "chain", "plugins": []}`)
+
+			_, err := libcni.ConfListFromFile(filepath.Join(configDir, "10-chain.conflist"))
+			Expect(err).To(MatchError(ContainSubstring("no plugins in list")))
+		})
+
+		It("names a plugin config that cannot be parsed", func() {
+			writeConf("10-chain.conflist", `{"name": "chain", "plugins": [{"type": "bridge"}, "tuning"]}`)
+
+			_, err := libcni.ConfListFromFile(filepath.Join(configDir, "10-chain.conflist"))
+			Expect(err).To(MatchError(ContainSubstring("failed to parse plugin 1 of list")))
+		})
+	})
+})
@@ -0,0 +1,52 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libcni
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// lockNetwork takes an exclusive lock on the network name in LockDir,
+// waiting for other holders, and returns a func that releases it. It
+// does nothing when LockDir is not set.
+func (c *CNIConfig) lockNetwork(name string) (func(), error) {
+	if c.LockDir == "" {
+		return func() {}, nil
+	}
+
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return nil, fmt.Errorf("network name %q cannot be used to name a lock file", name)
+	}
+	if err := os.MkdirAll(c.LockDir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(c.LockDir, name)
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %q: %v", path, err)
+	}
+
+	// closing the file releases the lock
+	return func() { f.Close() }, nil
+}
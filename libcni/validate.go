@@ -0,0 +1,81 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libcni
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// InvalidConfigError lists every problem ValidateConfig found in a
+// network configuration.
+type InvalidConfigError struct {
+	Problems []string
+}
+
+func (e *InvalidConfigError) Error() string {
+	return "invalid network configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// ValidateConfig checks that net has the fields every plugin relies on:
+// "cniVersion", "name" and "type" as non-empty strings, and, if "ipam"
+// is present, an "ipam.type" naming the IPAM plugin. All problems are
+// reported at once in an *InvalidConfigError.
+func ValidateConfig(net *NetworkConfig) error {
+	var conf map[string]interface{}
+	if err := json.Unmarshal(net.Bytes, &conf); err != nil || conf == nil {
+		return &InvalidConfigError{Problems: []string{"not a JSON object"}}
+	}
+
+	var problems []string
+	for _, field := range []string{"cniVersion", "name", "type"} {
+		if p := checkString(conf, field, field); p != "" {
+			problems = append(problems, p)
+		}
+	}
+
+	if v, ok := conf["ipam"]; ok {
+		ipam, ok := v.(map[string]interface{})
+		if !ok {
+			problems = append(problems, `"ipam" must be an object`)
+		} else if p := checkString(ipam, "type", "ipam.type"); p != "" {
+			problems = append(problems, p)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &InvalidConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// checkString describes what is wrong with obj[key] as a required
+// non-empty string, or returns "" if nothing is. path names the field
+// in the message.
+func checkString(obj map[string]interface{}, key, path string) string {
+	v, ok := obj[key]
+	if !ok {
+		return fmt.Sprintf("missing %q", path)
+	}
+	s, ok := v.(string)
+	switch {
+	case !ok:
+		return fmt.Sprintf("%q must be a string", path)
+	case s == "":
+		return fmt.Sprintf("%q must not be empty", path)
+	}
+	return ""
+}
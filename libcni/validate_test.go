@@ -0,0 +1,66 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libcni_test
+
+import (
+	"github.com/appc/cni/libcni"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidateConfig", func() {
+	validate := func(conf string) error {
+		return libcni.ValidateConfig(&libcni.NetworkConfig{Bytes: []byte(conf)})
+	}
+
+	It("accepts a config with the required fields", func() {
+		Expect(validate(`{"cniVersion": "0.1.0", "name": "mynet", "type": "bridge"}`)).To(Succeed())
+		Expect(validate(`{
+			"cniVersion": "0.1.0",
+			"name": "mynet",
+			"type": "bridge",
+			"ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}
+		}`)).To(Succeed())
+	})
+
+	DescribeTable("reports every problem in the config",
+		func(conf string, problems []string) {
+			err := validate(conf)
+			Expect(err).To(BeAssignableToTypeOf(&libcni.InvalidConfigError{}))
+			Expect(err.(*libcni.InvalidConfigError).Problems).To(Equal(problems))
+		},
+		Entry("empty object", `{}`,
+			[]string{`missing "cniVersion"`, `missing "name"`, `missing "type"`}),
+		Entry("wrongly typed fields", `{"cniVersion": 0.1, "name": ["mynet"], "type": "bridge"}`,
+			[]string{`"cniVersion" must be a string`, `"name" must be a string`}),
+		Entry("empty type", `{"cniVersion": "0.1.0", "name": "mynet", "type": ""}`,
+			[]string{`"type" must not be empty`}),
+		Entry("ipam without a type", `{"cniVersion": "0.1.0", "name": "mynet", "type": "bridge", "ipam": {"subnet": "10.1.2.0/24"}}`,
+			[]string{`missing "ipam.type"`}),
+		Entry("ipam with a wrongly typed type", `{"cniVersion": "0.1.0", "name": "mynet", "type": "bridge", "ipam": {"type": 7}}`,
+			[]string{`"ipam.type" must be a string`}),
+		Entry("ipam that is not an object", `{"name": "mynet", "type": "bridge", "ipam": "host-local"}`,
+			[]string{`missing "cniVersion"`, `"ipam" must be an object`}),
+		Entry("not an object", `["mynet"]`,
+			[]string{"not a JSON object"}),
+	)
+
+	It("lists the problems in its message", func() {
+		Expect(validate(`{"cniVersion": "0.1.0", "type": ""}`)).To(MatchError(
+			`invalid network configuration: missing "name"; "type" must not be empty`))
+	})
+})
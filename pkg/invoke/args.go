@@ -15,10 +15,23 @@
 package invoke
 
 import (
+	"fmt"
 	"os"
 	"strings"
+	"syscall"
+
+	"github.com/appc/cni/pkg/ns"
 )
 
+// inheritedNetNSPath is where a plugin finds the netns of
+// Args.NetNSHandle: ExecPlugin passes it as the first extra file,
+// which the child gets as fd 3.
+const inheritedNetNSPath = "/proc/self/fd/3"
+
+// defaultEnvAllowlist is what Args passes of the caller's environment
+// when EnvAllowlist is not set.
+var defaultEnvAllowlist = []string{"PATH"}
+
 type CNIArgs interface {
 	// For use with os/exec; i.e., return nil to inherit the
 	// environment from this process
@@ -38,17 +51,47 @@ func ArgsFromEnv() CNIArgs {
 }
 
 type Args struct {
-	Command       string
-	ContainerID   string
-	NetNS         string
+	Command     string
+	ContainerID string
+	NetNS       string
+	// NetNSHandle, when set, is handed to the plugin as an open file
+	// instead of the NetNS path, so the namespace cannot be swapped
+	// between the caller opening it and the plugin entering it. The
+	// plugin sees it as a /proc/self path, which means nothing to any
+	// other process, so plugins that pass the netns on to a daemon,
+	// like dhcp, refuse it.
+	NetNSHandle   ns.NetNS
 	PluginArgs    [][2]string
 	PluginArgsStr string
 	IfName        string
 	Path          string
+	// EnvAllowlist names the variables of the caller's environment
+	// that are passed to the plugin along with the CNI_* ones; all
+	// others are withheld so that no secrets leak to plugins. When
+	// nil, only PATH is passed.
+	EnvAllowlist []string
+	// Retry, when set, has ExecPlugin retry a plugin that fails with
+	// a transient error.
+	Retry *RetryPolicy
 }
 
 func (args *Args) AsEnv() []string {
-	env := os.Environ()
+	allowlist := args.EnvAllowlist
+	if allowlist == nil {
+		allowlist = defaultEnvAllowlist
+	}
+
+	var env []string
+	for _, name := range allowlist {
+		if val, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+val)
+		}
+	}
+
+	netns := args.NetNS
+	if args.NetNSHandle != nil {
+		netns = inheritedNetNSPath
+	}
 	pluginArgsStr := args.PluginArgsStr
 	if pluginArgsStr == "" {
 		pluginArgsStr = stringify(args.PluginArgs)
@@ -57,13 +100,34 @@ func (args *Args) AsEnv() []string {
 	env = append(env,
 		"CNI_COMMAND="+args.Command,
 		"CNI_CONTAINERID="+args.ContainerID,
-		"CNI_NETNS="+args.NetNS,
+		"CNI_NETNS="+netns,
 		"CNI_ARGS="+pluginArgsStr,
 		"CNI_IFNAME="+args.IfName,
 		"CNI_PATH="+args.Path)
 	return env
 }
 
+// netNSFile returns a duplicate of the NetNSHandle descriptor for the
+// plugin to inherit; the caller closes it once the plugin has started.
+func (args *Args) netNSFile() (*os.File, error) {
+	fd := args.NetNSHandle.Fd()
+	if fd == ^uintptr(0) {
+		return nil, fmt.Errorf("netns handle %q is closed", args.NetNSHandle.Path())
+	}
+
+	// hold ForkLock so no other child inherits the duplicate
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	dup, err := syscall.Dup(int(fd))
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate netns handle %q: %v", args.NetNSHandle.Path(), err)
+	}
+	syscall.CloseOnExec(dup)
+	return os.NewFile(uintptr(dup), args.NetNSHandle.Path()), nil
+}
+
+// stringify formats PluginArgs without validating them; callers
+// building Args from untrusted input should use types.EncodeArgs.
 // taken from rkt/networking/net_plugin.go
 func stringify(pluginArgs [][2]string) string {
 	entries := make([]string, len(pluginArgs))
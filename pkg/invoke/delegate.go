@@ -17,19 +17,32 @@ package invoke
 import (
 	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
 
 	"github.com/appc/cni/pkg/types"
 )
 
-func DelegateAdd(delegatePlugin string, netconf []byte) (*types.Result, error) {
+// pathsFromEnv splits CNI_PATH into its non-empty entries
+func pathsFromEnv() []string {
+	var paths []string
+	for _, p := range filepath.SplitList(os.Getenv("CNI_PATH")) {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// DelegateAdd runs the delegatePlugin found in CNI_PATH with netconf on
+// its stdin and the CNI_* environment of the calling plugin, which must
+// itself be running an ADD. It returns the delegate's result, or the
+// *types.Error the delegate reported.
+func DelegateAdd(delegatePlugin string, netconf []byte) (types.Result, error) {
 	if os.Getenv("CNI_COMMAND") != "ADD" {
 		return nil, fmt.Errorf("CNI_COMMAND is not ADD")
 	}
 
-	paths := strings.Split(os.Getenv("CNI_PATH"), ":")
-
-	pluginPath, err := FindInPath(delegatePlugin, paths)
+	pluginPath, err := FindInPath(delegatePlugin, pathsFromEnv())
 	if err != nil {
 		return nil, err
 	}
@@ -37,14 +50,13 @@ func DelegateAdd(delegatePlugin string, netconf []byte) (*types.Result, error) {
 	return ExecPluginWithResult(pluginPath, netconf, ArgsFromEnv())
 }
 
+// DelegateDel is the DEL counterpart of DelegateAdd.
 func DelegateDel(delegatePlugin string, netconf []byte) error {
 	if os.Getenv("CNI_COMMAND") != "DEL" {
 		return fmt.Errorf("CNI_COMMAND is not DEL")
 	}
 
-	paths := strings.Split(os.Getenv("CNI_PATH"), ":")
-
-	pluginPath, err := FindInPath(delegatePlugin, paths)
+	pluginPath, err := FindInPath(delegatePlugin, pathsFromEnv())
 	if err != nil {
 		return err
 	}
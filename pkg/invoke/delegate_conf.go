@@ -0,0 +1,52 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package invoke
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SaveDelegateConf keeps the delegate netconf a meta plugin generated
+// for containerID under dataDir, so that DEL can hand the delegate the
+// same config even if its inputs have changed since ADD.
+func SaveDelegateConf(containerID, dataDir string, conf []byte) error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, containerID)
+	return ioutil.WriteFile(path, conf, 0600)
+}
+
+// ConsumeDelegateConf returns and removes the netconf saved by
+// SaveDelegateConf. It returns nil without an error if there is none,
+// e.g. because an earlier DEL already consumed it.
+func ConsumeDelegateConf(containerID, dataDir string) ([]byte, error) {
+	path := filepath.Join(dataDir, containerID)
+
+	conf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package invoke_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/appc/cni/pkg/invoke"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("delegate config persistence", func() {
+	var (
+		tmpDir  string
+		dataDir string
+		conf    []byte
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "cni-delegate-conf")
+		Expect(err).NotTo(HaveOccurred())
+
+		// created on demand
+		dataDir = filepath.Join(tmpDir, "flannel")
+		conf = []byte(`{ "name": "mynet", "type": "bridge", "mtu": 1472 }`)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("hands back the saved config once", func() {
+		Expect(invoke.SaveDelegateConf("some-container-id", dataDir, conf)).To(Succeed())
+
+		consumed, err := invoke.ConsumeDelegateConf("some-container-id", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(consumed).To(Equal(conf))
+		Expect(filepath.Join(dataDir, "some-container-id")).NotTo(BeAnExistingFile())
+	})
+
+	It("keeps the configs of different containers apart", func() {
+		Expect(invoke.SaveDelegateConf("container-1", dataDir, conf)).To(Succeed())
+		Expect(invoke.SaveDelegateConf("container-2", dataDir, []byte(`{}`))).To(Succeed())
+
+		consumed, err := invoke.ConsumeDelegateConf("container-1", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(consumed).To(Equal(conf))
+		Expect(filepath.Join(dataDir, "container-2")).To(BeAnExistingFile())
+	})
+
+	It("returns nil when there is no saved config, as on a second DEL", func() {
+		Expect(invoke.SaveDelegateConf("some-container-id", dataDir, conf)).To(Succeed())
+		_, err := invoke.ConsumeDelegateConf("some-container-id", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		consumed, err := invoke.ConsumeDelegateConf("some-container-id", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(consumed).To(BeNil())
+	})
+})
@@ -0,0 +1,121 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package invoke_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/appc/cni/pkg/invoke"
+	"github.com/appc/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Delegate", func() {
+	var (
+		pluginName string
+		origEnv    map[string]string
+	)
+
+	setEnv := func(command, path string) {
+		Expect(os.Setenv("CNI_COMMAND", command)).To(Succeed())
+		Expect(os.Setenv("CNI_PATH", path)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		origEnv = map[string]string{}
+		for _, k := range []string{"CNI_COMMAND", "CNI_PATH"} {
+			origEnv[k] = os.Getenv(k)
+		}
+
+		pluginName = filepath.Base(pathToEchoPlugin)
+	})
+
+	AfterEach(func() {
+		for k, v := range origEnv {
+			Expect(os.Setenv(k, v)).To(Succeed())
+		}
+	})
+
+	Describe("DelegateAdd", func() {
+		It("finds the delegate in CNI_PATH and parses its result", func() {
+			setEnv("ADD", "/no/such/dir:"+filepath.Dir(pathToEchoPlugin))
+
+			result, err := invoke.DelegateAdd(pluginName, []byte(`{
+				"result": {
+					"ip4": {
+						"ip": "10.1.2.3/24",
+						"gateway": "10.1.2.1"
+					}
+				}
+			}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Version()).To(Equal("0.1.0"))
+			res := result.(*types.Result010)
+			Expect(res.IP4).NotTo(BeNil())
+			Expect(res.IP4.IP.String()).To(Equal("10.1.2.3/24"))
+			Expect(res.IP4.Gateway.String()).To(Equal("10.1.2.1"))
+		})
+
+		It("returns the error reported by the delegate", func() {
+			setEnv("ADD", filepath.Dir(pathToEchoPlugin))
+
+			_, err := invoke.DelegateAdd(pluginName, []byte(`{"errorTo": "stdout"}`))
+			Expect(err).To(Equal(&types.Error{
+				Code:    types.ErrTryAgainLater,
+				Msg:     "some error",
+				Details: "some details",
+			}))
+		})
+
+		It("refuses to run unless CNI_COMMAND is ADD", func() {
+			setEnv("DEL", filepath.Dir(pathToEchoPlugin))
+
+			_, err := invoke.DelegateAdd(pluginName, []byte(`{}`))
+			Expect(err).To(MatchError("CNI_COMMAND is not ADD"))
+		})
+
+		It("reports a missing CNI_PATH", func() {
+			setEnv("ADD", "")
+
+			_, err := invoke.DelegateAdd(pluginName, []byte(`{}`))
+			Expect(err).To(MatchError("no paths provided"))
+		})
+	})
+
+	Describe("DelegateDel", func() {
+		It("runs the delegate found in CNI_PATH", func() {
+			setEnv("DEL", filepath.Dir(pathToEchoPlugin))
+
+			Expect(invoke.DelegateDel(pluginName, []byte(`{}`))).To(Succeed())
+		})
+
+		It("returns the error reported by the delegate", func() {
+			setEnv("DEL", filepath.Dir(pathToEchoPlugin))
+
+			err := invoke.DelegateDel(pluginName, []byte(`{"errorTo": "stdout"}`))
+			Expect(err).To(BeAssignableToTypeOf(&types.Error{}))
+			Expect(err.(*types.Error).Code).To(Equal(types.ErrTryAgainLater))
+		})
+
+		It("refuses to run unless CNI_COMMAND is DEL", func() {
+			setEnv("ADD", filepath.Dir(pathToEchoPlugin))
+
+			Expect(invoke.DelegateDel(pluginName, []byte(`{}`))).To(MatchError("CNI_COMMAND is not DEL"))
+		})
+	})
+})
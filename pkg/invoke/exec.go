@@ -16,48 +16,97 @@ package invoke
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"syscall"
+	"time"
 
 	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
 )
 
-func pluginErr(err error, output []byte) error {
-	if _, ok := err.(*exec.ExitError); ok {
-		emsg := types.Error{}
-		if perr := json.Unmarshal(output, &emsg); perr != nil {
-			return fmt.Errorf("netplugin failed but error parsing its diagnostic message %q: %v", string(output), perr)
-		}
-		details := ""
-		if emsg.Details != "" {
-			details = fmt.Sprintf("; %v", emsg.Details)
+// pluginErr turns a failed plugin run into an error. A plugin that exits
+// with a nonzero status is expected to describe the failure as a
+// types.Error on stdout; stderr is tried as well for plugins that report
+// it there. The parsed *types.Error is returned as is so that callers,
+// and plugins delegating to other plugins, can pass it along unchanged.
+func pluginErr(err error, stdout, stderr []byte) error {
+	if _, ok := err.(*exec.ExitError); !ok {
+		return err
+	}
+
+	for _, output := range [][]byte{stdout, stderr} {
+		emsg := &types.Error{}
+		if json.Unmarshal(bytes.TrimSpace(output), emsg) == nil && emsg.Msg != "" {
+			return emsg
 		}
-		return fmt.Errorf("%v%v", emsg.Msg, details)
 	}
 
-	return err
+	return fmt.Errorf("netplugin failed but error parsing its diagnostic message %q: %v", string(stdout), err)
 }
 
-func ExecPluginWithResult(pluginPath string, netconf []byte, args CNIArgs) (*types.Result, error) {
-	stdoutBytes, err := execPlugin(pluginPath, netconf, args)
+// ExecPluginWithResult runs the plugin like ExecPlugin and decodes its
+// output as a result of the version the plugin printed it in.
+func ExecPluginWithResult(pluginPath string, netconf []byte, args CNIArgs) (types.Result, error) {
+	stdoutBytes, err := ExecPlugin(pluginPath, netconf, args)
 	if err != nil {
 		return nil, err
 	}
 
-	res := &types.Result{}
-	err = json.Unmarshal(stdoutBytes, res)
-	return res, err
+	return version.NewResult(stdoutBytes)
 }
 
 func ExecPluginWithoutResult(pluginPath string, netconf []byte, args CNIArgs) error {
-	_, err := execPlugin(pluginPath, netconf, args)
+	_, err := ExecPlugin(pluginPath, netconf, args)
 	return err
 }
 
-func execPlugin(pluginPath string, netconf []byte, args CNIArgs) ([]byte, error) {
+// ExecPlugin runs the plugin binary at pluginPath with the CNI_*
+// environment described by args and netconf on its stdin, and returns
+// what the plugin printed on stdout. If args is an *Args with a
+// NetNSHandle, the plugin inherits the namespace as an open file. If
+// the plugin fails, the returned error is the *types.Error it
+// reported, when it could be parsed.
+// If args is an *Args with a Retry policy, a plugin failing with a
+// retryable error is run again; the error of the last run is returned.
+func ExecPlugin(pluginPath string, netconf []byte, args CNIArgs) ([]byte, error) {
+	return ExecPluginWithContext(context.Background(), pluginPath, netconf, args)
+}
+
+// ExecPluginWithContext is ExecPlugin for plugins that may hang: once
+// ctx is done, the plugin and every process it started in its process
+// group are killed, and an error wrapping ctx.Err() is returned.
+func ExecPluginWithContext(ctx context.Context, pluginPath string, netconf []byte, args CNIArgs) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var policy *RetryPolicy
+	if a, ok := args.(*Args); ok {
+		policy = a.Retry
+	}
+
+	for attempt := 1; ; attempt++ {
+		stdout, err := execPlugin(ctx, pluginPath, netconf, args)
+		if err == nil || policy == nil || attempt >= policy.MaxAttempts || !types.IsRetryable(err) {
+			return stdout, err
+		}
+
+		select {
+		case <-time.After(policy.backoff(attempt)):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+func execPlugin(ctx context.Context, pluginPath string, netconf []byte, args CNIArgs) ([]byte, error) {
 	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
 
 	c := exec.Cmd{
 		Env:    args.AsEnv(),
@@ -65,10 +114,38 @@ func execPlugin(pluginPath string, netconf []byte, args CNIArgs) ([]byte, error)
 		Args:   []string{pluginPath},
 		Stdin:  bytes.NewBuffer(netconf),
 		Stdout: stdout,
-		Stderr: os.Stderr,
+		Stderr: io.MultiWriter(os.Stderr, stderr),
+	}
+	if a, ok := args.(*Args); ok && a.NetNSHandle != nil {
+		netns, err := a.netNSFile()
+		if err != nil {
+			return nil, err
+		}
+		defer netns.Close()
+		c.ExtraFiles = []*os.File{netns}
 	}
-	if err := c.Run(); err != nil {
-		return nil, pluginErr(err, stdout.Bytes())
+	if ctx.Done() != nil {
+		// a group of its own lets the plugin's children be killed with it
+		c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, pluginErr(err, stdout.Bytes(), stderr.Bytes())
+		}
+	case <-ctx.Done():
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		<-done
+		return nil, fmt.Errorf("plugin %q did not finish: %w", pluginPath, ctx.Err())
 	}
 
 	return stdout.Bytes(), nil
@@ -0,0 +1,314 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package invoke_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/appc/cni/pkg/invoke"
+	"github.com/appc/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type echoReport struct {
+	Env   map[string]string `json:"env"`
+	Stdin string            `json:"stdin"`
+}
+
+var _ = Describe("ExecPlugin", func() {
+	var args *invoke.Args
+
+	BeforeEach(func() {
+		args = &invoke.Args{
+			Command:     "ADD",
+			ContainerID: "some-container-id",
+			NetNS:       "/some/netns/path",
+			PluginArgs:  [][2]string{{"FOO", "bar"}, {"BAZ", "qux"}},
+			IfName:      "eth7",
+			Path:        "/some/bin:/other/bin",
+		}
+	})
+
+	It("passes the args as CNI_* environment and the netconf on stdin", func() {
+		netconf := []byte(`{"name": "some-net", "type": "echo-plugin"}`)
+
+		out, err := invoke.ExecPlugin(pathToEchoPlugin, netconf, args)
+		Expect(err).NotTo(HaveOccurred())
+
+		report := echoReport{}
+		Expect(json.Unmarshal(out, &report)).To(Succeed())
+		Expect(report.Stdin).To(Equal(string(netconf)))
+		Expect(report.Env).To(Equal(map[string]string{
+			"CNI_COMMAND":     "ADD",
+			"CNI_CONTAINERID": "some-container-id",
+			"CNI_NETNS":       "/some/netns/path",
+			"CNI_ARGS":        "FOO=bar;BAZ=qux",
+			"CNI_IFNAME":      "eth7",
+			"CNI_PATH":        "/some/bin:/other/bin",
+		}))
+	})
+
+	It("prefers the preformatted plugin args string", func() {
+		args.PluginArgsStr = "IgnoreUnknown=1"
+
+		out, err := invoke.ExecPlugin(pathToEchoPlugin, []byte(`{}`), args)
+		Expect(err).NotTo(HaveOccurred())
+
+		report := echoReport{}
+		Expect(json.Unmarshal(out, &report)).To(Succeed())
+		Expect(report.Env).To(HaveKeyWithValue("CNI_ARGS", "IgnoreUnknown=1"))
+	})
+
+	Describe("the environment of the plugin", func() {
+		envOf := func() map[string]string {
+			out, err := invoke.ExecPlugin(pathToEchoPlugin, []byte(`{"allEnv": true}`), args)
+			Expect(err).NotTo(HaveOccurred())
+
+			report := echoReport{}
+			Expect(json.Unmarshal(out, &report)).To(Succeed())
+			return report.Env
+		}
+
+		BeforeEach(func() {
+			os.Setenv("SOME_SECRET", "hunter2")
+			os.Setenv("HTTP_PROXY", "http://proxy.example.com:3128")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("SOME_SECRET")
+			os.Unsetenv("HTTP_PROXY")
+		})
+
+		It("passes PATH and withholds everything else by default", func() {
+			env := envOf()
+			Expect(env).To(HaveKeyWithValue("PATH", os.Getenv("PATH")))
+			Expect(env).NotTo(HaveKey("SOME_SECRET"))
+			Expect(env).NotTo(HaveKey("HTTP_PROXY"))
+			Expect(env).To(HaveKeyWithValue("CNI_COMMAND", "ADD"))
+		})
+
+		It("passes exactly the allowlisted variables", func() {
+			args.EnvAllowlist = []string{"HTTP_PROXY", "NOT_SET"}
+
+			env := envOf()
+			Expect(env).To(HaveKeyWithValue("HTTP_PROXY", "http://proxy.example.com:3128"))
+			Expect(env).NotTo(HaveKey("NOT_SET"))
+			Expect(env).NotTo(HaveKey("PATH"))
+			Expect(env).NotTo(HaveKey("SOME_SECRET"))
+			Expect(env).To(HaveKeyWithValue("CNI_IFNAME", "eth7"))
+		})
+	})
+
+	Context("when the plugin fails", func() {
+		expected := &types.Error{
+			Code:    types.ErrTryAgainLater,
+			Msg:     "some error",
+			Details: "some details",
+		}
+
+		It("returns the error the plugin reported on stdout", func() {
+			_, err := invoke.ExecPlugin(pathToEchoPlugin, []byte(`{"errorTo": "stdout"}`), args)
+			Expect(err).To(Equal(expected))
+		})
+
+		It("returns the error the plugin reported on stderr", func() {
+			_, err := invoke.ExecPlugin(pathToEchoPlugin, []byte(`{"errorTo": "stderr"}`), args)
+			Expect(err).To(Equal(expected))
+		})
+
+		It("returns the error through ExecPluginWithResult", func() {
+			_, err := invoke.ExecPluginWithResult(pathToEchoPlugin, []byte(`{"errorTo": "stdout"}`), args)
+			Expect(err).To(Equal(expected))
+		})
+	})
+
+	It("returns an error when the plugin cannot be run", func() {
+		_, err := invoke.ExecPlugin("/no/such/plugin", []byte(`{}`), args)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("ExecPluginWithContext", func() {
+	var (
+		args    *invoke.Args
+		dir     string
+		pidFile string
+	)
+
+	// gone reports whether the process has exited; a zombie counts, as
+	// reaping an orphan is up to init
+	gone := func(pid int) bool {
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if os.IsNotExist(err) {
+			return true
+		}
+		Expect(err).NotTo(HaveOccurred())
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		return fields[0] == "Z"
+	}
+
+	BeforeEach(func() {
+		args = &invoke.Args{Command: "ADD", NetNS: "/some/netns/path", IfName: "eth0"}
+
+		var err error
+		dir, err = ioutil.TempDir("", "invoke-test")
+		Expect(err).NotTo(HaveOccurred())
+		pidFile = filepath.Join(dir, "pids")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("runs the plugin like ExecPlugin", func() {
+		out, err := invoke.ExecPluginWithContext(context.Background(), pathToEchoPlugin, []byte(`{}`), args)
+		Expect(err).NotTo(HaveOccurred())
+
+		report := echoReport{}
+		Expect(json.Unmarshal(out, &report)).To(Succeed())
+		Expect(report.Env).To(HaveKeyWithValue("CNI_COMMAND", "ADD"))
+	})
+
+	It("kills a hung plugin and the processes it started when the deadline passes", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		netconf := []byte(fmt.Sprintf(`{"hang": %q}`, pidFile))
+		_, err := invoke.ExecPluginWithContext(ctx, pathToEchoPlugin, netconf, args)
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring(pathToEchoPlugin)))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+		var pluginPid, childPid int
+		pids, err := ioutil.ReadFile(pidFile)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = fmt.Sscanf(string(pids), "%d %d", &pluginPid, &childPid)
+		Expect(err).NotTo(HaveOccurred())
+
+		// the plugin itself has been reaped
+		_, err = os.Stat(fmt.Sprintf("/proc/%d", pluginPid))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		Eventually(func() bool { return gone(childPid) }).Should(BeTrue())
+	})
+
+	It("returns the error of a context that is already done without running the plugin", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		netconf := []byte(fmt.Sprintf(`{"hang": %q}`, pidFile))
+		_, err := invoke.ExecPluginWithContext(ctx, pathToEchoPlugin, netconf, args)
+		Expect(err).To(Equal(context.Canceled))
+		Expect(pidFile).NotTo(BeAnExistingFile())
+	})
+})
+
+var _ = Describe("ExecPlugin with a retry policy", func() {
+	var (
+		args    *invoke.Args
+		dir     string
+		counter string
+	)
+
+	// runs returns how often the plugin ran
+	runs := func() int {
+		data, err := ioutil.ReadFile(counter)
+		Expect(err).NotTo(HaveOccurred())
+		return int(data[0] - '0')
+	}
+
+	BeforeEach(func() {
+		args = &invoke.Args{
+			Command: "ADD",
+			NetNS:   "/some/netns/path",
+			IfName:  "eth0",
+			Retry:   &invoke.RetryPolicy{MaxAttempts: 4, Backoff: 10 * time.Millisecond},
+		}
+
+		var err error
+		dir, err = ioutil.TempDir("", "invoke-test")
+		Expect(err).NotTo(HaveOccurred())
+		counter = filepath.Join(dir, "runs")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("runs a plugin failing with a retryable error until it succeeds", func() {
+		netconf := []byte(fmt.Sprintf(`{"counter": %q, "failures": 2}`, counter))
+
+		out, err := invoke.ExecPlugin(pathToEchoPlugin, netconf, args)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(runs()).To(Equal(3))
+
+		report := echoReport{}
+		Expect(json.Unmarshal(out, &report)).To(Succeed())
+		Expect(report.Stdin).To(Equal(string(netconf)))
+	})
+
+	It("gives up after MaxAttempts runs and returns the last error", func() {
+		netconf := []byte(fmt.Sprintf(`{"counter": %q, "failures": 9}`, counter))
+
+		_, err := invoke.ExecPlugin(pathToEchoPlugin, netconf, args)
+		Expect(types.IsRetryable(err)).To(BeTrue())
+		Expect(runs()).To(Equal(4))
+	})
+
+	It("does not retry an error that is not retryable", func() {
+		netconf := []byte(fmt.Sprintf(`{"counter": %q, "failures": 2, "errorCode": %d}`, counter, types.ErrInvalidNetworkConfig))
+
+		_, err := invoke.ExecPlugin(pathToEchoPlugin, netconf, args)
+		Expect(err).To(Equal(&types.Error{
+			Code:    types.ErrInvalidNetworkConfig,
+			Msg:     "some error",
+			Details: "some details",
+		}))
+		Expect(runs()).To(Equal(1))
+	})
+
+	It("does not retry without a policy", func() {
+		args.Retry = nil
+		netconf := []byte(fmt.Sprintf(`{"counter": %q, "failures": 2}`, counter))
+
+		_, err := invoke.ExecPlugin(pathToEchoPlugin, netconf, args)
+		Expect(types.IsRetryable(err)).To(BeTrue())
+		Expect(runs()).To(Equal(1))
+	})
+
+	It("stops waiting to retry once the context is done", func() {
+		args.Retry.Backoff = time.Minute
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		netconf := []byte(fmt.Sprintf(`{"counter": %q, "failures": 2}`, counter))
+
+		start := time.Now()
+		_, err := invoke.ExecPluginWithContext(ctx, pathToEchoPlugin, netconf, args)
+		Expect(types.IsRetryable(err)).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		Expect(runs()).To(Equal(1))
+	})
+})
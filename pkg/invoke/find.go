@@ -20,7 +20,9 @@ import (
 	"path/filepath"
 )
 
-// FindInPath returns the full path of the plugin by searching in the provided path
+// FindInPath returns the absolute path of the plugin by searching the
+// provided paths in order. The first regular, executable file named
+// exactly plugin wins.
 func FindInPath(plugin string, paths []string) (string, error) {
 	if plugin == "" {
 		return "", fmt.Errorf("no plugin name provided")
@@ -30,18 +32,17 @@ func FindInPath(plugin string, paths []string) (string, error) {
 		return "", fmt.Errorf("no paths provided")
 	}
 
-	var fullpath string
 	for _, path := range paths {
 		full := filepath.Join(path, plugin)
-		if fi, err := os.Stat(full); err == nil && fi.Mode().IsRegular() {
-			fullpath = full
-			break
+		if isExecutable(full) {
+			return filepath.Abs(full)
 		}
 	}
 
-	if fullpath == "" {
-		return "", fmt.Errorf("failed to find plugin %q in path %s", plugin, paths)
-	}
+	return "", fmt.Errorf("failed to find plugin %q in path %s", plugin, paths)
+}
 
-	return fullpath, nil
+func isExecutable(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular() && fi.Mode().Perm()&0111 != 0
 }
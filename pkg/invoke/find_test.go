@@ -17,6 +17,7 @@ package invoke_test
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 
 	"github.com/appc/cni/pkg/invoke"
@@ -32,16 +33,29 @@ var _ = Describe("FindInPath", func() {
 		anotherTempDir string
 	)
 
+	writePlugin := func(dir, name string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte("#!/bin/sh\n"), mode)).To(Succeed())
+		return path
+	}
+
 	BeforeEach(func() {
-		tempDir, err := ioutil.TempDir("", "cni-find")
+		var err error
+		pluginDir, err = ioutil.TempDir("", "cni-find")
 		Expect(err).NotTo(HaveOccurred())
 
-		plugin, err := ioutil.TempFile(tempDir, "a-cni-plugin")
+		pluginName = "a-cni-plugin"
+		writePlugin(pluginDir, pluginName, 0755)
 
 		anotherTempDir, err = ioutil.TempDir("", "nothing-here")
+		Expect(err).NotTo(HaveOccurred())
+
+		multiplePaths = []string{anotherTempDir, pluginDir}
+	})
 
-		multiplePaths = []string{anotherTempDir, tempDir}
-		pluginDir, pluginName = filepath.Split(plugin.Name())
+	AfterEach(func() {
+		Expect(os.RemoveAll(pluginDir)).To(Succeed())
+		Expect(os.RemoveAll(anotherTempDir)).To(Succeed())
 	})
 
 	Context("when multiple paths are provided", func() {
@@ -50,6 +64,51 @@ var _ = Describe("FindInPath", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(pluginPath).To(Equal(filepath.Join(pluginDir, pluginName)))
 		})
+
+		It("returns the plugin found in the first path that has it", func() {
+			first := writePlugin(anotherTempDir, pluginName, 0755)
+
+			pluginPath, err := invoke.FindInPath(pluginName, multiplePaths)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pluginPath).To(Equal(first))
+		})
+
+		It("skips files that are not executable", func() {
+			writePlugin(anotherTempDir, pluginName, 0644)
+
+			pluginPath, err := invoke.FindInPath(pluginName, multiplePaths)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pluginPath).To(Equal(filepath.Join(pluginDir, pluginName)))
+		})
+
+		It("skips directories", func() {
+			Expect(os.Mkdir(filepath.Join(anotherTempDir, pluginName), 0755)).To(Succeed())
+
+			pluginPath, err := invoke.FindInPath(pluginName, multiplePaths)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pluginPath).To(Equal(filepath.Join(pluginDir, pluginName)))
+		})
+	})
+
+	Context("when a relative path is provided", func() {
+		var cwd string
+
+		BeforeEach(func() {
+			var err error
+			cwd, err = os.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Chdir(filepath.Dir(pluginDir))).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.Chdir(cwd)).To(Succeed())
+		})
+
+		It("returns an absolute path", func() {
+			pluginPath, err := invoke.FindInPath(pluginName, []string{filepath.Base(pluginDir)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pluginPath).To(Equal(filepath.Join(pluginDir, pluginName)))
+		})
 	})
 
 	Context("when an error occurs", func() {
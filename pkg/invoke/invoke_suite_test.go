@@ -17,6 +17,7 @@ package invoke_test
 import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
 
 	"testing"
 )
@@ -25,3 +26,15 @@ func TestInvoke(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Invoke Suite")
 }
+
+var pathToEchoPlugin string
+
+var _ = BeforeSuite(func() {
+	var err error
+	pathToEchoPlugin, err = gexec.Build("github.com/appc/cni/pkg/invoke/testdata/echo-plugin")
+	Expect(err).NotTo(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	gexec.CleanupBuildArtifacts()
+})
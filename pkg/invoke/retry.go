@@ -0,0 +1,49 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package invoke
+
+import (
+	"time"
+)
+
+// RetryPolicy has ExecPlugin run a plugin again when it fails with an
+// error it marked as transient, see types.Error.Retryable. Any other
+// failure, e.g. of the config, is returned at once.
+type RetryPolicy struct {
+	// MaxAttempts is how often the plugin is run at most, the first
+	// run included; less than 2 means no retries.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubling for each
+	// further one.
+	Backoff time.Duration
+	// MaxBackoff, if set, caps the wait between attempts.
+	MaxBackoff time.Duration
+}
+
+// backoff returns the wait after the given failed attempt, counting
+// from 1.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
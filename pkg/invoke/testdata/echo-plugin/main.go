@@ -0,0 +1,110 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// echo-plugin is a stub plugin for the invoke tests. It prints a JSON
+// object holding its CNI_* environment, or all of it if "allEnv" is
+// true, and its stdin. If the netconf it
+// was given has a non-empty "errorTo" field ("stdout" or "stderr"), it
+// instead reports a types.Error there and exits with status 1, with
+// the code in "errorCode" or else ErrTryAgainLater. With a "counter"
+// file, it counts its runs there and reports an error on stdout for the
+// first "failures" of them. If it has a "result" field, that is printed
+// instead, as an IPAM plugin would.
+// A "hang" field makes it start a child process, write its own PID and
+// the child's to the file named by "hang", and sleep for a minute.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/appc/cni/pkg/types"
+)
+
+type report struct {
+	Env   map[string]string `json:"env"`
+	Stdin string            `json:"stdin"`
+}
+
+func main() {
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		panic(err)
+	}
+
+	conf := struct {
+		ErrorTo   string          `json:"errorTo"`
+		ErrorCode uint            `json:"errorCode"`
+		Counter   string          `json:"counter"`
+		Failures  int             `json:"failures"`
+		Result    json.RawMessage `json:"result"`
+		Hang      string          `json:"hang"`
+		AllEnv    bool            `json:"allEnv"`
+	}{ErrorCode: types.ErrTryAgainLater}
+	json.Unmarshal(stdin, &conf)
+
+	if conf.Counter != "" {
+		runs := 0
+		if data, err := ioutil.ReadFile(conf.Counter); err == nil {
+			fmt.Sscanf(string(data), "%d", &runs)
+		}
+		runs++
+		if err := ioutil.WriteFile(conf.Counter, []byte(fmt.Sprint(runs)), 0644); err != nil {
+			panic(err)
+		}
+		if runs <= conf.Failures {
+			conf.ErrorTo = "stdout"
+		}
+	}
+
+	if conf.Hang != "" {
+		child := exec.Command("sleep", "60")
+		if err := child.Start(); err != nil {
+			panic(err)
+		}
+		pids := fmt.Sprintf("%d %d", os.Getpid(), child.Process.Pid)
+		if err := ioutil.WriteFile(conf.Hang, []byte(pids), 0644); err != nil {
+			panic(err)
+		}
+		time.Sleep(time.Minute)
+	}
+
+	if conf.ErrorTo != "" {
+		out := os.Stdout
+		if conf.ErrorTo == "stderr" {
+			out = os.Stderr
+		}
+		json.NewEncoder(out).Encode(types.NewError(conf.ErrorCode, "some error", "some details"))
+		os.Exit(1)
+	}
+
+	if conf.Result != nil {
+		os.Stdout.Write(conf.Result)
+		return
+	}
+
+	r := report{Env: map[string]string{}, Stdin: string(stdin)}
+	for _, kv := range os.Environ() {
+		if conf.AllEnv || strings.HasPrefix(kv, "CNI_") {
+			parts := strings.SplitN(kv, "=", 2)
+			r.Env[parts[0]] = parts[1]
+		}
+	}
+	json.NewEncoder(os.Stdout).Encode(r)
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	// ifaFlags is the IFA_FLAGS attribute, which carries the address
+	// flags that do not fit in ifa_flags; syscall does not define it
+	ifaFlags = 0x8
+	// ifaCacheinfo is the IFA_CACHEINFO attribute, which carries the
+	// lifetimes of an address
+	ifaCacheinfo = 0x6
+
+	settlePollInterval = 50 * time.Millisecond
+)
+
+// ValidateExpectedInterfaceIPs checks that every address in resultIPs is
+// configured on ifName in the current network namespace. The returned
+// error names the addresses that are missing.
+func ValidateExpectedInterfaceIPs(ifName string, resultIPs []*net.IPNet) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
+	}
+
+	var missing []string
+	for _, want := range resultIPs {
+		if !hasAddr(addrs, want) {
+			missing = append(missing, want.String())
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("interface %q is missing expected addresses: %s", ifName, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func hasAddr(addrs []netlink.Addr, ipn *net.IPNet) bool {
+	wantOnes, wantBits := ipn.Mask.Size()
+	for _, a := range addrs {
+		ones, bits := a.IPNet.Mask.Size()
+		if a.IPNet.IP.Equal(ipn.IP) && ones == wantOnes && bits == wantBits {
+			return true
+		}
+	}
+	return false
+}
+
+// SettleAddresses waits until none of the IPv6 addresses of ifName is
+// tentative, i.e. until duplicate address detection has finished and
+// they can be used, e.g. as the source of a route. It returns an error
+// naming the addresses that failed DAD, or those still tentative when
+// timeout elapses.
+func SettleAddresses(ifName string, timeout time.Duration) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		tentative, failed, err := unsettledAddrs(link.Attrs().Index)
+		if err != nil {
+			return fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
+		}
+
+		if len(failed) > 0 {
+			return fmt.Errorf("interface %q has addresses that failed duplicate address detection: %s", ifName, strings.Join(failed, ", "))
+		}
+		if len(tentative) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("interface %q has addresses still tentative after %v: %s", ifName, timeout, strings.Join(tentative, ", "))
+		}
+
+		time.Sleep(settlePollInterval)
+	}
+}
+
+// AddrAddWithLifetime adds addr to link, valid for validLft and
+// preferred for prefLft seconds, after which the kernel deprecates and
+// then removes it. If link already has addr, its lifetimes are updated
+// instead, so that an address can be kept alive by calling this again.
+func AddrAddWithLifetime(link netlink.Link, addr *netlink.Addr, validLft, prefLft int) error {
+	if validLft <= 0 || prefLft < 0 || prefLft > validLft {
+		return fmt.Errorf("invalid lifetimes for %s: valid %d, preferred %d", addr.IPNet, validLft, prefLft)
+	}
+
+	// netlink.AddrAdd cannot set lifetimes, so the request is built here
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE|syscall.NLM_F_ACK)
+
+	family := nl.GetIPFamily(addr.IP)
+	msg := nl.NewIfAddrmsg(family)
+	msg.Index = uint32(link.Attrs().Index)
+	prefixlen, _ := addr.Mask.Size()
+	msg.Prefixlen = uint8(prefixlen)
+	req.AddData(msg)
+
+	addrData := addr.IP.To16()
+	if family == netlink.FAMILY_V4 {
+		addrData = addr.IP.To4()
+	}
+	req.AddData(nl.NewRtAttr(syscall.IFA_LOCAL, addrData))
+	req.AddData(nl.NewRtAttr(syscall.IFA_ADDRESS, addrData))
+
+	// struct ifa_cacheinfo: ifa_prefered, ifa_valid, cstamp, tstamp
+	cacheinfo := make([]byte, 16)
+	nl.NativeEndian().PutUint32(cacheinfo[0:4], uint32(prefLft))
+	nl.NativeEndian().PutUint32(cacheinfo[4:8], uint32(validLft))
+	req.AddData(nl.NewRtAttr(ifaCacheinfo, cacheinfo))
+
+	if _, err := req.Execute(syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to add IP addr %s to %q: %v", addr.IPNet, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// unsettledAddrs returns the IPv6 addresses of the link with index
+// that are tentative and those that failed DAD. The netlink package
+// does not expose address flags, so they are read from a raw dump.
+func unsettledAddrs(index int) (tentative, failed []string, err error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETADDR, syscall.NLM_F_DUMP)
+	req.AddData(nl.NewIfAddrmsg(syscall.AF_INET6))
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWADDR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, m := range msgs {
+		msg := nl.DeserializeIfAddrmsg(m)
+		if int(msg.Index) != index {
+			continue
+		}
+
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var addr net.IP
+		flags := uint32(msg.Flags)
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.IFA_ADDRESS:
+				addr = net.IP(attr.Value)
+			case ifaFlags:
+				flags = nl.NativeEndian().Uint32(attr.Value[0:4])
+			}
+		}
+
+		// a failed address stays tentative too
+		switch {
+		case flags&syscall.IFA_F_DADFAILED != 0:
+			failed = append(failed, addr.String())
+		case flags&syscall.IFA_F_TENTATIVE != 0:
+			tentative = append(tentative, addr.String())
+		}
+	}
+	return tentative, failed, nil
+}
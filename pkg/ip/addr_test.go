@@ -0,0 +1,343 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidateExpectedInterfaceIPs", func() {
+	var (
+		nsName  string
+		netNS   *os.File
+		present *net.IPNet
+		missing *net.IPNet
+		inNS    func(func() error) error
+	)
+
+	BeforeEach(func() {
+		var err error
+		nsName = fmt.Sprintf("test-addr-%d", rand.Int())
+		netNS, err = ns.CreateNetNS(nsName)
+		Expect(err).NotTo(HaveOccurred())
+
+		inNS = func(f func() error) error {
+			return ns.WithNetNS(netNS, true, func(_ *os.File) error {
+				return f()
+			})
+		}
+
+		present = &net.IPNet{IP: net.IPv4(10, 1, 1, 2), Mask: net.CIDRMask(24, 32)}
+		missing = &net.IPNet{IP: net.IPv4(10, 1, 2, 2), Mask: net.CIDRMask(24, 32)}
+
+		err = inNS(func() error {
+			if err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "eth0"},
+				PeerName:  "eth0p",
+			}); err != nil {
+				return err
+			}
+			link, err := netlink.LinkByName("eth0")
+			if err != nil {
+				return err
+			}
+			return netlink.AddrAdd(link, &netlink.Addr{IPNet: present})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(netNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(nsName)).To(Succeed())
+	})
+
+	It("succeeds when all expected addresses are configured", func() {
+		err := inNS(func() error {
+			return ip.ValidateExpectedInterfaceIPs("eth0", []*net.IPNet{present})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("names the expected addresses that are missing", func() {
+		err := inNS(func() error {
+			return ip.ValidateExpectedInterfaceIPs("eth0", []*net.IPNet{present, missing})
+		})
+		Expect(err).To(MatchError(`interface "eth0" is missing expected addresses: 10.1.2.2/24`))
+	})
+
+	It("treats a different prefix length as missing", func() {
+		wrongMask := &net.IPNet{IP: present.IP, Mask: net.CIDRMask(16, 32)}
+		err := inNS(func() error {
+			return ip.ValidateExpectedInterfaceIPs("eth0", []*net.IPNet{wrongMask})
+		})
+		Expect(err).To(MatchError(ContainSubstring("10.1.1.2/16")))
+	})
+
+	It("fails when the interface does not exist", func() {
+		err := inNS(func() error {
+			return ip.ValidateExpectedInterfaceIPs("eth1", []*net.IPNet{present})
+		})
+		Expect(err).To(MatchError(ContainSubstring(`failed to lookup "eth1"`)))
+	})
+})
+
+var _ = Describe("SettleAddresses", func() {
+	var (
+		nsName string
+		netNS  *os.File
+		inNS   func(func() error) error
+		v6Addr *net.IPNet
+	)
+
+	setUp := func(name string) error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	}
+
+	// addAddr adds addr to the named link after setting it up
+	addAddr := func(name string, addr *net.IPNet) error {
+		if err := setUp(name); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		return netlink.AddrAdd(link, &netlink.Addr{IPNet: addr})
+	}
+
+	BeforeEach(func() {
+		var err error
+		nsName = fmt.Sprintf("test-settle-%d", rand.Int())
+		netNS, err = ns.CreateNetNS(nsName)
+		Expect(err).NotTo(HaveOccurred())
+
+		inNS = func(f func() error) error {
+			return ns.WithNetNS(netNS, true, func(_ *os.File) error {
+				return f()
+			})
+		}
+
+		v6Addr = &net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)}
+
+		err = inNS(func() error {
+			return netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "eth0"},
+				PeerName:  "eth0p",
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(netNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(nsName)).To(Succeed())
+	})
+
+	It("returns once the address has left the tentative state", func() {
+		err := inNS(func() error {
+			Expect(setUp("eth0p")).To(Succeed())
+			Expect(addAddr("eth0", v6Addr)).To(Succeed())
+
+			// DAD takes about a second, so the address starts out tentative
+			Expect(ip.SettleAddresses("eth0", 0)).To(MatchError(ContainSubstring("still tentative")))
+
+			Expect(ip.SettleAddresses("eth0", 10*time.Second)).To(Succeed())
+			return ip.SettleAddresses("eth0", 0)
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("times out while the link has no carrier", func() {
+		err := inNS(func() error {
+			// with its peer down, eth0 never gets to run DAD
+			Expect(addAddr("eth0", v6Addr)).To(Succeed())
+
+			return ip.SettleAddresses("eth0", 200*time.Millisecond)
+		})
+		Expect(err).To(MatchError(`interface "eth0" has addresses still tentative after 200ms: fd00::2`))
+	})
+
+	It("names an address that failed duplicate address detection", func() {
+		// the peer holds the address first, from a namespace of its own
+		peerNSName := fmt.Sprintf("test-settle-peer-%d", rand.Int())
+		peerNS, err := ns.CreateNetNS(peerNSName)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			Expect(peerNS.Close()).To(Succeed())
+			Expect(ns.DeleteNetNS(peerNSName)).To(Succeed())
+		}()
+
+		err = inNS(func() error {
+			peer, err := netlink.LinkByName("eth0p")
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetNsFd(peer, int(peerNS.Fd())); err != nil {
+				return err
+			}
+			return setUp("eth0")
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = ns.WithNetNS(peerNS, true, func(_ *os.File) error {
+			Expect(addAddr("eth0p", v6Addr)).To(Succeed())
+			return ip.SettleAddresses("eth0p", 10*time.Second)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = inNS(func() error {
+			Expect(addAddr("eth0", v6Addr)).To(Succeed())
+			return ip.SettleAddresses("eth0", 10*time.Second)
+		})
+		Expect(err).To(MatchError(`interface "eth0" has addresses that failed duplicate address detection: fd00::2`))
+	})
+})
+
+// addrLifetimes returns the valid and preferred lifetimes, in seconds,
+// of the address ipn of the link with index
+func addrLifetimes(index int, ipn *net.IPNet) (valid, preferred uint32) {
+	const ifaCacheinfo = 0x6
+
+	req := nl.NewNetlinkRequest(syscall.RTM_GETADDR, syscall.NLM_F_DUMP)
+	req.AddData(nl.NewIfAddrmsg(syscall.AF_UNSPEC))
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWADDR)
+	Expect(err).NotTo(HaveOccurred())
+
+	for _, m := range msgs {
+		msg := nl.DeserializeIfAddrmsg(m)
+		if int(msg.Index) != index {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		Expect(err).NotTo(HaveOccurred())
+
+		var addr net.IP
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.IFA_LOCAL:
+				addr = net.IP(attr.Value)
+			case ifaCacheinfo:
+				preferred = nl.NativeEndian().Uint32(attr.Value[0:4])
+				valid = nl.NativeEndian().Uint32(attr.Value[4:8])
+			}
+		}
+		if addr.Equal(ipn.IP) {
+			return valid, preferred
+		}
+	}
+	Fail(fmt.Sprintf("address %s not found", ipn))
+	return 0, 0
+}
+
+var _ = Describe("AddrAddWithLifetime", func() {
+	var (
+		nsName string
+		netNS  *os.File
+		addr   *netlink.Addr
+	)
+
+	inNS := func(f func(link netlink.Link)) {
+		err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			f(link)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		var err error
+		nsName = fmt.Sprintf("test-lifetime-%d", rand.Int())
+		netNS, err = ns.CreateNetNS(nsName)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = ns.WithNetNS(netNS, true, func(_ *os.File) error {
+			return netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "eth0"},
+				PeerName:  "eth1",
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		addr = &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("10.1.2.3").To4(), Mask: net.CIDRMask(24, 32)}}
+	})
+
+	AfterEach(func() {
+		Expect(netNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(nsName)).To(Succeed())
+	})
+
+	It("adds the address with the given lifetimes", func() {
+		inNS(func(link netlink.Link) {
+			Expect(ip.AddrAddWithLifetime(link, addr, 60, 30)).To(Succeed())
+
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].IPNet.String()).To(Equal("10.1.2.3/24"))
+
+			valid, preferred := addrLifetimes(link.Attrs().Index, addr.IPNet)
+			Expect(valid).To(BeNumerically("~", 60, 2))
+			Expect(preferred).To(BeNumerically("~", 30, 2))
+		})
+	})
+
+	It("updates the lifetimes of an address that is already there", func() {
+		inNS(func(link netlink.Link) {
+			Expect(ip.AddrAddWithLifetime(link, addr, 60, 30)).To(Succeed())
+			Expect(ip.AddrAddWithLifetime(link, addr, 600, 600)).To(Succeed())
+
+			valid, preferred := addrLifetimes(link.Attrs().Index, addr.IPNet)
+			Expect(valid).To(BeNumerically("~", 600, 2))
+			Expect(preferred).To(BeNumerically("~", 600, 2))
+		})
+	})
+
+	It("lets the kernel remove the address once it expires", func() {
+		inNS(func(link netlink.Link) {
+			Expect(ip.AddrAddWithLifetime(link, addr, 1, 1)).To(Succeed())
+
+			Eventually(func() ([]netlink.Addr, error) {
+				return netlink.AddrList(link, netlink.FAMILY_V4)
+			}, "5s", "100ms").Should(BeEmpty())
+		})
+	})
+
+	It("rejects a preferred lifetime longer than the valid one", func() {
+		inNS(func(link netlink.Link) {
+			Expect(ip.AddrAddWithLifetime(link, addr, 30, 60)).To(MatchError(
+				"invalid lifetimes for 10.1.2.3/24: valid 30, preferred 60"))
+		})
+	})
+})
@@ -15,31 +15,58 @@
 package ip
 
 import (
-	"math/big"
 	"net"
 )
 
-// NextIP returns IP incremented by 1
-func NextIP(ip net.IP) net.IP {
-	i := ipToInt(ip)
-	return intToIP(i.Add(i, big.NewInt(1)))
+// ParseCIDR parses s as an address with a prefix length, such as
+// "10.0.0.5/24", and returns both the address as written and the
+// network it is in. Unlike net.ParseCIDR, an IPv4 address is returned
+// in its 4-byte form, the same length as the network's mask.
+func ParseCIDR(s string) (net.IP, *net.IPNet, error) {
+	addr, ipn, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+	return addr, ipn, nil
 }
 
-// PrevIP returns IP decremented by 1
-func PrevIP(ip net.IP) net.IP {
-	i := ipToInt(ip)
-	return intToIP(i.Sub(i, big.NewInt(1)))
+// NextIP returns IP incremented by 1, carrying into the higher bytes.
+// The address after the last one of a family wraps around to the first.
+func NextIP(ip net.IP) net.IP {
+	next := canonical(ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			break
+		}
+	}
+	return next
 }
 
-func ipToInt(ip net.IP) *big.Int {
-	if v := ip.To4(); v != nil {
-		return big.NewInt(0).SetBytes(v)
+// PrevIP returns IP decremented by 1, borrowing from the higher bytes.
+// The address before the first one of a family wraps around to the last.
+func PrevIP(ip net.IP) net.IP {
+	prev := canonical(ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		if prev[i]--; prev[i] != 0xff {
+			break
+		}
 	}
-	return big.NewInt(0).SetBytes(ip.To16())
+	return prev
 }
 
-func intToIP(i *big.Int) net.IP {
-	return net.IP(i.Bytes())
+// canonical returns a copy of ip, 4 bytes long for IPv4 and 16 for IPv6.
+func canonical(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else {
+		ip = ip.To16()
+	}
+	c := make(net.IP, len(ip))
+	copy(c, ip)
+	return c
 }
 
 // Network masks off the host portion of the IP
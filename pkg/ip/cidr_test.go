@@ -0,0 +1,93 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"net"
+
+	"github.com/appc/cni/pkg/ip"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CIDR helpers", func() {
+	Describe("ParseCIDR", func() {
+		It("keeps the host address along with the network", func() {
+			addr, ipn, err := ip.ParseCIDR("10.0.0.5/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addr.String()).To(Equal("10.0.0.5"))
+			Expect(addr).To(HaveLen(net.IPv4len))
+			Expect(ipn.String()).To(Equal("10.0.0.0/24"))
+		})
+
+		It("keeps the host address of an IPv6 CIDR", func() {
+			addr, ipn, err := ip.ParseCIDR("fd00::1:5/64")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addr.String()).To(Equal("fd00::1:5"))
+			Expect(addr).To(HaveLen(net.IPv6len))
+			Expect(ipn.String()).To(Equal("fd00::/64"))
+		})
+
+		It("fails for a string without a prefix length", func() {
+			_, _, err := ip.ParseCIDR("10.0.0.5")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("NextIP", func() {
+		It("rolls over an octet boundary", func() {
+			Expect(ip.NextIP(net.ParseIP("10.0.0.255")).String()).To(Equal("10.0.1.0"))
+			Expect(ip.NextIP(net.ParseIP("10.0.255.255")).String()).To(Equal("10.1.0.0"))
+		})
+
+		It("keeps leading zero bytes", func() {
+			next := ip.NextIP(net.ParseIP("0.0.0.255"))
+			Expect(next).To(HaveLen(net.IPv4len))
+			Expect(next.String()).To(Equal("0.0.1.0"))
+			Expect(ip.NextIP(net.ParseIP("::ffff:ffff")).String()).To(Equal("::1:0:0"))
+		})
+
+		It("wraps around after the last address", func() {
+			Expect(ip.NextIP(net.ParseIP("255.255.255.255")).String()).To(Equal("0.0.0.0"))
+		})
+
+		It("does not modify its argument", func() {
+			addr := net.ParseIP("10.0.0.1")
+			ip.NextIP(addr)
+			Expect(addr.String()).To(Equal("10.0.0.1"))
+		})
+	})
+
+	Describe("PrevIP", func() {
+		It("steps back over the network boundary", func() {
+			_, ipn, err := ip.ParseCIDR("10.0.1.0/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ip.PrevIP(ipn.IP).String()).To(Equal("10.0.0.255"))
+			Expect(ipn.Contains(ip.PrevIP(ipn.IP))).To(BeFalse())
+		})
+
+		It("undoes NextIP", func() {
+			for _, s := range []string{"10.0.0.255", "10.0.1.0", "fd00::ffff", "fd00::1:0"} {
+				addr := net.ParseIP(s)
+				Expect(ip.PrevIP(ip.NextIP(addr)).Equal(addr)).To(BeTrue(), s)
+			}
+		})
+
+		It("wraps around before the first address", func() {
+			Expect(ip.PrevIP(net.ParseIP("0.0.0.0")).String()).To(Equal("255.255.255.255"))
+		})
+	})
+})
@@ -15,17 +15,25 @@
 package ip
 
 import (
-	"io/ioutil"
+	"github.com/appc/cni/pkg/utils/sysctl"
 )
 
+// EnableIP4Forward turns on IPv4 forwarding in the current network namespace.
 func EnableIP4Forward() error {
-	return echo1("/proc/sys/net/ipv4/ip_forward")
+	return echo1("net.ipv4.ip_forward")
 }
 
+// EnableIP6Forward turns on IPv6 forwarding on all interfaces in the
+// current network namespace.
 func EnableIP6Forward() error {
-	return echo1("/proc/sys/net/ipv6/conf/all/forwarding")
+	return echo1("net.ipv6.conf.all.forwarding")
 }
 
-func echo1(f string) error {
-	return ioutil.WriteFile(f, []byte("1"), 0644)
+// echo1 sets the sysctl to 1, skipping the write if it already is.
+func echo1(name string) error {
+	if val, err := sysctl.Sysctl(name); err == nil && val == "1" {
+		return nil
+	}
+	_, err := sysctl.Sysctl(name, "1")
+	return err
 }
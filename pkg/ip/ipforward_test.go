@@ -0,0 +1,80 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/utils/sysctl"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IP forwarding", func() {
+	var (
+		nsName string
+		netNS  *os.File
+	)
+
+	BeforeEach(func() {
+		var err error
+		nsName = fmt.Sprintf("test-fwd-%d", rand.Int())
+		netNS, err = ns.CreateNetNS(nsName)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(netNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(nsName)).To(Succeed())
+	})
+
+	testEnable := func(name string, enable func() error) {
+		err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+			defer GinkgoRecover()
+
+			orig, err := sysctl.Sysctl(name)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_, err := sysctl.Sysctl(name, orig)
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			_, err = sysctl.Sysctl(name, "0")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(enable()).To(Succeed())
+			Expect(sysctl.Sysctl(name)).To(Equal("1"))
+
+			// already enabled
+			Expect(enable()).To(Succeed())
+			Expect(sysctl.Sysctl(name)).To(Equal("1"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("enables IPv4 forwarding", func() {
+		testEnable("net.ipv4.ip_forward", ip.EnableIP4Forward)
+	})
+
+	It("enables IPv6 forwarding", func() {
+		testEnable("net.ipv6.conf.all.forwarding", ip.EnableIP6Forward)
+	})
+})
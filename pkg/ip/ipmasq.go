@@ -15,52 +15,35 @@
 package ip
 
 import (
-	"fmt"
 	"net"
 
-	"github.com/coreos/go-iptables/iptables"
+	"github.com/appc/cni/pkg/utils/iptables"
 )
 
 // SetupIPMasq installs iptables rules to masquerade traffic
 // coming from ipn and going outside of it
 func SetupIPMasq(ipn *net.IPNet, chain string, comment string) error {
-	ipt, err := iptables.New()
-	if err != nil {
-		return fmt.Errorf("failed to locate iptables: %v", err)
-	}
-
-	if err = ipt.NewChain("nat", chain); err != nil {
-		if err.(*iptables.Error).ExitStatus() != 1 {
-			// TODO(eyakubovich): assumes exit status 1 implies chain exists
-			return err
-		}
+	if err := iptables.EnsureChain("nat", chain); err != nil {
+		return err
 	}
 
-	if err = ipt.AppendUnique("nat", chain, "-d", ipn.String(), "-j", "ACCEPT", "-m", "comment", "--comment", comment); err != nil {
+	if err := iptables.EnsureRule("nat", chain, []string{"-d", ipn.String(), "-j", "ACCEPT", "-m", "comment", "--comment", comment}); err != nil {
 		return err
 	}
 
-	if err = ipt.AppendUnique("nat", chain, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE", "-m", "comment", "--comment", comment); err != nil {
+	if err := iptables.EnsureRule("nat", chain, []string{"!", "-d", "224.0.0.0/4", "-j", "MASQUERADE", "-m", "comment", "--comment", comment}); err != nil {
 		return err
 	}
 
-	return ipt.AppendUnique("nat", "POSTROUTING", "-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment)
+	return iptables.EnsureRule("nat", "POSTROUTING", []string{"-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment})
 }
 
-// TeardownIPMasq undoes the effects of SetupIPMasq
+// TeardownIPMasq undoes the effects of SetupIPMasq.
+// It is safe to call again once the rules are gone.
 func TeardownIPMasq(ipn *net.IPNet, chain string, comment string) error {
-	ipt, err := iptables.New()
-	if err != nil {
-		return fmt.Errorf("failed to locate iptables: %v", err)
-	}
-
-	if err = ipt.Delete("nat", "POSTROUTING", "-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment); err != nil {
-		return err
-	}
-
-	if err = ipt.ClearChain("nat", chain); err != nil {
+	if err := iptables.DeleteRule("nat", "POSTROUTING", []string{"-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment}); err != nil {
 		return err
 	}
 
-	return ipt.DeleteChain("nat", chain)
+	return iptables.DeleteChain("nat", chain)
 }
@@ -0,0 +1,122 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/types"
+	"github.com/coreos/go-iptables/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IP masquerading", func() {
+	const (
+		chain   = "CNI-test-masq"
+		comment = `name: "testnet" id: "some-container-id"`
+	)
+
+	var (
+		netnsName string
+		netns     *os.File
+	)
+
+	// inNS runs f in a scratch namespace, which has its own iptables
+	// rules; iptables is exec'ed and inherits the namespace of the thread
+	inNS := func(f func(ipt *iptables.IPTables)) {
+		err := ns.WithNetNS(netns, true, func(_ *os.File) error {
+			ipt, err := iptables.New()
+			Expect(err).NotTo(HaveOccurred())
+			f(ipt)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	postroutingRules := func(ipt *iptables.IPTables) []string {
+		rules, err := ipt.List("nat", "POSTROUTING")
+		Expect(err).NotTo(HaveOccurred())
+		var ours []string
+		for _, r := range rules {
+			if strings.Contains(r, chain) {
+				ours = append(ours, r)
+			}
+		}
+		return ours
+	}
+
+	BeforeEach(func() {
+		if _, err := exec.LookPath("iptables"); err != nil {
+			Skip("iptables not available")
+		}
+
+		var err error
+		netnsName = fmt.Sprintf("test-masq-netns-%d", rand.Int())
+		netns, err = ns.CreateNetNS(netnsName)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if netns == nil {
+			return
+		}
+		Expect(netns.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(netnsName)).To(Succeed())
+		netns = nil
+	})
+
+	It("installs the rules on setup and removes them all on teardown", func() {
+		ipn, err := types.ParseCIDR("10.1.2.0/24")
+		Expect(err).NotTo(HaveOccurred())
+
+		inNS(func(ipt *iptables.IPTables) {
+			Expect(ip.SetupIPMasq(ipn, chain, comment)).To(Succeed())
+
+			Expect(postroutingRules(ipt)).To(HaveLen(1))
+			Expect(postroutingRules(ipt)[0]).To(ContainSubstring(comment))
+
+			rules, err := ipt.List("nat", chain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(ContainElement(ContainSubstring("MASQUERADE")))
+
+			Expect(ip.TeardownIPMasq(ipn, chain, comment)).To(Succeed())
+
+			Expect(postroutingRules(ipt)).To(BeEmpty())
+			_, err = ipt.List("nat", chain)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("tolerates a second teardown", func() {
+		ipn, err := types.ParseCIDR("10.1.2.0/24")
+		Expect(err).NotTo(HaveOccurred())
+
+		inNS(func(ipt *iptables.IPTables) {
+			Expect(ip.SetupIPMasq(ipn, chain, comment)).To(Succeed())
+			Expect(ip.TeardownIPMasq(ipn, chain, comment)).To(Succeed())
+			Expect(ip.TeardownIPMasq(ipn, chain, comment)).To(Succeed())
+
+			Expect(postroutingRules(ipt)).To(BeEmpty())
+		})
+	})
+})
@@ -16,12 +16,25 @@ package ip
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/appc/cni/pkg/ns"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	// iffLowerUp is IFF_LOWER_UP, the flag of a link with carrier;
+	// syscall does not define it
+	iffLowerUp = 0x10000
+
+	carrierPollInterval = 20 * time.Millisecond
 )
 
 func makeVethPair(name, peer string, mtu int) (netlink.Link, error) {
@@ -40,9 +53,19 @@ func makeVethPair(name, peer string, mtu int) (netlink.Link, error) {
 	return veth, nil
 }
 
-func makeVeth(name string, mtu int) (peerName string, veth netlink.Link, err error) {
+// makeVeth creates a veth pair with the given name and peer name, or a
+// random peer name if peer is empty.
+func makeVeth(name, peer string, mtu int) (peerName string, veth netlink.Link, err error) {
+	if peer != "" {
+		peerName = peer
+		if veth, err = makeVethPair(name, peerName, mtu); err != nil {
+			err = fmt.Errorf("failed to make veth pair: %v", err)
+		}
+		return
+	}
+
 	for i := 0; i < 10; i++ {
-		peerName, err = RandomVethName()
+		peerName, err = randomVethName()
 		if err != nil {
 			return
 		}
@@ -66,6 +89,10 @@ func makeVeth(name string, mtu int) (peerName string, veth netlink.Link, err err
 	return
 }
 
+// randomVethName generates the host veth names; tests replace it to
+// force collisions.
+var randomVethName = RandomVethName
+
 // RandomVethName returns string "veth" with random prefix (hashed from entropy)
 func RandomVethName() (string, error) {
 	entropy := make([]byte, 4)
@@ -78,21 +105,81 @@ func RandomVethName() (string, error) {
 	return fmt.Sprintf("veth%x", entropy), nil
 }
 
-// SetupVeth sets up a virtual ethernet link.
+// LinkExistsError is returned by SetupVethWithName when the requested
+// host veth name is already taken in the host namespace.
+type LinkExistsError struct {
+	Name string
+}
+
+func (e *LinkExistsError) Error() string {
+	return fmt.Sprintf("host veth name %q already exists", e.Name)
+}
+
+// SetupVeth sets up a virtual ethernet link with a random host veth name.
 // Should be in container netns, and will switch back to hostNS to set the host
 // veth end up.
 func SetupVeth(contVethName string, mtu int, hostNS *os.File) (hostVeth, contVeth netlink.Link, err error) {
-	var hostVethName string
-	hostVethName, contVeth, err = makeVeth(contVethName, mtu)
+	return SetupVethWithName(contVethName, "", mtu, nil, hostNS)
+}
+
+// SetupVethWithName is like SetupVeth but names the host end hostVethName,
+// picking a random name if it is empty. Unless contVethMac is nil, the
+// container end gets that MAC before it is brought up. It returns a
+// *LinkExistsError if hostNS already has an interface of that name; a
+// random name that turns out to be taken there is replaced by another
+// instead.
+func SetupVethWithName(contVethName, hostVethName string, mtu int, contVethMac net.HardwareAddr, hostNS *os.File) (hostVeth, contVeth netlink.Link, err error) {
+	if hostVethName != "" {
+		return setupVeth(contVethName, hostVethName, mtu, contVethMac, hostNS)
+	}
+
+	// makeVeth only sees the names of the current namespace
+	for i := 0; i < 10; i++ {
+		hostVeth, contVeth, err = setupVeth(contVethName, "", mtu, contVethMac, hostNS)
+		if _, taken := err.(*LinkExistsError); !taken {
+			return
+		}
+	}
+	err = fmt.Errorf("failed to find a unique veth name")
+	return
+}
+
+func setupVeth(contVethName, hostVethName string, mtu int, contVethMac net.HardwareAddr, hostNS *os.File) (hostVeth, contVeth netlink.Link, err error) {
+	hostVethName, contVeth, err = makeVeth(contVethName, hostVethName, mtu)
 	if err != nil {
 		return
 	}
 
+	// a pair left half set up would fail a retry on contVethName;
+	// deleting the container end takes the host end with it
+	veth := contVeth
+	defer func() {
+		if err != nil {
+			netlink.LinkDel(veth)
+		}
+	}()
+
+	// the MAC is set while the link is down so that nothing sees the
+	// kernel-assigned one
+	if contVethMac != nil {
+		if err = netlink.LinkSetHardwareAddr(contVeth, contVethMac); err != nil {
+			err = fmt.Errorf("failed to set %q mac to %v: %v", contVethName, contVethMac, err)
+			return
+		}
+	}
+
 	if err = netlink.LinkSetUp(contVeth); err != nil {
 		err = fmt.Errorf("failed to set %q up: %v", contVethName, err)
 		return
 	}
 
+	// refresh so that the returned link carries the kernel-assigned attributes
+	contVeth, err = netlink.LinkByName(contVethName)
+	if err != nil {
+		err = fmt.Errorf("failed to lookup %q: %v", contVethName, err)
+		return
+	}
+
 	hostVeth, err = netlink.LinkByName(hostVethName)
 	if err != nil {
 		err = fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
@@ -100,12 +187,18 @@ func SetupVeth(contVethName string, mtu int, hostNS *os.File) (hostVeth, contVet
 	}
 
 	if err = netlink.LinkSetNsFd(hostVeth, int(hostNS.Fd())); err != nil {
+		// the kernel refuses to move a link onto a name already in use
+		if os.IsExist(err) {
+			err = &LinkExistsError{Name: hostVethName}
+			return
+		}
 		err = fmt.Errorf("failed to move veth to host netns: %v", err)
 		return
 	}
 
 	err = ns.WithNetNS(hostNS, false, func(_ *os.File) error {
-		hostVeth, err := netlink.LinkByName(hostVethName)
+		var err error
+		hostVeth, err = netlink.LinkByName(hostVethName)
 		if err != nil {
 			return fmt.Errorf("failed to lookup %q in %q: %v", hostVethName, hostNS.Name(), err)
 		}
@@ -113,15 +206,144 @@ func SetupVeth(contVethName string, mtu int, hostNS *os.File) (hostVeth, contVet
 		if err = netlink.LinkSetUp(hostVeth); err != nil {
 			return fmt.Errorf("failed to set %q up: %v", hostVethName, err)
 		}
+
+		// refresh so that the returned link reflects its state in hostNS
+		hostVeth, err = netlink.LinkByName(hostVethName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q in %q: %v", hostVethName, hostNS.Name(), err)
+		}
 		return nil
 	})
 	return
 }
 
+// SetMTU sets the MTU of link.
+func SetMTU(link netlink.Link, mtu int) error {
+	if mtu <= 0 {
+		return fmt.Errorf("invalid MTU %d for %q", mtu, link.Attrs().Name)
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("failed to set %q mtu to %d: %v", link.Attrs().Name, mtu, err)
+	}
+	return nil
+}
+
+// SetHardwareAddr sets the MAC address of the interface ifName.
+func SetHardwareAddr(ifName string, mac net.HardwareAddr) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	if err = netlink.LinkSetHardwareAddr(link, mac); err != nil {
+		return fmt.Errorf("failed to set %q mac to %v: %v", ifName, mac, err)
+	}
+	return nil
+}
+
+// MoveLinkToNS moves link into the network namespace ns. It fails with
+// a conflict error if ns already has an interface of the same name.
+func MoveLinkToNS(link netlink.Link, ns *os.File) error {
+	name := link.Attrs().Name
+	if err := netlink.LinkSetNsFd(link, int(ns.Fd())); err != nil {
+		// the kernel refuses to move a link onto a name already in use
+		if os.IsExist(err) {
+			return fmt.Errorf("failed to move %q to %q: an interface of that name already exists there", name, ns.Name())
+		}
+		return fmt.Errorf("failed to move %q to %q: %v", name, ns.Name(), err)
+	}
+	return nil
+}
+
+// RenameLink renames the interface oldName to newName. The interface
+// must be down. It fails with a conflict error if newName is taken.
+func RenameLink(oldName, newName string) error {
+	link, err := netlink.LinkByName(oldName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", oldName, err)
+	}
+
+	if err = netlink.LinkSetName(link, newName); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("failed to rename %q to %q: an interface of that name already exists", oldName, newName)
+		}
+		return fmt.Errorf("failed to rename %q to %q: %v", oldName, newName, err)
+	}
+	return nil
+}
+
+// SetLinkUp sets link up. The link may not have carrier yet when it
+// returns; see WaitForCarrier.
+func SetLinkUp(link netlink.Link) error {
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// WaitForCarrier waits until ifName has carrier, i.e. until the kernel
+// reports it as IFF_LOWER_UP, or returns an error once timeout elapses.
+// Note that a veth only gets carrier once both of its ends are up.
+func WaitForCarrier(ifName string, timeout time.Duration) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		flags, err := linkRawFlags(link.Attrs().Index)
+		if err != nil {
+			return fmt.Errorf("failed to get the flags of %q: %v", ifName, err)
+		}
+		if flags&iffLowerUp != 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("interface %q has no carrier after %v", ifName, timeout)
+		}
+
+		time.Sleep(carrierPollInterval)
+	}
+}
+
+// linkRawFlags returns the IFF_* flags of the link with index; the
+// netlink package only exposes those net.Flags knows.
+func linkRawFlags(index int) (uint32, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return 0, err
+	}
+	if len(msgs) != 1 {
+		return 0, fmt.Errorf("expected one link, got %d", len(msgs))
+	}
+	return nl.DeserializeIfInfomsg(msgs[0]).Flags, nil
+}
+
+// ErrLinkNotFound is returned by DelLinkByName and DelLinkByNameAddr
+// when the interface does not exist, e.g. because it was already
+// deleted by an earlier DEL.
+var ErrLinkNotFound = errors.New("link not found")
+
+// IsLinkNotFound reports whether err is the lookup failure netlink
+// returns for a missing interface, or ErrLinkNotFound; netlink does not
+// export a typed error for this.
+func IsLinkNotFound(err error) bool {
+	return err != nil && strings.HasSuffix(err.Error(), "not found")
+}
+
 // DelLinkByName removes an interface link.
 func DelLinkByName(ifName string) error {
 	iface, err := netlink.LinkByName(ifName)
 	if err != nil {
+		if IsLinkNotFound(err) {
+			return ErrLinkNotFound
+		}
 		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
 	}
 
@@ -133,15 +355,18 @@ func DelLinkByName(ifName string) error {
 }
 
 // DelLinkByNameAddr remove an interface returns its IP address
-// of the specified family
+// of the specified family, or nil if it has none
 func DelLinkByNameAddr(ifName string, family int) (*net.IPNet, error) {
 	iface, err := netlink.LinkByName(ifName)
 	if err != nil {
+		if IsLinkNotFound(err) {
+			return nil, ErrLinkNotFound
+		}
 		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
 	}
 
 	addrs, err := netlink.AddrList(iface, family)
-	if err != nil || len(addrs) == 0 {
+	if err != nil {
 		return nil, fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
 	}
 
@@ -149,5 +374,8 @@ func DelLinkByNameAddr(ifName string, family int) (*net.IPNet, error) {
 		return nil, fmt.Errorf("failed to delete %q: %v", ifName, err)
 	}
 
+	if len(addrs) == 0 {
+		return nil, nil
+	}
 	return addrs[0].IPNet, nil
 }
@@ -0,0 +1,531 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Link", func() {
+	const ifaceName = "eth0"
+
+	var (
+		hostNSName, containerNSName string
+		hostNS, containerNS         *os.File
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		hostNSName = fmt.Sprintf("test-host-netns-%d", rand.Int())
+		hostNS, err = ns.CreateNetNS(hostNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		containerNSName = fmt.Sprintf("test-cont-netns-%d", rand.Int())
+		containerNS, err = ns.CreateNetNS(containerNSName)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(containerNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(containerNSName)).To(Succeed())
+
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(hostNSName)).To(Succeed())
+	})
+
+	Describe("SetupVeth", func() {
+		var hostVeth, contVeth netlink.Link
+
+		BeforeEach(func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				var err error
+				hostVeth, contVeth, err = ip.SetupVeth(ifaceName, 1500, hostNS)
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("creates the container end in the container namespace and sets it up", func() {
+			Expect(contVeth.Attrs().Name).To(Equal(ifaceName))
+
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifaceName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Index).To(Equal(contVeth.Attrs().Index))
+				Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+				Expect(link.Attrs().MTU).To(Equal(1500))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("moves the host end to the host namespace and sets it up", func() {
+			hostVethName := hostVeth.Attrs().Name
+
+			err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(hostVethName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Index).To(Equal(hostVeth.Attrs().Index))
+				Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				_, err := netlink.LinkByName(hostVethName)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	It("removes the veth pair when setting up the host end fails", func() {
+		closedNS, err := os.Open(hostNS.Name())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(closedNS.Close()).To(Succeed())
+
+		err = ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+			defer GinkgoRecover()
+
+			_, _, err := ip.SetupVeth(ifaceName, 1500, closedNS)
+			Expect(err).To(MatchError(HavePrefix("failed to move veth to host netns: ")))
+
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(links).To(HaveLen(1))
+			Expect(links[0].Attrs().Name).To(Equal("lo"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("SetupVethWithName", func() {
+		const hostVethName = "host-veth0"
+
+		setup := func() (hostVeth netlink.Link, err error) {
+			err = ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				var err error
+				hostVeth, _, err = ip.SetupVethWithName(ifaceName, hostVethName, 1500, nil, hostNS)
+				return err
+			})
+			return
+		}
+
+		It("gives the host end the chosen name", func() {
+			hostVeth, err := setup()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hostVeth.Attrs().Name).To(Equal(hostVethName))
+
+			err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(hostVethName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("gives the container end the MAC before setting it up", func() {
+			mac, err := net.ParseMAC("02:00:00:00:00:01")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				updates := make(chan netlink.LinkUpdate, 100)
+				done := make(chan struct{})
+				Expect(netlink.LinkSubscribe(updates, done)).To(Succeed())
+
+				_, contVeth, err := ip.SetupVethWithName(ifaceName, hostVethName, 1500, mac, hostNS)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contVeth.Attrs().HardwareAddr).To(Equal(mac))
+
+				// every notification of the link being up carries the MAC
+				var up int
+				Eventually(func() int {
+					for {
+						select {
+						case u := <-updates:
+							if u.Attrs().Name == ifaceName && u.Flags&syscall.IFF_UP != 0 {
+								Expect(u.Attrs().HardwareAddr).To(Equal(mac))
+								up++
+							}
+						default:
+							return up
+						}
+					}
+				}).ShouldNot(BeZero())
+				close(done)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("when the host name is already taken", func() {
+			BeforeEach(func() {
+				err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+					return netlink.LinkAdd(&netlink.Veth{
+						LinkAttrs: netlink.LinkAttrs{Name: hostVethName},
+						PeerName:  "host-veth0p",
+					})
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns a LinkExistsError and leaves no veth behind", func() {
+				_, err := setup()
+				Expect(err).To(Equal(&ip.LinkExistsError{Name: hostVethName}))
+				Expect(err).To(MatchError(`host veth name "host-veth0" already exists`))
+
+				err = ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+					_, err := netlink.LinkByName(ifaceName)
+					Expect(err).To(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			Context("and the name was picked at random", func() {
+				var names []string
+
+				BeforeEach(func() {
+					names = nil
+				})
+
+				// randomNames hands out the given names in turn, recording them
+				randomNames := func(candidates ...string) func() {
+					return ip.SetRandomVethName(func() (string, error) {
+						name := candidates[len(names)%len(candidates)]
+						names = append(names, name)
+						return name, nil
+					})
+				}
+
+				setupRandom := func() (hostVeth netlink.Link, err error) {
+					err = ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+						var err error
+						hostVeth, _, err = ip.SetupVethWithName(ifaceName, "", 1500, nil, hostNS)
+						return err
+					})
+					return
+				}
+
+				It("retries with a fresh name", func() {
+					defer randomNames(hostVethName, "host-veth1")()
+
+					hostVeth, err := setupRandom()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(names).To(Equal([]string{hostVethName, "host-veth1"}))
+					Expect(hostVeth.Attrs().Name).To(Equal("host-veth1"))
+
+					err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+						_, err := netlink.LinkByName("host-veth1")
+						return err
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					err = ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+						links, err := netlink.LinkList()
+						Expect(err).NotTo(HaveOccurred())
+						var linkNames []string
+						for _, l := range links {
+							linkNames = append(linkNames, l.Attrs().Name)
+						}
+						Expect(linkNames).To(ConsistOf("lo", ifaceName))
+						return nil
+					})
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("gives up when every name is taken", func() {
+					defer randomNames(hostVethName)()
+
+					_, err := setupRandom()
+					Expect(err).To(MatchError("failed to find a unique veth name"))
+					Expect(names).To(HaveLen(10))
+				})
+			})
+		})
+	})
+
+	Describe("SetMTU", func() {
+		It("sets the MTU of the link", func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				defer GinkgoRecover()
+
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: ifaceName},
+					PeerName:  "eth0p",
+				})).To(Succeed())
+				link, err := netlink.LinkByName(ifaceName)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ip.SetMTU(link, 1400)).To(Succeed())
+
+				link, err = netlink.LinkByName(ifaceName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().MTU).To(Equal(1400))
+
+				Expect(ip.SetMTU(link, 0)).To(MatchError(`invalid MTU 0 for "eth0"`))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("SetHardwareAddr", func() {
+		It("sets the MAC of the link", func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				defer GinkgoRecover()
+
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: ifaceName},
+					PeerName:  "eth0p",
+				})).To(Succeed())
+
+				mac, err := net.ParseMAC("0a:58:0a:01:02:03")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ip.SetHardwareAddr(ifaceName, mac)).To(Succeed())
+
+				link, err := netlink.LinkByName(ifaceName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().HardwareAddr).To(Equal(mac))
+
+				Expect(ip.SetHardwareAddr("missing0", mac)).To(MatchError(ContainSubstring(`failed to lookup "missing0"`)))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("DelLinkByName and DelLinkByNameAddr", func() {
+		const linkName = "test0"
+
+		var addr *net.IPNet
+
+		BeforeEach(func() {
+			var err error
+			addr, err = types.ParseCIDR("10.0.0.5/24")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				veth := &netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: linkName},
+					PeerName:  "test0-peer",
+				}
+				Expect(netlink.LinkAdd(veth)).To(Succeed())
+
+				link, err := netlink.LinkByName(linkName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.AddrAdd(link, &netlink.Addr{IPNet: addr})).To(Succeed())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("returns the address that was on the deleted link", func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				deleted, err := ip.DelLinkByNameAddr(linkName, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(deleted.String()).To(Equal("10.0.0.5/24"))
+
+				_, err = netlink.LinkByName(linkName)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("deletes a link without an address of the family and returns nil", func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				deleted, err := ip.DelLinkByNameAddr(linkName, netlink.FAMILY_V6)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(deleted).To(BeNil())
+
+				_, err = netlink.LinkByName(linkName)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("returns ErrLinkNotFound once the link is gone", func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				Expect(ip.DelLinkByName(linkName)).To(Succeed())
+
+				Expect(ip.DelLinkByName(linkName)).To(Equal(ip.ErrLinkNotFound))
+
+				_, err := ip.DelLinkByNameAddr(linkName, netlink.FAMILY_V4)
+				Expect(err).To(Equal(ip.ErrLinkNotFound))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("recognizes the error of looking up a missing link", func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				_, err := netlink.LinkByName(linkName)
+				Expect(ip.IsLinkNotFound(err)).To(BeFalse())
+
+				Expect(ip.DelLinkByName(linkName)).To(Succeed())
+				_, err = netlink.LinkByName(linkName)
+				Expect(ip.IsLinkNotFound(err)).To(BeTrue())
+
+				Expect(ip.IsLinkNotFound(ip.ErrLinkNotFound)).To(BeTrue())
+				Expect(ip.IsLinkNotFound(fmt.Errorf("permission denied"))).To(BeFalse())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("MoveLinkToNS and RenameLink", func() {
+		const linkName = "test0"
+
+		addVeth := func(netNS *os.File, name, peer string) {
+			err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+				return netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: name},
+					PeerName:  peer,
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		hasLink := func(netNS *os.File, name string) bool {
+			found := false
+			err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+				_, err := netlink.LinkByName(name)
+				found = err == nil
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return found
+		}
+
+		moveLink := func() error {
+			return ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(linkName)
+				Expect(err).NotTo(HaveOccurred())
+				return ip.MoveLinkToNS(link, containerNS)
+			})
+		}
+
+		BeforeEach(func() {
+			addVeth(hostNS, linkName, "test0-peer")
+		})
+
+		It("moves the link to the namespace, where it can be renamed", func() {
+			Expect(moveLink()).To(Succeed())
+
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				return ip.RenameLink(linkName, "net1")
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(hasLink(hostNS, linkName)).To(BeFalse())
+			Expect(hasLink(hostNS, "net1")).To(BeFalse())
+			Expect(hasLink(containerNS, linkName)).To(BeFalse())
+			Expect(hasLink(containerNS, "net1")).To(BeTrue())
+		})
+
+		Context("when the namespace has an interface of the same name", func() {
+			It("returns a conflict error and leaves the link where it was", func() {
+				addVeth(containerNS, linkName, "other0")
+
+				err := moveLink()
+				Expect(err).To(MatchError(fmt.Sprintf(
+					`failed to move "test0" to %q: an interface of that name already exists there`, containerNS.Name())))
+				Expect(hasLink(hostNS, linkName)).To(BeTrue())
+			})
+		})
+
+		Context("when the new name is taken", func() {
+			It("returns a conflict error and keeps the old name", func() {
+				err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+					return ip.RenameLink(linkName, "test0-peer")
+				})
+				Expect(err).To(MatchError(`failed to rename "test0" to "test0-peer": an interface of that name already exists`))
+				Expect(hasLink(hostNS, linkName)).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("SetLinkUp and WaitForCarrier", func() {
+		BeforeEach(func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				return netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: "test0"},
+					PeerName:  "test0-peer",
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		setUp := func(name string) error {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			return ip.SetLinkUp(link)
+		}
+
+		It("returns once both ends of the veth are up", func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				Expect(setUp("test0")).To(Succeed())
+				Expect(setUp("test0-peer")).To(Succeed())
+
+				start := time.Now()
+				Expect(ip.WaitForCarrier("test0", 5*time.Second)).To(Succeed())
+				Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+				link, err := netlink.LinkByName("test0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("times out while the peer is down", func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				Expect(setUp("test0")).To(Succeed())
+
+				return ip.WaitForCarrier("test0", 100*time.Millisecond)
+			})
+			Expect(err).To(MatchError(`interface "test0" has no carrier after 100ms`))
+		})
+
+		It("fails for a missing interface", func() {
+			err := ns.WithNetNS(containerNS, true, func(_ *os.File) error {
+				return ip.WaitForCarrier("missing0", time.Second)
+			})
+			Expect(err).To(MatchError(HavePrefix(`failed to lookup "missing0"`)))
+		})
+	})
+})
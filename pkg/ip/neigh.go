@@ -0,0 +1,59 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// FlushNeighbors deletes the neighbor (ARP and NDP) entries of the
+// interface, so that no stale MAC address is used for an IP that has
+// moved to a new interface. If ips are given, only the entries for those
+// addresses are deleted and the rest of the table is left alone.
+func FlushNeighbors(ifName string, ips ...net.IP) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list neighbors of %q: %v", ifName, err)
+	}
+
+	for _, n := range neighs {
+		if len(ips) > 0 && !containsIP(ips, n.IP) {
+			continue
+		}
+		// the entry may have expired in the meantime
+		if err = netlink.NeighDel(&n); err != nil && err != syscall.ENOENT {
+			return fmt.Errorf("failed to delete neighbor %s of %q: %v", n.IP, ifName, err)
+		}
+	}
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
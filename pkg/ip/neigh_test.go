@@ -0,0 +1,139 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FlushNeighbors", func() {
+	var (
+		nsName string
+		netNS  *os.File
+	)
+
+	inNS := func(f func()) {
+		err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+			defer GinkgoRecover()
+			f()
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	addNeigh := func(ifName, ipAddr, mac string) {
+		link, err := netlink.LinkByName(ifName)
+		Expect(err).NotTo(HaveOccurred())
+		hwAddr, err := net.ParseMAC(mac)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(netlink.NeighAdd(&netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			State:        netlink.NUD_REACHABLE,
+			IP:           net.ParseIP(ipAddr),
+			HardwareAddr: hwAddr,
+		})).To(Succeed())
+	}
+
+	// neighsOf lists the neighbors of ifName, leaving out the multicast
+	// ones the kernel adds by itself as IPv6 comes up on the link
+	neighsOf := func(ifName string) []string {
+		link, err := netlink.LinkByName(ifName)
+		Expect(err).NotTo(HaveOccurred())
+		neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_ALL)
+		Expect(err).NotTo(HaveOccurred())
+
+		var ips []string
+		for _, n := range neighs {
+			if !n.IP.IsMulticast() {
+				ips = append(ips, n.IP.String())
+			}
+		}
+		return ips
+	}
+
+	BeforeEach(func() {
+		var err error
+		nsName = fmt.Sprintf("test-neigh-%d", rand.Int())
+		netNS, err = ns.CreateNetNS(nsName)
+		Expect(err).NotTo(HaveOccurred())
+
+		inNS(func() {
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "eth0"},
+				PeerName:  "eth1",
+			})).To(Succeed())
+			for _, name := range []string{"eth0", "eth1"} {
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(link)).To(Succeed())
+			}
+		})
+	})
+
+	AfterEach(func() {
+		Expect(netNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(nsName)).To(Succeed())
+	})
+
+	It("deletes the neighbor entries of the interface only", func() {
+		inNS(func() {
+			addNeigh("eth0", "10.1.1.5", "0a:58:0a:01:01:05")
+			addNeigh("eth0", "fd00::5", "0a:58:0a:01:01:05")
+			addNeigh("eth1", "10.1.1.6", "0a:58:0a:01:01:06")
+			Expect(neighsOf("eth0")).To(ConsistOf("10.1.1.5", "fd00::5"))
+
+			Expect(ip.FlushNeighbors("eth0")).To(Succeed())
+
+			Expect(neighsOf("eth0")).To(BeEmpty())
+			Expect(neighsOf("eth1")).To(ConsistOf("10.1.1.6"))
+		})
+	})
+
+	It("deletes only the entries of the given addresses", func() {
+		inNS(func() {
+			addNeigh("eth0", "10.1.1.5", "0a:58:0a:01:01:05")
+			addNeigh("eth0", "10.1.1.7", "0a:58:0a:01:01:07")
+			addNeigh("eth0", "fd00::5", "0a:58:0a:01:01:05")
+			addNeigh("eth0", "fd00::7", "0a:58:0a:01:01:07")
+
+			Expect(ip.FlushNeighbors("eth0", net.ParseIP("10.1.1.5"), net.ParseIP("fd00::5"))).To(Succeed())
+
+			Expect(neighsOf("eth0")).To(ConsistOf("10.1.1.7", "fd00::7"))
+		})
+	})
+
+	It("succeeds when there is nothing to flush", func() {
+		inNS(func() {
+			Expect(ip.FlushNeighbors("eth0")).To(Succeed())
+		})
+	})
+
+	It("fails for a missing interface", func() {
+		inNS(func() {
+			Expect(ip.FlushNeighbors("missing0")).To(MatchError(HavePrefix(`failed to lookup "missing0": `)))
+		})
+	})
+})
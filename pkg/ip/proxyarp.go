@@ -0,0 +1,38 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/appc/cni/pkg/utils/sysctl"
+)
+
+// SetProxyArp turns proxy ARP on or off for the interface in the
+// current network namespace.
+func SetProxyArp(ifName string, enable bool) error {
+	val := "0"
+	if enable {
+		val = "1"
+	}
+
+	// dots in interface names are written as slashes, see sysctl.Sysctl
+	name := fmt.Sprintf("net.ipv4.conf.%s.proxy_arp", strings.Replace(ifName, ".", "/", -1))
+	if _, err := sysctl.Sysctl(name, val); err != nil {
+		return fmt.Errorf("failed to set proxy_arp on %q: %v", ifName, err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SetProxyArp", func() {
+	var (
+		nsName string
+		netNS  *os.File
+	)
+
+	inNS := func(f func()) {
+		err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+			defer GinkgoRecover()
+			f()
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		var err error
+		nsName = fmt.Sprintf("test-proxyarp-%d", rand.Int())
+		netNS, err = ns.CreateNetNS(nsName)
+		Expect(err).NotTo(HaveOccurred())
+
+		inNS(func() {
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "eth0.1"},
+				PeerName:  "eth0p",
+			})).To(Succeed())
+		})
+	})
+
+	AfterEach(func() {
+		Expect(netNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(nsName)).To(Succeed())
+	})
+
+	It("turns proxy ARP on and off", func() {
+		inNS(func() {
+			Expect(sysctl.Sysctl("net.ipv4.conf.eth0p.proxy_arp")).To(Equal("0"))
+
+			Expect(ip.SetProxyArp("eth0p", true)).To(Succeed())
+			Expect(sysctl.Sysctl("net.ipv4.conf.eth0p.proxy_arp")).To(Equal("1"))
+
+			Expect(ip.SetProxyArp("eth0p", false)).To(Succeed())
+			Expect(sysctl.Sysctl("net.ipv4.conf.eth0p.proxy_arp")).To(Equal("0"))
+		})
+	})
+
+	It("handles interface names containing dots", func() {
+		inNS(func() {
+			Expect(ip.SetProxyArp("eth0.1", true)).To(Succeed())
+			Expect(sysctl.Sysctl("net.ipv4.conf.eth0/1.proxy_arp")).To(Equal("1"))
+		})
+	})
+
+	It("fails for a missing interface", func() {
+		inNS(func() {
+			err := ip.SetProxyArp("missing0", true)
+			Expect(err).To(MatchError(HavePrefix(`failed to set proxy_arp on "missing0": `)))
+		})
+	})
+})
@@ -16,32 +16,106 @@ package ip
 
 import (
 	"net"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 )
 
 // AddDefaultRoute sets the default route on the given gateway.
+// The route is IPv6 if gw is, IPv4 otherwise.
 func AddDefaultRoute(gw net.IP, dev netlink.Link) error {
-	_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
+	defNet := &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	if gw.To4() == nil && gw.To16() != nil {
+		defNet = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
 	return AddRoute(defNet, gw, dev)
 }
 
-// AddRoute adds a universally-scoped route to a device.
+// AddRoute adds a universally-scoped route to a device, or a link-scoped
+// one if gw is nil. Adding a route that is already present is not an
+// error, but adding one that conflicts with a different route is.
 func AddRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link) error {
-	return netlink.RouteAdd(&netlink.Route{
+	scope := netlink.SCOPE_UNIVERSE
+	if gw == nil {
+		scope = netlink.SCOPE_LINK
+	}
+	return addRoute(&netlink.Route{
 		LinkIndex: dev.Attrs().Index,
-		Scope:     netlink.SCOPE_UNIVERSE,
+		Scope:     scope,
 		Dst:       ipn,
 		Gw:        gw,
-	})
+	}, dev)
 }
 
 // AddHostRoute adds a host-scoped route to a device.
 func AddHostRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link) error {
-	return netlink.RouteAdd(&netlink.Route{
+	return addRoute(&netlink.Route{
 		LinkIndex: dev.Attrs().Index,
 		Scope:     netlink.SCOPE_HOST,
 		Dst:       ipn,
 		Gw:        gw,
+	}, dev)
+}
+
+// DeleteRoute removes the route to ipn via gw from a device. Deleting
+// a route that is not there is not an error, so teardown can be
+// repeated.
+func DeleteRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link) error {
+	// SCOPE_NOWHERE matches the route whatever its scope
+	err := netlink.RouteDel(&netlink.Route{
+		LinkIndex: dev.Attrs().Index,
+		Scope:     netlink.SCOPE_NOWHERE,
+		Dst:       ipn,
+		Gw:        gw,
 	})
+	if err == syscall.ESRCH || err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+func addRoute(route *netlink.Route, dev netlink.Link) error {
+	err := netlink.RouteAdd(route)
+	if err == syscall.EEXIST && routeExists(route, dev) {
+		return nil
+	}
+	return err
+}
+
+// routeExists reports whether dev already has a route to the same
+// destination through the same gateway.
+func routeExists(route *netlink.Route, dev netlink.Link) bool {
+	family := netlink.FAMILY_V4
+	if route.Dst.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	routes, err := netlink.RouteList(dev, family)
+	if err != nil {
+		return false
+	}
+
+	for _, r := range routes {
+		if sameDst(r.Dst, route.Dst) && r.Gw.Equal(route.Gw) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameDst compares route destinations, where the kernel reports a
+// default route with a nil Dst.
+func sameDst(a, b *net.IPNet) bool {
+	isDefault := func(n *net.IPNet) bool {
+		if n == nil {
+			return true
+		}
+		ones, _ := n.Mask.Size()
+		return ones == 0
+	}
+
+	if isDefault(a) || isDefault(b) {
+		return isDefault(a) && isDefault(b)
+	}
+	return a.String() == b.String()
 }
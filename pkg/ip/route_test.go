@@ -0,0 +1,177 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Routes", func() {
+	var (
+		nsName string
+		netNS  *os.File
+		link   netlink.Link
+	)
+
+	inNS := func(f func()) {
+		err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+			f()
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	routeTo := func(dst string) *netlink.Route {
+		routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+		Expect(err).NotTo(HaveOccurred())
+		for _, r := range routes {
+			if (r.Dst == nil && dst == "default") || (r.Dst != nil && r.Dst.String() == dst) {
+				return &r
+			}
+		}
+		return nil
+	}
+
+	BeforeEach(func() {
+		var err error
+		nsName = fmt.Sprintf("test-route-%d", rand.Int())
+		netNS, err = ns.CreateNetNS(nsName)
+		Expect(err).NotTo(HaveOccurred())
+
+		inNS(func() {
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "eth0"},
+				PeerName:  "eth0p",
+			})).To(Succeed())
+
+			var err error
+			link, err = netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+
+			addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(10, 1, 1, 2), Mask: net.CIDRMask(24, 32)}}
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+		})
+	})
+
+	AfterEach(func() {
+		Expect(netNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(nsName)).To(Succeed())
+	})
+
+	Describe("AddDefaultRoute", func() {
+		It("adds a default route via the gateway", func() {
+			inNS(func() {
+				Expect(ip.AddDefaultRoute(net.IPv4(10, 1, 1, 1), link)).To(Succeed())
+
+				r := routeTo("default")
+				Expect(r).NotTo(BeNil())
+				Expect(r.Gw.String()).To(Equal("10.1.1.1"))
+				Expect(r.LinkIndex).To(Equal(link.Attrs().Index))
+			})
+		})
+
+		It("succeeds when the same default route is added again", func() {
+			inNS(func() {
+				Expect(ip.AddDefaultRoute(net.IPv4(10, 1, 1, 1), link)).To(Succeed())
+				Expect(ip.AddDefaultRoute(net.IPv4(10, 1, 1, 1), link)).To(Succeed())
+			})
+		})
+
+		It("fails when a default route via another gateway exists", func() {
+			inNS(func() {
+				Expect(ip.AddDefaultRoute(net.IPv4(10, 1, 1, 1), link)).To(Succeed())
+				Expect(ip.AddDefaultRoute(net.IPv4(10, 1, 1, 254), link)).To(Equal(syscall.EEXIST))
+			})
+		})
+	})
+
+	Describe("AddRoute", func() {
+		It("adds a route to a specific network via the gateway", func() {
+			inNS(func() {
+				_, dst, _ := net.ParseCIDR("10.2.0.0/16")
+				Expect(ip.AddRoute(dst, net.IPv4(10, 1, 1, 254), link)).To(Succeed())
+
+				r := routeTo("10.2.0.0/16")
+				Expect(r).NotTo(BeNil())
+				Expect(r.Gw.String()).To(Equal("10.1.1.254"))
+				Expect(r.Scope).To(Equal(netlink.SCOPE_UNIVERSE))
+
+				// idempotent
+				Expect(ip.AddRoute(dst, net.IPv4(10, 1, 1, 254), link)).To(Succeed())
+			})
+		})
+
+		It("adds a link-scoped route when there is no gateway", func() {
+			inNS(func() {
+				_, dst, _ := net.ParseCIDR("10.3.0.0/16")
+				Expect(ip.AddRoute(dst, nil, link)).To(Succeed())
+
+				r := routeTo("10.3.0.0/16")
+				Expect(r).NotTo(BeNil())
+				Expect(r.Gw).To(BeNil())
+				Expect(r.Scope).To(Equal(netlink.SCOPE_LINK))
+
+				Expect(ip.AddRoute(dst, nil, link)).To(Succeed())
+			})
+		})
+	})
+
+	Describe("DeleteRoute", func() {
+		It("removes the route and succeeds when it is already gone", func() {
+			inNS(func() {
+				_, dst, _ := net.ParseCIDR("10.2.0.0/16")
+				Expect(ip.AddRoute(dst, net.IPv4(10, 1, 1, 254), link)).To(Succeed())
+
+				Expect(ip.DeleteRoute(dst, net.IPv4(10, 1, 1, 254), link)).To(Succeed())
+				Expect(routeTo("10.2.0.0/16")).To(BeNil())
+
+				Expect(ip.DeleteRoute(dst, net.IPv4(10, 1, 1, 254), link)).To(Succeed())
+			})
+		})
+
+		It("removes a host route", func() {
+			inNS(func() {
+				_, dst, _ := net.ParseCIDR("10.4.0.5/32")
+				Expect(ip.AddHostRoute(dst, nil, link)).To(Succeed())
+				Expect(routeTo("10.4.0.5/32")).NotTo(BeNil())
+
+				Expect(ip.DeleteRoute(dst, nil, link)).To(Succeed())
+				Expect(routeTo("10.4.0.5/32")).To(BeNil())
+			})
+		})
+
+		It("leaves routes via other gateways alone", func() {
+			inNS(func() {
+				_, dst, _ := net.ParseCIDR("10.2.0.0/16")
+				Expect(ip.AddRoute(dst, net.IPv4(10, 1, 1, 254), link)).To(Succeed())
+
+				Expect(ip.DeleteRoute(dst, net.IPv4(10, 1, 1, 253), link)).To(Succeed())
+				Expect(routeTo("10.2.0.0/16")).NotTo(BeNil())
+			})
+		})
+	})
+})
@@ -25,8 +25,14 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
-func ExecAdd(plugin string, netconf []byte) (*types.Result, error) {
-	return invoke.DelegateAdd(plugin, netconf)
+// ExecAdd runs the IPAM plugin and returns its result in the 0.1.0
+// layout the plugins here configure interfaces from.
+func ExecAdd(plugin string, netconf []byte) (*types.Result010, error) {
+	result, err := invoke.DelegateAdd(plugin, netconf)
+	if err != nil {
+		return nil, err
+	}
+	return types.GetResult010(result)
 }
 
 func ExecDel(plugin string, netconf []byte) error {
@@ -35,7 +41,12 @@ func ExecDel(plugin string, netconf []byte) error {
 
 // ConfigureIface takes the result of IPAM plugin and
 // applies to the ifName interface
-func ConfigureIface(ifName string, res *types.Result) error {
+func ConfigureIface(ifName string, res *types.Result010) error {
+	ipcs := res.IPConfigs()
+	if len(ipcs) == 0 {
+		return fmt.Errorf("IPAM result has no IP configuration for %q", ifName)
+	}
+
 	link, err := netlink.LinkByName(ifName)
 	if err != nil {
 		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
@@ -45,18 +56,28 @@ func ConfigureIface(ifName string, res *types.Result) error {
 		return fmt.Errorf("failed to set %q UP: %v", ifName, err)
 	}
 
-	// TODO(eyakubovich): IPv6
-	addr := &netlink.Addr{IPNet: &res.IP4.IP, Label: ""}
-	if err = netlink.AddrAdd(link, addr); err != nil {
-		return fmt.Errorf("failed to add IP addr to %q: %v", ifName, err)
+	for _, ipc := range ipcs {
+		if err = configureIPConfig(link, ifName, ipc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configureIPConfig adds the address and routes of one IP family.
+func configureIPConfig(link netlink.Link, ifName string, ipc *types.IPConfig) error {
+	addr := &netlink.Addr{IPNet: &ipc.IP, Label: ""}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("failed to add IP addr %v to %q: %v", ipc.IP.String(), ifName, err)
 	}
 
-	for _, r := range res.IP4.Routes {
+	for _, r := range ipc.Routes {
 		gw := r.GW
 		if gw == nil {
-			gw = res.IP4.Gateway
+			gw = ipc.Gateway
 		}
-		if err = ip.AddRoute(&r.Dst, gw, link); err != nil {
+		if err := ip.AddRoute(&r.Dst, gw, link); err != nil {
 			// we skip over duplicate routes as we assume the first one wins
 			if !os.IsExist(err) {
 				return fmt.Errorf("failed to add route '%v via %v dev %v': %v", r.Dst, gw, ifName, err)
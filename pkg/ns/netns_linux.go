@@ -0,0 +1,195 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const nsRunDir = "/var/run/netns"
+
+const (
+	// https://github.com/torvalds/linux/blob/master/include/uapi/linux/magic.h
+	nsfsMagic      = 0x6e736673
+	procSuperMagic = 0x9fa0
+)
+
+// IsNSorErr returns nil if nspath refers to a network namespace, that is
+// a file on nsfs or, on kernels before 3.19, on procfs. Otherwise it
+// returns an *NSPathError describing why it does not.
+func IsNSorErr(nspath string) error {
+	stat := &unix.Statfs_t{}
+	if err := unix.Statfs(nspath, stat); err != nil {
+		return &NSPathError{Op: "statfs", Path: nspath, Err: err}
+	}
+
+	switch stat.Type {
+	case nsfsMagic, procSuperMagic:
+		return nil
+	default:
+		return &NSPathError{Op: "check", Path: nspath, Err: fmt.Errorf("not a network namespace (filesystem magic %#x)", stat.Type)}
+	}
+}
+
+// CreateNetNS creates a new persistent network namespace bind-mounted
+// at /var/run/netns/<name>, the same way `ip netns add` does, and
+// returns an open handle to it.
+func CreateNetNS(name string) (*os.File, error) {
+	if err := os.MkdirAll(nsRunDir, 0755); err != nil {
+		return nil, &NSPathError{Op: "create", Path: nsRunDir, Err: err}
+	}
+
+	nsPath := filepath.Join(nsRunDir, name)
+	mountPoint, err := os.OpenFile(nsPath, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return nil, &NSPathError{Op: "create", Path: nsPath, Err: err}
+	}
+	mountPoint.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		// The thread is deliberately never unlocked: once this
+		// goroutine exits the runtime discards the thread instead of
+		// reusing it from inside the new namespace.
+		runtime.LockOSThread()
+
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errCh <- &NSPathError{Op: "unshare", Path: nsPath, Err: err}
+			return
+		}
+
+		threadNS := fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+		if err := unix.Mount(threadNS, nsPath, "none", unix.MS_BIND, ""); err != nil {
+			errCh <- &NSPathError{Op: "mount", Path: nsPath, Err: err}
+			return
+		}
+		errCh <- nil
+	}()
+
+	if err := <-errCh; err != nil {
+		os.Remove(nsPath)
+		return nil, err
+	}
+
+	netns, err := os.Open(nsPath)
+	if err != nil {
+		DeleteNetNS(name)
+		return nil, &NSPathError{Op: "open", Path: nsPath, Err: err}
+	}
+	return netns, nil
+}
+
+// NewNetNS creates a new anonymous network namespace, one that is not
+// bind-mounted under /var/run/netns. A helper thread stays in it so that
+// its Path, /proc/<pid>/task/<tid>/ns/net, can be opened by other
+// processes, such as plugins given it as CNI_NETNS. Closing the handle
+// ends the helper thread; the namespace then goes away unless something
+// else holds it open.
+func NewNetNS() (NetNS, error) {
+	type result struct {
+		ns  *netNS
+		err error
+	}
+	resultCh := make(chan result, 1)
+	release := make(chan struct{})
+
+	go func() {
+		// The thread is deliberately never unlocked: once this
+		// goroutine exits the runtime discards the thread instead of
+		// reusing it from inside the new namespace.
+		runtime.LockOSThread()
+
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			resultCh <- result{err: &NSPathError{Op: "unshare", Path: "anonymous namespace", Err: err}}
+			return
+		}
+
+		nsPath := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+		file, err := os.Open(nsPath)
+		if err != nil {
+			resultCh <- result{err: &NSPathError{Op: "open", Path: nsPath, Err: err}}
+			return
+		}
+		resultCh <- result{ns: &netNS{file: file, release: release}}
+
+		<-release
+	}()
+
+	res := <-resultCh
+	if res.err != nil {
+		return nil, res.err
+	}
+	return res.ns, nil
+}
+
+// DeleteNetNS unmounts and removes a network namespace previously
+// created by CreateNetNS (or `ip netns add`).
+func DeleteNetNS(name string) error {
+	nsPath := filepath.Join(nsRunDir, name)
+	if err := unix.Unmount(nsPath, unix.MNT_DETACH); err != nil {
+		return &NSPathError{Op: "unmount", Path: nsPath, Err: err}
+	}
+	if err := os.Remove(nsPath); err != nil {
+		return &NSPathError{Op: "remove", Path: nsPath, Err: err}
+	}
+	return nil
+}
+
+// CheckNoStaleNS returns an error naming every namespace under
+// /var/run/netns whose name starts with prefix. Test suites that create
+// namespaces with a common prefix can call it once they are done to
+// catch namespaces that a failed setup or teardown left behind.
+func CheckNoStaleNS(prefix string) error {
+	names, err := listNetNS()
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			stale = append(stale, name)
+		}
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("stale network namespaces in %s: %s", nsRunDir, strings.Join(stale, ", "))
+	}
+	return nil
+}
+
+// listNetNS returns the names of the namespaces under /var/run/netns,
+// or none if it does not exist.
+func listNetNS() ([]string, error) {
+	dir, err := os.Open(nsRunDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &NSPathError{Op: "list", Path: nsRunDir, Err: err}
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, &NSPathError{Op: "list", Path: nsRunDir, Err: err}
+	}
+	return names, nil
+}
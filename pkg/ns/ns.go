@@ -15,10 +15,15 @@
 package ns
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 var setNsMap = map[string]uintptr{
@@ -27,8 +32,37 @@ var setNsMap = map[string]uintptr{
 	"arm":   374,
 }
 
+// NSPathError records a failed namespace operation along with the
+// namespace path (or fd description) it was attempted on. Err is the
+// underlying error, typically a syscall.Errno such as EINVAL when the
+// target is not a namespace or EPERM when CAP_SYS_ADMIN is missing.
+type NSPathError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *NSPathError) Error() string {
+	switch e.Op {
+	case "open":
+		return fmt.Sprintf("Failed to open %v: %v", e.Path, e.Err)
+	case "setns":
+		return fmt.Sprintf("Error switching to ns %v: %v", e.Path, e.Err)
+	default:
+		return fmt.Sprintf("Failed to %v ns %v: %v", e.Op, e.Path, e.Err)
+	}
+}
+
+func (e *NSPathError) Unwrap() error {
+	return e.Err
+}
+
 // SetNS sets the network namespace on a target file.
 func SetNS(f *os.File, flags uintptr) error {
+	return setNS(f.Fd(), flags)
+}
+
+func setNS(fd uintptr, flags uintptr) error {
 	if runtime.GOOS != "linux" {
 		return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
 	}
@@ -38,7 +72,7 @@ func SetNS(f *os.File, flags uintptr) error {
 		return fmt.Errorf("unsupported arch: %s", runtime.GOARCH)
 	}
 
-	_, _, err := syscall.RawSyscall(trap, f.Fd(), flags, 0)
+	_, _, err := syscall.RawSyscall(trap, fd, flags, 0)
 	if err != 0 {
 		return err
 	}
@@ -52,12 +86,21 @@ func SetNS(f *os.File, flags uintptr) error {
 // locked to an OS thread. If lockThread arg is true, this function
 // locks the goroutine prior to change namespace and unlocks before
 // returning
+//
+// nspath may name any network namespace: one bind-mounted by `ip netns
+// add` or CreateNetNS as well as the /proc/<pid>/ns/net of a process
+// that unshared its own. A path that is not a namespace is refused with
+// the *NSPathError of IsNSorErr before f is called.
 func WithNetNSPath(nspath string, lockThread bool, f func(*os.File) error) error {
 	ns, err := os.Open(nspath)
 	if err != nil {
-		return fmt.Errorf("Failed to open %v: %v", nspath, err)
+		return &NSPathError{Op: "open", Path: nspath, Err: err}
 	}
 	defer ns.Close()
+
+	if err := IsNSorErr(nspath); err != nil {
+		return err
+	}
 	return WithNetNS(ns, lockThread, f)
 }
 
@@ -68,22 +111,95 @@ func WithNetNSPath(nspath string, lockThread bool, f func(*os.File) error) error
 // locks the goroutine prior to change namespace and unlocks before
 // returning.  If the closure returns an error, WithNetNS attempts to
 // restore the original namespace before returning.
+//
+// If the calling thread is in the target namespace already, as in
+// nested calls, the closure runs without switching.
+//
+// Inside the closure, sysctls under /proc/sys/net already reflect the
+// target namespace, since the kernel resolves them against the calling
+// thread. /proc/self/net does not: it follows the thread group leader,
+// so use /proc/thread-self/net instead.
 func WithNetNS(ns *os.File, lockThread bool, f func(*os.File) error) error {
+	return withNetNS(ns.Fd(), ns.Name(), lockThread, f)
+}
+
+// WithNetNSContext executes the passed closure under the given network
+// namespace like WithNetNS, passing ctx through so long-running work
+// can be cancelled. The calling thread is restored to the original
+// namespace before returning even when the closure returns early because
+// ctx was cancelled. If ctx is already done, the closure is not run and
+// ctx.Err() is returned.
+func WithNetNSContext(ctx context.Context, ns *os.File, lockThread bool, f func(context.Context, *os.File) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return withNetNS(ns.Fd(), ns.Name(), lockThread, func(hostNS *os.File) error {
+		return f(ctx, hostNS)
+	})
+}
+
+// WithNetNSFD executes the passed closure under the network namespace
+// referred to by fd, restoring the original namespace afterwards.
+// It behaves like WithNetNS, but the caller retains ownership of fd:
+// it is neither duplicated nor closed.
+func WithNetNSFD(fd int, lockThread bool, f func(*os.File) error) error {
+	return withNetNS(uintptr(fd), fmt.Sprintf("fd %d", fd), lockThread, f)
+}
+
+// WithNetNSInfo executes the passed closure under the given network
+// namespace, like WithNetNS, additionally passing the inode of the
+// target namespace to the closure. The inode is looked up before
+// switching, so a failure there leaves the calling thread untouched.
+func WithNetNSInfo(ns *os.File, lockThread bool, f func(hostNS *os.File, targetInode uint64) error) error {
+	stat := &unix.Stat_t{}
+	if err := unix.Fstat(int(ns.Fd()), stat); err != nil {
+		return &NSPathError{Op: "stat", Path: ns.Name(), Err: err}
+	}
+
+	return withNetNS(ns.Fd(), ns.Name(), lockThread, func(hostNS *os.File) error {
+		return f(hostNS, stat.Ino)
+	})
+}
+
+func withNetNS(fd uintptr, name string, lockThread bool, f func(*os.File) error) (err error) {
 	if lockThread {
 		runtime.LockOSThread()
 		defer runtime.UnlockOSThread()
 	}
-	// save a handle to current (host) network namespace
-	thisNS, err := os.Open("/proc/self/ns/net")
+	// save a handle to the calling thread's (host) network namespace;
+	// /proc/self/ns/net would be the main thread's
+	tid := unix.Gettid()
+	threadNSPath := fmt.Sprintf("/proc/self/task/%d/ns/net", tid)
+	thisNS, err := os.Open(threadNSPath)
 	if err != nil {
-		return fmt.Errorf("Failed to open /proc/self/ns/net: %v", err)
+		return &NSPathError{Op: "open", Path: threadNSPath, Err: err}
 	}
 	defer thisNS.Close()
 
-	if err = SetNS(ns, syscall.CLONE_NEWNET); err != nil {
-		return fmt.Errorf("Error switching to ns %v: %v", ns.Name(), err)
+	// nested calls often target the namespace the thread is in already;
+	// the setns round trip is wasted there, and some kernels refuse it
+	if inNetNS(fd) {
+		return f(thisNS)
+	}
+
+	// restore from a private duplicate, so f closing thisNS cannot leave
+	// the thread stranded in the target namespace
+	restoreNS, err := dupFile(thisNS)
+	if err != nil {
+		return err
+	}
+	defer restoreNS.Close()
+
+	if err = setNS(fd, syscall.CLONE_NEWNET); err != nil {
+		return &NSPathError{Op: "setns", Path: name, Err: err}
 	}
-	defer SetNS(thisNS, syscall.CLONE_NEWNET) // switch back
+	defer func() {
+		SetNS(restoreNS, syscall.CLONE_NEWNET) // switch back
+		if checkErr := checkThreadRestored(tid, restoreNS); checkErr != nil && err == nil {
+			err = checkErr
+		}
+	}()
 
 	if err = f(thisNS); err != nil {
 		return err
@@ -91,3 +207,194 @@ func WithNetNS(ns *os.File, lockThread bool, f func(*os.File) error) error {
 
 	return nil
 }
+
+// inNetNS reports whether the calling thread is in the network
+// namespace fd refers to. It errs on the side of false, leaving any
+// failure for setns to report.
+func inNetNS(fd uintptr) bool {
+	target := &unix.Stat_t{}
+	if err := unix.Fstat(int(fd), target); err != nil {
+		return false
+	}
+
+	current := &unix.Stat_t{}
+	if err := unix.Stat(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()), current); err != nil {
+		return false
+	}
+	return target.Dev == current.Dev && target.Ino == current.Ino
+}
+
+// dupFile returns a close-on-exec duplicate of f.
+func dupFile(f *os.File) (*os.File, error) {
+	// hold ForkLock so no child started meanwhile inherits the duplicate
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	dup, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, &NSPathError{Op: "dup", Path: f.Name(), Err: err}
+	}
+	syscall.CloseOnExec(dup)
+	return os.NewFile(uintptr(dup), f.Name()), nil
+}
+
+// NetNS is a handle to a network namespace that keeps it open for the
+// lifetime of the handle, so callers can enter it repeatedly without
+// reopening its path.
+type NetNS interface {
+	// Do executes toRun inside the namespace on a locked OS thread and
+	// restores the calling thread's namespace afterwards. toRun is passed
+	// a handle to the original namespace, valid only for the duration of
+	// the call; closing it is a no-op.
+	Do(toRun func(hostNS NetNS) error) error
+
+	// DoBatch runs each callback in turn inside the namespace, switching
+	// into it only once, and returns their errors in the same order. If
+	// the namespace cannot be entered, every slot holds that error.
+	DoBatch(cbs []func() error) []error
+
+	// Path returns the path the namespace was opened from.
+	Path() string
+
+	// Fd returns the file descriptor of the namespace, or ^uintptr(0)
+	// once the handle is closed.
+	Fd() uintptr
+
+	// Close releases the namespace. Closing an already closed handle
+	// does nothing.
+	Close() error
+}
+
+type netNS struct {
+	mu       sync.Mutex
+	file     *os.File
+	closed   bool
+	borrowed bool
+	// release, if set, is closed along with the handle to let the
+	// thread holding an anonymous namespace exit
+	release chan struct{}
+}
+
+// GetNS opens the network namespace at nspath.
+func GetNS(nspath string) (NetNS, error) {
+	if err := IsNSorErr(nspath); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(nspath)
+	if err != nil {
+		return nil, &NSPathError{Op: "open", Path: nspath, Err: err}
+	}
+	return &netNS{file: file}, nil
+}
+
+// GetCurrentNS opens the network namespace of the calling OS thread.
+// The goroutine should be locked to its thread for the result to be
+// meaningful.
+func GetCurrentNS() (NetNS, error) {
+	return GetNS(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+}
+
+func (ns *netNS) Path() string {
+	return ns.file.Name()
+}
+
+func (ns *netNS) Fd() uintptr {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if ns.closed {
+		return ^uintptr(0)
+	}
+	return ns.file.Fd()
+}
+
+func (ns *netNS) Close() error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if ns.closed || ns.borrowed {
+		return nil
+	}
+	ns.closed = true
+	if ns.release != nil {
+		close(ns.release)
+	}
+	return ns.file.Close()
+}
+
+func (ns *netNS) Do(toRun func(NetNS) error) error {
+	ns.mu.Lock()
+	closed := ns.closed
+	ns.mu.Unlock()
+	if closed {
+		return &NSPathError{Op: "setns", Path: ns.Path(), Err: os.ErrClosed}
+	}
+
+	return withNetNS(ns.file.Fd(), ns.Path(), true, func(hostFile *os.File) error {
+		return toRun(&netNS{file: hostFile, borrowed: true})
+	})
+}
+
+func (ns *netNS) DoBatch(cbs []func() error) []error {
+	errs := make([]error, len(cbs))
+	err := ns.Do(func(NetNS) error {
+		for i, cb := range cbs {
+			errs[i] = cb()
+		}
+		return nil
+	})
+	if err != nil {
+		// failed to enter, or to restore the thread afterwards
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+var strictThreadChecks int32
+
+// SetStrictThreadChecks toggles a debug assertion in WithNetNS and its
+// variants: after switching back, the OS thread that entered the target
+// namespace must be back in its original namespace and still be the one
+// running the goroutine, or an error is returned. This catches goroutines
+// that were not locked to their thread. It is off by default.
+func SetStrictThreadChecks(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&strictThreadChecks, v)
+}
+
+// checkThreadRestored checks that thread tid, which called setns, is in
+// hostNS again and is still the calling thread. Restoring switches back
+// whatever thread the goroutine runs on, so a goroutine that migrated
+// leaves tid stranded in the target namespace.
+func checkThreadRestored(tid int, hostNS *os.File) error {
+	if atomic.LoadInt32(&strictThreadChecks) == 0 {
+		return nil
+	}
+
+	expected := &unix.Stat_t{}
+	if err := unix.Fstat(int(hostNS.Fd()), expected); err != nil {
+		return &NSPathError{Op: "stat", Path: hostNS.Name(), Err: err}
+	}
+
+	threadNSPath := fmt.Sprintf("/proc/self/task/%d/ns/net", tid)
+	actual := &unix.Stat_t{}
+	if err := unix.Stat(threadNSPath, actual); err != nil {
+		return &NSPathError{Op: "stat", Path: threadNSPath, Err: err}
+	}
+
+	// inode numbers are only unique within a device
+	if actual.Dev != expected.Dev || actual.Ino != expected.Ino {
+		return fmt.Errorf("thread %d left in netns %d:%d (dev:inode) after restoring, expected %d:%d (is the goroutine locked to its OS thread?)", tid, actual.Dev, actual.Ino, expected.Dev, expected.Ino)
+	}
+	if now := unix.Gettid(); now != tid {
+		return fmt.Errorf("goroutine moved from thread %d to thread %d while in the netns (is the goroutine locked to its OS thread?)", tid, now)
+	}
+	return nil
+}
@@ -15,12 +15,17 @@
 package ns_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 
@@ -44,42 +49,52 @@ func getInodeF(file *os.File) (uint64, error) {
 	return stat.Ino, err
 }
 
+// isMountPoint reports whether path lives on a different device than
+// its parent directory, as a bind-mounted namespace file does.
+func isMountPoint(path string) bool {
+	stat := &unix.Stat_t{}
+	if err := unix.Stat(path, stat); err != nil {
+		return false
+	}
+	parent := &unix.Stat_t{}
+	if err := unix.Stat(filepath.Dir(path), parent); err != nil {
+		return false
+	}
+	return stat.Dev != parent.Dev
+}
+
 const CurrentNetNS = "/proc/self/ns/net"
 
 var _ = Describe("Linux namespace operations", func() {
-	Describe("WithNetNS", func() {
-		var (
-			originalNetNS *os.File
+	var (
+		originalNetNS *os.File
 
-			targetNetNSName string
-			targetNetNSPath string
-			targetNetNS     *os.File
-		)
+		targetNetNSName string
+		targetNetNSPath string
+		targetNetNS     *os.File
+	)
 
-		BeforeEach(func() {
-			var err error
-			originalNetNS, err = os.Open(CurrentNetNS)
-			Expect(err).NotTo(HaveOccurred())
+	BeforeEach(func() {
+		var err error
+		originalNetNS, err = os.Open(CurrentNetNS)
+		Expect(err).NotTo(HaveOccurred())
 
-			targetNetNSName = fmt.Sprintf("test-netns-%d", rand.Int())
+		targetNetNSName = fmt.Sprintf("test-netns-%d", rand.Int())
 
-			err = exec.Command("ip", "netns", "add", targetNetNSName).Run()
-			Expect(err).NotTo(HaveOccurred())
-
-			targetNetNSPath = filepath.Join("/var/run/netns/", targetNetNSName)
-			targetNetNS, err = os.Open(targetNetNSPath)
-			Expect(err).NotTo(HaveOccurred())
-		})
+		targetNetNSPath = filepath.Join("/var/run/netns/", targetNetNSName)
+		targetNetNS, err = ns.CreateNetNS(targetNetNSName)
+		Expect(err).NotTo(HaveOccurred())
+	})
 
-		AfterEach(func() {
-			Expect(targetNetNS.Close()).To(Succeed())
+	AfterEach(func() {
+		Expect(targetNetNS.Close()).To(Succeed())
 
-			err := exec.Command("ip", "netns", "del", targetNetNSName).Run()
-			Expect(err).NotTo(HaveOccurred())
+		Expect(ns.DeleteNetNS(targetNetNSName)).To(Succeed())
 
-			Expect(originalNetNS.Close()).To(Succeed())
-		})
+		Expect(originalNetNS.Close()).To(Succeed())
+	})
 
+	Describe("WithNetNS", func() {
 		It("executes the callback within the target network namespace", func() {
 			expectedInode, err := getInode(targetNetNSPath)
 			Expect(err).NotTo(HaveOccurred())
@@ -127,6 +142,26 @@ var _ = Describe("Linux namespace operations", func() {
 			Expect(postTestInode).To(Equal(preTestInode))
 		})
 
+		Context("when the callback closes the host namespace file", func() {
+			It("still restores the calling thread to the original namespace", func() {
+				runtime.LockOSThread()
+				defer runtime.UnlockOSThread()
+				threadNSPath := fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+
+				preTestInode, err := getInode(threadNSPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = ns.WithNetNS(targetNetNS, false, func(hostNS *os.File) error {
+					return hostNS.Close()
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				postTestInode, err := getInode(threadNSPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(postTestInode).To(Equal(preTestInode))
+			})
+		})
+
 		Context("when the callback returns an error", func() {
 			It("restores the calling thread to the original namespace before returning", func() {
 				preTestInode, err := getInode(CurrentNetNS)
@@ -150,6 +185,122 @@ var _ = Describe("Linux namespace operations", func() {
 			})
 		})
 
+		Context("when the target is not a network namespace", func() {
+			var notNS *os.File
+
+			BeforeEach(func() {
+				var err error
+				notNS, err = ioutil.TempFile("", "not-a-netns")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				Expect(notNS.Close()).To(Succeed())
+				Expect(os.Remove(notNS.Name())).To(Succeed())
+			})
+
+			It("returns an NSPathError wrapping EINVAL", func() {
+				called := false
+				err := ns.WithNetNS(notNS, false, func(*os.File) error {
+					called = true
+					return nil
+				})
+				Expect(called).To(BeFalse())
+
+				var nsErr *ns.NSPathError
+				Expect(errors.As(err, &nsErr)).To(BeTrue())
+				Expect(nsErr.Op).To(Equal("setns"))
+				Expect(nsErr.Path).To(Equal(notNS.Name()))
+				Expect(errors.Is(err, syscall.EINVAL)).To(BeTrue())
+			})
+		})
+
+		Context("when the thread is in the target namespace already", func() {
+			var threadNSPath string
+
+			BeforeEach(func() {
+				runtime.LockOSThread()
+				threadNSPath = fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+			})
+
+			AfterEach(func() {
+				runtime.UnlockOSThread()
+			})
+
+			It("runs the callback without switching", func() {
+				preTestInode, err := getInode(threadNSPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				// setns refuses an O_PATH descriptor, so only the fast
+				// path can succeed with one
+				fd, err := unix.Open(threadNSPath, unix.O_PATH|unix.O_CLOEXEC, 0)
+				Expect(err).NotTo(HaveOccurred())
+				defer unix.Close(fd)
+
+				var innerInode uint64
+				called := false
+				err = ns.WithNetNSFD(fd, true, func(*os.File) error {
+					called = true
+					innerInode, err = getInode(threadNSPath)
+					return err
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(called).To(BeTrue())
+				Expect(innerInode).To(Equal(preTestInode))
+
+				postTestInode, err := getInode(threadNSPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(postTestInode).To(Equal(preTestInode))
+			})
+
+			It("runs a nested call in the outer call's namespace", func() {
+				targetInode, err := getInode(targetNetNSPath)
+				Expect(err).NotTo(HaveOccurred())
+				preTestInode, err := getInode(threadNSPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				var innerInode uint64
+				err = ns.WithNetNS(targetNetNS, false, func(*os.File) error {
+					return ns.WithNetNS(targetNetNS, true, func(*os.File) error {
+						var err error
+						innerInode, err = getInode(threadNSPath)
+						return err
+					})
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(innerInode).To(Equal(targetInode))
+
+				postTestInode, err := getInode(threadNSPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(postTestInode).To(Equal(preTestInode))
+			})
+
+			It("leaves no threads behind", func() {
+				threads := func() int {
+					tasks, err := ioutil.ReadDir("/proc/self/task")
+					Expect(err).NotTo(HaveOccurred())
+					return len(tasks)
+				}
+				before := threads()
+
+				for i := 0; i < 100; i++ {
+					done := make(chan error)
+					go func() {
+						current, err := os.Open(CurrentNetNS)
+						if err != nil {
+							done <- err
+							return
+						}
+						defer current.Close()
+						done <- ns.WithNetNS(current, true, func(*os.File) error { return nil })
+					}()
+					Expect(<-done).To(Succeed())
+				}
+
+				Expect(threads()).To(BeNumerically("<=", before+5))
+			})
+		})
+
 		Describe("validating inode mapping to namespaces", func() {
 			It("checks that different namespaces have different inodes", func() {
 				hostNSInode, err := getInode(CurrentNetNS)
@@ -164,4 +315,707 @@ var _ = Describe("Linux namespace operations", func() {
 			})
 		})
 	})
+
+	Describe("WithNetNSPath", func() {
+		Context("when the path does not exist", func() {
+			It("returns an NSPathError for the open", func() {
+				missing := filepath.Join(os.TempDir(), fmt.Sprintf("missing-netns-%d", rand.Int()))
+				err := ns.WithNetNSPath(missing, false, func(*os.File) error {
+					return nil
+				})
+
+				var nsErr *ns.NSPathError
+				Expect(errors.As(err, &nsErr)).To(BeTrue())
+				Expect(nsErr.Op).To(Equal("open"))
+				Expect(nsErr.Path).To(Equal(missing))
+				Expect(os.IsNotExist(nsErr.Err)).To(BeTrue())
+			})
+		})
+
+		Context("when the path is the netns of a process that unshared it", func() {
+			var cmd *exec.Cmd
+
+			BeforeEach(func() {
+				cmd = exec.Command("sleep", "60")
+				cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+				Expect(cmd.Start()).To(Succeed())
+			})
+
+			AfterEach(func() {
+				Expect(cmd.Process.Kill()).To(Succeed())
+				cmd.Wait()
+			})
+
+			It("executes the callback within that namespace", func() {
+				procPath := fmt.Sprintf("/proc/%d/ns/net", cmd.Process.Pid)
+				expectedInode, err := getInode(procPath)
+				Expect(err).NotTo(HaveOccurred())
+				hostNSInode, err := getInode(CurrentNetNS)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(expectedInode).NotTo(Equal(hostNSInode))
+
+				var actualInode uint64
+				var innerErr error
+				err = ns.WithNetNSPath(procPath, true, func(*os.File) error {
+					actualInode, innerErr = getInode(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(innerErr).NotTo(HaveOccurred())
+				Expect(actualInode).To(Equal(expectedInode))
+			})
+		})
+
+		Context("when the path is not a network namespace", func() {
+			It("returns the NSPathError of the check without calling the callback", func() {
+				notNS, err := ioutil.TempFile("", "not-a-netns")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.Remove(notNS.Name())
+				Expect(notNS.Close()).To(Succeed())
+
+				called := false
+				err = ns.WithNetNSPath(notNS.Name(), true, func(*os.File) error {
+					called = true
+					return nil
+				})
+				Expect(called).To(BeFalse())
+
+				var nsErr *ns.NSPathError
+				Expect(errors.As(err, &nsErr)).To(BeTrue())
+				Expect(nsErr.Op).To(Equal("check"))
+				Expect(nsErr.Path).To(Equal(notNS.Name()))
+				Expect(err.Error()).To(ContainSubstring("not a network namespace"))
+			})
+		})
+	})
+
+	Describe("WithNetNSContext", func() {
+		It("passes the context to the callback inside the target namespace", func() {
+			type key struct{}
+			ctx := context.WithValue(context.Background(), key{}, "value")
+
+			targetInode, err := getInode(targetNetNSPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			var actualInode uint64
+			var value interface{}
+			err = ns.WithNetNSContext(ctx, targetNetNS, true, func(ctx context.Context, _ *os.File) error {
+				value = ctx.Value(key{})
+				var err error
+				actualInode, err = getInode(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("value"))
+			Expect(actualInode).To(Equal(targetInode))
+		})
+
+		Context("when the context is cancelled mid-callback", func() {
+			It("restores the original namespace and returns the context error", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				originalInode, err := getInodeF(originalNetNS)
+				Expect(err).NotTo(HaveOccurred())
+
+				var threadNSPath string
+				entered := make(chan struct{})
+				done := make(chan error)
+				go func() {
+					runtime.LockOSThread()
+					defer runtime.UnlockOSThread()
+
+					threadNSPath = fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+					err := ns.WithNetNSContext(ctx, targetNetNS, false, func(ctx context.Context, _ *os.File) error {
+						close(entered)
+						<-ctx.Done()
+						return ctx.Err()
+					})
+
+					if inode, statErr := getInode(threadNSPath); statErr != nil || inode != originalInode {
+						err = fmt.Errorf("thread not restored: inode %d, %v", inode, statErr)
+					}
+					done <- err
+				}()
+
+				Eventually(entered).Should(BeClosed())
+				cancel()
+
+				var err2 error
+				Eventually(done).Should(Receive(&err2))
+				Expect(err2).To(Equal(context.Canceled))
+			})
+		})
+
+		Context("when the context is already done", func() {
+			It("returns the context error without calling the callback", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				called := false
+				err := ns.WithNetNSContext(ctx, targetNetNS, true, func(context.Context, *os.File) error {
+					called = true
+					return nil
+				})
+				Expect(err).To(Equal(context.Canceled))
+				Expect(called).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("WithNetNSFD", func() {
+		var targetFD int
+
+		BeforeEach(func() {
+			var err error
+			targetFD, err = unix.Open(targetNetNSPath, unix.O_RDONLY, 0)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(unix.Close(targetFD)).To(Succeed())
+		})
+
+		fdIsOpen := func(fd int) bool {
+			stat := &unix.Stat_t{}
+			return unix.Fstat(fd, stat) == nil
+		}
+
+		It("executes the callback within the target network namespace", func() {
+			expectedInode, err := getInode(targetNetNSPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			var actualInode uint64
+			var innerErr error
+			err = ns.WithNetNSFD(targetFD, false, func(*os.File) error {
+				actualInode, innerErr = getInode(CurrentNetNS)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(innerErr).NotTo(HaveOccurred())
+			Expect(actualInode).To(Equal(expectedInode))
+		})
+
+		It("restores the calling thread to the original network namespace", func() {
+			preTestInode, err := getInode(CurrentNetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ns.WithNetNSFD(targetFD, false, func(*os.File) error {
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			postTestInode, err := getInode(CurrentNetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(postTestInode).To(Equal(preTestInode))
+		})
+
+		It("leaves the caller's fd open", func() {
+			err := ns.WithNetNSFD(targetFD, false, func(*os.File) error {
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fdIsOpen(targetFD)).To(BeTrue())
+
+			// the fd must still be usable for a subsequent switch
+			err = ns.WithNetNSFD(targetFD, false, func(*os.File) error {
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("when the callback returns an error", func() {
+			It("returns the error from the callback", func() {
+				err := ns.WithNetNSFD(targetFD, false, func(*os.File) error {
+					return errors.New("potato")
+				})
+				Expect(err).To(MatchError("potato"))
+			})
+
+			It("leaves the caller's fd open", func() {
+				_ = ns.WithNetNSFD(targetFD, false, func(*os.File) error {
+					return errors.New("potato")
+				})
+
+				Expect(fdIsOpen(targetFD)).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("WithNetNSInfo", func() {
+		It("passes the inode of the target namespace to the callback", func() {
+			expectedInode, err := getInode(targetNetNSPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			var passedInode, actualInode uint64
+			var innerErr error
+			err = ns.WithNetNSInfo(targetNetNS, false, func(_ *os.File, targetInode uint64) error {
+				passedInode = targetInode
+				actualInode, innerErr = getInode(CurrentNetNS)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(innerErr).NotTo(HaveOccurred())
+			Expect(passedInode).To(Equal(expectedInode))
+			Expect(actualInode).To(Equal(expectedInode))
+		})
+
+		It("passes the host namespace to the callback", func() {
+			hostNSInode, err := getInode(CurrentNetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			var inputNSInode uint64
+			var innerErr error
+			err = ns.WithNetNSInfo(targetNetNS, false, func(inputNS *os.File, _ uint64) error {
+				inputNSInode, innerErr = getInodeF(inputNS)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(innerErr).NotTo(HaveOccurred())
+			Expect(inputNSInode).To(Equal(hostNSInode))
+		})
+
+		Context("when the target cannot be stat'ed", func() {
+			It("returns an error without calling the callback", func() {
+				closedNS, err := os.Open(targetNetNSPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(closedNS.Close()).To(Succeed())
+
+				called := false
+				err = ns.WithNetNSInfo(closedNS, false, func(*os.File, uint64) error {
+					called = true
+					return nil
+				})
+				Expect(err).To(HaveOccurred())
+				Expect(called).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("CreateNetNS", func() {
+		It("bind-mounts a new namespace under /var/run/netns", func() {
+			Expect(isMountPoint(targetNetNSPath)).To(BeTrue())
+		})
+
+		It("returns a handle to a namespace distinct from the host", func() {
+			hostNSInode, err := getInode(CurrentNetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			handleInode, err := getInodeF(targetNetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			pathInode, err := getInode(targetNetNSPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(handleInode).To(Equal(pathInode))
+			Expect(handleInode).NotTo(Equal(hostNSInode))
+		})
+
+		It("leaves the calling thread in its original namespace", func() {
+			originalInode, err := getInodeF(originalNetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			currentInode, err := getInode(CurrentNetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(currentInode).To(Equal(originalInode))
+		})
+
+		Context("when the namespace already exists", func() {
+			It("returns an error", func() {
+				_, err := ns.CreateNetNS(targetNetNSName)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("IsNSorErr", func() {
+		It("accepts a bind-mounted namespace", func() {
+			Expect(ns.IsNSorErr(targetNetNSPath)).To(Succeed())
+		})
+
+		It("accepts the current namespace under /proc", func() {
+			Expect(ns.IsNSorErr(CurrentNetNS)).To(Succeed())
+		})
+
+		Context("when the path is a regular file", func() {
+			It("returns an NSPathError for the check", func() {
+				notNS, err := ioutil.TempFile("", "not-a-netns")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.Remove(notNS.Name())
+				Expect(notNS.Close()).To(Succeed())
+
+				err = ns.IsNSorErr(notNS.Name())
+
+				var nsErr *ns.NSPathError
+				Expect(errors.As(err, &nsErr)).To(BeTrue())
+				Expect(nsErr.Op).To(Equal("check"))
+				Expect(nsErr.Path).To(Equal(notNS.Name()))
+				Expect(err.Error()).To(ContainSubstring("not a network namespace"))
+			})
+		})
+
+		Context("when the path does not exist", func() {
+			It("returns an NSPathError wrapping ENOENT", func() {
+				missing := filepath.Join(os.TempDir(), fmt.Sprintf("missing-netns-%d", rand.Int()))
+
+				err := ns.IsNSorErr(missing)
+
+				var nsErr *ns.NSPathError
+				Expect(errors.As(err, &nsErr)).To(BeTrue())
+				Expect(nsErr.Op).To(Equal("statfs"))
+				Expect(errors.Is(err, syscall.ENOENT)).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("NetNS handles", func() {
+		var handle ns.NetNS
+
+		BeforeEach(func() {
+			var err error
+			handle, err = ns.GetNS(targetNetNSPath)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(handle.Close()).To(Succeed())
+		})
+
+		It("reports the path it was opened from", func() {
+			Expect(handle.Path()).To(Equal(targetNetNSPath))
+		})
+
+		It("runs Do inside the namespace and restores the thread afterwards", func() {
+			targetInode, err := getInode(targetNetNSPath)
+			Expect(err).NotTo(HaveOccurred())
+			originalInode, err := getInodeF(originalNetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			var insideInode, hostInode uint64
+			err = handle.Do(func(hostNS ns.NetNS) error {
+				var err error
+				insideInode, err = getInode(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+				if err != nil {
+					return err
+				}
+				stat := &unix.Stat_t{}
+				err = unix.Fstat(int(hostNS.Fd()), stat)
+				hostInode = stat.Ino
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(insideInode).To(Equal(targetInode))
+			Expect(hostInode).To(Equal(originalInode))
+
+			currentInode, err := getInode(CurrentNetNS)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(currentInode).To(Equal(originalInode))
+		})
+
+		It("can be entered repeatedly", func() {
+			for i := 0; i < 3; i++ {
+				Expect(handle.Do(func(ns.NetNS) error { return nil })).To(Succeed())
+			}
+		})
+
+		It("ignores attempts to close the host handle passed to Do", func() {
+			err := handle.Do(func(hostNS ns.NetNS) error {
+				return hostNS.Close()
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Describe("DoBatch", func() {
+			threadInode := func() uint64 {
+				inode, err := getInode(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+				Expect(err).NotTo(HaveOccurred())
+				return inode
+			}
+
+			It("runs every callback in the namespace on the same thread", func() {
+				targetInode, err := getInode(targetNetNSPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				var inodes []uint64
+				var tids []int
+				record := func() error {
+					inodes = append(inodes, threadInode())
+					tids = append(tids, unix.Gettid())
+					return nil
+				}
+
+				errs := handle.DoBatch([]func() error{record, record, record})
+				Expect(errs).To(Equal([]error{nil, nil, nil}))
+
+				Expect(inodes).To(Equal([]uint64{targetInode, targetInode, targetInode}))
+				Expect(tids).To(HaveLen(3))
+				Expect(tids[1]).To(Equal(tids[0]))
+				Expect(tids[2]).To(Equal(tids[0]))
+
+				originalInode, err := getInodeF(originalNetNS)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(threadInode()).To(Equal(originalInode))
+			})
+
+			It("captures each callback's error independently", func() {
+				errA := errors.New("a failed")
+				errC := errors.New("c failed")
+
+				errs := handle.DoBatch([]func() error{
+					func() error { return errA },
+					func() error { return nil },
+					func() error { return errC },
+				})
+
+				Expect(errs).To(Equal([]error{errA, nil, errC}))
+			})
+
+			It("reports the failure to enter in every slot", func() {
+				Expect(handle.Close()).To(Succeed())
+
+				called := false
+				cb := func() error {
+					called = true
+					return nil
+				}
+				errs := handle.DoBatch([]func() error{cb, cb})
+
+				Expect(called).To(BeFalse())
+				Expect(errs).To(HaveLen(2))
+				for _, err := range errs {
+					Expect(errors.Is(err, os.ErrClosed)).To(BeTrue())
+				}
+			})
+		})
+
+		It("makes Close idempotent", func() {
+			Expect(handle.Close()).To(Succeed())
+			Expect(handle.Close()).To(Succeed())
+			Expect(handle.Fd()).To(Equal(^uintptr(0)))
+		})
+
+		It("refuses Do once closed", func() {
+			Expect(handle.Close()).To(Succeed())
+
+			called := false
+			err := handle.Do(func(ns.NetNS) error {
+				called = true
+				return nil
+			})
+			Expect(errors.Is(err, os.ErrClosed)).To(BeTrue())
+			Expect(called).To(BeFalse())
+		})
+
+		It("rejects paths that are not namespaces", func() {
+			_, err := ns.GetNS("/")
+			Expect(err).To(HaveOccurred())
+		})
+
+		Describe("GetCurrentNS", func() {
+			It("opens the namespace of the calling thread", func() {
+				current, err := ns.GetCurrentNS()
+				Expect(err).NotTo(HaveOccurred())
+				defer current.Close()
+
+				currentInode, err := getInode(current.Path())
+				Expect(err).NotTo(HaveOccurred())
+				originalInode, err := getInodeF(originalNetNS)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(currentInode).To(Equal(originalInode))
+			})
+		})
+	})
+
+	Describe("NewNetNS", func() {
+		It("creates distinct namespaces without touching /var/run/netns", func() {
+			before, err := ioutil.ReadDir("/var/run/netns")
+			Expect(err).NotTo(HaveOccurred())
+
+			first, err := ns.NewNetNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer first.Close()
+			second, err := ns.NewNetNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer second.Close()
+
+			firstInode, err := getInode(first.Path())
+			Expect(err).NotTo(HaveOccurred())
+			secondInode, err := getInode(second.Path())
+			Expect(err).NotTo(HaveOccurred())
+			originalInode, err := getInodeF(originalNetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(firstInode).NotTo(Equal(secondInode))
+			Expect(firstInode).NotTo(Equal(originalInode))
+			Expect(secondInode).NotTo(Equal(originalInode))
+
+			after, err := ioutil.ReadDir("/var/run/netns")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after).To(HaveLen(len(before)))
+		})
+
+		It("runs Do inside the namespace", func() {
+			anon, err := ns.NewNetNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer anon.Close()
+
+			anonInode, err := getInode(anon.Path())
+			Expect(err).NotTo(HaveOccurred())
+
+			var insideInode uint64
+			err = anon.Do(func(ns.NetNS) error {
+				var err error
+				insideInode, err = getInode(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(insideInode).To(Equal(anonInode))
+		})
+
+		It("ends the helper thread, and with it the path, on Close", func() {
+			anon, err := ns.NewNetNS()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ns.IsNSorErr(anon.Path())).To(Succeed())
+
+			Expect(anon.Close()).To(Succeed())
+			Eventually(func() bool {
+				_, err := os.Stat(anon.Path())
+				return os.IsNotExist(err)
+			}).Should(BeTrue())
+			Expect(anon.Close()).To(Succeed())
+		})
+	})
+
+	Describe("DeleteNetNS", func() {
+		It("unmounts and removes the namespace", func() {
+			name := fmt.Sprintf("test-netns-%d", rand.Int())
+			netns, err := ns.CreateNetNS(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netns.Close()).To(Succeed())
+
+			Expect(ns.DeleteNetNS(name)).To(Succeed())
+
+			nsPath := filepath.Join("/var/run/netns/", name)
+			_, err = os.Stat(nsPath)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+		})
+	})
+
+	Describe("CheckNoStaleNS", func() {
+		var prefix string
+
+		BeforeEach(func() {
+			prefix = fmt.Sprintf("test-stale-%d-", rand.Int())
+		})
+
+		It("reports clean when no namespace has the prefix", func() {
+			Expect(ns.CheckNoStaleNS(prefix)).To(Succeed())
+		})
+
+		It("names the namespaces with the prefix until they are deleted", func() {
+			names := []string{prefix + "a", prefix + "b"}
+			for _, name := range names {
+				netns, err := ns.CreateNetNS(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netns.Close()).To(Succeed())
+			}
+
+			err := ns.CheckNoStaleNS(prefix)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("stale network namespaces in /var/run/netns: "))
+			Expect(err.Error()).To(ContainSubstring(names[0]))
+			Expect(err.Error()).To(ContainSubstring(names[1]))
+			Expect(err.Error()).NotTo(ContainSubstring(targetNetNSName))
+
+			for _, name := range names {
+				Expect(ns.DeleteNetNS(name)).To(Succeed())
+			}
+			Expect(ns.CheckNoStaleNS(prefix)).To(Succeed())
+		})
+	})
+
+	Describe("SetStrictThreadChecks", func() {
+		BeforeEach(func() {
+			ns.SetStrictThreadChecks(true)
+		})
+
+		AfterEach(func() {
+			ns.SetStrictThreadChecks(false)
+		})
+
+		It("reports no leakage across many concurrent WithNetNS calls", func() {
+			const workers = 50
+
+			var wg sync.WaitGroup
+			errs := make(chan error, workers)
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- ns.WithNetNS(targetNetNS, true, func(*os.File) error {
+						return nil
+					})
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("still returns the error from the callback", func() {
+			err := ns.WithNetNS(targetNetNS, false, func(*os.File) error {
+				return errors.New("potato")
+			})
+			Expect(err).To(MatchError("potato"))
+		})
+
+		It("reports a goroutine that left its thread behind in the target namespace", func() {
+			var releases []chan struct{}
+			defer func() {
+				for _, release := range releases {
+					close(release)
+				}
+			}()
+
+			// the spec's goroutine is locked by the suite, so use a fresh one
+			errs := make(chan error)
+			go func() {
+				errs <- ns.WithNetNS(targetNetNS, true, func(*os.File) error {
+					// let go of the thread and have another goroutine take
+					// it over, so that this one resumes on a different one
+					entered := unix.Gettid()
+					runtime.UnlockOSThread()
+					for i := 0; i < 100; i++ {
+						release := make(chan struct{})
+						releases = append(releases, release)
+						tids := make(chan int)
+						go func() {
+							// exiting while locked ends the thread, stranded
+							// in the target namespace as it is
+							runtime.LockOSThread()
+							tids <- unix.Gettid()
+							<-release
+						}()
+						if <-tids == entered {
+							return nil
+						}
+					}
+					return errors.New("the thread was never taken over")
+				})
+			}()
+
+			Expect(<-errs).To(MatchError(MatchRegexp(`^thread \d+ left in netns \d+:\d+ \(dev:inode\) after restoring`)))
+		})
+	})
 })
@@ -17,12 +17,16 @@
 package skel
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
 )
 
 // CmdArgs captures all the arguments passed in to the plugin
@@ -36,9 +40,32 @@ type CmdArgs struct {
 	StdinData   []byte
 }
 
-// PluginMain is the "main" for a plugin. It accepts
-// two callback functions for add and del commands.
-func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
+// logger receives a line for each invocation and its outcome.
+// It is nil unless set with SetLogger.
+var logger func(format string, args ...interface{})
+
+// SetLogger has PluginMain log the command, container ID, interface
+// name and netns of each invocation, and its outcome, to logf. The
+// network config is never logged, as it may contain secrets. Passing
+// nil turns logging off again, which is the default.
+func SetLogger(logf func(format string, args ...interface{})) {
+	logger = logf
+}
+
+func logf(format string, args ...interface{}) {
+	if logger != nil {
+		logger(format, args...)
+	}
+}
+
+type dispatcher struct {
+	Getenv func(string) string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func (t *dispatcher) getCmdArgsFromEnv() (string, *CmdArgs, *types.Error) {
 	var cmd, contID, netns, ifName, args, path string
 
 	vars := []struct {
@@ -56,20 +83,31 @@ func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
 
 	argsMissing := false
 	for _, v := range vars {
-		*v.val = os.Getenv(v.name)
-		if v.req && *v.val == "" {
-			log.Printf("%v env variable missing", v.name)
+		*v.val = t.Getenv(v.name)
+		// VERSION only needs CNI_COMMAND
+		if v.req && *v.val == "" && cmd != "VERSION" {
+			fmt.Fprintf(t.Stderr, "%v env variable missing\n", v.name)
 			argsMissing = true
 		}
 	}
 
 	if argsMissing {
-		dieMsg("required env variables missing")
+		return "", nil, types.NewInvalidEnvironmentVariablesError("required env variables missing", "")
 	}
 
-	stdinData, err := ioutil.ReadAll(os.Stdin)
-	if err != nil {
-		dieMsg("error reading from stdin: %v", err)
+	switch format := t.Getenv("CNI_OUTPUT_FORMAT"); format {
+	case "", "compact", "pretty":
+	default:
+		return "", nil, types.NewInvalidEnvironmentVariablesError(fmt.Sprintf("invalid CNI_OUTPUT_FORMAT %q: must be compact or pretty", format), "")
+	}
+
+	if _, err := types.DecodeArgs(args); err != nil {
+		return "", nil, types.NewInvalidEnvironmentVariablesError(fmt.Sprintf("invalid CNI_ARGS: %v", err), "")
+	}
+
+	stdinData, e := t.readConfig()
+	if e != nil {
+		return "", nil, e
 	}
 
 	cmdArgs := &CmdArgs{
@@ -80,33 +118,144 @@ func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
 		Path:        path,
 		StdinData:   stdinData,
 	}
+	return cmd, cmdArgs, nil
+}
+
+// readConfig reads the network config from stdin. When stdin is empty,
+// the config is read from the file named by CNI_CONFIG_PATH instead, if
+// set; this is not used by runtimes, but helps run a plugin by hand.
+func (t *dispatcher) readConfig() ([]byte, *types.Error) {
+	configPath := t.Getenv("CNI_CONFIG_PATH")
+
+	var stdinData []byte
+	// a terminal is never empty, but waits for input
+	if configPath == "" || !isTerminal(t.Stdin) {
+		var err error
+		if stdinData, err = ioutil.ReadAll(t.Stdin); err != nil {
+			return nil, types.NewIOFailureError(fmt.Sprintf("error reading from stdin: %v", err), "")
+		}
+	}
+	if len(stdinData) > 0 || configPath == "" {
+		return stdinData, nil
+	}
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, types.NewIOFailureError(fmt.Sprintf("error reading CNI_CONFIG_PATH: %v", err), "")
+	}
+	return data, nil
+}
+
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
 
+func checkVersion(stdinData []byte, versionInfo version.PluginInfo) *types.Error {
+	configVersion, err := version.ConfigVersion(stdinData)
+	if err != nil {
+		return types.NewDecodingFailureError(err.Error(), "")
+	}
+
+	if !version.Supports(versionInfo, configVersion) {
+		return types.NewIncompatibleCNIVersionError(
+			fmt.Sprintf("incompatible CNI versions: config is %q", configVersion),
+			fmt.Sprintf("plugin supports %s", strings.Join(versionInfo.SupportedVersions(), ", ")),
+		)
+	}
+	return nil
+}
+
+func (t *dispatcher) pluginMain(cmdAdd, cmdDel, cmdCheck func(_ *CmdArgs) error, versionInfo version.PluginInfo) *types.Error {
+	cmd, cmdArgs, e := t.getCmdArgsFromEnv()
+	if e != nil {
+		logf("CNI invocation failed: %v", e)
+		return e
+	}
+
+	logf("CNI %s: containerID=%q ifName=%q netns=%q", cmd, cmdArgs.ContainerID, cmdArgs.IfName, cmdArgs.Netns)
+	if e := t.dispatch(cmd, cmdArgs, cmdAdd, cmdDel, cmdCheck, versionInfo); e != nil {
+		logf("CNI %s failed: containerID=%q ifName=%q: %v", cmd, cmdArgs.ContainerID, cmdArgs.IfName, e)
+		return e
+	}
+	logf("CNI %s succeeded: containerID=%q ifName=%q", cmd, cmdArgs.ContainerID, cmdArgs.IfName)
+	return nil
+}
+
+func (t *dispatcher) dispatch(cmd string, cmdArgs *CmdArgs, cmdAdd, cmdDel, cmdCheck func(_ *CmdArgs) error, versionInfo version.PluginInfo) *types.Error {
+	var err error
 	switch cmd {
 	case "ADD":
+		if e := checkVersion(cmdArgs.StdinData, versionInfo); e != nil {
+			return e
+		}
 		err = cmdAdd(cmdArgs)
 
 	case "DEL":
+		if e := checkVersion(cmdArgs.StdinData, versionInfo); e != nil {
+			return e
+		}
 		err = cmdDel(cmdArgs)
 
+	case "CHECK":
+		if cmdCheck == nil {
+			return types.NewInvalidEnvironmentVariablesError("plugin does not implement CHECK", "")
+		}
+		if e := checkVersion(cmdArgs.StdinData, versionInfo); e != nil {
+			return e
+		}
+		err = cmdCheck(cmdArgs)
+
+	case "VERSION":
+		if err := versionInfo.Encode(t.Stdout); err != nil {
+			return types.NewIOFailureError(fmt.Sprintf("error writing version: %v", err), "")
+		}
+
 	default:
-		dieMsg("unknown CNI_COMMAND: %v", cmd)
+		return types.NewInvalidEnvironmentVariablesError(fmt.Sprintf("unknown CNI_COMMAND: %v", cmd), "")
 	}
 
 	if err != nil {
 		if e, ok := err.(*types.Error); ok {
 			// don't wrap Error in Error
-			dieErr(e)
+			return e
+		}
+		// keep the code of an Error the plugin wrapped with context,
+		// so that e.g. a delegated IPAM failure stays retryable
+		var e *types.Error
+		if errors.As(err, &e) {
+			return types.NewError(e.Code, err.Error(), e.Details)
 		}
-		dieMsg(err.Error())
+		return types.NewError(types.ErrInternal, err.Error(), "")
 	}
+	return nil
 }
 
-func dieMsg(f string, args ...interface{}) {
-	e := &types.Error{
-		Code: 100,
-		Msg:  fmt.Sprintf(f, args...),
+// PluginMain is the "main" for a plugin. It accepts
+// callback functions for the add, del and check commands, and
+// the spec versions the plugin supports. cmdCheck may be nil,
+// in which case CHECK is rejected. Configs asking for any
+// other cniVersion are rejected, and the VERSION command
+// prints versionInfo.
+// On failure the error is printed as CNI error JSON on stdout
+// and the process exits with a nonzero status. A callback marks
+// a transient failure, which the caller may retry, by returning
+// types.NewTryAgainLaterError, or an error wrapping one with %w.
+func PluginMain(cmdAdd, cmdDel, cmdCheck func(_ *CmdArgs) error, versionInfo version.PluginInfo) {
+	caller := dispatcher{
+		Getenv: os.Getenv,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	if e := caller.pluginMain(cmdAdd, cmdDel, cmdCheck, versionInfo); e != nil {
+		dieErr(e)
 	}
-	dieErr(e)
 }
 
 func dieErr(e *types.Error) {
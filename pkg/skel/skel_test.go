@@ -15,61 +15,408 @@
 package skel
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
-var _ = Describe("Skel", func() {
+type fakeCmd struct {
+	CallCount int
+	Returns   error
+	Received  *CmdArgs
+}
+
+func (c *fakeCmd) Func(args *CmdArgs) error {
+	c.CallCount++
+	c.Received = args
+	return c.Returns
+}
+
+var _ = Describe("dispatching to the correct callback", func() {
 	var (
-		fNoop = func(_ *CmdArgs) error { return nil }
-		// fErr    = func(_ *CmdArgs) error { return errors.New("dummy") }
-		envVars = []struct {
-			name string
-			val  string
-		}{
-			{"CNI_CONTAINERID", "dummy"},
-			{"CNI_NETNS", "dummy"},
-			{"CNI_IFNAME", "dummy"},
-			{"CNI_ARGS", "dummy"},
-			{"CNI_PATH", "dummy"},
-		}
+		environment     map[string]string
+		stdin           string
+		stdout, stderr  *bytes.Buffer
+		versionInfo     version.PluginInfo
+		cmdAdd, cmdDel  *fakeCmd
+		cmdCheck        *fakeCmd
+		dispatch        *dispatcher
+		expectedCmdArgs *CmdArgs
 	)
 
-	It("Must be possible to set the env vars", func() {
-		for _, v := range envVars {
-			err := os.Setenv(v.name, v.val)
-			Expect(err).NotTo(HaveOccurred())
+	BeforeEach(func() {
+		environment = map[string]string{
+			"CNI_COMMAND":     "ADD",
+			"CNI_CONTAINERID": "some-container-id",
+			"CNI_NETNS":       "/some/netns/path",
+			"CNI_IFNAME":      "eth0",
+			"CNI_ARGS":        "some=extra;args=1",
+			"CNI_PATH":        "/some/cni/path",
 		}
+		stdin = `{ "some": "config" }`
+		stdout = &bytes.Buffer{}
+		stderr = &bytes.Buffer{}
+		versionInfo = version.PluginSupports("0.1.0", "0.2.0")
+		dispatch = &dispatcher{
+			Getenv: func(key string) string { return environment[key] },
+			Stdin:  strings.NewReader(stdin),
+			Stdout: stdout,
+			Stderr: stderr,
+		}
+		cmdAdd = &fakeCmd{}
+		cmdDel = &fakeCmd{}
+		cmdCheck = &fakeCmd{}
+		expectedCmdArgs = &CmdArgs{
+			ContainerID: "some-container-id",
+			Netns:       "/some/netns/path",
+			IfName:      "eth0",
+			Args:        "some=extra;args=1",
+			Path:        "/some/cni/path",
+			StdinData:   []byte(stdin),
+		}
+	})
+
+	Context("when the CNI_COMMAND is ADD", func() {
+		It("extracts env vars and stdin data and calls cmdAdd", func() {
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(BeNil())
+			Expect(cmdAdd.CallCount).To(Equal(1))
+			Expect(cmdDel.CallCount).To(Equal(0))
+			Expect(cmdAdd.Received).To(Equal(expectedCmdArgs))
+		})
+
+		It("does not call cmdDel", func() {
+			dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(cmdDel.CallCount).To(Equal(0))
+		})
+
+		Context("when a required env var is missing", func() {
+			It("reports each missing var on stderr and returns an error", func() {
+				delete(environment, "CNI_NETNS")
+				delete(environment, "CNI_PATH")
+
+				err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+				Expect(err).To(Equal(&types.Error{
+					Code: types.ErrInvalidEnvironmentVariables,
+					Msg:  "required env variables missing",
+				}))
+				Expect(stderr.String()).To(ContainSubstring("CNI_NETNS env variable missing\n"))
+				Expect(stderr.String()).To(ContainSubstring("CNI_PATH env variable missing\n"))
+				Expect(cmdAdd.CallCount).To(Equal(0))
+			})
+		})
+
+		Context("when CNI_ARGS is malformed", func() {
+			It("returns an error and does not call cmdAdd", func() {
+				environment["CNI_ARGS"] = "some;extra;args"
+
+				err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+				Expect(err).To(Equal(&types.Error{
+					Code: types.ErrInvalidEnvironmentVariables,
+					Msg:  `invalid CNI_ARGS: ARGS: invalid pair "some"`,
+				}))
+				Expect(cmdAdd.CallCount).To(Equal(0))
+			})
+		})
+
+		Context("when CNI_OUTPUT_FORMAT is unknown", func() {
+			It("returns an error and does not call cmdAdd", func() {
+				environment["CNI_OUTPUT_FORMAT"] = "yaml"
+
+				err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+				Expect(err).To(Equal(&types.Error{
+					Code: types.ErrInvalidEnvironmentVariables,
+					Msg:  `invalid CNI_OUTPUT_FORMAT "yaml": must be compact or pretty`,
+				}))
+				Expect(cmdAdd.CallCount).To(Equal(0))
+			})
+		})
+
+		Context("when CNI_CONFIG_PATH is set", func() {
+			var configPath string
+
+			BeforeEach(func() {
+				f, err := ioutil.TempFile("", "skel-test")
+				Expect(err).NotTo(HaveOccurred())
+				_, err = f.WriteString(`{ "some": "file config" }`)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(f.Close()).To(Succeed())
+
+				configPath = f.Name()
+				environment["CNI_CONFIG_PATH"] = configPath
+			})
+
+			AfterEach(func() {
+				Expect(os.Remove(configPath)).To(Succeed())
+			})
+
+			It("prefers the config on stdin", func() {
+				err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+				Expect(err).To(BeNil())
+				Expect(cmdAdd.Received).To(Equal(expectedCmdArgs))
+			})
+
+			It("reads the config from the file when stdin is empty", func() {
+				dispatch.Stdin = strings.NewReader("")
+				expectedCmdArgs.StdinData = []byte(`{ "some": "file config" }`)
+
+				err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+				Expect(err).To(BeNil())
+				Expect(cmdAdd.Received).To(Equal(expectedCmdArgs))
+			})
+
+			It("returns an error when the file cannot be read", func() {
+				dispatch.Stdin = strings.NewReader("")
+				environment["CNI_CONFIG_PATH"] = configPath + ".missing"
+
+				err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+				Expect(err).NotTo(BeNil())
+				Expect(err.Code).To(Equal(types.ErrIOFailure))
+				Expect(err.Msg).To(HavePrefix("error reading CNI_CONFIG_PATH: "))
+				Expect(cmdAdd.CallCount).To(Equal(0))
+			})
+		})
+
+		Context("when an optional env var is missing", func() {
+			It("calls cmdAdd with an empty value", func() {
+				delete(environment, "CNI_ARGS")
+				expectedCmdArgs.Args = ""
+
+				err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+				Expect(err).To(BeNil())
+				Expect(cmdAdd.Received).To(Equal(expectedCmdArgs))
+			})
+		})
+	})
+
+	Context("when the CNI_COMMAND is DEL", func() {
+		BeforeEach(func() {
+			environment["CNI_COMMAND"] = "DEL"
+		})
+
+		It("calls cmdDel and not cmdAdd", func() {
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(BeNil())
+			Expect(cmdDel.CallCount).To(Equal(1))
+			Expect(cmdDel.Received).To(Equal(expectedCmdArgs))
+			Expect(cmdAdd.CallCount).To(Equal(0))
+		})
+	})
+
+	Context("when the CNI_COMMAND is CHECK", func() {
+		BeforeEach(func() {
+			environment["CNI_COMMAND"] = "CHECK"
+		})
+
+		It("calls cmdCheck and neither of the others", func() {
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(BeNil())
+			Expect(cmdCheck.CallCount).To(Equal(1))
+			Expect(cmdCheck.Received).To(Equal(expectedCmdArgs))
+			Expect(cmdAdd.CallCount).To(Equal(0))
+			Expect(cmdDel.CallCount).To(Equal(0))
+		})
+
+		It("passes on the error of cmdCheck", func() {
+			cmdCheck.Returns = errors.New("lo is down")
+
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(Equal(&types.Error{
+				Code: types.ErrInternal,
+				Msg:  "lo is down",
+			}))
+		})
+
+		It("returns an error when the plugin has no CHECK handler", func() {
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, nil, versionInfo)
+
+			Expect(err).To(Equal(&types.Error{
+				Code: types.ErrInvalidEnvironmentVariables,
+				Msg:  "plugin does not implement CHECK",
+			}))
+			Expect(cmdAdd.CallCount).To(Equal(0))
+			Expect(cmdDel.CallCount).To(Equal(0))
+		})
+	})
+
+	Context("when the config asks for a cniVersion", func() {
+		It("calls cmdAdd when the version is supported", func() {
+			stdin = `{ "cniVersion": "0.2.0", "some": "config" }`
+			dispatch.Stdin = strings.NewReader(stdin)
+			expectedCmdArgs.StdinData = []byte(stdin)
+
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(BeNil())
+			Expect(cmdAdd.Received).To(Equal(expectedCmdArgs))
+		})
+
+		It("returns an error listing the supported versions when it is not supported", func() {
+			dispatch.Stdin = strings.NewReader(`{ "cniVersion": "0.3.0" }`)
+
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(Equal(&types.Error{
+				Code:    types.ErrIncompatibleCNIVersion,
+				Msg:     `incompatible CNI versions: config is "0.3.0"`,
+				Details: "plugin supports 0.1.0, 0.2.0",
+			}))
+			Expect(cmdAdd.CallCount).To(Equal(0))
+		})
+
+		It("checks the version on DEL too", func() {
+			environment["CNI_COMMAND"] = "DEL"
+			dispatch.Stdin = strings.NewReader(`{ "cniVersion": "0.3.0" }`)
+
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err.Code).To(Equal(types.ErrIncompatibleCNIVersion))
+			Expect(cmdDel.CallCount).To(Equal(0))
+		})
+
+		It("returns a decoding error when the config is not JSON", func() {
+			dispatch.Stdin = strings.NewReader(`not json`)
+
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err.Code).To(Equal(types.ErrDecodingFailure))
+			Expect(cmdAdd.CallCount).To(Equal(0))
+		})
 	})
 
-	Context("When dummy environment variables are passed", func() {
+	Context("when the CNI_COMMAND is VERSION", func() {
+		It("prints the supported versions and calls neither callback", func() {
+			environment = map[string]string{"CNI_COMMAND": "VERSION"}
 
-		It("should not fail with ADD and noop callback", func() {
-			err := os.Setenv("CNI_COMMAND", "ADD")
-			Expect(err).NotTo(HaveOccurred())
-			PluginMain(fNoop, nil)
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(BeNil())
+			Expect(stdout.Bytes()).To(MatchJSON(`{
+				"cniVersion": "0.2.0",
+				"supportedVersions": ["0.1.0", "0.2.0"]
+			}`))
+			Expect(stderr.String()).To(BeEmpty())
+			Expect(cmdAdd.CallCount).To(Equal(0))
+			Expect(cmdDel.CallCount).To(Equal(0))
 		})
+	})
 
-		// TODO: figure out howto mock printing and os.Exit()
-		// It("should fail with ADD and error callback", func() {
-		// 	err := os.Setenv("CNI_COMMAND", "ADD")
-		// 	Expect(err).NotTo(HaveOccurred())
-		// 	PluginMain(fErr, nil)
-		// })
+	Context("when the CNI_COMMAND is unrecognized", func() {
+		It("returns an error and calls neither callback", func() {
+			environment["CNI_COMMAND"] = "NOPE"
 
-		It("should not fail with DEL and noop callback", func() {
-			err := os.Setenv("CNI_COMMAND", "DEL")
-			Expect(err).NotTo(HaveOccurred())
-			PluginMain(nil, fNoop)
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(Equal(&types.Error{
+				Code: types.ErrInvalidEnvironmentVariables,
+				Msg:  "unknown CNI_COMMAND: NOPE",
+			}))
+			Expect(cmdAdd.CallCount).To(Equal(0))
+			Expect(cmdDel.CallCount).To(Equal(0))
 		})
+	})
+
+	Context("when the callback returns an error", func() {
+		It("wraps a plain error in a CNI error", func() {
+			cmdAdd.Returns = errors.New("potato")
 
-		// TODO: figure out howto mock printing and os.Exit()
-		// It("should fail with DEL and error callback", func() {
-		// 	err := os.Setenv("CNI_COMMAND", "DEL")
-		// 	Expect(err).NotTo(HaveOccurred())
-		// 	PluginMain(fErr, nil)
-		// })
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(Equal(&types.Error{
+				Code: types.ErrInternal,
+				Msg:  "potato",
+			}))
+		})
+
+		It("passes a CNI error through unchanged", func() {
+			cmdAdd.Returns = &types.Error{
+				Code:    1234,
+				Msg:     "some message",
+				Details: "some details",
+			}
+
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(Equal(cmdAdd.Returns))
+		})
+
+		It("keeps the code of a wrapped CNI error, so it stays retryable", func() {
+			cmdAdd.Returns = fmt.Errorf("failed to allocate: %w", types.NewTryAgainLaterError("server unreachable", "some details"))
+
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(err).To(Equal(&types.Error{
+				Code:    types.ErrTryAgainLater,
+				Msg:     "failed to allocate: server unreachable",
+				Details: "some details",
+			}))
+			Expect(err.Retryable()).To(BeTrue())
+		})
+	})
+
+	Context("when a logger is set", func() {
+		var logged []string
+
+		BeforeEach(func() {
+			logged = nil
+			SetLogger(func(format string, args ...interface{}) {
+				logged = append(logged, fmt.Sprintf(format, args...))
+			})
+		})
+
+		AfterEach(func() {
+			SetLogger(nil)
+		})
+
+		It("logs the invocation and its outcome, but not the config", func() {
+			err := dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+			Expect(err).To(BeNil())
+
+			Expect(logged).To(Equal([]string{
+				`CNI ADD: containerID="some-container-id" ifName="eth0" netns="/some/netns/path"`,
+				`CNI ADD succeeded: containerID="some-container-id" ifName="eth0"`,
+			}))
+			for _, line := range logged {
+				Expect(line).NotTo(ContainSubstring("config"))
+			}
+		})
+
+		It("logs the error when the callback fails", func() {
+			cmdAdd.Returns = errors.New("potato")
+
+			dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(logged).To(HaveLen(2))
+			Expect(logged[1]).To(Equal(`CNI ADD failed: containerID="some-container-id" ifName="eth0": potato`))
+		})
+
+		It("logs invocations that fail before dispatching", func() {
+			delete(environment, "CNI_NETNS")
+
+			dispatch.pluginMain(cmdAdd.Func, cmdDel.Func, cmdCheck.Func, versionInfo)
+
+			Expect(logged).To(Equal([]string{"CNI invocation failed: required env variables missing"}))
+		})
 	})
 })
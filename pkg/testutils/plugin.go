@@ -0,0 +1,68 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutils holds fixtures shared by the plugin integration tests.
+package testutils
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/appc/cni/pkg/ns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+// PluginArgs are the CNI_* variables a runtime passes to a plugin.
+type PluginArgs struct {
+	Command     string
+	ContainerID string
+	Netns       string
+	IfName      string
+	Path        string
+}
+
+func (a PluginArgs) env() []string {
+	return append(os.Environ(),
+		"CNI_COMMAND="+a.Command,
+		"CNI_CONTAINERID="+a.ContainerID,
+		"CNI_NETNS="+a.Netns,
+		"CNI_IFNAME="+a.IfName,
+		"CNI_PATH="+a.Path,
+	)
+}
+
+// RunPluginInNS runs the plugin binary at pluginPath with conf on stdin,
+// forking it from within netns so that the plugin treats netns as its host
+// namespace. It fails the running spec if the plugin cannot be started and
+// waits for it to exit before returning its session.
+func RunPluginInNS(netns *os.File, pluginPath string, args PluginArgs, conf string) *gexec.Session {
+	cmd := exec.Command(pluginPath)
+	cmd.Env = args.env()
+	cmd.Stdin = strings.NewReader(conf)
+
+	// the child process inherits the namespace of the forking thread
+	var session *gexec.Session
+	err := ns.WithNetNS(netns, true, func(_ *os.File) error {
+		var err error
+		session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		return err
+	})
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	EventuallyWithOffset(1, session, "10s").Should(gexec.Exit())
+	return session
+}
@@ -18,6 +18,7 @@ import (
 	"encoding"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 )
 
@@ -53,38 +54,159 @@ func GetKeyField(keyString string, v reflect.Value) reflect.Value {
 	return v.Elem().FieldByName(keyString)
 }
 
-// LoadArgs parses args from a string in the form "K=V;K2=V2;..."
-func LoadArgs(args string, container interface{}) error {
+// EncodeArgs formats ordered key/value pairs in the "K=V;K2=V2;..." form
+// of CNI_ARGS. Order is preserved, as are repeated keys. Keys must be
+// non-empty, and neither keys nor values may contain ';' or '='.
+func EncodeArgs(pairs [][2]string) (string, error) {
+	entries := make([]string, len(pairs))
+	for i, kv := range pairs {
+		if kv[0] == "" {
+			return "", fmt.Errorf("ARGS: empty key in pair %q", strings.Join(kv[:], "="))
+		}
+		for _, s := range kv {
+			if strings.ContainsAny(s, ";=") {
+				return "", fmt.Errorf("ARGS: %q must not contain ';' or '='", s)
+			}
+		}
+		entries[i] = strings.Join(kv[:], "=")
+	}
+	return strings.Join(entries, ";"), nil
+}
+
+// DecodeArgs parses a string in the form "K=V;K2=V2;..." into ordered
+// key/value pairs. It is the inverse of EncodeArgs.
+func DecodeArgs(args string) ([][2]string, error) {
 	if args == "" {
-		return nil
+		return nil, nil
+	}
+
+	var pairs [][2]string
+	for _, pair := range strings.Split(args, ";") {
+		kv := strings.Split(pair, "=")
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("ARGS: invalid pair %q", pair)
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return pairs, nil
+}
+
+type argField struct {
+	value    reflect.Value
+	required bool
+}
+
+// argFields maps each CNI_ARGS key to the struct field receiving it.
+// A field is keyed by the name in its `cni:"NAME"` tag or, without
+// one, by its own name; `cni:"NAME,required"` makes the key mandatory
+// and `cni:"-"` skips the field. Embedded structs contribute their
+// fields as if they were declared in the outer struct.
+func argFields(v reflect.Value, fields map[string]argField) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			argFields(v.Field(i), fields)
+			continue
+		}
+
+		name, required := f.Name, false
+		if tag := f.Tag.Get("cni"); tag != "" {
+			opts := strings.Split(tag, ",")
+			if opts[0] == "-" {
+				continue
+			}
+			if opts[0] != "" {
+				name = opts[0]
+			}
+			for _, o := range opts[1:] {
+				if o == "required" {
+					required = true
+				}
+			}
+		}
+		fields[name] = argField{value: v.Field(i), required: required}
+	}
+}
+
+// setArg parses value into field. Types implementing
+// encoding.TextUnmarshaler (such as net.IP) parse themselves; strings
+// and integers are supported directly.
+func setArg(field reflect.Value, value string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	default:
+		return fmt.Errorf("unsupported type %v", field.Type())
+	}
+	return nil
+}
+
+// LoadArgs parses args from a string in the form "K=V;K2=V2;..." into
+// the struct container points to; see argFields for how keys are
+// matched to fields. Unknown keys are an error if the struct embeds
+// CommonArgs and IgnoreUnknown is not set, and are ignored otherwise.
+func LoadArgs(args string, container interface{}) error {
+	pairs, err := DecodeArgs(args)
+	if err != nil {
+		return err
 	}
 
 	containerValue := reflect.ValueOf(container)
+	if containerValue.Kind() != reflect.Ptr || containerValue.Elem().Kind() != reflect.Struct {
+		if len(pairs) == 0 {
+			return nil
+		}
+		return fmt.Errorf("ARGS: container must be a pointer to a struct, not %T", container)
+	}
+
+	fields := map[string]argField{}
+	argFields(containerValue.Elem(), fields)
 
-	pairs := strings.Split(args, ";")
+	seen := map[string]bool{}
 	unknownArgs := []string{}
-	for _, pair := range pairs {
-		kv := strings.Split(pair, "=")
-		if len(kv) != 2 {
-			return fmt.Errorf("ARGS: invalid pair %q", pair)
-		}
-		keyString := kv[0]
-		valueString := kv[1]
-		keyField := GetKeyField(keyString, containerValue)
-		if !keyField.IsValid() {
+	for _, kv := range pairs {
+		pair := strings.Join(kv[:], "=")
+		field, ok := fields[kv[0]]
+		if !ok {
 			unknownArgs = append(unknownArgs, pair)
 			continue
 		}
 
-		u := keyField.Addr().Interface().(encoding.TextUnmarshaler)
-		err := u.UnmarshalText([]byte(valueString))
-		if err != nil {
+		if err := setArg(field.value, kv[1]); err != nil {
 			return fmt.Errorf("ARGS: error parsing value of pair %q: %v)", pair, err)
 		}
+		seen[kv[0]] = true
+	}
+
+	for name, field := range fields {
+		if field.required && !seen[name] {
+			return fmt.Errorf("ARGS: missing required arg %q", name)
+		}
 	}
 
-	isIgnoreUnknown := GetKeyField("IgnoreUnknown", containerValue).Bool()
-	if len(unknownArgs) > 0 && !isIgnoreUnknown {
+	ignoreUnknown, ok := fields["IgnoreUnknown"]
+	if len(unknownArgs) > 0 && ok && !ignoreUnknown.value.Bool() {
 		return fmt.Errorf("ARGS: unknown args %q", unknownArgs)
 	}
 	return nil
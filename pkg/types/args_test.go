@@ -15,6 +15,7 @@
 package types_test
 
 import (
+	"net"
 	"reflect"
 
 	. "github.com/appc/cni/pkg/types"
@@ -104,3 +105,111 @@ var _ = Describe("LoadArgs", func() {
 		})
 	})
 })
+
+var _ = Describe("LoadArgs with cni struct tags", func() {
+	type podArgs struct {
+		IP       net.IP `cni:"IP"`
+		PodName  string `cni:"K8S_POD_NAME,required"`
+		Priority int    `cni:"PRIORITY"`
+		MTU      uint16
+		Skipped  string `cni:"-"`
+	}
+
+	It("populates tagged fields of various types", func() {
+		args := podArgs{}
+		err := LoadArgs("IP=10.0.0.5;K8S_POD_NAME=web-1;PRIORITY=-3;MTU=1400", &args)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(args.IP.String()).To(Equal("10.0.0.5"))
+		Expect(args.PodName).To(Equal("web-1"))
+		Expect(args.Priority).To(Equal(-3))
+		Expect(args.MTU).To(Equal(uint16(1400)))
+	})
+
+	It("ignores unknown keys when the struct does not embed CommonArgs", func() {
+		args := podArgs{}
+		err := LoadArgs("K8S_POD_NAME=web-1;K8S_POD_NAMESPACE=default;Skipped=x", &args)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(args.PodName).To(Equal("web-1"))
+		Expect(args.Skipped).To(BeEmpty())
+	})
+
+	It("fails when a required key is missing", func() {
+		args := podArgs{}
+		err := LoadArgs("IP=10.0.0.5", &args)
+		Expect(err).To(MatchError(`ARGS: missing required arg "K8S_POD_NAME"`))
+	})
+
+	It("fails on a malformed K=V segment", func() {
+		args := podArgs{}
+		err := LoadArgs("K8S_POD_NAME=web-1;IP", &args)
+		Expect(err).To(MatchError(`ARGS: invalid pair "IP"`))
+	})
+
+	It("fails on a value that does not parse", func() {
+		args := podArgs{}
+		Expect(LoadArgs("K8S_POD_NAME=web-1;IP=not-an-ip", &args)).To(HaveOccurred())
+		Expect(LoadArgs("K8S_POD_NAME=web-1;MTU=70000", &args)).To(HaveOccurred())
+	})
+
+	It("fills fields of embedded structs, honouring IgnoreUnknown", func() {
+		type embedding struct {
+			CommonArgs
+			IP net.IP `cni:"IP"`
+		}
+
+		args := embedding{}
+		Expect(LoadArgs("IP=10.0.0.5;Unk=nown", &args)).To(MatchError(`ARGS: unknown args ["Unk=nown"]`))
+
+		args = embedding{}
+		Expect(LoadArgs("IgnoreUnknown=1;IP=10.0.0.5;Unk=nown", &args)).To(Succeed())
+		Expect(args.IP.String()).To(Equal("10.0.0.5"))
+	})
+})
+
+var _ = Describe("EncodeArgs and DecodeArgs", func() {
+	It("round-trips pairs in order, keeping repeated keys", func() {
+		pairs := [][2]string{{"K8S_POD_NAME", "web"}, {"IP", "10.0.0.5"}, {"K8S_POD_NAME", "db"}, {"EMPTY", ""}}
+
+		encoded, err := EncodeArgs(pairs)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(encoded).To(Equal("K8S_POD_NAME=web;IP=10.0.0.5;K8S_POD_NAME=db;EMPTY="))
+
+		decoded, err := DecodeArgs(encoded)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(pairs))
+	})
+
+	It("encodes no pairs as an empty string and decodes it back", func() {
+		encoded, err := EncodeArgs(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(encoded).To(Equal(""))
+
+		decoded, err := DecodeArgs("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(BeEmpty())
+	})
+
+	DescribeTable("rejects pairs containing reserved characters",
+		func(pair [2]string) {
+			_, err := EncodeArgs([][2]string{{"OK", "1"}, pair})
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("';' in a value", [2]string{"K", "a;b"}),
+		Entry("'=' in a value", [2]string{"K", "a=b"}),
+		Entry("';' in a key", [2]string{"K;L", "v"}),
+		Entry("'=' in a key", [2]string{"K=L", "v"}),
+		Entry("an empty key", [2]string{"", "v"}),
+	)
+
+	DescribeTable("rejects malformed strings",
+		func(args string) {
+			_, err := DecodeArgs(args)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("a pair without '='", "K=V;novalue"),
+		Entry("a pair with two '='", "K=V=W"),
+		Entry("an empty key", "=V"),
+		Entry("a trailing ';'", "K=V;"),
+	)
+})
@@ -0,0 +1,162 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MergeResults combines the results of two plugins of a chain into
+// one 0.2.0 result, as the runtime sees the container's network:
+//
+//   - Interfaces are the union of both lists. An interface of overlay
+//     with the same name and sandbox as one of base is the same
+//     interface; it keeps base's position and takes overlay's MAC
+//     address if overlay has one. Other interfaces of overlay are
+//     appended in order.
+//   - IPs are base's followed by overlay's, whose interface indices are
+//     rewritten to point at the same interfaces in the merged list. An
+//     address listed by both, such as one passed through from
+//     prevResult, appears once.
+//   - Routes are base's followed by overlay's, again without repeats.
+//   - DNS is overlay's, unless overlay has no DNS settings at all.
+//
+// It fails if an address refers to an interface its result does not
+// list. Neither base nor overlay is modified.
+func MergeResults(base, overlay Result) (Result, error) {
+	b, err := asResult020(base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert base result: %v", err)
+	}
+	o, err := asResult020(overlay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert overlay result: %v", err)
+	}
+	if err := checkInterfaceIndices(b); err != nil {
+		return nil, fmt.Errorf("invalid base result: %v", err)
+	}
+	if err := checkInterfaceIndices(o); err != nil {
+		return nil, fmt.Errorf("invalid overlay result: %v", err)
+	}
+
+	merged := &Result020{CNIVersion: "0.2.0", DNS: b.DNS}
+	for _, iface := range b.Interfaces {
+		ifaceCopy := *iface
+		merged.Interfaces = append(merged.Interfaces, &ifaceCopy)
+	}
+
+	// remap[i] is the index in merged of overlay's interface i
+	remap := make([]int, len(o.Interfaces))
+	for i, iface := range o.Interfaces {
+		remap[i] = -1
+		for j, m := range merged.Interfaces {
+			if m.Name == iface.Name && m.Sandbox == iface.Sandbox {
+				if iface.Mac != "" {
+					m.Mac = iface.Mac
+				}
+				remap[i] = j
+				break
+			}
+		}
+		if remap[i] < 0 {
+			ifaceCopy := *iface
+			merged.Interfaces = append(merged.Interfaces, &ifaceCopy)
+			remap[i] = len(merged.Interfaces) - 1
+		}
+	}
+
+	for _, addr := range b.IPs {
+		merged.addIP(addr, addr.Interface)
+	}
+	for _, addr := range o.IPs {
+		idx := addr.Interface
+		if idx != nil {
+			m := remap[*idx]
+			idx = &m
+		}
+		merged.addIP(addr, idx)
+	}
+
+	for _, routes := range [][]Route{b.Routes, o.Routes} {
+		for _, route := range routes {
+			if !merged.hasRoute(route) {
+				merged.Routes = append(merged.Routes, route)
+			}
+		}
+	}
+
+	if !o.DNS.empty() {
+		merged.DNS = o.DNS
+	}
+	return merged, nil
+}
+
+func asResult020(r Result) (*Result020, error) {
+	res, err := r.GetAsVersion("0.2.0")
+	if err != nil {
+		return nil, err
+	}
+	return res.(*Result020), nil
+}
+
+func checkInterfaceIndices(r *Result020) error {
+	for _, addr := range r.IPs {
+		if addr.Interface != nil && (*addr.Interface < 0 || *addr.Interface >= len(r.Interfaces)) {
+			return fmt.Errorf("address %s refers to interface %d of %d", addr.Address.String(), *addr.Interface, len(r.Interfaces))
+		}
+	}
+	return nil
+}
+
+// addIP appends a copy of addr on the interface with index idx, unless
+// the same address is already listed for it.
+func (r *Result020) addIP(addr *IPAddress, idx *int) {
+	for _, ip := range r.IPs {
+		if ip.Version == addr.Version && sameIndex(ip.Interface, idx) &&
+			ip.Address.IP.Equal(addr.Address.IP) && bytes.Equal(ip.Address.Mask, addr.Address.Mask) &&
+			ip.Gateway.Equal(addr.Gateway) {
+			return
+		}
+	}
+
+	addrCopy := *addr
+	addrCopy.Interface = nil
+	if idx != nil {
+		i := *idx
+		addrCopy.Interface = &i
+	}
+	r.IPs = append(r.IPs, &addrCopy)
+}
+
+func (r *Result020) hasRoute(route Route) bool {
+	for _, rt := range r.Routes {
+		if rt.Dst.IP.Equal(route.Dst.IP) && bytes.Equal(rt.Dst.Mask, route.Dst.Mask) && rt.GW.Equal(route.GW) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameIndex(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func (d DNS) empty() bool {
+	return len(d.Nameservers) == 0 && d.Domain == "" && len(d.Search) == 0 && len(d.Options) == 0
+}
@@ -0,0 +1,144 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types_test
+
+import (
+	"encoding/json"
+
+	. "github.com/appc/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MergeResults", func() {
+	parse := func(cniVersion, data string) Result {
+		result, err := NewResult(cniVersion, []byte(data))
+		Expect(err).NotTo(HaveOccurred())
+		return result
+	}
+
+	mergedJSON := func(base, overlay Result) []byte {
+		merged, err := MergeResults(base, overlay)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := json.Marshal(merged)
+		Expect(err).NotTo(HaveOccurred())
+		return data
+	}
+
+	base := `{
+		"cniVersion": "0.2.0",
+		"interfaces": [
+			{ "name": "veth0" },
+			{ "name": "eth0", "sandbox": "/var/run/netns/blue" }
+		],
+		"ips": [ { "version": "4", "interface": 1, "address": "10.1.2.3/24", "gateway": "10.1.2.1" } ],
+		"routes": [ { "dst": "0.0.0.0/0" } ],
+		"dns": { "nameservers": [ "10.1.2.1" ] }
+	}`
+
+	It("unions the interfaces and appends the addresses and routes of overlay", func() {
+		overlay := `{
+			"cniVersion": "0.2.0",
+			"interfaces": [
+				{ "name": "eth1", "sandbox": "/var/run/netns/blue" },
+				{ "name": "eth0", "mac": "0a:58:0a:01:02:03", "sandbox": "/var/run/netns/blue" }
+			],
+			"ips": [
+				{ "version": "6", "interface": 1, "address": "fd00::3/64" },
+				{ "version": "4", "interface": 0, "address": "192.168.0.3/24" }
+			],
+			"routes": [ { "dst": "192.168.1.0/24", "gw": "192.168.0.1" } ],
+			"dns": { "nameservers": [ "192.168.0.1" ], "search": [ "example.com" ] }
+		}`
+
+		Expect(mergedJSON(parse("0.2.0", base), parse("0.2.0", overlay))).To(MatchJSON(`{
+			"cniVersion": "0.2.0",
+			"interfaces": [
+				{ "name": "veth0" },
+				{ "name": "eth0", "mac": "0a:58:0a:01:02:03", "sandbox": "/var/run/netns/blue" },
+				{ "name": "eth1", "sandbox": "/var/run/netns/blue" }
+			],
+			"ips": [
+				{ "version": "4", "interface": 1, "address": "10.1.2.3/24", "gateway": "10.1.2.1" },
+				{ "version": "6", "interface": 1, "address": "fd00::3/64" },
+				{ "version": "4", "interface": 2, "address": "192.168.0.3/24" }
+			],
+			"routes": [
+				{ "dst": "0.0.0.0/0" },
+				{ "dst": "192.168.1.0/24", "gw": "192.168.0.1" }
+			],
+			"dns": { "nameservers": [ "192.168.0.1" ], "search": [ "example.com" ] }
+		}`))
+	})
+
+	It("keeps the DNS settings of base when overlay has none", func() {
+		overlay := `{ "cniVersion": "0.2.0", "dns": {} }`
+
+		merged, err := MergeResults(parse("0.2.0", base), parse("0.2.0", overlay))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(merged.(*Result020).DNS).To(Equal(DNS{Nameservers: []string{"10.1.2.1"}}))
+	})
+
+	It("lists what overlay passed through from base only once", func() {
+		Expect(mergedJSON(parse("0.2.0", base), parse("0.2.0", base))).To(MatchJSON(base))
+	})
+
+	It("merges 0.1.0 results, whose addresses have no interface", func() {
+		overlay := `{ "ip6": { "ip": "fd00::3/64", "routes": [ { "dst": "::/0" } ] } }`
+
+		Expect(mergedJSON(parse("0.2.0", base), parse("0.1.0", overlay))).To(MatchJSON(`{
+			"cniVersion": "0.2.0",
+			"interfaces": [
+				{ "name": "veth0" },
+				{ "name": "eth0", "sandbox": "/var/run/netns/blue" }
+			],
+			"ips": [
+				{ "version": "4", "interface": 1, "address": "10.1.2.3/24", "gateway": "10.1.2.1" },
+				{ "version": "6", "address": "fd00::3/64" }
+			],
+			"routes": [ { "dst": "0.0.0.0/0" }, { "dst": "::/0" } ],
+			"dns": { "nameservers": [ "10.1.2.1" ] }
+		}`))
+	})
+
+	It("leaves base and overlay unchanged", func() {
+		b := parse("0.2.0", base)
+		overlay := parse("0.2.0", `{
+			"cniVersion": "0.2.0",
+			"interfaces": [ { "name": "eth0", "mac": "0a:58:0a:01:02:03", "sandbox": "/var/run/netns/blue" } ],
+			"ips": [ { "version": "4", "interface": 0, "address": "10.1.2.4/24" } ]
+		}`)
+
+		_, err := MergeResults(b, overlay)
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := json.Marshal(b)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(base))
+		Expect(*overlay.(*Result020).IPs[0].Interface).To(Equal(0))
+	})
+
+	It("fails when an address refers to an interface its result does not list", func() {
+		overlay := `{
+			"cniVersion": "0.2.0",
+			"interfaces": [ { "name": "eth1" } ],
+			"ips": [ { "version": "4", "interface": 1, "address": "192.168.0.3/24" } ]
+		}`
+
+		_, err := MergeResults(parse("0.2.0", base), parse("0.2.0", overlay))
+		Expect(err).To(MatchError("invalid overlay result: address 192.168.0.3/24 refers to interface 1 of 1"))
+	})
+})
@@ -0,0 +1,71 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// PortMapping forwards HostPort on the host to ContainerPort in the
+// container. Runtimes pass them to plugins declaring the "portMappings"
+// capability. HostIP, if set, restricts the mapping to that address of
+// the host.
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+func (m *PortMapping) validate() error {
+	if m.HostPort < 1 || m.HostPort > 65535 {
+		return fmt.Errorf("hostPort %d is not in 1-65535", m.HostPort)
+	}
+	if m.ContainerPort < 1 || m.ContainerPort > 65535 {
+		return fmt.Errorf("containerPort %d is not in 1-65535", m.ContainerPort)
+	}
+	if m.Protocol != "tcp" && m.Protocol != "udp" {
+		return fmt.Errorf("protocol %q is neither tcp nor udp", m.Protocol)
+	}
+	if m.HostIP != "" && net.ParseIP(m.HostIP) == nil {
+		return fmt.Errorf("hostIP %q is not an IP address", m.HostIP)
+	}
+	return nil
+}
+
+// ParsePortMappings returns the runtimeConfig.portMappings of the
+// network configuration netconf, or none if the runtime passed none.
+// Every mapping must have its ports in 1-65535, a protocol of tcp or
+// udp and, if it has one, a valid hostIP.
+func ParsePortMappings(netconf []byte) ([]PortMapping, error) {
+	var conf struct {
+		RuntimeConfig struct {
+			PortMappings []PortMapping `json:"portMappings"`
+		} `json:"runtimeConfig"`
+	}
+	if err := json.Unmarshal(netconf, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse port mappings: %v", err)
+	}
+
+	mappings := conf.RuntimeConfig.PortMappings
+	for i := range mappings {
+		if err := mappings[i].validate(); err != nil {
+			return nil, fmt.Errorf("invalid port mapping %d: %v", i, err)
+		}
+	}
+	return mappings, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types_test
+
+import (
+	. "github.com/appc/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParsePortMappings", func() {
+	It("parses the port mappings of the runtimeConfig", func() {
+		mappings, err := ParsePortMappings([]byte(`{
+			"name": "mynet",
+			"type": "portmap",
+			"capabilities": {"portMappings": true},
+			"runtimeConfig": {
+				"portMappings": [
+					{"hostPort": 8080, "containerPort": 80, "protocol": "tcp"},
+					{"hostPort": 5353, "containerPort": 53, "protocol": "udp"},
+					{"hostPort": 65535, "containerPort": 1, "protocol": "tcp"},
+					{"hostPort": 8443, "containerPort": 443, "protocol": "tcp", "hostIP": "192.168.1.5"}
+				]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mappings).To(Equal([]PortMapping{
+			{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+			{HostPort: 5353, ContainerPort: 53, Protocol: "udp"},
+			{HostPort: 65535, ContainerPort: 1, Protocol: "tcp"},
+			{HostPort: 8443, ContainerPort: 443, Protocol: "tcp", HostIP: "192.168.1.5"},
+		}))
+	})
+
+	It("returns no mappings when the runtime passed none", func() {
+		mappings, err := ParsePortMappings([]byte(`{"name": "mynet", "type": "portmap"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mappings).To(BeEmpty())
+	})
+
+	DescribeTable("rejects invalid mappings",
+		func(mapping, message string) {
+			_, err := ParsePortMappings([]byte(`{"runtimeConfig": {"portMappings": [
+				{"hostPort": 8080, "containerPort": 80, "protocol": "tcp"},
+				` + mapping + `
+			]}}`))
+			Expect(err).To(MatchError(message))
+		},
+		Entry("zero host port", `{"hostPort": 0, "containerPort": 80, "protocol": "tcp"}`,
+			"invalid port mapping 1: hostPort 0 is not in 1-65535"),
+		Entry("missing container port", `{"hostPort": 8081, "protocol": "tcp"}`,
+			"invalid port mapping 1: containerPort 0 is not in 1-65535"),
+		Entry("port above 65535", `{"hostPort": 65536, "containerPort": 80, "protocol": "tcp"}`,
+			"invalid port mapping 1: hostPort 65536 is not in 1-65535"),
+		Entry("unknown protocol", `{"hostPort": 8081, "containerPort": 80, "protocol": "sctp"}`,
+			`invalid port mapping 1: protocol "sctp" is neither tcp nor udp`),
+		Entry("malformed host IP", `{"hostPort": 8081, "containerPort": 80, "protocol": "tcp", "hostIP": "192.168.1"}`,
+			`invalid port mapping 1: hostIP "192.168.1" is not an IP address`),
+	)
+
+	It("fails on a config that is not JSON", func() {
+		_, err := ParsePortMappings([]byte(`nope`))
+		Expect(err).To(MatchError(HavePrefix("failed to parse port mappings: ")))
+	})
+})
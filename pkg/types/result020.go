@@ -0,0 +1,131 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// Result020 is the result layout of spec version 0.2.0. It lists any
+// number of addresses, each tied to one of the interfaces the plugin
+// set up, and keeps the routes apart from the addresses.
+type Result020 struct {
+	CNIVersion string       `json:"cniVersion"`
+	Interfaces []*Interface `json:"interfaces,omitempty"`
+	IPs        []*IPAddress `json:"ips,omitempty"`
+	Routes     []Route      `json:"routes,omitempty"`
+	DNS        DNS          `json:"dns,omitempty"`
+}
+
+// Interface is an interface a plugin created or configured.
+type Interface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// IPAddress is an address of a Result020.
+type IPAddress struct {
+	// Version is "4" or "6"
+	Version string
+	// Interface is the index of the address's interface in
+	// Result020.Interfaces, or nil if not known
+	Interface *int
+	Address   net.IPNet
+	Gateway   net.IP
+}
+
+func (r *Result020) Version() string {
+	return "0.2.0"
+}
+
+// GetAsVersion returns r itself for 0.2.0. For 0.1.0 it returns the
+// first address of each family, with the routes of its family and the
+// DNS settings, as a Result010; interfaces and further addresses have
+// no place there and are dropped.
+func (r *Result020) GetAsVersion(version string) (Result, error) {
+	switch version {
+	case "0.2.0":
+		return r, nil
+	case "0.1.0":
+		return r.to010(), nil
+	}
+	return nil, fmt.Errorf("cannot convert a %s result to version %q", r.Version(), version)
+}
+
+func (r *Result020) to010() *Result010 {
+	res := &Result010{DNS: r.DNS}
+	for _, ip := range r.IPs {
+		ipc := &IPConfig{IP: ip.Address, Gateway: ip.Gateway}
+		if ip.Version == "4" && res.IP4 == nil {
+			res.IP4 = ipc
+		} else if ip.Version == "6" && res.IP6 == nil {
+			res.IP6 = ipc
+		}
+	}
+
+	for _, route := range r.Routes {
+		ipc := res.IP4
+		if route.Dst.IP.To4() == nil {
+			ipc = res.IP6
+		}
+		if ipc != nil {
+			ipc.Routes = append(ipc.Routes, route)
+		}
+	}
+	return res
+}
+
+func (r *Result020) Print() error {
+	return printJSON(r)
+}
+
+// String returns a formatted string in the form of
+// "IPs: [$1, ...], Routes: [$2, ...], DNS: $3".
+func (r *Result020) String() string {
+	return fmt.Sprintf("IPs:%+v, Routes:%+v, DNS:%+v", r.IPs, r.Routes, r.DNS)
+}
+
+// JSON (un)marshallable form of IPAddress
+type ipAddress struct {
+	Version   string `json:"version"`
+	Interface *int   `json:"interface,omitempty"`
+	Address   IPNet  `json:"address"`
+	Gateway   net.IP `json:"gateway,omitempty"`
+}
+
+func (a *IPAddress) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ipAddress{
+		Version:   a.Version,
+		Interface: a.Interface,
+		Address:   IPNet(a.Address),
+		Gateway:   a.Gateway,
+	})
+}
+
+func (a *IPAddress) UnmarshalJSON(data []byte) error {
+	ipa := ipAddress{}
+	if err := json.Unmarshal(data, &ipa); err != nil {
+		return err
+	}
+
+	a.Version = ipa.Version
+	a.Interface = ipa.Interface
+	a.Address = net.IPNet(ipa.Address)
+	a.Gateway = ipa.Gateway
+	return nil
+}
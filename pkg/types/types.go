@@ -16,6 +16,7 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -55,31 +56,145 @@ func (n *IPNet) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// NetConf describes a network.
+// NetConf describes a network. It holds the fields common to every
+// plugin's configuration and is meant to be embedded in plugin-specific
+// config structs, so that a single json.Unmarshal fills in both.
 type NetConf struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+
 	Name string `json:"name,omitempty"`
 	Type string `json:"type,omitempty"`
 	IPAM struct {
 		Type string `json:"type,omitempty"`
 	} `json:"ipam,omitempty"`
 	DNS DNS `json:"dns"`
+
+	// Capabilities lists the runtime data the plugin accepts in its
+	// runtimeConfig
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+
+	// PrevResult is the result of the preceding plugin of a network
+	// configuration list, in the layout of CNIVersion. It is kept as is;
+	// ParsePrevResult decodes it.
+	PrevResult json.RawMessage `json:"prevResult,omitempty"`
+}
+
+// ParsePrevResult decodes PrevResult as a result of the config's
+// cniVersion. It returns nil if the config has no prevResult.
+func (c *NetConf) ParsePrevResult() (Result, error) {
+	if len(c.PrevResult) == 0 || string(c.PrevResult) == "null" {
+		return nil, nil
+	}
+
+	result, err := NewResult(c.CNIVersion, c.PrevResult)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+	}
+	return result, nil
 }
 
-// Result is what gets returned from the plugin (via stdout) to the caller
-type Result struct {
+// Result is what a plugin prints on stdout on a successful ADD. Its
+// layout depends on the version of the spec; see Result010 and
+// Result020.
+type Result interface {
+	// Version returns the spec version of the result's layout.
+	Version() string
+
+	// GetAsVersion returns the result converted to the given version.
+	GetAsVersion(version string) (Result, error)
+
+	// Print writes the result as JSON to stdout.
+	Print() error
+
+	// String returns a short human readable form of the result.
+	String() string
+}
+
+// NewResult decodes data as a result in the layout of spec version
+// cniVersion. An empty version is 0.1.0, which predates the field.
+func NewResult(cniVersion string, data []byte) (Result, error) {
+	var result Result
+	switch cniVersion {
+	case "", "0.1.0":
+		result = &Result010{}
+	case "0.2.0":
+		result = &Result020{}
+	default:
+		return nil, fmt.Errorf("unsupported result version %q", cniVersion)
+	}
+
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Result010 is the result layout of spec version 0.1.0: at most one
+// IPv4 and one IPv6 configuration, each with its own routes. Most
+// plugins in this repository build one and print it with PrintResult in
+// the version of their configuration.
+type Result010 struct {
 	IP4 *IPConfig `json:"ip4,omitempty"`
 	IP6 *IPConfig `json:"ip6,omitempty"`
 	DNS DNS       `json:"dns,omitempty"`
 }
 
-func (r *Result) Print() error {
-	return prettyPrint(r)
+func (r *Result010) Version() string {
+	return "0.1.0"
+}
+
+// GetAsVersion returns r itself for 0.1.0, and for 0.2.0 the same
+// addresses, routes and DNS settings as a Result020.
+func (r *Result010) GetAsVersion(version string) (Result, error) {
+	switch version {
+	case "0.1.0":
+		return r, nil
+	case "0.2.0":
+		return r.to020(), nil
+	}
+	return nil, fmt.Errorf("cannot convert a %s result to version %q", r.Version(), version)
+}
+
+func (r *Result010) to020() *Result020 {
+	res := &Result020{
+		CNIVersion: "0.2.0",
+		DNS:        r.DNS,
+	}
+	for _, ipc := range r.IPConfigs() {
+		version := "4"
+		if ipc.IP.IP.To4() == nil {
+			version = "6"
+		}
+		res.IPs = append(res.IPs, &IPAddress{
+			Version: version,
+			Address: ipc.IP,
+			Gateway: ipc.Gateway,
+		})
+		res.Routes = append(res.Routes, ipc.Routes...)
+	}
+	return res
+}
+
+func (r *Result010) Print() error {
+	return printJSON(r)
+}
+
+// IPConfigs returns the IP configurations that are set, IPv4 first.
+func (r *Result010) IPConfigs() []*IPConfig {
+	var ipcs []*IPConfig
+	if r.IP4 != nil {
+		ipcs = append(ipcs, r.IP4)
+	}
+	if r.IP6 != nil {
+		ipcs = append(ipcs, r.IP6)
+	}
+	return ipcs
 }
 
 // String returns a formatted string in the form of "[IP4: $1,][ IP6: $2,] DNS: $3" where
 // $1 represents the receiver's IPv4, $2 represents the receiver's IPv6 and $3 the
 // receiver's DNS. If $1 or $2 are nil, they won't be present in the returned string.
-func (r *Result) String() string {
+func (r *Result010) String() string {
 	var str string
 	if r.IP4 != nil {
 		str = fmt.Sprintf("IP4:%+v, ", *r.IP4)
@@ -90,6 +205,32 @@ func (r *Result) String() string {
 	return fmt.Sprintf("%sDNS:%+v", str, r.DNS)
 }
 
+// GetResult010 returns r as a Result010, converting it if needed.
+func GetResult010(r Result) (*Result010, error) {
+	conv, err := r.GetAsVersion("0.1.0")
+	if err != nil {
+		return nil, err
+	}
+	res, ok := conv.(*Result010)
+	if !ok {
+		return nil, fmt.Errorf("cannot convert a %s result to version 0.1.0", r.Version())
+	}
+	return res, nil
+}
+
+// PrintResult writes r to stdout in the layout of spec version
+// cniVersion, converting it if needed. An empty version is 0.1.0.
+func PrintResult(r Result, cniVersion string) error {
+	if cniVersion == "" {
+		cniVersion = "0.1.0"
+	}
+	result, err := r.GetAsVersion(cniVersion)
+	if err != nil {
+		return err
+	}
+	return result.Print()
+}
+
 // IPConfig contains values necessary to configure an interface
 type IPConfig struct {
 	IP      net.IPNet
@@ -110,6 +251,24 @@ type Route struct {
 	GW  net.IP
 }
 
+// Well-known error codes, see the "Well-known Error Codes" section of SPEC.md.
+// Codes 0-99 are reserved for these; plugins may use 100 and above.
+const (
+	ErrIncompatibleCNIVersion      uint = 1
+	ErrUnsupportedField            uint = 2
+	ErrUnknownContainer            uint = 3
+	ErrInvalidEnvironmentVariables uint = 4
+	ErrIOFailure                   uint = 5
+	ErrDecodingFailure             uint = 6
+	ErrInvalidNetworkConfig        uint = 7
+	ErrTryAgainLater               uint = 11
+
+	// ErrInternal is the generic code used for errors without a
+	// more specific well-known code.
+	ErrInternal uint = 100
+)
+
+// Error is the JSON object a plugin prints on stdout when it fails.
 type Error struct {
 	Code    uint   `json:"code"`
 	Msg     string `json:"msg"`
@@ -121,7 +280,69 @@ func (e *Error) Error() string {
 }
 
 func (e *Error) Print() error {
-	return prettyPrint(e)
+	return printJSON(e)
+}
+
+// Retryable reports whether the plugin marked the failure as transient,
+// i.e. whether running it again later may succeed.
+func (e *Error) Retryable() bool {
+	return e.Code == ErrTryAgainLater
+}
+
+// IsRetryable reports whether err is, or wraps, an *Error that is
+// Retryable.
+func IsRetryable(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Retryable()
+}
+
+// NewError returns an Error with the given code, message and details.
+func NewError(code uint, msg, details string) *Error {
+	return &Error{
+		Code:    code,
+		Msg:     msg,
+		Details: details,
+	}
+}
+
+// NewIncompatibleCNIVersionError reports a cniVersion the plugin cannot handle.
+func NewIncompatibleCNIVersionError(msg, details string) *Error {
+	return NewError(ErrIncompatibleCNIVersion, msg, details)
+}
+
+// NewUnsupportedFieldError reports a network config field the plugin does not support.
+func NewUnsupportedFieldError(field, details string) *Error {
+	return NewError(ErrUnsupportedField, fmt.Sprintf("unsupported field %q", field), details)
+}
+
+// NewUnknownContainerError reports a container ID the plugin knows nothing about.
+func NewUnknownContainerError(containerID, details string) *Error {
+	return NewError(ErrUnknownContainer, fmt.Sprintf("unknown container %q", containerID), details)
+}
+
+// NewInvalidEnvironmentVariablesError reports missing or malformed CNI_* variables.
+func NewInvalidEnvironmentVariablesError(msg, details string) *Error {
+	return NewError(ErrInvalidEnvironmentVariables, msg, details)
+}
+
+// NewIOFailureError reports a failure to read or write plugin input or output.
+func NewIOFailureError(msg, details string) *Error {
+	return NewError(ErrIOFailure, msg, details)
+}
+
+// NewDecodingFailureError reports input that could not be decoded.
+func NewDecodingFailureError(msg, details string) *Error {
+	return NewError(ErrDecodingFailure, msg, details)
+}
+
+// NewInvalidNetworkConfigError reports a network config that failed validation.
+func NewInvalidNetworkConfigError(msg, details string) *Error {
+	return NewError(ErrInvalidNetworkConfig, msg, details)
+}
+
+// NewTryAgainLaterError reports a transient condition; the runtime may retry.
+func NewTryAgainLaterError(msg, details string) *Error {
+	return NewError(ErrTryAgainLater, msg, details)
 }
 
 // net.IPNet is not JSON (un)marshallable so this duality is needed
@@ -181,8 +402,16 @@ func (r *Route) MarshalJSON() ([]byte, error) {
 	return json.Marshal(rt)
 }
 
-func prettyPrint(obj interface{}) error {
-	data, err := json.MarshalIndent(obj, "", "    ")
+// printJSON writes obj to stdout as JSON, on a single line unless
+// CNI_OUTPUT_FORMAT is "pretty".
+func printJSON(obj interface{}) error {
+	var data []byte
+	var err error
+	if os.Getenv("CNI_OUTPUT_FORMAT") == "pretty" {
+		data, err = json.MarshalIndent(obj, "", "    ")
+	} else {
+		data, err = json.Marshal(obj)
+	}
 	if err != nil {
 		return err
 	}
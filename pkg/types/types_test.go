@@ -0,0 +1,535 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	. "github.com/appc/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Error", func() {
+	It("marshals to the JSON object described by the spec", func() {
+		data, err := json.Marshal(NewError(ErrTryAgainLater, "some message", "some details"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+			"code": 11,
+			"msg": "some message",
+			"details": "some details"
+		}`))
+	})
+
+	It("omits empty details", func() {
+		data, err := json.Marshal(NewError(ErrInternal, "some message", ""))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{ "code": 100, "msg": "some message" }`))
+	})
+
+	It("round-trips through json.Unmarshal", func() {
+		original := NewError(ErrDecodingFailure, "some message", "some details")
+		data, err := json.Marshal(original)
+		Expect(err).NotTo(HaveOccurred())
+
+		decoded := &Error{}
+		Expect(json.Unmarshal(data, decoded)).To(Succeed())
+		Expect(decoded).To(Equal(original))
+	})
+
+	It("uses the message as the error string", func() {
+		var err error = NewError(ErrInternal, "some message", "some details")
+		Expect(err.Error()).To(Equal("some message"))
+	})
+
+	DescribeTable("constructors for well-known codes",
+		func(e *Error, code uint) {
+			Expect(e.Code).To(Equal(code))
+		},
+		Entry("incompatible CNI version", NewIncompatibleCNIVersionError("m", "d"), uint(1)),
+		Entry("unsupported field", NewUnsupportedFieldError("f", "d"), uint(2)),
+		Entry("unknown container", NewUnknownContainerError("c", "d"), uint(3)),
+		Entry("invalid env vars", NewInvalidEnvironmentVariablesError("m", "d"), uint(4)),
+		Entry("I/O failure", NewIOFailureError("m", "d"), uint(5)),
+		Entry("decoding failure", NewDecodingFailureError("m", "d"), uint(6)),
+		Entry("invalid network config", NewInvalidNetworkConfigError("m", "d"), uint(7)),
+		Entry("try again later", NewTryAgainLaterError("m", "d"), uint(11)),
+	)
+
+	It("is retryable only when the plugin asks to try again later", func() {
+		Expect(NewTryAgainLaterError("m", "d").Retryable()).To(BeTrue())
+		Expect(NewInvalidNetworkConfigError("m", "d").Retryable()).To(BeFalse())
+		Expect(NewError(ErrInternal, "m", "d").Retryable()).To(BeFalse())
+	})
+
+	It("finds a retryable error wrapped in another", func() {
+		Expect(IsRetryable(NewTryAgainLaterError("m", "d"))).To(BeTrue())
+		Expect(IsRetryable(fmt.Errorf("context: %w", NewTryAgainLaterError("m", "d")))).To(BeTrue())
+		Expect(IsRetryable(fmt.Errorf("context: %v", NewTryAgainLaterError("m", "d")))).To(BeFalse())
+		Expect(IsRetryable(errors.New("m"))).To(BeFalse())
+		Expect(IsRetryable(nil)).To(BeFalse())
+	})
+
+	It("names the offending field and container in the message", func() {
+		Expect(NewUnsupportedFieldError("mtu", "").Msg).To(Equal(`unsupported field "mtu"`))
+		Expect(NewUnknownContainerError("abc", "").Msg).To(Equal(`unknown container "abc"`))
+	})
+})
+
+var _ = Describe("NetConf", func() {
+	type bridgeConf struct {
+		NetConf
+		BrName string `json:"bridge"`
+		IsGW   bool   `json:"isGateway"`
+		MTU    int    `json:"mtu"`
+	}
+
+	It("unmarshals the common and plugin-specific fields in one pass when embedded", func() {
+		conf := bridgeConf{}
+		err := json.Unmarshal([]byte(`{
+			"cniVersion": "0.1.0",
+			"name": "mynet",
+			"type": "bridge",
+			"bridge": "cni0",
+			"isGateway": true,
+			"mtu": 1400,
+			"ipam": { "type": "host-local", "subnet": "10.1.0.0/16" },
+			"dns": { "nameservers": ["10.1.0.1"] }
+		}`), &conf)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(conf.CNIVersion).To(Equal("0.1.0"))
+		Expect(conf.Name).To(Equal("mynet"))
+		Expect(conf.Type).To(Equal("bridge"))
+		Expect(conf.IPAM.Type).To(Equal("host-local"))
+		Expect(conf.DNS.Nameservers).To(Equal([]string{"10.1.0.1"}))
+
+		Expect(conf.BrName).To(Equal("cni0"))
+		Expect(conf.IsGW).To(BeTrue())
+		Expect(conf.MTU).To(Equal(1400))
+	})
+})
+
+var _ = Describe("prevResult", func() {
+	It("parses into the result of the config's version and marshals back unchanged", func() {
+		data := []byte(`{
+			"cniVersion": "0.2.0",
+			"name": "mynet",
+			"type": "tuning",
+			"ipam": {},
+			"dns": {},
+			"prevResult": {
+				"cniVersion": "0.2.0",
+				"interfaces": [ { "name": "eth0", "sandbox": "/var/run/netns/blue" } ],
+				"ips": [ { "version": "4", "interface": 0, "address": "10.1.2.3/24", "gateway": "10.1.2.1" } ],
+				"routes": [ { "dst": "0.0.0.0/0" } ],
+				"dns": { "nameservers": [ "10.1.2.1" ] }
+			}
+		}`)
+
+		conf := &NetConf{}
+		Expect(json.Unmarshal(data, conf)).To(Succeed())
+
+		result, err := conf.ParsePrevResult()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Version()).To(Equal("0.2.0"))
+		res := result.(*Result020)
+		Expect(res.Interfaces[0].Name).To(Equal("eth0"))
+		Expect(*res.IPs[0].Interface).To(Equal(0))
+		Expect(res.IPs[0].Address.String()).To(Equal("10.1.2.3/24"))
+		Expect(res.DNS.Nameservers).To(Equal([]string{"10.1.2.1"}))
+
+		emitted, err := json.Marshal(conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(emitted).To(MatchJSON(data))
+
+		reparsed, err := json.Marshal(result)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reparsed).To(MatchJSON(conf.PrevResult))
+	})
+
+	It("parses a 0.1.0 prevResult", func() {
+		conf := &NetConf{}
+		Expect(json.Unmarshal([]byte(`{
+			"name": "mynet",
+			"type": "tuning",
+			"prevResult": { "ip4": { "ip": "10.1.2.3/24" } }
+		}`), conf)).To(Succeed())
+
+		result, err := conf.ParsePrevResult()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.(*Result010).IP4.IP.String()).To(Equal("10.1.2.3/24"))
+	})
+
+	It("is nil when the config has none", func() {
+		conf := &NetConf{}
+		Expect(json.Unmarshal([]byte(`{"name": "mynet", "type": "tuning"}`), conf)).To(Succeed())
+
+		result, err := conf.ParsePrevResult()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeNil())
+
+		emitted, err := json.Marshal(conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(emitted)).NotTo(ContainSubstring("prevResult"))
+	})
+
+	It("fails for a config version without a result layout", func() {
+		conf := &NetConf{CNIVersion: "0.9.0", PrevResult: json.RawMessage(`{}`)}
+
+		_, err := conf.ParsePrevResult()
+		Expect(err).To(MatchError(`failed to parse prevResult: unsupported result version "0.9.0"`))
+	})
+})
+
+var _ = Describe("NewResult", func() {
+	It("decodes the layout of the given version", func() {
+		result, err := NewResult("", []byte(`{"ip4": {"ip": "10.1.2.3/24"}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeAssignableToTypeOf(&Result010{}))
+
+		result, err = NewResult("0.2.0", []byte(`{"cniVersion": "0.2.0", "ips": [{"version": "4", "address": "10.1.2.3/24"}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeAssignableToTypeOf(&Result020{}))
+	})
+
+	It("fails for malformed data", func() {
+		_, err := NewResult("0.1.0", []byte(`{"ip4": 5}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Result010", func() {
+	var (
+		result     *Result010
+		goldenJSON string
+	)
+
+	BeforeEach(func() {
+		mustParse := func(s string) net.IPNet {
+			ipn, err := ParseCIDR(s)
+			Expect(err).NotTo(HaveOccurred())
+			return *ipn
+		}
+
+		result = &Result010{
+			IP4: &IPConfig{
+				IP:      mustParse("10.1.2.3/24"),
+				Gateway: net.ParseIP("10.1.2.1"),
+				Routes: []Route{
+					{Dst: mustParse("0.0.0.0/0")},
+					{Dst: mustParse("192.168.0.0/16"), GW: net.ParseIP("10.1.2.254")},
+				},
+			},
+			IP6: &IPConfig{
+				IP:      mustParse("abcd:1234:ffff::cdde/64"),
+				Gateway: net.ParseIP("abcd:1234:ffff::1"),
+				Routes: []Route{
+					{Dst: mustParse("::/0")},
+					{Dst: mustParse("1111:dddd::/80"), GW: net.ParseIP("abcd:1234:ffff::fe")},
+				},
+			},
+			DNS: DNS{
+				Nameservers: []string{"1.2.3.4", "1::cafe"},
+				Domain:      "acompany.com",
+				Search:      []string{"somedomain.com", "otherdomain.net"},
+				Options:     []string{"foo", "bar"},
+			},
+		}
+
+		goldenJSON = `{
+			"ip4": {
+				"ip": "10.1.2.3/24",
+				"gateway": "10.1.2.1",
+				"routes": [
+					{ "dst": "0.0.0.0/0" },
+					{ "dst": "192.168.0.0/16", "gw": "10.1.2.254" }
+				]
+			},
+			"ip6": {
+				"ip": "abcd:1234:ffff::cdde/64",
+				"gateway": "abcd:1234:ffff::1",
+				"routes": [
+					{ "dst": "::/0" },
+					{ "dst": "1111:dddd::/80", "gw": "abcd:1234:ffff::fe" }
+				]
+			},
+			"dns": {
+				"nameservers": [ "1.2.3.4", "1::cafe" ],
+				"domain": "acompany.com",
+				"search": [ "somedomain.com", "otherdomain.net" ],
+				"options": [ "foo", "bar" ]
+			}
+		}`
+	})
+
+	It("marshals to the golden JSON", func() {
+		data, err := json.Marshal(result)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(goldenJSON))
+	})
+
+	It("unmarshals the golden JSON back into an equal Result", func() {
+		decoded := &Result010{}
+		Expect(json.Unmarshal([]byte(goldenJSON), decoded)).To(Succeed())
+
+		data, err := json.Marshal(decoded)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(goldenJSON))
+
+		Expect(decoded.IP4.IP.String()).To(Equal("10.1.2.3/24"))
+		Expect(decoded.IP4.Gateway.Equal(result.IP4.Gateway)).To(BeTrue())
+		Expect(decoded.IP6.Routes).To(HaveLen(2))
+		Expect(decoded.IP6.Routes[1].GW.Equal(result.IP6.Routes[1].GW)).To(BeTrue())
+		Expect(decoded.DNS).To(Equal(result.DNS))
+	})
+
+	Describe("Print", func() {
+		printed := func(format string) string {
+			os.Setenv("CNI_OUTPUT_FORMAT", format)
+			defer os.Unsetenv("CNI_OUTPUT_FORMAT")
+
+			r, w, err := os.Pipe()
+			Expect(err).NotTo(HaveOccurred())
+			defer r.Close()
+			stdout := os.Stdout
+			os.Stdout = w
+			printErr := result.Print()
+			os.Stdout = stdout
+			w.Close()
+			Expect(printErr).NotTo(HaveOccurred())
+
+			data, err := ioutil.ReadAll(r)
+			Expect(err).NotTo(HaveOccurred())
+			return string(data)
+		}
+
+		It("prints on a single line by default", func() {
+			out := printed("")
+			Expect(out).NotTo(ContainSubstring("\n"))
+			Expect(out).To(MatchJSON(goldenJSON))
+			Expect(printed("compact")).To(Equal(out))
+		})
+
+		It("indents the output when CNI_OUTPUT_FORMAT is pretty", func() {
+			out := printed("pretty")
+			Expect(out).To(ContainSubstring("\n    \"ip4\": {\n"))
+			Expect(out).To(MatchJSON(goldenJSON))
+		})
+
+		It("prints the same result in both formats", func() {
+			compact, pretty := &Result010{}, &Result010{}
+			Expect(json.Unmarshal([]byte(printed("compact")), compact)).To(Succeed())
+			Expect(json.Unmarshal([]byte(printed("pretty")), pretty)).To(Succeed())
+			Expect(pretty).To(Equal(compact))
+		})
+	})
+
+	It("lists the configs that are set, IPv4 first", func() {
+		Expect(result.IPConfigs()).To(Equal([]*IPConfig{result.IP4, result.IP6}))
+
+		result.IP4 = nil
+		Expect(result.IPConfigs()).To(Equal([]*IPConfig{result.IP6}))
+		Expect((&Result010{}).IPConfigs()).To(BeEmpty())
+	})
+
+	It("marshals an empty Result without addresses", func() {
+		data, err := json.Marshal(&Result010{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{ "dns": {} }`))
+	})
+
+	Describe("GetAsVersion", func() {
+		It("returns the result itself for 0.1.0", func() {
+			conv, err := result.GetAsVersion("0.1.0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conv == Result(result)).To(BeTrue())
+		})
+
+		It("maps the addresses, routes and DNS settings to a 0.2.0 result", func() {
+			conv, err := result.GetAsVersion("0.2.0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conv.Version()).To(Equal("0.2.0"))
+
+			res := conv.(*Result020)
+			Expect(res.CNIVersion).To(Equal("0.2.0"))
+			Expect(res.Interfaces).To(BeEmpty())
+			Expect(res.IPs).To(Equal([]*IPAddress{
+				{Version: "4", Address: result.IP4.IP, Gateway: result.IP4.Gateway},
+				{Version: "6", Address: result.IP6.IP, Gateway: result.IP6.Gateway},
+			}))
+			Expect(res.Routes).To(Equal(append(append([]Route{}, result.IP4.Routes...), result.IP6.Routes...)))
+			Expect(res.DNS).To(Equal(result.DNS))
+
+			data, err := json.Marshal(res)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(MatchJSON(`{
+				"cniVersion": "0.2.0",
+				"ips": [
+					{ "version": "4", "address": "10.1.2.3/24", "gateway": "10.1.2.1" },
+					{ "version": "6", "address": "abcd:1234:ffff::cdde/64", "gateway": "abcd:1234:ffff::1" }
+				],
+				"routes": [
+					{ "dst": "0.0.0.0/0" },
+					{ "dst": "192.168.0.0/16", "gw": "10.1.2.254" },
+					{ "dst": "::/0" },
+					{ "dst": "1111:dddd::/80", "gw": "abcd:1234:ffff::fe" }
+				],
+				"dns": {
+					"nameservers": [ "1.2.3.4", "1::cafe" ],
+					"domain": "acompany.com",
+					"search": [ "somedomain.com", "otherdomain.net" ],
+					"options": [ "foo", "bar" ]
+				}
+			}`))
+		})
+
+		It("converts back from 0.2.0 to an equal result", func() {
+			conv, err := result.GetAsVersion("0.2.0")
+			Expect(err).NotTo(HaveOccurred())
+
+			back, err := GetResult010(conv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(back).To(Equal(result))
+		})
+
+		It("fails for an unknown version", func() {
+			_, err := result.GetAsVersion("0.9.0")
+			Expect(err).To(MatchError(`cannot convert a 0.1.0 result to version "0.9.0"`))
+		})
+	})
+})
+
+var _ = Describe("Result020", func() {
+	It("keeps only the first address of each family in 0.1.0", func() {
+		result := &Result020{}
+		Expect(json.Unmarshal([]byte(`{
+			"cniVersion": "0.2.0",
+			"interfaces": [ { "name": "eth0", "mac": "aa:bb:cc:dd:ee:ff", "sandbox": "/var/run/netns/blue" } ],
+			"ips": [
+				{ "version": "4", "interface": 0, "address": "10.1.2.3/24", "gateway": "10.1.2.1" },
+				{ "version": "4", "interface": 0, "address": "10.1.3.3/24" },
+				{ "version": "6", "interface": 0, "address": "2001:db8::3/64" }
+			],
+			"routes": [
+				{ "dst": "0.0.0.0/0", "gw": "10.1.2.1" },
+				{ "dst": "2001:db8:1::/48" }
+			]
+		}`), result)).To(Succeed())
+		Expect(*result.IPs[0].Interface).To(Equal(0))
+		Expect(result.Interfaces[0].Sandbox).To(Equal("/var/run/netns/blue"))
+
+		res, err := GetResult010(result)
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := json.Marshal(res)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+			"ip4": {
+				"ip": "10.1.2.3/24",
+				"gateway": "10.1.2.1",
+				"routes": [ { "dst": "0.0.0.0/0", "gw": "10.1.2.1" } ]
+			},
+			"ip6": {
+				"ip": "2001:db8::3/64",
+				"routes": [ { "dst": "2001:db8:1::/48" } ]
+			},
+			"dns": {}
+		}`))
+	})
+
+	It("fails for an unknown version", func() {
+		_, err := (&Result020{}).GetAsVersion("0.3.0")
+		Expect(err).To(MatchError(`cannot convert a 0.2.0 result to version "0.3.0"`))
+	})
+})
+
+var _ = Describe("PrintResult", func() {
+	printed := func(r Result, cniVersion string) (string, error) {
+		rd, w, err := os.Pipe()
+		Expect(err).NotTo(HaveOccurred())
+		defer rd.Close()
+		stdout := os.Stdout
+		os.Stdout = w
+		printErr := PrintResult(r, cniVersion)
+		os.Stdout = stdout
+		w.Close()
+
+		data, err := ioutil.ReadAll(rd)
+		Expect(err).NotTo(HaveOccurred())
+		return string(data), printErr
+	}
+
+	result := &Result010{IP4: &IPConfig{IP: net.IPNet{IP: net.IPv4(10, 1, 2, 3), Mask: net.CIDRMask(24, 32)}}}
+
+	It("prints a 0.1.0 result for a config without a version", func() {
+		out, err := printed(result, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(MatchJSON(`{"ip4": {"ip": "10.1.2.3/24"}, "dns": {}}`))
+	})
+
+	It("converts the result to the version of the config", func() {
+		out, err := printed(result, "0.2.0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(MatchJSON(`{
+			"cniVersion": "0.2.0",
+			"ips": [{"version": "4", "address": "10.1.2.3/24"}],
+			"dns": {}
+		}`))
+	})
+
+	It("fails for a version it cannot convert to", func() {
+		out, err := printed(result, "0.3.0")
+		Expect(err).To(MatchError(`cannot convert a 0.1.0 result to version "0.3.0"`))
+		Expect(out).To(BeEmpty())
+	})
+})
+
+var _ = Describe("IPNet", func() {
+	It("marshals the assigned host address rather than the network address", func() {
+		ipn, err := ParseCIDR("10.0.0.5/24")
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := json.Marshal(IPNet(*ipn))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`"10.0.0.5/24"`))
+	})
+
+	It("keeps the host address when unmarshalling", func() {
+		var ipn IPNet
+		Expect(json.Unmarshal([]byte(`"10.0.0.5/24"`), &ipn)).To(Succeed())
+
+		Expect(ipn.IP.Equal(net.ParseIP("10.0.0.5"))).To(BeTrue())
+		ones, bits := ipn.Mask.Size()
+		Expect(ones).To(Equal(24))
+		Expect(bits).To(Equal(32))
+	})
+
+	It("round-trips an IPv6 host address", func() {
+		var ipn IPNet
+		Expect(json.Unmarshal([]byte(`"2001:db8::5/64"`), &ipn)).To(Succeed())
+
+		data, err := json.Marshal(ipn)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`"2001:db8::5/64"`))
+	})
+})
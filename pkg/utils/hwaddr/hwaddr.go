@@ -0,0 +1,76 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hwaddr
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+const ipRelevantByteLen = 4
+
+// PrivateMACPrefix is a locally administered, unicast MAC prefix
+// suitable for use with GenerateHardwareAddr4.
+var PrivateMACPrefix = []byte{0x0a, 0x58}
+
+// SupportIp4OnlyErr is returned when an address other than IPv4 is
+// passed to GenerateHardwareAddr4.
+type SupportIp4OnlyErr struct{ msg string }
+
+func (e SupportIp4OnlyErr) Error() string { return e.msg }
+
+// InvalidPrefixLengthErr is returned when the prefix passed to
+// GenerateHardwareAddr4 is not exactly two bytes long.
+type InvalidPrefixLengthErr struct{ msg string }
+
+func (e InvalidPrefixLengthErr) Error() string { return e.msg }
+
+// GenerateHardwareAddr4 generates a 6-byte MAC address from the 2-byte
+// prefix followed by the 4 bytes of the IPv4 address ip, so that an
+// interface recreated with the same address gets the same MAC.
+func GenerateHardwareAddr4(ip net.IP, prefix []byte) (net.HardwareAddr, error) {
+	ip4 := ip.To4()
+	switch {
+	case ip4 == nil:
+		return nil, SupportIp4OnlyErr{msg: fmt.Sprintf("GenerateHardwareAddr4 only supports valid IPv4 addresses, got %v", ip)}
+	case len(prefix) != len(PrivateMACPrefix):
+		return nil, InvalidPrefixLengthErr{msg: fmt.Sprintf("prefix has length %d instead of %d", len(prefix), len(PrivateMACPrefix))}
+	}
+
+	hwAddr := make(net.HardwareAddr, 0, len(prefix)+ipRelevantByteLen)
+	hwAddr = append(hwAddr, prefix...)
+	return append(hwAddr, ip4...), nil
+}
+
+// ParseUnicast parses s as the MAC address of an ethernet interface. It
+// refuses multicast (and so broadcast) addresses and the all-zero
+// address, which no interface can have.
+func ParseUnicast(s string) (net.HardwareAddr, error) {
+	hwAddr, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mac %q: %v", s, err)
+	}
+
+	switch {
+	case len(hwAddr) != 6:
+		return nil, fmt.Errorf("invalid mac %q: not an ethernet address", s)
+	case hwAddr[0]&0x01 != 0:
+		return nil, fmt.Errorf("invalid mac %q: multicast address", s)
+	case bytes.Equal(hwAddr, make(net.HardwareAddr, 6)):
+		return nil, fmt.Errorf("invalid mac %q: all-zero address", s)
+	}
+	return hwAddr, nil
+}
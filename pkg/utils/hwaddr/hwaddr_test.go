@@ -0,0 +1,117 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hwaddr_test
+
+import (
+	"net"
+
+	"github.com/appc/cni/pkg/utils/hwaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hwaddr", func() {
+	Context("Generate Hardware Address", func() {
+		It("generates the hardware address from the prefix and the IPv4 address", func() {
+			testCases := []struct {
+				ip          net.IP
+				expectedMAC net.HardwareAddr
+			}{
+				{
+					ip:          net.ParseIP("10.0.0.2"),
+					expectedMAC: (net.HardwareAddr)(append(hwaddr.PrivateMACPrefix, 0x0a, 0x00, 0x00, 0x02)),
+				},
+				{
+					ip:          net.ParseIP("10.250.0.244"),
+					expectedMAC: (net.HardwareAddr)(append(hwaddr.PrivateMACPrefix, 0x0a, 0xfa, 0x00, 0xf4)),
+				},
+				{
+					ip:          net.IPv4(172, 17, 0, 2).To4(),
+					expectedMAC: (net.HardwareAddr)(append(hwaddr.PrivateMACPrefix, 0xac, 0x11, 0x00, 0x02)),
+				},
+			}
+
+			for _, tc := range testCases {
+				mac, err := hwaddr.GenerateHardwareAddr4(tc.ip, hwaddr.PrivateMACPrefix)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mac).To(Equal(tc.expectedMAC))
+			}
+		})
+
+		It("maps a known IP to a known MAC", func() {
+			mac, err := hwaddr.GenerateHardwareAddr4(net.ParseIP("192.168.1.5"), hwaddr.PrivateMACPrefix)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mac.String()).To(Equal("0a:58:c0:a8:01:05"))
+		})
+
+		It("does not modify the prefix", func() {
+			prefix := make([]byte, 2, 8)
+			copy(prefix, []byte{0x02, 0x42})
+
+			mac1, err := hwaddr.GenerateHardwareAddr4(net.ParseIP("10.0.0.1"), prefix)
+			Expect(err).NotTo(HaveOccurred())
+			mac2, err := hwaddr.GenerateHardwareAddr4(net.ParseIP("10.0.0.2"), prefix)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(mac1.String()).To(Equal("02:42:0a:00:00:01"))
+			Expect(mac2.String()).To(Equal("02:42:0a:00:00:02"))
+		})
+
+		It("returns an error when a non-IPv4 address is given", func() {
+			for _, ip := range []net.IP{net.ParseIP("2001:db8:0:1:1:1:1:1"), nil} {
+				_, err := hwaddr.GenerateHardwareAddr4(ip, hwaddr.PrivateMACPrefix)
+				Expect(err).To(BeAssignableToTypeOf(hwaddr.SupportIp4OnlyErr{}))
+			}
+		})
+
+		It("returns an error when the prefix has the wrong length", func() {
+			for _, prefix := range [][]byte{nil, {0x0a}, {0x0a, 0x58, 0x00}} {
+				_, err := hwaddr.GenerateHardwareAddr4(net.ParseIP("10.0.0.2"), prefix)
+				Expect(err).To(BeAssignableToTypeOf(hwaddr.InvalidPrefixLengthErr{}))
+			}
+		})
+	})
+
+	Context("Parse Unicast", func() {
+		It("accepts locally administered and vendor addresses", func() {
+			for _, s := range []string{"0a:58:0a:00:00:02", "00:16:3e:12:34:56"} {
+				mac, err := hwaddr.ParseUnicast(s)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mac.String()).To(Equal(s))
+			}
+		})
+
+		It("rejects multicast and broadcast addresses", func() {
+			for _, s := range []string{"01:00:5e:00:00:01", "33:33:00:00:00:01", "ff:ff:ff:ff:ff:ff"} {
+				_, err := hwaddr.ParseUnicast(s)
+				Expect(err).To(MatchError(ContainSubstring("multicast address")))
+			}
+		})
+
+		It("rejects the all-zero address", func() {
+			_, err := hwaddr.ParseUnicast("00:00:00:00:00:00")
+			Expect(err).To(MatchError(`invalid mac "00:00:00:00:00:00": all-zero address`))
+		})
+
+		It("rejects addresses that are not ethernet addresses", func() {
+			_, err := hwaddr.ParseUnicast("0a:58:0a:00:00:02:00:01")
+			Expect(err).To(MatchError(ContainSubstring("not an ethernet address")))
+
+			_, err = hwaddr.ParseUnicast("not-a-mac")
+			Expect(err).To(MatchError(ContainSubstring(`invalid mac "not-a-mac"`)))
+		})
+	})
+})
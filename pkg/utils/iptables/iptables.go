@@ -0,0 +1,112 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package iptables has idempotent helpers for the chains and rules that
+// plugins install, so that ADD can be retried and DEL can run after a
+// partial ADD.
+package iptables
+
+import (
+	"fmt"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// DefaultComment is attached to the rules that do not have a comment of
+// their own, to tell where they came from.
+const DefaultComment = "generated by CNI"
+
+// withComment returns rule with DefaultComment attached, unless it
+// already has a comment.
+func withComment(rule []string) []string {
+	for _, arg := range rule {
+		if arg == "--comment" {
+			return rule
+		}
+	}
+	return append(rule[:len(rule):len(rule)], "-m", "comment", "--comment", DefaultComment)
+}
+
+// EnsureChain creates chain in table. It does nothing if the chain
+// exists, and leaves its rules alone.
+func EnsureChain(table, chain string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	if err = ipt.NewChain(table, chain); err != nil {
+		// exit status 1 means the chain exists
+		if e, ok := err.(*iptables.Error); !ok || e.ExitStatus() != 1 {
+			return fmt.Errorf("failed to create chain %s: %v", chain, err)
+		}
+	}
+	return nil
+}
+
+// DeleteChain flushes and deletes chain from table. It succeeds if the
+// chain is missing. Rules jumping to the chain must be deleted first.
+func DeleteChain(table, chain string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	// ClearChain creates the chain if it is missing, so that
+	// DeleteChain succeeds either way
+	if err = ipt.ClearChain(table, chain); err != nil {
+		return fmt.Errorf("failed to flush chain %s: %v", chain, err)
+	}
+	if err = ipt.DeleteChain(table, chain); err != nil {
+		return fmt.Errorf("failed to delete chain %s: %v", chain, err)
+	}
+	return nil
+}
+
+// EnsureRule appends rule to chain in table, with DefaultComment if it
+// has no comment. It does nothing if the rule exists.
+func EnsureRule(table, chain string, rule []string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	if err = ipt.AppendUnique(table, chain, withComment(rule)...); err != nil {
+		return fmt.Errorf("failed to add rule to %s: %v", chain, err)
+	}
+	return nil
+}
+
+// DeleteRule deletes a rule added by EnsureRule from chain in table. It
+// succeeds if the rule or the chain is missing.
+func DeleteRule(table, chain string, rule []string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	rule = withComment(rule)
+	// Exists reports a missing chain as a missing rule
+	exists, err := ipt.Exists(table, chain, rule...)
+	if err != nil {
+		return fmt.Errorf("failed to check rule in %s: %v", chain, err)
+	}
+	if !exists {
+		return nil
+	}
+	if err = ipt.Delete(table, chain, rule...); err != nil {
+		return fmt.Errorf("failed to delete rule from %s: %v", chain, err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/utils/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("iptables helpers", func() {
+	const chain = "CNI-test-chain"
+
+	var (
+		netnsName string
+		netns     *os.File
+	)
+
+	// inNS runs f in a scratch namespace, which has its own iptables
+	// rules; iptables is exec'ed and inherits the namespace of the thread
+	inNS := func(f func()) {
+		err := ns.WithNetNS(netns, true, func(_ *os.File) error {
+			f()
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	// list returns the rules of chain in the nat table, or nil if the
+	// chain is missing
+	list := func(chain string) []string {
+		out, err := exec.Command("iptables", "-t", "nat", "-S", chain).CombinedOutput()
+		if err != nil {
+			return nil
+		}
+		return strings.Split(strings.TrimSpace(string(out)), "\n")
+	}
+
+	BeforeEach(func() {
+		if _, err := exec.LookPath("iptables"); err != nil {
+			Skip("iptables not available")
+		}
+
+		var err error
+		netnsName = fmt.Sprintf("test-iptables-netns-%d", rand.Int())
+		netns, err = ns.CreateNetNS(netnsName)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if netns == nil {
+			return
+		}
+		Expect(netns.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(netnsName)).To(Succeed())
+		netns = nil
+	})
+
+	It("adds a rule once with a comment and deletes it", func() {
+		rule := []string{"-d", "10.0.0.0/8", "-j", "ACCEPT"}
+
+		inNS(func() {
+			Expect(iptables.EnsureChain("nat", chain)).To(Succeed())
+			Expect(iptables.EnsureRule("nat", chain, rule)).To(Succeed())
+			Expect(iptables.EnsureRule("nat", chain, rule)).To(Succeed())
+
+			Expect(list(chain)).To(Equal([]string{
+				"-N " + chain,
+				"-A " + chain + ` -d 10.0.0.0/8 -m comment --comment "generated by CNI" -j ACCEPT`,
+			}))
+
+			Expect(iptables.DeleteRule("nat", chain, rule)).To(Succeed())
+			Expect(list(chain)).To(Equal([]string{"-N " + chain}))
+
+			By("deleting it again")
+			Expect(iptables.DeleteRule("nat", chain, rule)).To(Succeed())
+		})
+	})
+
+	It("keeps a comment the rule has", func() {
+		rule := []string{"-j", "ACCEPT", "-m", "comment", "--comment", "mine"}
+
+		inNS(func() {
+			Expect(iptables.EnsureChain("nat", chain)).To(Succeed())
+			Expect(iptables.EnsureRule("nat", chain, rule)).To(Succeed())
+			Expect(list(chain)).To(ContainElement("-A " + chain + " -m comment --comment mine -j ACCEPT"))
+
+			Expect(iptables.DeleteRule("nat", chain, rule)).To(Succeed())
+			Expect(list(chain)).To(Equal([]string{"-N " + chain}))
+		})
+	})
+
+	It("creates a chain once and keeps its rules", func() {
+		rule := []string{"-j", "ACCEPT"}
+
+		inNS(func() {
+			Expect(iptables.EnsureChain("nat", chain)).To(Succeed())
+			Expect(iptables.EnsureRule("nat", chain, rule)).To(Succeed())
+			Expect(iptables.EnsureChain("nat", chain)).To(Succeed())
+			Expect(list(chain)).To(HaveLen(2))
+		})
+	})
+
+	It("flushes and deletes a chain, and succeeds when it is missing", func() {
+		inNS(func() {
+			Expect(iptables.EnsureChain("nat", chain)).To(Succeed())
+			Expect(iptables.EnsureRule("nat", chain, []string{"-j", "ACCEPT"})).To(Succeed())
+
+			Expect(iptables.DeleteChain("nat", chain)).To(Succeed())
+			Expect(list(chain)).To(BeNil())
+
+			Expect(iptables.DeleteChain("nat", chain)).To(Succeed())
+		})
+	})
+
+	It("succeeds in deleting a rule from a missing chain", func() {
+		inNS(func() {
+			Expect(iptables.DeleteRule("nat", chain, []string{"-j", "ACCEPT"})).To(Succeed())
+		})
+	})
+})
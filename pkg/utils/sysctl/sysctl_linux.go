@@ -0,0 +1,70 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Sysctl reads the kernel parameter name from /proc/sys or, when a value
+// is passed as well, writes it first. Either way the resulting value is
+// returned, with surrounding whitespace trimmed.
+//
+// As with sysctl(8), dots and slashes in name are swapped when mapping it
+// to a path, so an interface name containing dots is written with slashes:
+// "net.ipv4.conf.eth0/100.rp_filter" refers to
+// /proc/sys/net/ipv4/conf/eth0.100/rp_filter.
+func Sysctl(name string, params ...string) (string, error) {
+	if len(params) > 1 {
+		return "", fmt.Errorf("unexpected additional parameters")
+	} else if len(params) == 1 {
+		return setSysctl(name, params[0])
+	}
+	return getSysctl(name)
+}
+
+// Path returns the file under /proc/sys backing the sysctl name.
+func Path(name string) string {
+	swapped := strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '/':
+			return '.'
+		}
+		return r
+	}, name)
+	return filepath.Join("/proc/sys", swapped)
+}
+
+func getSysctl(name string) (string, error) {
+	data, err := ioutil.ReadFile(Path(name))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func setSysctl(name, value string) (string, error) {
+	if err := ioutil.WriteFile(Path(name), []byte(value), 0644); err != nil {
+		return "", err
+	}
+
+	return getSysctl(name)
+}
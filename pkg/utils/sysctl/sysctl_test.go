@@ -0,0 +1,149 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysctl_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sysctl", func() {
+	It("maps dotted names to paths under /proc/sys", func() {
+		Expect(sysctl.Path("net.ipv4.conf.eth0.rp_filter")).To(Equal("/proc/sys/net/ipv4/conf/eth0/rp_filter"))
+	})
+
+	It("maps slashes to dots for interface names containing dots", func() {
+		Expect(sysctl.Path("net.ipv4.conf.eth0/100.rp_filter")).To(Equal("/proc/sys/net/ipv4/conf/eth0.100/rp_filter"))
+	})
+
+	It("reads a sysctl", func() {
+		expected, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
+		Expect(err).NotTo(HaveOccurred())
+
+		value, err := sysctl.Sysctl("net.ipv4.ip_forward")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal(strings.TrimSpace(string(expected))))
+	})
+
+	It("fails to read a sysctl that does not exist", func() {
+		_, err := sysctl.Sysctl("net.ipv4.no_such_sysctl")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("refuses more than one value", func() {
+		_, err := sysctl.Sysctl("net.ipv4.ip_forward", "1", "0")
+		Expect(err).To(MatchError("unexpected additional parameters"))
+	})
+
+	Context("in a scratch network namespace", func() {
+		var (
+			nsName string
+			netNS  *os.File
+		)
+
+		BeforeEach(func() {
+			var err error
+			nsName = fmt.Sprintf("test-sysctl-%d", rand.Int())
+			netNS, err = ns.CreateNetNS(nsName)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(netNS.Close()).To(Succeed())
+			Expect(ns.DeleteNetNS(nsName)).To(Succeed())
+		})
+
+		It("round-trips a written value", func() {
+			err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+				for _, v := range []string{"1", "0"} {
+					value, err := sysctl.Sysctl("net.ipv4.ip_forward", v)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(value).To(Equal(v))
+
+					value, err = sysctl.Sysctl("net.ipv4.ip_forward")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(value).To(Equal(v))
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("sees the values of the calling thread's namespace without remounting /proc", func() {
+			hostValue, err := sysctl.Sysctl("net.ipv4.conf.all.rp_filter")
+			Expect(err).NotTo(HaveOccurred())
+
+			nsValue := "2"
+			if hostValue == nsValue {
+				nsValue = "1"
+			}
+
+			done := make(chan error)
+			go func() {
+				// a fresh locked thread, typically not the thread group leader
+				runtime.LockOSThread()
+				defer runtime.UnlockOSThread()
+
+				done <- ns.WithNetNS(netNS, false, func(_ *os.File) error {
+					if _, err := sysctl.Sysctl("net.ipv4.conf.all.rp_filter", nsValue); err != nil {
+						return err
+					}
+					value, err := sysctl.Sysctl("net.ipv4.conf.all.rp_filter")
+					if err != nil {
+						return err
+					}
+					if value != nsValue {
+						return fmt.Errorf("read %q inside the namespace, wrote %q", value, nsValue)
+					}
+					return nil
+				})
+			}()
+			Expect(<-done).To(Succeed())
+
+			Expect(sysctl.Sysctl("net.ipv4.conf.all.rp_filter")).To(Equal(hostValue))
+		})
+
+		It("addresses interfaces whose names contain dots", func() {
+			err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+				err := netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: "eth0.100"},
+					PeerName:  "eth0.100p",
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				value, err := sysctl.Sysctl("net.ipv4.conf.eth0/100.rp_filter", "2")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal("2"))
+
+				data, err := ioutil.ReadFile("/proc/sys/net/ipv4/conf/eth0.100/rp_filter")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(strings.TrimSpace(string(data))).To(Equal("2"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,103 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package version describes which versions of the CNI spec a plugin
+// supports and reads the version a network configuration asks for.
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/appc/cni/pkg/types"
+)
+
+// Current is the version of the CNI spec implemented by this library.
+const Current = "0.2.0"
+
+// PluginInfo reports the spec versions a plugin can handle.
+type PluginInfo interface {
+	// SupportedVersions returns the versions the plugin accepts.
+	SupportedVersions() []string
+
+	// Encode writes the VERSION command output as JSON.
+	Encode(io.Writer) error
+}
+
+type pluginInfo struct {
+	CNIVersion string   `json:"cniVersion"`
+	Supported  []string `json:"supportedVersions"`
+}
+
+func (p *pluginInfo) SupportedVersions() []string {
+	return p.Supported
+}
+
+func (p *pluginInfo) Encode(w io.Writer) error {
+	return json.NewEncoder(w).Encode(p)
+}
+
+// PluginSupports returns a PluginInfo for a plugin accepting the given
+// versions. It panics if none are given.
+func PluginSupports(supportedVersions ...string) PluginInfo {
+	if len(supportedVersions) < 1 {
+		panic("programmer error: you must support at least one version")
+	}
+	return &pluginInfo{
+		CNIVersion: Current,
+		Supported:  supportedVersions,
+	}
+}
+
+// All is every version of the spec this library knows about.
+var All = PluginSupports("0.1.0", "0.2.0")
+
+// ConfigVersion returns the cniVersion a network configuration asks for.
+// Configurations predating the field are treated as version 0.1.0.
+func ConfigVersion(netconf []byte) (string, error) {
+	var conf struct {
+		CNIVersion string `json:"cniVersion"`
+	}
+	if err := json.Unmarshal(netconf, &conf); err != nil {
+		return "", fmt.Errorf("decoding version from network config: %v", err)
+	}
+	if conf.CNIVersion == "" {
+		return "0.1.0", nil
+	}
+	return conf.CNIVersion, nil
+}
+
+// Supports reports whether info lists the given version.
+func Supports(info PluginInfo, v string) bool {
+	for _, s := range info.SupportedVersions() {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewResult decodes a result printed by a plugin into the layout of the
+// cniVersion it declares. Results without the field are 0.1.0 results.
+func NewResult(data []byte) (types.Result, error) {
+	var res struct {
+		CNIVersion string `json:"cniVersion"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("decoding version from result: %v", err)
+	}
+
+	return types.NewResult(res.CNIVersion, data)
+}
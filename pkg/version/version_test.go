@@ -0,0 +1,90 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version_test
+
+import (
+	"bytes"
+
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PluginInfo", func() {
+	It("encodes the current and supported versions", func() {
+		info := version.PluginSupports("0.1.0", "0.2.0")
+		Expect(info.SupportedVersions()).To(Equal([]string{"0.1.0", "0.2.0"}))
+
+		var buf bytes.Buffer
+		Expect(info.Encode(&buf)).To(Succeed())
+		Expect(buf.Bytes()).To(MatchJSON(`{
+			"cniVersion": "0.2.0",
+			"supportedVersions": ["0.1.0", "0.2.0"]
+		}`))
+	})
+
+	It("panics when no versions are given", func() {
+		Expect(func() { version.PluginSupports() }).To(Panic())
+	})
+
+	It("reports whether a version is supported", func() {
+		info := version.PluginSupports("0.1.0")
+		Expect(version.Supports(info, "0.1.0")).To(BeTrue())
+		Expect(version.Supports(info, "0.2.0")).To(BeFalse())
+	})
+})
+
+var _ = Describe("ConfigVersion", func() {
+	It("returns the cniVersion of the config", func() {
+		v, err := version.ConfigVersion([]byte(`{"cniVersion": "0.2.0", "name": "x"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v).To(Equal("0.2.0"))
+	})
+
+	It("defaults to 0.1.0 when the field is absent", func() {
+		v, err := version.ConfigVersion([]byte(`{"name": "x"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v).To(Equal("0.1.0"))
+	})
+
+	It("fails on a config that is not JSON", func() {
+		_, err := version.ConfigVersion([]byte(`nope`))
+		Expect(err).To(MatchError(HavePrefix("decoding version from network config: ")))
+	})
+})
+
+var _ = Describe("NewResult", func() {
+	It("decodes a result without a version as 0.1.0", func() {
+		result, err := version.NewResult([]byte(`{"ip4": {"ip": "10.1.2.3/24"}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.(*types.Result010).IP4.IP.String()).To(Equal("10.1.2.3/24"))
+	})
+
+	It("decodes a 0.2.0 result", func() {
+		result, err := version.NewResult([]byte(`{
+			"cniVersion": "0.2.0",
+			"ips": [{"version": "4", "address": "10.1.2.3/24"}]
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.(*types.Result020).IPs[0].Address.String()).To(Equal("10.1.2.3/24"))
+	})
+
+	It("fails on an unknown version", func() {
+		_, err := version.NewResult([]byte(`{"cniVersion": "0.9.0"}`))
+		Expect(err).To(MatchError(`unsupported result version "0.9.0"`))
+	})
+})
@@ -23,9 +23,12 @@ import (
 	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/appc/cni/pkg/skel"
 	"github.com/appc/cni/pkg/types"
@@ -35,11 +38,18 @@ import (
 const listenFdsStart = 3
 const resendCount = 3
 
+// shutdownGrace bounds how long the daemon waits for its leases to be
+// released once it is told to stop
+const shutdownGrace = 10 * time.Second
+
 var errNoMoreTries = errors.New("no more tries")
+var errShuttingDown = errors.New("DHCP daemon is shutting down")
 
 type DHCP struct {
 	mux    sync.Mutex
 	leases map[string]*DHCPLease
+	// closed is set once the leases are being released on shutdown
+	closed bool
 }
 
 func newDHCP() *DHCP {
@@ -50,7 +60,7 @@ func newDHCP() *DHCP {
 
 // Allocate acquires an IP from a DHCP server for a specified container.
 // The acquired lease will be maintained until Release() is called.
-func (d *DHCP) Allocate(args *skel.CmdArgs, result *types.Result) error {
+func (d *DHCP) Allocate(args *skel.CmdArgs, result *types.Result010) error {
 	conf := types.NetConf{}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("error parsing netconf: %v", err)
@@ -68,7 +78,10 @@ func (d *DHCP) Allocate(args *skel.CmdArgs, result *types.Result) error {
 		return err
 	}
 
-	d.setLease(args.ContainerID, conf.Name, l)
+	if !d.setLease(args.ContainerID, conf.Name, l) {
+		l.Stop()
+		return errShuttingDown
+	}
 
 	result.IP4 = &types.IPConfig{
 		IP:      *ipn,
@@ -87,7 +100,7 @@ func (d *DHCP) Release(args *skel.CmdArgs, reply *struct{}) error {
 		return fmt.Errorf("error parsing netconf: %v", err)
 	}
 
-	if l := d.getLease(args.ContainerID, conf.Name); l != nil {
+	if l := d.takeLease(args.ContainerID, conf.Name); l != nil {
 		l.Stop()
 		return nil
 	}
@@ -107,12 +120,85 @@ func (d *DHCP) getLease(contID, netName string) *DHCPLease {
 	return l
 }
 
-func (d *DHCP) setLease(contID, netName string, l *DHCPLease) {
+// setLease records l, unless the daemon is shutting down, in which case
+// it returns false.
+func (d *DHCP) setLease(contID, netName string, l *DHCPLease) bool {
 	d.mux.Lock()
 	defer d.mux.Unlock()
 
+	if d.closed {
+		return false
+	}
 	// TODO(eyakubovich): hash it to avoid collisions
 	d.leases[contID+netName] = l
+	return true
+}
+
+// takeLease removes the lease from the map and returns it, or nil if
+// there is none. Looking it up and removing it under the same lock
+// keeps a lease from being stopped by both Release and releaseAll.
+func (d *DHCP) takeLease(contID, netName string) *DHCPLease {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	// TODO(eyakubovich): hash it to avoid collisions
+	l, ok := d.leases[contID+netName]
+	if !ok {
+		return nil
+	}
+	delete(d.leases, contID+netName)
+	return l
+}
+
+// releaseAll stops maintaining all the leases and releases them, giving
+// up after grace. Leases whose network namespace is gone are dropped.
+// Leases acquired afterwards are released right away.
+func (d *DHCP) releaseAll(grace time.Duration) {
+	d.mux.Lock()
+	d.closed = true
+	leases := d.leases
+	d.leases = make(map[string]*DHCPLease)
+	d.mux.Unlock()
+
+	var wg sync.WaitGroup
+	for _, l := range leases {
+		wg.Add(1)
+		go func(l *DHCPLease) {
+			defer wg.Done()
+			l.Stop()
+		}(l)
+	}
+
+	released := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(released)
+	}()
+
+	select {
+	case <-released:
+	case <-time.After(grace):
+		log.Printf("gave up releasing leases after %v", grace)
+	}
+}
+
+// serve answers RPCs on l until a signal arrives on sigs. It then stops
+// accepting RPCs and releases all the leases, waiting at most grace for
+// them.
+func (d *DHCP) serve(l net.Listener, sigs <-chan os.Signal, grace time.Duration) {
+	srv := rpc.NewServer()
+	srv.Register(d)
+
+	go func() {
+		sig := <-sigs
+		log.Printf("received %v, releasing leases", sig)
+		l.Close()
+	}()
+
+	// returns once l is closed
+	http.Serve(l, srv)
+
+	d.releaseAll(grace)
 }
 
 func getListener() (net.Listener, error) {
@@ -150,8 +236,8 @@ func runDaemon() {
 		return
 	}
 
-	dhcp := newDHCP()
-	rpc.Register(dhcp)
-	rpc.HandleHTTP()
-	http.Serve(l, nil)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	newDHCP().serve(l, sigs, shutdownGrace)
 }
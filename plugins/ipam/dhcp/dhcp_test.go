@@ -0,0 +1,699 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/skel"
+	"github.com/appc/cni/pkg/types"
+	"github.com/d2g/dhcp4"
+	"github.com/d2g/dhcp4client"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	serverIfName = "dhcp-srv0"
+	contIfName   = "eth0"
+	leaseTime    = 4 * time.Second
+)
+
+var (
+	serverIP = net.IPv4(192, 168, 1, 1)
+	leasedIP = net.IPv4(192, 168, 1, 5)
+)
+
+// mockServer is a minimal DHCP responder: it offers leasedIP to every
+// DISCOVER, ACKs REQUESTs and records what kind each one was and when
+// it arrived.
+type mockServer struct {
+	conn      net.PacketConn
+	leaseTime time.Duration
+
+	mux      sync.Mutex
+	requests []mockRequest
+	releases int
+	ignoring bool
+}
+
+type mockRequest struct {
+	kind string // "select", "renew" or "rebind"
+	at   time.Time
+}
+
+// requestKind tells apart the REQUESTs a client sends while selecting
+// an offer, renewing and rebinding (RFC 2131, Section 4.3.2)
+func requestKind(req dhcp4.Packet, opts dhcp4.Options) string {
+	switch {
+	case req.CIAddr().Equal(net.IPv4zero):
+		return "select"
+	case opts[dhcp4.OptionServerIdentifier] != nil:
+		return "renew"
+	default:
+		return "rebind"
+	}
+}
+
+// newMockServer binds a broadcast-capable UDP socket to port 67 on
+// ifName in the calling thread's network namespace.
+func newMockServer(ifName string) (*mockServer, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "dhcp-server")
+	defer f.Close()
+
+	if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_BROADCAST, 1); err != nil {
+		return nil, err
+	}
+	if err = unix.BindToDevice(fd, ifName); err != nil {
+		return nil, err
+	}
+	if err = unix.Bind(fd, &unix.SockaddrInet4{Port: 67}); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return &mockServer{conn: conn, leaseTime: leaseTime}, nil
+}
+
+func (s *mockServer) serve() {
+	bcast := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+	buf := make([]byte, 1500)
+
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if n < 240 {
+			// too short to be a DHCP message
+			continue
+		}
+
+		req := dhcp4.Packet(append([]byte{}, buf[:n]...))
+		opts := req.ParseOptions()
+		if len(opts[dhcp4.OptionDHCPMessageType]) < 1 {
+			continue
+		}
+
+		var reply dhcp4.MessageType
+		switch dhcp4.MessageType(opts[dhcp4.OptionDHCPMessageType][0]) {
+		case dhcp4.Discover:
+			reply = dhcp4.Offer
+		case dhcp4.Request:
+			kind := requestKind(req, opts)
+			s.mux.Lock()
+			s.requests = append(s.requests, mockRequest{kind, time.Now()})
+			ignoring := s.ignoring && kind != "select"
+			s.mux.Unlock()
+			if ignoring {
+				continue
+			}
+			reply = dhcp4.ACK
+		case dhcp4.Release:
+			s.mux.Lock()
+			s.releases++
+			s.mux.Unlock()
+			continue
+		default:
+			continue
+		}
+
+		pkt := dhcp4.ReplyPacket(req, reply, serverIP.To4(), leasedIP.To4(), s.leaseTime, []dhcp4.Option{
+			{Code: dhcp4.OptionSubnetMask, Value: []byte(net.CIDRMask(24, 32))},
+			{Code: dhcp4.OptionRouter, Value: []byte(serverIP.To4())},
+		})
+		s.conn.WriteTo(pkt, bcast)
+	}
+}
+
+// ignoreExtensions makes the server stop answering renewals and
+// rebinds, while still granting new leases
+func (s *mockServer) ignoreExtensions() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.ignoring = true
+}
+
+func (s *mockServer) requestTimes() []time.Time {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	times := []time.Time{}
+	for _, r := range s.requests {
+		times = append(times, r.at)
+	}
+	return times
+}
+
+func (s *mockServer) requestKinds() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	kinds := []string{}
+	for _, r := range s.requests {
+		kinds = append(kinds, r.kind)
+	}
+	return kinds
+}
+
+func (s *mockServer) releaseCount() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.releases
+}
+
+// fakeClock only moves forward when told to
+type fakeClock struct {
+	mux     sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{c.now.Add(d), ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.now = c.now.Add(d)
+
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiters
+}
+
+func (c *fakeClock) pending() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.waiters)
+}
+
+// addrLifetimes returns the valid and preferred lifetimes, in seconds,
+// of the address ipn of the link with index
+func addrLifetimes(index int, ipn *net.IPNet) (valid, preferred uint32) {
+	const ifaCacheinfo = 0x6
+
+	req := nl.NewNetlinkRequest(syscall.RTM_GETADDR, syscall.NLM_F_DUMP)
+	req.AddData(nl.NewIfAddrmsg(syscall.AF_INET))
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWADDR)
+	Expect(err).NotTo(HaveOccurred())
+
+	for _, m := range msgs {
+		msg := nl.DeserializeIfAddrmsg(m)
+		if int(msg.Index) != index {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		Expect(err).NotTo(HaveOccurred())
+
+		var addr net.IP
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.IFA_LOCAL:
+				addr = net.IP(attr.Value)
+			case ifaCacheinfo:
+				preferred = nl.NativeEndian().Uint32(attr.Value[0:4])
+				valid = nl.NativeEndian().Uint32(attr.Value[4:8])
+			}
+		}
+		if addr.Equal(ipn.IP) {
+			return valid, preferred
+		}
+	}
+	Fail(fmt.Sprintf("address %s not found", ipn))
+	return 0, 0
+}
+
+var _ = Describe("DHCP", func() {
+	var (
+		hostNSName, contNSName string
+		hostNS, contNS         *os.File
+		server                 *mockServer
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		hostNSName = fmt.Sprintf("test-dhcp-host-%d", rand.Int())
+		hostNS, err = ns.CreateNetNS(hostNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		contNSName = fmt.Sprintf("test-dhcp-cont-%d", rand.Int())
+		contNS, err = ns.CreateNetNS(contNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		// the server end of the veth stays in the fake host namespace,
+		// the client end becomes the container's eth0 (left down, as
+		// a freshly created container interface would be)
+		err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			veth := &netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: serverIfName},
+				PeerName:  contIfName,
+			}
+			if err := netlink.LinkAdd(veth); err != nil {
+				return err
+			}
+
+			peer, err := netlink.LinkByName(contIfName)
+			if err != nil {
+				return err
+			}
+			if err = netlink.LinkSetNsFd(peer, int(contNS.Fd())); err != nil {
+				return err
+			}
+
+			link, err := netlink.LinkByName(serverIfName)
+			if err != nil {
+				return err
+			}
+			addr := &netlink.Addr{IPNet: &net.IPNet{IP: serverIP, Mask: net.CIDRMask(24, 32)}}
+			if err = netlink.AddrAdd(link, addr); err != nil {
+				return err
+			}
+			if err = netlink.LinkSetUp(link); err != nil {
+				return err
+			}
+
+			server, err = newMockServer(serverIfName)
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		go server.serve()
+	})
+
+	AfterEach(func() {
+		server.conn.Close()
+
+		if contNS != nil {
+			Expect(contNS.Close()).To(Succeed())
+			Expect(ns.DeleteNetNS(contNSName)).To(Succeed())
+		}
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(hostNSName)).To(Succeed())
+	})
+
+	It("allocates the offered lease and releases it", func() {
+		d := newDHCP()
+		args := &skel.CmdArgs{
+			ContainerID: "some-container-id",
+			Netns:       contNS.Name(),
+			IfName:      contIfName,
+			StdinData:   []byte(`{"name": "testnet", "ipam": {"type": "dhcp"}}`),
+		}
+
+		result := &types.Result010{}
+		Expect(d.Allocate(args, result)).To(Succeed())
+
+		Expect(result.IP4).NotTo(BeNil())
+		Expect(result.IP4.IP.String()).To(Equal("192.168.1.5/24"))
+		Expect(result.IP4.Gateway.String()).To(Equal(serverIP.String()))
+
+		err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+			link, err := netlink.LinkByName(contIfName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(d.Release(args, &struct{}{})).To(Succeed())
+		Eventually(server.releaseCount, "2s").Should(Equal(1))
+
+		Expect(d.Release(args, &struct{}{})).To(MatchError("lease not found: some-container-id/testnet"))
+	})
+
+	It("releases the live leases and stops answering on SIGTERM", func() {
+		socketDir, err := ioutil.TempDir("", "dhcp-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(socketDir)
+
+		l, err := net.Listen("unix", filepath.Join(socketDir, "dhcp.sock"))
+		Expect(err).NotTo(HaveOccurred())
+
+		// ginkgo aborts the run on a real SIGTERM, so the signal is
+		// delivered as signal.Notify would
+		sigs := make(chan os.Signal, 1)
+
+		d := newDHCP()
+		served := make(chan struct{})
+		go func() {
+			defer close(served)
+			d.serve(l, sigs, 5*time.Second)
+		}()
+
+		client, err := rpc.DialHTTP("unix", l.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		args := &skel.CmdArgs{
+			ContainerID: "some-container-id",
+			Netns:       contNS.Name(),
+			IfName:      contIfName,
+			StdinData:   []byte(`{"name": "testnet", "ipam": {"type": "dhcp"}}`),
+		}
+		Expect(client.Call("DHCP.Allocate", args, &types.Result010{})).To(Succeed())
+		client.Close()
+
+		// a lease of a container that was deleted behind the daemon's back
+		goneNSName := fmt.Sprintf("test-dhcp-gone-%d", rand.Int())
+		goneNS, err := ns.CreateNetNS(goneNSName)
+		Expect(err).NotTo(HaveOccurred())
+		gone := &DHCPLease{
+			clientID: "gone-container-id/testnet",
+			netns:    goneNS.Name(),
+			ifName:   contIfName,
+			ack:      d.getLease("some-container-id", "testnet").ack,
+			clock:    realClock{},
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+		gone.renewalTime = time.Now().Add(time.Hour)
+		gone.rebindingTime = gone.renewalTime
+		gone.expireTime = gone.renewalTime
+		go gone.Maintain()
+		Expect(d.setLease("gone-container-id", "testnet", gone)).To(BeTrue())
+		Expect(goneNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(goneNSName)).To(Succeed())
+
+		sigs <- syscall.SIGTERM
+		Eventually(served, "5s").Should(BeClosed())
+
+		Expect(server.releaseCount()).To(Equal(1))
+		Expect(gone.done).To(BeClosed())
+
+		_, err = rpc.DialHTTP("unix", l.Addr().String())
+		Expect(err).To(HaveOccurred())
+		Expect(d.Allocate(args, &types.Result010{})).To(MatchError(errShuttingDown))
+		Expect(server.releaseCount()).To(Equal(2))
+	})
+
+	It("releases a lease once when Release races the shutdown", func() {
+		d := newDHCP()
+		args := &skel.CmdArgs{
+			ContainerID: "some-container-id",
+			Netns:       contNS.Name(),
+			IfName:      contIfName,
+			StdinData:   []byte(`{"name": "testnet", "ipam": {"type": "dhcp"}}`),
+		}
+		Expect(d.Allocate(args, &types.Result010{})).To(Succeed())
+
+		var (
+			wg         sync.WaitGroup
+			releaseErr error
+		)
+		start := make(chan struct{})
+		wg.Add(2)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			<-start
+			releaseErr = d.Release(args, &struct{}{})
+		}()
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			<-start
+			d.releaseAll(5 * time.Second)
+		}()
+		close(start)
+		wg.Wait()
+
+		// whichever got to the lease first released it
+		Expect(releaseErr).To(Or(Succeed(), MatchError("lease not found: some-container-id/testnet")))
+		Consistently(server.releaseCount, "500ms").Should(Equal(1))
+	})
+
+	It("stops a lease only once", func() {
+		l, err := AcquireLease("some-container-id/testnet", contNS.Name(), contIfName)
+		Expect(err).NotTo(HaveOccurred())
+
+		l.Stop()
+		l.Stop()
+		Expect(server.releaseCount()).To(Equal(1))
+	})
+
+	It("renews the lease before it expires", func() {
+		l, err := AcquireLease("some-container-id/testnet", contNS.Name(), contIfName)
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Stop()
+
+		Expect(server.requestTimes()).To(HaveLen(1))
+		expiry := l.expireTime
+
+		// renewal is due at half the lease time
+		Eventually(func() int { return len(server.requestTimes()) }, leaseTime).Should(BeNumerically(">=", 2))
+		Expect(server.requestTimes()[1]).To(BeTemporally("<", expiry))
+	})
+
+	Context("with a controllable clock", func() {
+		const longLease = 100 * time.Second
+
+		var (
+			clk         *fakeClock
+			origTimeout time.Duration
+		)
+
+		// acquire brings the container interface up and waits until it
+		// can transmit, so that the first exchange does not fail and
+		// leave the lease waiting on the fake clock
+		acquire := func() *DHCPLease {
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(contIfName)
+				if err != nil {
+					return err
+				}
+				if err = netlink.LinkSetUp(link); err != nil {
+					return err
+				}
+
+				sock, err := dhcp4client.NewPacketSock(link.Attrs().Index)
+				if err != nil {
+					return err
+				}
+				defer sock.Close()
+
+				Eventually(func() error {
+					return sock.Write([]byte{0})
+				}, "5s", "50ms").Should(Succeed())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			l, err := acquireLease("some-container-id/testnet", contNS.Name(), contIfName, clk)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(server.requestKinds()).To(Equal([]string{"select"}))
+
+			// wait for Maintain to start sleeping until T1
+			Eventually(clk.pending).Should(Equal(1))
+			return l
+		}
+
+		BeforeEach(func() {
+			clk = newFakeClock()
+			server.leaseTime = longLease
+
+			origTimeout = exchangeTimeout
+			exchangeTimeout = 200 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			exchangeTimeout = origTimeout
+		})
+
+		It("renews at half the lease time", func() {
+			l := acquire()
+			defer l.Stop()
+
+			Expect(l.renewalTime.Sub(clk.Now())).To(Equal(longLease / 2))
+			Expect(l.rebindingTime.Sub(clk.Now())).To(Equal(longLease * 7 / 8))
+
+			clk.Advance(longLease/2 - time.Second)
+			Consistently(server.requestKinds, "500ms").Should(Equal([]string{"select"}))
+
+			clk.Advance(time.Second)
+			Eventually(server.requestKinds).Should(Equal([]string{"select", "renew"}))
+
+			// the renewal restarts the timers from the current time
+			Eventually(clk.pending).Should(Equal(1))
+			Expect(l.expireTime).To(Equal(clk.Now().Add(longLease)))
+		})
+
+		It("gives the leased address the lease time as its lifetime once renewed", func() {
+			l := acquire()
+			defer l.Stop()
+
+			// the address as the plugin receiving the result adds it
+			ipn, err := l.IPNet()
+			Expect(err).NotTo(HaveOccurred())
+			err = ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(contIfName)
+				if err != nil {
+					return err
+				}
+				return netlink.AddrAdd(link, &netlink.Addr{IPNet: ipn})
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			clk.Advance(longLease / 2)
+			Eventually(server.requestKinds).Should(Equal([]string{"select", "renew"}))
+			Eventually(clk.pending).Should(Equal(1))
+
+			err = ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(contIfName)
+				Expect(err).NotTo(HaveOccurred())
+				valid, preferred := addrLifetimes(link.Attrs().Index, ipn)
+				Expect(valid).To(BeNumerically("~", longLease/time.Second, 2))
+				Expect(preferred).To(Equal(valid))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("gives the leased address the lease time as its lifetime once the plugin has added it", func() {
+			l := acquire()
+			defer l.Stop()
+
+			ipn, err := l.IPNet()
+			Expect(err).NotTo(HaveOccurred())
+
+			// the daemon must leave adding the address to the plugin
+			clk.Advance(addrPollDelay0)
+			Eventually(clk.pending).Should(Equal(1))
+			err = ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(contIfName)
+				Expect(err).NotTo(HaveOccurred())
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(BeEmpty())
+
+				return netlink.AddrAdd(link, &netlink.Addr{IPNet: ipn})
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// well before T1
+			clk.Advance(2 * addrPollDelay0)
+			Eventually(func() uint32 {
+				var valid uint32
+				err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+					link, err := netlink.LinkByName(contIfName)
+					Expect(err).NotTo(HaveOccurred())
+					valid, _ = addrLifetimes(link.Attrs().Index, ipn)
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return valid
+			}).Should(BeNumerically("~", (longLease-3*addrPollDelay0)/time.Second, 2))
+			Expect(server.requestKinds()).To(Equal([]string{"select"}))
+		})
+
+		It("rebinds at seven eighths of the lease time when renewals go unanswered", func() {
+			server.ignoreExtensions()
+
+			l := acquire()
+			defer l.Stop()
+
+			clk.Advance(longLease / 2)
+			Eventually(server.requestKinds).Should(Equal([]string{"select", "renew"}))
+
+			// retries back off, but never sleep past T2
+			Eventually(clk.pending, "2s").Should(Equal(1))
+			clk.Advance(longLease*7/8 - longLease/2 - time.Second)
+			Eventually(server.requestKinds).Should(Equal([]string{"select", "renew", "renew"}))
+
+			Eventually(clk.pending, "2s").Should(Equal(1))
+			clk.Advance(time.Second)
+			Eventually(server.requestKinds).Should(Equal([]string{"select", "renew", "renew", "rebind"}))
+		})
+
+		It("stops maintaining the lease once the network namespace is gone", func() {
+			l := acquire()
+
+			Expect(contNS.Close()).To(Succeed())
+			Expect(ns.DeleteNetNS(contNSName)).To(Succeed())
+			contNS = nil
+
+			clk.Advance(longLease / 2)
+			Eventually(l.done).Should(BeClosed())
+			Expect(server.requestKinds()).To(Equal([]string{"select"}))
+
+			// stopping a lease that already terminated must not block
+			l.Stop()
+		})
+	})
+})
+
+var _ = Describe("cmdAdd", func() {
+	It("refuses a netns path the daemon cannot open", func() {
+		err := cmdAdd(&skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/proc/self/fd/3",
+			IfName:      "eth0",
+			StdinData:   []byte(`{"cniVersion": "0.2.0", "name": "mynet", "ipam": {"type": "dhcp"}}`),
+		})
+		Expect(err).To(Equal(types.NewInvalidEnvironmentVariablesError(
+			`netns "/proc/self/fd/3" is only valid within the plugin process; the dhcp daemon needs a path it can open`, "")))
+	})
+})
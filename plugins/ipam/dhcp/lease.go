@@ -15,18 +15,21 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/d2g/dhcp4"
 	"github.com/d2g/dhcp4client"
 	"github.com/vishvananda/netlink"
 
+	"github.com/appc/cni/pkg/ip"
 	"github.com/appc/cni/pkg/ns"
 	"github.com/appc/cni/pkg/types"
 )
@@ -36,111 +39,253 @@ import (
 const resendDelay0 = 4 * time.Second
 const resendDelayMax = 32 * time.Second
 
+// addrPollDelay0 is how long after acquiring a lease the daemon first
+// looks for the leased address on the interface; it backs off from there
+const addrPollDelay0 = time.Second
+
+// exchangeTimeout bounds how long a single exchange waits for an answer
+var exchangeTimeout = 5 * time.Second
+
 const (
 	leaseStateBound = iota
 	leaseStateRenewing
 	leaseStateRebinding
+	leaseStateExpired
 )
 
-// This implementation uses 1 OS thread per lease. This is because
-// all the network operations have to be done in network namespace
-// of the interface. This can be improved by switching to the proper
-// namespace for network ops and using fewer threads. However, this
-// needs to be done carefully as dhcp4client ops are blocking.
+// Each lease is maintained by its own goroutine. All the network
+// operations have to be done in the network namespace of the interface,
+// so the goroutine only enters the namespace for the duration of each
+// exchange. The namespace is re-opened every time: the container may
+// have been deleted in the meantime, in which case maintenance stops.
+
+// clock abstracts the passage of time so that lease timers can be
+// driven by tests.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
 
 type DHCPLease struct {
 	clientID      string
+	netns         string
+	ifName        string
 	ack           *dhcp4.Packet
 	opts          dhcp4.Options
-	link          netlink.Link
 	renewalTime   time.Time
 	rebindingTime time.Time
 	expireTime    time.Time
+	clock         clock
 	stop          chan struct{}
-	wg            sync.WaitGroup
+	stopOnce      sync.Once
+	done          chan struct{}
+
+	// addrRefreshed is set once the leased address has been given the
+	// remaining lease time as its lifetime
+	addrRefreshed bool
 }
 
 // AcquireLease gets an DHCP lease and then maintains it in the background
 // by periodically renewing it. The acquired lease can be released by
 // calling DHCPLease.Stop()
 func AcquireLease(clientID, netns, ifName string) (*DHCPLease, error) {
-	errCh := make(chan error, 1)
+	return acquireLease(clientID, netns, ifName, realClock{})
+}
+
+func acquireLease(clientID, netns, ifName string, clk clock) (*DHCPLease, error) {
 	l := &DHCPLease{
 		clientID: clientID,
+		netns:    netns,
+		ifName:   ifName,
+		clock:    clk,
 		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
 	}
 
 	log.Printf("%v: acquiring lease", clientID)
 
-	l.wg.Add(1)
-	go func() {
-		errCh <- ns.WithNetNSPath(netns, true, func(_ *os.File) error {
-			defer l.wg.Done()
+	err := l.backoffRetry(func() error {
+		return l.withLink(l.request)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			link, err := netlink.LinkByName(ifName)
-			if err != nil {
-				return fmt.Errorf("error looking up %q: %v", ifName, err)
-			}
+	log.Printf("%v: lease acquired, expiration is %v", l.clientID, l.expireTime)
 
-			l.link = link
+	go l.Maintain()
 
-			if err = l.acquire(); err != nil {
-				return err
-			}
+	return l, nil
+}
 
-			log.Printf("%v: lease acquired, expiration is %v", l.clientID, l.expireTime)
+// Stop terminates the background task that maintains the lease
+// and issues a DHCP Release. Calling it again only waits for the
+// task to finish.
+func (l *DHCPLease) Stop() {
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.done
+}
 
-			errCh <- nil
+// withLink runs f inside the lease's network namespace, passing it a
+// fresh handle to the leased interface.
+func (l *DHCPLease) withLink(f func(netlink.Link) error) error {
+	return ns.WithNetNSPath(l.netns, true, func(_ *os.File) error {
+		link, err := netlink.LinkByName(l.ifName)
+		if err != nil {
+			return fmt.Errorf("error looking up %q: %v", l.ifName, err)
+		}
+		return f(link)
+	})
+}
 
-			l.maintain()
-			return nil
-		})
-	}()
+// isNetNSGone reports whether err means the lease's network namespace
+// no longer exists, either because its bind mount was removed or
+// because only a plain file is left behind at its path.
+func isNetNSGone(err error) bool {
+	nsErr, ok := err.(*ns.NSPathError)
+	if !ok {
+		return false
+	}
+	switch nsErr.Op {
+	case "open":
+		return os.IsNotExist(nsErr.Err)
+	case "setns":
+		return nsErr.Err == syscall.EINVAL
+	}
+	return false
+}
 
-	if err := <-errCh; err != nil {
-		return nil, err
+// request performs a full DISCOVER/OFFER/REQUEST/ACK exchange.
+func (l *DHCPLease) request(link netlink.Link) error {
+	if (link.Attrs().Flags & net.FlagUp) != net.FlagUp {
+		log.Printf("Link %q down. Attempting to set up", link.Attrs().Name)
+		if err := netlink.LinkSetUp(link); err != nil {
+			return err
+		}
 	}
 
-	return l, nil
+	c, err := newDHCPClient(link)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ok, ack, err := c.Request()
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		return fmt.Errorf("DHCP server NACK'd own offer")
+	}
+
+	return l.commit(&ack)
 }
 
-// Stop terminates the background task that maintains the lease
-// and issues a DHCP Release
-func (l *DHCPLease) Stop() {
-	close(l.stop)
-	l.wg.Wait()
+// renew asks the server that granted the lease to extend it.
+func (l *DHCPLease) renew(link netlink.Link) error {
+	return l.sendRequest(link, func(c *dhcp4client.Client) dhcp4.Packet {
+		return c.RenewalRequestPacket(l.ack)
+	})
+}
+
+// rebind asks any server to extend the lease. Unlike a renewal, the
+// DHCPREQUEST carries neither a server identifier nor a requested IP
+// address option (RFC 2131, Section 4.3.2).
+func (l *DHCPLease) rebind(link netlink.Link) error {
+	return l.sendRequest(link, func(c *dhcp4client.Client) dhcp4.Packet {
+		xid := make([]byte, 4)
+		binary.BigEndian.PutUint32(xid, rand.Uint32())
+
+		pkt := dhcp4.NewPacket(dhcp4.BootRequest)
+		pkt.SetCHAddr(l.ack.CHAddr())
+		pkt.SetXId(xid)
+		pkt.SetCIAddr(l.ack.YIAddr())
+		pkt.AddOption(dhcp4.OptionDHCPMessageType, []byte{byte(dhcp4.Request)})
+		return pkt
+	})
 }
 
-func (l *DHCPLease) acquire() error {
-	c, err := newDHCPClient(l.link)
+func (l *DHCPLease) sendRequest(link netlink.Link, build func(*dhcp4client.Client) dhcp4.Packet) error {
+	c, err := newDHCPClient(link)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	if (l.link.Attrs().Flags & net.FlagUp) != net.FlagUp {
-		log.Printf("Link %q down. Attempting to set up", l.link.Attrs().Name)
-		if err = netlink.LinkSetUp(l.link); err != nil {
-			return err
-		}
+	req := build(c)
+	req.PadToMinSize()
+
+	if err = c.SendPacket(req); err != nil {
+		return err
 	}
 
-	pkt, err := backoffRetry(func() (*dhcp4.Packet, error) {
-		ok, ack, err := c.Request()
-		switch {
-		case err != nil:
-			return nil, err
-		case !ok:
-			return nil, fmt.Errorf("DHCP server NACK'd own offer")
-		default:
-			return &ack, nil
+	ack, err := c.GetAcknowledgement(&req)
+	if err != nil {
+		return err
+	}
+
+	opts := ack.ParseOptions()
+	if dhcp4.MessageType(opts[dhcp4.OptionDHCPMessageType][0]) != dhcp4.ACK {
+		return fmt.Errorf("DHCP server did not extend lease")
+	}
+
+	if err = l.commit(&ack); err != nil {
+		return err
+	}
+
+	if err = l.refreshAddr(link); err != nil {
+		log.Printf("%v: failed to set the lifetime of the leased address: %v", l.clientID, err)
+	} else {
+		l.addrRefreshed = true
+	}
+	return nil
+}
+
+// applyAddrLifetime refreshes the leased address if the plugin the IPAM
+// result went to has added it to the interface by now. Adding it before
+// that plugin does would make the plugin fail, so until then nothing is
+// done.
+func (l *DHCPLease) applyAddrLifetime(link netlink.Link) error {
+	ipn, err := l.IPNet()
+	if err != nil {
+		return err
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to get IP addresses for %q: %v", link.Attrs().Name, err)
+	}
+	for _, addr := range addrs {
+		if addr.IPNet.IP.Equal(ipn.IP) {
+			if err = l.refreshAddr(link); err != nil {
+				return err
+			}
+			l.addrRefreshed = true
+			return nil
 		}
-	})
+	}
+	return nil
+}
+
+// refreshAddr makes the leased address on the interface valid until the
+// lease expires, so that the kernel removes it should the lease not be
+// extended again, e.g. because the daemon died.
+func (l *DHCPLease) refreshAddr(link netlink.Link) error {
+	ipn, err := l.IPNet()
 	if err != nil {
 		return err
 	}
 
-	return l.commit(pkt)
+	lifetime := int(l.expireTime.Sub(l.clock.Now()) / time.Second)
+	if lifetime <= 0 {
+		return nil
+	}
+	return ip.AddrAddWithLifetime(link, &netlink.Addr{IPNet: ipn}, lifetime, lifetime)
 }
 
 func (l *DHCPLease) commit(ack *dhcp4.Packet) error {
@@ -153,8 +298,8 @@ func (l *DHCPLease) commit(ack *dhcp4.Packet) error {
 
 	rebindingTime, err := parseRebindingTime(opts)
 	if err != nil || rebindingTime > leaseTime {
-		// Per RFC 2131 Section 4.4.5, it should default to 85% of lease time
-		rebindingTime = leaseTime * 85 / 100
+		// Per RFC 2131 Section 4.4.5, it should default to 87.5% of lease time
+		rebindingTime = leaseTime * 875 / 1000
 	}
 
 	renewalTime, err := parseRenewalTime(opts)
@@ -163,7 +308,7 @@ func (l *DHCPLease) commit(ack *dhcp4.Packet) error {
 		renewalTime = leaseTime / 2
 	}
 
-	now := time.Now()
+	now := l.clock.Now()
 	l.expireTime = now.Add(leaseTime)
 	l.renewalTime = now.Add(renewalTime)
 	l.rebindingTime = now.Add(rebindingTime)
@@ -173,97 +318,141 @@ func (l *DHCPLease) commit(ack *dhcp4.Packet) error {
 	return nil
 }
 
-func (l *DHCPLease) maintain() {
+func (l *DHCPLease) stateAt(t time.Time) int {
+	switch {
+	case t.Before(l.renewalTime):
+		return leaseStateBound
+	case t.Before(l.rebindingTime):
+		return leaseStateRenewing
+	case t.Before(l.expireTime):
+		return leaseStateRebinding
+	default:
+		return leaseStateExpired
+	}
+}
+
+// Maintain keeps the lease alive until Stop is called or the network
+// namespace of the interface disappears. Per RFC 2131, the lease is
+// renewed with the granting server at T1 and rebound with any server
+// at T2. Should it expire, the interface is brought down, the lease is
+// released and a new one is requested. Failed attempts are retried
+// with exponential backoff, but never past the next of these deadlines.
+// Until the leased address shows up on the interface, it is looked for
+// with backoff as well, so that its lifetime is set well before T1.
+func (l *DHCPLease) Maintain() {
+	defer close(l.done)
+
 	state := leaseStateBound
+	delay := resendDelay0
+	addrDelay := addrPollDelay0
 
 	for {
-		var sleepDur time.Duration
+		now := l.clock.Now()
 
-		switch state {
-		case leaseStateBound:
-			sleepDur = l.renewalTime.Sub(time.Now())
-			if sleepDur <= 0 {
+		if newState := l.stateAt(now); newState != state {
+			state = newState
+			delay = resendDelay0
+
+			switch state {
+			case leaseStateRenewing:
 				log.Printf("%v: renewing lease", l.clientID)
-				state = leaseStateRenewing
-				continue
+			case leaseStateRebinding:
+				log.Printf("%v: renewal time expired, rebinding", l.clientID)
+			case leaseStateExpired:
+				log.Printf("%v: lease expired, bringing interface DOWN", l.clientID)
+				err := l.withLink(func(link netlink.Link) error {
+					l.downIface(link)
+					return l.release(link)
+				})
+				if isNetNSGone(err) {
+					log.Printf("%v: network namespace is gone, stopping maintenance", l.clientID)
+					return
+				}
 			}
+		}
+
+		var err error
+		var deadline time.Time
 
+		switch state {
 		case leaseStateRenewing:
-			if err := l.renew(); err != nil {
-				log.Printf("%v: %v", l.clientID, err)
+			err = l.withLink(l.renew)
+			deadline = l.rebindingTime
+		case leaseStateRebinding:
+			err = l.withLink(l.rebind)
+			deadline = l.expireTime
+		case leaseStateExpired:
+			err = l.withLink(l.request)
+		}
 
-				if time.Now().After(l.rebindingTime) {
-					log.Printf("%v: renawal time expired, rebinding", l.clientID)
-					state = leaseStateRebinding
+		var sleepDur time.Duration
+
+		switch {
+		case state == leaseStateBound:
+			sleepDur = l.renewalTime.Sub(now)
+
+			if !l.addrRefreshed {
+				if err := l.withLink(l.applyAddrLifetime); err != nil {
+					log.Printf("%v: failed to set the lifetime of the leased address: %v", l.clientID, err)
+				}
+			}
+			if !l.addrRefreshed && addrDelay < sleepDur {
+				sleepDur = addrDelay
+				if addrDelay < resendDelayMax {
+					addrDelay *= 2
 				}
-			} else {
-				log.Printf("%v: lease renewed, expiration is %v", l.clientID, l.expireTime)
-				state = leaseStateBound
 			}
 
-		case leaseStateRebinding:
-			if err := l.acquire(); err != nil {
-				log.Printf("%v: %v", l.clientID, err)
+		case err == nil:
+			log.Printf("%v: lease extended, expiration is %v", l.clientID, l.expireTime)
+			continue
 
-				if time.Now().After(l.expireTime) {
-					log.Printf("%v: lease expired, bringing interface DOWN", l.clientID)
-					l.downIface()
-					return
+		case isNetNSGone(err):
+			log.Printf("%v: network namespace is gone, stopping maintenance", l.clientID)
+			return
+
+		default:
+			log.Printf("%v: %v", l.clientID, err)
+
+			sleepDur = delay + jitter(time.Second)
+			if !deadline.IsZero() {
+				if untilDeadline := deadline.Sub(l.clock.Now()); sleepDur > untilDeadline {
+					sleepDur = untilDeadline
 				}
-			} else {
-				log.Printf("%v: lease rebound, expiration is %v", l.clientID, l.expireTime)
-				state = leaseStateBound
+			}
+			if delay < resendDelayMax {
+				delay *= 2
 			}
 		}
 
 		select {
-		case <-time.After(sleepDur):
+		case <-l.clock.After(sleepDur):
 
 		case <-l.stop:
-			if err := l.release(); err != nil {
-				log.Printf("%v: failed to release DHCP lease: %v", l.clientID, err)
+			if state != leaseStateExpired {
+				err := l.withLink(l.release)
+				switch {
+				case isNetNSGone(err):
+					log.Printf("%v: network namespace is gone, dropping lease", l.clientID)
+				case err != nil:
+					log.Printf("%v: failed to release DHCP lease: %v", l.clientID, err)
+				}
 			}
 			return
 		}
 	}
 }
 
-func (l *DHCPLease) downIface() {
-	if err := netlink.LinkSetDown(l.link); err != nil {
-		log.Printf("%v: failed to bring %v interface DOWN: %v", l.clientID, l.link.Attrs().Name, err)
+func (l *DHCPLease) downIface(link netlink.Link) {
+	if err := netlink.LinkSetDown(link); err != nil {
+		log.Printf("%v: failed to bring %v interface DOWN: %v", l.clientID, link.Attrs().Name, err)
 	}
 }
 
-func (l *DHCPLease) renew() error {
-	c, err := newDHCPClient(l.link)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
-
-	pkt, err := backoffRetry(func() (*dhcp4.Packet, error) {
-		ok, ack, err := c.Renew(*l.ack)
-		switch {
-		case err != nil:
-			return nil, err
-		case !ok:
-			return nil, fmt.Errorf("DHCP server did not renew lease")
-		default:
-			return &ack, nil
-		}
-	})
-	if err != nil {
-		return err
-	}
-
-	l.commit(pkt)
-	return nil
-}
-
-func (l *DHCPLease) release() error {
+func (l *DHCPLease) release(link netlink.Link) error {
 	log.Printf("%v: releasing lease", l.clientID)
 
-	c, err := newDHCPClient(l.link)
+	c, err := newDHCPClient(link)
 	if err != nil {
 		return err
 	}
@@ -302,25 +491,25 @@ func jitter(span time.Duration) time.Duration {
 	return time.Duration(float64(span) * (2.0*rand.Float64() - 1.0))
 }
 
-func backoffRetry(f func() (*dhcp4.Packet, error)) (*dhcp4.Packet, error) {
+func (l *DHCPLease) backoffRetry(f func() error) error {
 	var baseDelay time.Duration = resendDelay0
 
 	for i := 0; i < resendCount; i++ {
-		pkt, err := f()
+		err := f()
 		if err == nil {
-			return pkt, nil
+			return nil
 		}
 
 		log.Print(err)
 
-		time.Sleep(baseDelay + jitter(time.Second))
+		<-l.clock.After(baseDelay + jitter(time.Second))
 
 		if baseDelay < resendDelayMax {
 			baseDelay *= 2
 		}
 	}
 
-	return nil, errNoMoreTries
+	return errNoMoreTries
 }
 
 func newDHCPClient(link netlink.Link) (*dhcp4client.Client, error) {
@@ -331,7 +520,7 @@ func newDHCPClient(link netlink.Link) (*dhcp4client.Client, error) {
 
 	return dhcp4client.New(
 		dhcp4client.HardwareAddr(link.Attrs().HardwareAddr),
-		dhcp4client.Timeout(5*time.Second),
+		dhcp4client.Timeout(exchangeTimeout),
 		dhcp4client.Broadcast(false),
 		dhcp4client.Connection(pktsock),
 	)
@@ -19,9 +19,11 @@ import (
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/appc/cni/pkg/skel"
 	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
 )
 
 const socketPath = "/run/cni/dhcp.sock"
@@ -30,16 +32,29 @@ func main() {
 	if len(os.Args) > 1 && os.Args[1] == "daemon" {
 		runDaemon()
 	} else {
-		skel.PluginMain(cmdAdd, cmdDel)
+		skel.PluginMain(cmdAdd, cmdDel, nil, version.All)
 	}
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
-	result := types.Result{}
-	if err := rpcCall("DHCP.Allocate", args, &result); err != nil {
+	confVersion, err := version.ConfigVersion(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// The daemon enters the netns itself, for as long as it renews the
+	// lease, so a path that only resolves within this process (such as
+	// the inherited netns handle of invoke.Args) is of no use to it.
+	if processLocal(args.Netns) {
+		return types.NewInvalidEnvironmentVariablesError(
+			fmt.Sprintf("netns %q is only valid within the plugin process; the dhcp daemon needs a path it can open", args.Netns), "")
+	}
+
+	result := &types.Result010{}
+	if err := rpcCall("DHCP.Allocate", args, result); err != nil {
 		return err
 	}
-	return result.Print()
+	return types.PrintResult(result, confVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -50,6 +65,12 @@ func cmdDel(args *skel.CmdArgs) error {
 	return nil
 }
 
+// processLocal reports whether path names a different file depending on
+// the process that opens it.
+func processLocal(path string) bool {
+	return strings.HasPrefix(path, "/proc/self/") || strings.HasPrefix(path, "/proc/thread-self/")
+}
+
 func rpcCall(method string, args *skel.CmdArgs, result interface{}) error {
 	client, err := rpc.DialHTTP("unix", socketPath)
 	if err != nil {
@@ -23,42 +23,82 @@ import (
 	"github.com/appc/cni/plugins/ipam/host-local/backend"
 )
 
+// IPAllocator hands out addresses of one family from the ranges of
+// a network.
 type IPAllocator struct {
-	start net.IP
-	end   net.IP
-	conf  *IPAMConfig
-	store backend.Store
+	ranges  []*allocRange
+	v6      bool
+	exclude []ipSpan
+	conf    *IPAMConfig
+	store   backend.Store
 }
 
+// NewIPAllocator returns an allocator for a network whose ranges are
+// all of one address family.
 func NewIPAllocator(conf *IPAMConfig, store backend.Store) (*IPAllocator, error) {
-	var (
-		start net.IP
-		end   net.IP
-		err   error
-	)
-	start, end, err = networkRange((*net.IPNet)(&conf.Subnet))
+	allocators, err := NewIPAllocators(conf, store)
 	if err != nil {
 		return nil, err
 	}
+	if len(allocators) > 1 {
+		return nil, fmt.Errorf("network %s has both IPv4 and IPv6 ranges", conf.Name)
+	}
+	return allocators[0], nil
+}
 
-	// skip the .0 address
-	start = ip.NextIP(start)
+// NewIPAllocators returns an allocator for each address family the
+// network has ranges of, IPv4 first.
+func NewIPAllocators(conf *IPAMConfig, store backend.Store) ([]*IPAllocator, error) {
+	rangeSet, err := conf.rangeSet()
+	if err != nil {
+		return nil, err
+	}
 
-	if conf.RangeStart != nil {
-		if err := validateRangeIP(conf.RangeStart, (*net.IPNet)(&conf.Subnet)); err != nil {
-			return nil, err
-		}
-		start = conf.RangeStart
+	ranges, err := rangeSet.resolve()
+	if err != nil {
+		return nil, err
 	}
-	if conf.RangeEnd != nil {
-		if err := validateRangeIP(conf.RangeEnd, (*net.IPNet)(&conf.Subnet)); err != nil {
-			return nil, err
+
+	exclude, err := parseExclude(conf.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var v4, v6 []*allocRange
+	for _, r := range ranges {
+		if r.start.To4() != nil {
+			v4 = append(v4, r)
+		} else {
+			v6 = append(v6, r)
 		}
-		// RangeEnd is inclusive
-		end = ip.NextIP(conf.RangeEnd)
 	}
 
-	return &IPAllocator{start, end, conf, store}, nil
+	var allocators []*IPAllocator
+	if len(v4) > 0 {
+		allocators = append(allocators, &IPAllocator{v4, false, exclude, conf, store})
+	}
+	if len(v6) > 0 {
+		allocators = append(allocators, &IPAllocator{v6, true, exclude, conf, store})
+	}
+
+	return allocators, nil
+}
+
+// checkRequestedIP returns an error if the IP requested through CNI_ARGS
+// is of a family that none of allocators hands out, as each allocator
+// ignores an IP of the other family.
+func checkRequestedIP(conf *IPAMConfig, allocators []*IPAllocator) error {
+	if conf.Args == nil || conf.Args.IP == nil {
+		return nil
+	}
+
+	requested := conf.Args.IP
+	for _, a := range allocators {
+		if (requested.To4() == nil) == a.v6 {
+			return nil
+		}
+	}
+	return fmt.Errorf("requested IP %s is not in any range of network: %s", requested, conf.Name)
 }
 
 func validateRangeIP(ip net.IP, ipnet *net.IPNet) error {
@@ -70,31 +110,29 @@ func validateRangeIP(ip net.IP, ipnet *net.IPNet) error {
 
 // Returns newly allocated IP along with its config
 func (a *IPAllocator) Get(id string) (*types.IPConfig, error) {
-	a.store.Lock()
-	defer a.store.Unlock()
-
-	gw := a.conf.Gateway
-	if gw == nil {
-		gw = ip.NextIP(a.conf.Subnet.IP)
+	if err := a.store.Lock(); err != nil {
+		return nil, fmt.Errorf("failed to lock store: %v", err)
 	}
+	defer a.store.Unlock()
 
+	// a requested IP only applies to the allocator of its family
 	var requestedIP net.IP
-	if a.conf.Args != nil {
+	if a.conf.Args != nil && a.conf.Args.IP != nil && (a.conf.Args.IP.To4() == nil) == a.v6 {
 		requestedIP = a.conf.Args.IP
 	}
 
 	if requestedIP != nil {
-		if gw != nil && gw.Equal(a.conf.Args.IP) {
-			return nil, fmt.Errorf("requested IP must differ gateway IP")
+		r, err := a.rangeFor(requestedIP)
+		if err != nil {
+			return nil, err
 		}
 
-		subnet := net.IPNet{
-			IP:   a.conf.Subnet.IP,
-			Mask: a.conf.Subnet.Mask,
+		if r.gw != nil && r.gw.Equal(requestedIP) {
+			return nil, fmt.Errorf("requested IP must differ gateway IP")
 		}
-		err := validateRangeIP(requestedIP, &subnet)
-		if err != nil {
-			return nil, err
+
+		if a.excluded(requestedIP) != nil {
+			return nil, fmt.Errorf("requested IP %s is excluded from allocation in network: %s", requestedIP, a.conf.Name)
 		}
 
 		reserved, err := a.store.Reserve(id, requestedIP)
@@ -103,39 +141,177 @@ func (a *IPAllocator) Get(id string) (*types.IPConfig, error) {
 		}
 
 		if reserved {
-			return &types.IPConfig{
-				IP:      net.IPNet{IP: requestedIP, Mask: a.conf.Subnet.Mask},
-				Gateway: gw,
-				Routes:  a.conf.Routes,
-			}, nil
+			return a.ipConfig(r, requestedIP), nil
 		}
 		return nil, fmt.Errorf("requested IP address %q is not available in network: %s", requestedIP, a.conf.Name)
 	}
 
-	for cur := a.start; !cur.Equal(a.end); cur = ip.NextIP(cur) {
-		// don't allocate gateway IP
-		if gw != nil && cur.Equal(gw) {
+	first, ok := a.scanStart()
+	if !ok {
+		return nil, fmt.Errorf("no IP addresses available in network: %s", a.conf.Name)
+	}
+
+	ips, err := a.store.ReservedIPs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list leases: %v", err)
+	}
+	used := newUsedIndex(ips)
+
+	for _, seg := range a.scanOrder(first) {
+		r := a.ranges[seg.idx]
+		for cur := used.firstFree(seg.from, seg.to); cur != nil; cur = used.firstFree(ip.NextIP(cur), seg.to) {
+			// don't allocate gateway IP
+			if r.gw != nil && cur.Equal(r.gw) {
+				continue
+			}
+			// skip the rest of an excluded span in one go
+			if span := a.excluded(cur); span != nil {
+				if !r.contains(ip.NextIP(span.last)) {
+					break
+				}
+				cur = span.last
+				continue
+			}
+			reserved, err := a.store.Reserve(id, cur)
+			if err != nil {
+				return nil, err
+			}
+			if reserved {
+				return a.ipConfig(r, cur), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no IP addresses available in network: %s", a.conf.Name)
+}
+
+func (a *IPAllocator) ipConfig(r *allocRange, addr net.IP) *types.IPConfig {
+	// routes without a gw go via the gateway of the range addr came
+	// from; routes of the other family belong to the other allocator
+	var routes []types.Route
+	for _, route := range a.conf.Routes {
+		if (route.Dst.IP.To4() == nil) != a.v6 {
 			continue
 		}
+		if route.GW == nil {
+			route.GW = r.gw
+		}
+		routes = append(routes, route)
+	}
 
-		reserved, err := a.store.Reserve(id, cur)
-		if err != nil {
-			return nil, err
+	return &types.IPConfig{
+		IP:      net.IPNet{IP: addr, Mask: r.subnet.Mask},
+		Gateway: r.gw,
+		Routes:  routes,
+	}
+}
+
+// rangeFor returns the range that addr may be allocated from.
+func (a *IPAllocator) rangeFor(addr net.IP) (*allocRange, error) {
+	for _, r := range a.ranges {
+		if r.contains(addr) {
+			return r, nil
 		}
-		if reserved {
-			return &types.IPConfig{
-				IP:      net.IPNet{IP: cur, Mask: a.conf.Subnet.Mask},
-				Gateway: gw,
-				Routes:  a.conf.Routes,
-			}, nil
+	}
+	return nil, fmt.Errorf("requested IP %s is not in any range of network: %s", addr, a.conf.Name)
+}
+
+// excluded returns the excluded span addr lies in, or nil.
+func (a *IPAllocator) excluded(addr net.IP) *ipSpan {
+	for i := range a.exclude {
+		if a.exclude[i].contains(addr) {
+			return &a.exclude[i]
 		}
 	}
-	return nil, fmt.Errorf("no IP addresses available in network: %s", a.conf.Name)
+	return nil
+}
+
+// position is an address within one of the allocator's ranges.
+type position struct {
+	idx int
+	ip  net.IP
+}
+
+// next returns the address after pos, moving on to the following
+// non-empty range, and back to the first, at the end of a range.
+func (a *IPAllocator) next(pos position) position {
+	if next := ip.NextIP(pos.ip); !next.Equal(a.ranges[pos.idx].end) {
+		return position{pos.idx, next}
+	}
+
+	idx := pos.idx
+	for {
+		idx = (idx + 1) % len(a.ranges)
+		if r := a.ranges[idx]; !r.empty() {
+			return position{idx, r.start}
+		}
+	}
+}
+
+// segment is the addresses [from, to) of one of the allocator's ranges.
+type segment struct {
+	idx      int
+	from, to net.IP
+}
+
+// scanOrder splits the scan for a free address starting at first into
+// the segments to look through in turn: the rest of first's range, the
+// following non-empty ranges, and then wrapping around so that a
+// last-used scan also covers the addresses before where it started.
+func (a *IPAllocator) scanOrder(first position) []segment {
+	r := a.ranges[first.idx]
+	segs := []segment{{first.idx, first.ip, r.end}}
+	for i := 1; i < len(a.ranges); i++ {
+		idx := (first.idx + i) % len(a.ranges)
+		if other := a.ranges[idx]; !other.empty() {
+			segs = append(segs, segment{idx, other.start, other.end})
+		}
+	}
+	if !first.ip.Equal(r.start) {
+		segs = append(segs, segment{first.idx, r.start, first.ip})
+	}
+	return segs
+}
+
+// scanStart returns the address to start looking for a free one at,
+// according to the configured allocation strategy. It returns false if
+// every range is empty.
+func (a *IPAllocator) scanStart() (position, bool) {
+	first := -1
+	for i, r := range a.ranges {
+		if !r.empty() {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return position{}, false
+	}
+	start := position{first, a.ranges[first].start}
+
+	if a.conf.AllocationStrategy != StrategyLastUsed {
+		return start, true
+	}
+
+	last, err := a.store.LastReservedIP(a.v6)
+	if err != nil || last == nil {
+		// nothing reserved yet
+		return start, true
+	}
+
+	for i, r := range a.ranges {
+		if r.contains(last) {
+			return a.next(position{i, last}), true
+		}
+	}
+	// the ranges changed since
+	return start, true
 }
 
 // Releases all IPs allocated for the container with given ID
 func (a *IPAllocator) Release(id string) error {
-	a.store.Lock()
+	if err := a.store.Lock(); err != nil {
+		return fmt.Errorf("failed to lock store: %v", err)
+	}
 	defer a.store.Unlock()
 
 	return a.store.ReleaseByID(id)
@@ -157,9 +333,10 @@ func networkRange(ipnet *net.IPNet) (net.IP, net.IP, error) {
 		return nil, nil, fmt.Errorf("IPNet IP and Mask version mismatch")
 	}
 
-	var end net.IP
+	var start, end net.IP
 	for i := 0; i < len(ip); i++ {
+		start = append(start, ip[i]&ipnet.Mask[i])
 		end = append(end, ip[i]|^ipnet.Mask[i])
 	}
-	return ipnet.IP, end, nil
+	return start, end, nil
 }
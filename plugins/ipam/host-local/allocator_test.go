@@ -0,0 +1,531 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/plugins/ipam/host-local/backend/disk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("host-local allocator", func() {
+	var (
+		dataDir   string
+		store     *disk.Store
+		conf      *IPAMConfig
+		allocator *IPAllocator
+	)
+
+	newAllocator := func(subnet string) *IPAllocator {
+		ipn, err := types.ParseCIDR(subnet)
+		Expect(err).NotTo(HaveOccurred())
+		conf = &IPAMConfig{
+			Name:    "test-net",
+			Type:    "host-local",
+			Subnet:  types.IPNet(*ipn),
+			DataDir: dataDir,
+		}
+
+		store, err = disk.New(conf.Name, conf.DataDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		a, err := NewIPAllocator(conf, store)
+		Expect(err).NotTo(HaveOccurred())
+		return a
+	}
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(store.Close()).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("allocates the first free address after the gateway", func() {
+		allocator = newAllocator("10.0.0.0/24")
+
+		ipConf, err := allocator.Get("container-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipConf.IP.String()).To(Equal("10.0.0.2/24"))
+		Expect(ipConf.Gateway.String()).To(Equal("10.0.0.1"))
+	})
+
+	Describe("the gateway", func() {
+		It("defaults to the first usable address and is never allocated", func() {
+			allocator = newAllocator("10.0.0.0/29")
+
+			var allocated []string
+			for i := 0; ; i++ {
+				ipConf, err := allocator.Get(fmt.Sprintf("container-%d", i))
+				if err != nil {
+					Expect(err).To(MatchError("no IP addresses available in network: test-net"))
+					break
+				}
+				Expect(ipConf.Gateway.String()).To(Equal("10.0.0.1"))
+				allocated = append(allocated, ipConf.IP.IP.String())
+			}
+
+			Expect(allocated).To(Equal([]string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}))
+		})
+
+		It("is derived from the network address when the subnet has host bits set", func() {
+			allocator = newAllocator("10.0.0.5/29")
+
+			ipConf, err := allocator.Get("container-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipConf.Gateway.String()).To(Equal("10.0.0.1"))
+			Expect(ipConf.IP.String()).To(Equal("10.0.0.2/29"))
+		})
+
+		It("is skipped when configured explicitly inside the range", func() {
+			newAllocator("10.0.0.0/29")
+			conf.Gateway = net.ParseIP("10.0.0.3")
+			var err error
+			allocator, err = NewIPAllocator(conf, store)
+			Expect(err).NotTo(HaveOccurred())
+
+			var allocated []string
+			for i := 0; i < 5; i++ {
+				ipConf, err := allocator.Get(fmt.Sprintf("container-%d", i))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ipConf.Gateway.String()).To(Equal("10.0.0.3"))
+				allocated = append(allocated, ipConf.IP.IP.String())
+			}
+			Expect(allocated).To(Equal([]string{"10.0.0.1", "10.0.0.2", "10.0.0.4", "10.0.0.5", "10.0.0.6"}))
+
+			_, err = allocator.Get("container-5")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("records the container ID in a lease file under dataDir", func() {
+		allocator = newAllocator("10.0.0.0/24")
+
+		_, err := allocator.Get("container-1")
+		Expect(err).NotTo(HaveOccurred())
+
+		contents, err := ioutil.ReadFile(filepath.Join(dataDir, "test-net", "10.0.0.2"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(Equal("container-1"))
+	})
+
+	Context("when the subnet is exhausted", func() {
+		It("returns an error", func() {
+			// a /30 leaves only .2 once the network, gateway and
+			// broadcast addresses are skipped
+			allocator = newAllocator("10.0.0.0/30")
+
+			ipConf, err := allocator.Get("container-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipConf.IP.String()).To(Equal("10.0.0.2/30"))
+
+			_, err = allocator.Get("container-2")
+			Expect(err).To(MatchError("no IP addresses available in network: test-net"))
+		})
+	})
+
+	Describe("Release", func() {
+		It("frees the address for reuse", func() {
+			allocator = newAllocator("10.0.0.0/30")
+
+			_, err := allocator.Get("container-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(allocator.Release("container-1")).To(Succeed())
+
+			_, err = os.Stat(filepath.Join(dataDir, "test-net", "10.0.0.2"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			ipConf, err := allocator.Get("container-2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipConf.IP.String()).To(Equal("10.0.0.2/30"))
+		})
+
+		It("leaves other containers' leases alone", func() {
+			allocator = newAllocator("10.0.0.0/24")
+
+			_, err := allocator.Get("container-1")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = allocator.Get("container-2")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(allocator.Release("container-1")).To(Succeed())
+
+			contents, err := ioutil.ReadFile(filepath.Join(dataDir, "test-net", "10.0.0.3"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("container-2"))
+		})
+	})
+
+	Context("when many allocations run concurrently", func() {
+		It("never hands out the same address twice", func() {
+			allocator = newAllocator("10.0.0.0/24")
+
+			const workers = 50
+
+			var wg sync.WaitGroup
+			ips := make(chan string, workers)
+			errs := make(chan error, workers)
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(id string) {
+					defer wg.Done()
+					defer GinkgoRecover()
+
+					// a store per worker, like separate plugin processes
+					s, err := disk.New(conf.Name, conf.DataDir)
+					if err != nil {
+						errs <- err
+						return
+					}
+					defer s.Close()
+
+					a, err := NewIPAllocator(conf, s)
+					if err != nil {
+						errs <- err
+						return
+					}
+
+					ipConf, err := a.Get(id)
+					if err != nil {
+						errs <- err
+						return
+					}
+					ips <- ipConf.IP.IP.String()
+				}(fmt.Sprintf("container-%d", i))
+			}
+			wg.Wait()
+			close(ips)
+			close(errs)
+
+			for err := range errs {
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			seen := map[string]bool{}
+			for ip := range ips {
+				Expect(seen).NotTo(HaveKey(ip))
+				seen[ip] = true
+			}
+			Expect(seen).To(HaveLen(workers))
+		})
+	})
+
+	It("keeps its lock in the network's data dir", func() {
+		allocator = newAllocator("10.0.0.0/24")
+
+		_, err := os.Stat(filepath.Join(dataDir, "test-net", "lock"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Context("when a specific IP is requested", func() {
+		getIP := func(id, requested string) (*types.IPConfig, error) {
+			conf.Args = &IPAMArgs{IP: net.ParseIP(requested)}
+			defer func() { conf.Args = nil }()
+			return allocator.Get(id)
+		}
+
+		BeforeEach(func() {
+			allocator = newAllocator("10.0.0.0/24")
+		})
+
+		It("allocates exactly that address", func() {
+			ipConf, err := getIP("container-1", "10.0.0.50")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipConf.IP.String()).To(Equal("10.0.0.50/24"))
+			Expect(ipConf.Gateway.String()).To(Equal("10.0.0.1"))
+
+			contents, err := ioutil.ReadFile(filepath.Join(dataDir, "test-net", "10.0.0.50"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("container-1"))
+		})
+
+		It("refuses it to a second container", func() {
+			_, err := getIP("container-1", "10.0.0.50")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = getIP("container-2", "10.0.0.50")
+			Expect(err).To(MatchError(`requested IP address "10.0.0.50" is not available in network: test-net`))
+		})
+
+		It("leaves dynamic allocation to skip it", func() {
+			_, err := getIP("container-1", "10.0.0.2")
+			Expect(err).NotTo(HaveOccurred())
+
+			ipConf, err := allocator.Get("container-2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipConf.IP.String()).To(Equal("10.0.0.3/24"))
+		})
+
+		It("rejects an address outside the range", func() {
+			conf.RangeStart = net.ParseIP("10.0.0.10")
+			conf.RangeEnd = net.ParseIP("10.0.0.20")
+			var err error
+			allocator, err = NewIPAllocator(conf, store)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = getIP("container-1", "10.0.0.50")
+			Expect(err).To(MatchError("requested IP 10.0.0.50 is not in any range of network: test-net"))
+
+			_, err = getIP("container-1", "10.0.1.50")
+			Expect(err).To(MatchError("requested IP 10.0.1.50 is not in any range of network: test-net"))
+		})
+
+		It("rejects the gateway address", func() {
+			conf.RangeStart = net.ParseIP("10.0.0.1")
+			var err error
+			allocator, err = NewIPAllocator(conf, store)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = getIP("container-1", "10.0.0.1")
+			Expect(err).To(MatchError("requested IP must differ gateway IP"))
+		})
+	})
+
+	Context("with excluded addresses", func() {
+		// newExcluding returns an allocator for subnet that never hands
+		// out the addresses of exclude
+		newExcluding := func(subnet string, exclude ...string) *IPAllocator {
+			newAllocator(subnet)
+			conf.Exclude = exclude
+			a, err := NewIPAllocator(conf, store)
+			Expect(err).NotTo(HaveOccurred())
+			return a
+		}
+
+		allocateAll := func() []string {
+			var allocated []string
+			for i := 0; ; i++ {
+				ipConf, err := allocator.Get(fmt.Sprintf("container-%d", i))
+				if err != nil {
+					Expect(err).To(MatchError("no IP addresses available in network: test-net"))
+					return allocated
+				}
+				allocated = append(allocated, ipConf.IP.IP.String())
+			}
+		}
+
+		It("never allocates excluded single addresses or ranges", func() {
+			allocator = newExcluding("10.0.0.0/28", "10.0.0.3/32", "10.0.0.5-10.0.0.9", "10.0.0.12/30")
+			Expect(allocateAll()).To(Equal([]string{"10.0.0.2", "10.0.0.4", "10.0.0.10", "10.0.0.11"}))
+		})
+
+		It("skips them in a last-used scan that wraps around", func() {
+			allocator = newExcluding("10.0.0.0/29", "10.0.0.2-10.0.0.3")
+			conf.AllocationStrategy = StrategyLastUsed
+
+			allocated := allocateAll()
+			Expect(allocated).To(Equal([]string{"10.0.0.4", "10.0.0.5", "10.0.0.6"}))
+
+			Expect(allocator.Release("container-0")).To(Succeed())
+			ipConf, err := allocator.Get("container-again")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipConf.IP.IP.String()).To(Equal("10.0.0.4"))
+		})
+
+		It("returns the no-addresses error when the whole subnet is excluded", func() {
+			allocator = newExcluding("10.0.0.0/24", "10.0.0.0/24")
+
+			_, err := allocator.Get("container-1")
+			Expect(err).To(MatchError("no IP addresses available in network: test-net"))
+		})
+
+		It("rejects a requested IP that is excluded", func() {
+			allocator = newExcluding("10.0.0.0/24", "10.0.0.20-10.0.0.25")
+			conf.Args = &IPAMArgs{IP: net.ParseIP("10.0.0.22")}
+
+			_, err := allocator.Get("container-1")
+			Expect(err).To(MatchError("requested IP 10.0.0.22 is excluded from allocation in network: test-net"))
+		})
+
+		It("ignores excluded addresses of the other family", func() {
+			allocator = newExcluding("10.0.0.0/29", "fd00::/8")
+			Expect(allocateAll()).To(HaveLen(5))
+		})
+	})
+
+	Context("with several ranges", func() {
+		newRangeAllocator := func(subnets ...string) *IPAllocator {
+			conf = &IPAMConfig{
+				Name:    "test-net",
+				Type:    "host-local",
+				DataDir: dataDir,
+			}
+			for _, subnet := range subnets {
+				ipn, err := types.ParseCIDR(subnet)
+				Expect(err).NotTo(HaveOccurred())
+				conf.Ranges = append(conf.Ranges, Range{Subnet: types.IPNet(*ipn)})
+			}
+
+			var err error
+			store, err = disk.New(conf.Name, conf.DataDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			a, err := NewIPAllocator(conf, store)
+			Expect(err).NotTo(HaveOccurred())
+			return a
+		}
+
+		It("moves on to the next range once the first is full", func() {
+			// each /28 has .2 to .14 free once the network, gateway and
+			// broadcast addresses are skipped
+			allocator = newRangeAllocator("10.0.0.0/28", "10.0.0.16/28")
+
+			var ipConf *types.IPConfig
+			var err error
+			for i := 0; i < 13; i++ {
+				ipConf, err = allocator.Get(fmt.Sprintf("container-%d", i))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(ipConf.IP.String()).To(Equal("10.0.0.14/28"))
+			Expect(ipConf.Gateway.String()).To(Equal("10.0.0.1"))
+
+			ipConf, err = allocator.Get("container-overflow")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipConf.IP.String()).To(Equal("10.0.0.18/28"))
+			Expect(ipConf.Gateway.String()).To(Equal("10.0.0.17"))
+		})
+
+		It("releases an address from whichever range it came from", func() {
+			allocator = newRangeAllocator("10.0.0.0/30", "10.0.0.4/30")
+
+			_, err := allocator.Get("container-1")
+			Expect(err).NotTo(HaveOccurred())
+			ipConf, err := allocator.Get("container-2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipConf.IP.String()).To(Equal("10.0.0.6/30"))
+
+			Expect(allocator.Release("container-2")).To(Succeed())
+			_, err = os.Stat(filepath.Join(dataDir, "test-net", "10.0.0.6"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			ipConf, err = allocator.Get("container-3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipConf.IP.String()).To(Equal("10.0.0.6/30"))
+		})
+
+		It("returns an error when every range is exhausted", func() {
+			allocator = newRangeAllocator("10.0.0.0/30", "10.0.0.4/30")
+
+			_, err := allocator.Get("container-1")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = allocator.Get("container-2")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = allocator.Get("container-3")
+			Expect(err).To(MatchError("no IP addresses available in network: test-net"))
+		})
+
+		It("wraps a last-used scan around to the first range", func() {
+			allocator = newRangeAllocator("10.0.0.0/30", "10.0.0.4/30")
+			conf.AllocationStrategy = StrategyLastUsed
+
+			_, err := allocator.Get("container-1")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = allocator.Get("container-2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(allocator.Release("container-1")).To(Succeed())
+
+			ipConf, err := allocator.Get("container-3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipConf.IP.String()).To(Equal("10.0.0.2/30"))
+		})
+
+		It("rejects a requested IP outside every range", func() {
+			allocator = newRangeAllocator("10.0.0.0/30", "10.0.0.4/30")
+			conf.Args = &IPAMArgs{IP: net.ParseIP("10.0.1.2")}
+
+			_, err := allocator.Get("container-1")
+			Expect(err).To(MatchError("requested IP 10.0.1.2 is not in any range of network: test-net"))
+		})
+	})
+
+	Describe("allocation strategies", func() {
+		// getFresh allocates through a new store and allocator, as a
+		// separate plugin invocation would
+		getFresh := func(id string) string {
+			s, err := disk.New(conf.Name, conf.DataDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			a, err := NewIPAllocator(conf, s)
+			Expect(err).NotTo(HaveOccurred())
+
+			ipConf, err := a.Get(id)
+			Expect(err).NotTo(HaveOccurred())
+			return ipConf.IP.IP.String()
+		}
+
+		Context("sequential", func() {
+			BeforeEach(func() {
+				allocator = newAllocator("10.0.0.0/24")
+				conf.AllocationStrategy = StrategySequential
+			})
+
+			It("hands out the lowest free addresses in order", func() {
+				Expect(getFresh("container-1")).To(Equal("10.0.0.2"))
+				Expect(getFresh("container-2")).To(Equal("10.0.0.3"))
+				Expect(getFresh("container-3")).To(Equal("10.0.0.4"))
+			})
+
+			It("reuses a freed address first", func() {
+				Expect(getFresh("container-1")).To(Equal("10.0.0.2"))
+				Expect(getFresh("container-2")).To(Equal("10.0.0.3"))
+				Expect(allocator.Release("container-1")).To(Succeed())
+
+				Expect(getFresh("container-3")).To(Equal("10.0.0.2"))
+			})
+		})
+
+		Context("last-used", func() {
+			BeforeEach(func() {
+				allocator = newAllocator("10.0.0.0/24")
+				conf.AllocationStrategy = StrategyLastUsed
+			})
+
+			It("continues past the previously allocated address across invocations", func() {
+				Expect(getFresh("container-1")).To(Equal("10.0.0.2"))
+				Expect(getFresh("container-2")).To(Equal("10.0.0.3"))
+				Expect(allocator.Release("container-1")).To(Succeed())
+
+				Expect(getFresh("container-3")).To(Equal("10.0.0.4"))
+			})
+
+			It("wraps around to the start of the range", func() {
+				conf.RangeStart = net.ParseIP("10.0.0.10")
+				conf.RangeEnd = net.ParseIP("10.0.0.11")
+
+				Expect(getFresh("container-1")).To(Equal("10.0.0.10"))
+				Expect(getFresh("container-2")).To(Equal("10.0.0.11"))
+				Expect(allocator.Release("container-1")).To(Succeed())
+
+				Expect(getFresh("container-3")).To(Equal("10.0.0.10"))
+			})
+		})
+	})
+})
@@ -15,6 +15,7 @@
 package disk
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
@@ -23,18 +24,35 @@ import (
 
 var defaultDataDir = "/var/lib/cni/networks"
 
+const (
+	// lockFileName is flock'ed to serialize allocations across processes
+	// sharing a data dir
+	lockFileName = "lock"
+	// lastIPFileName and lastIP6FileName record the most recently
+	// reserved IPv4 and IPv6 address so that allocation can resume
+	// after it
+	lastIPFileName  = "last_reserved_ip"
+	lastIP6FileName = "last_reserved_ip6"
+)
+
 type Store struct {
 	FileLock
 	dataDir string
 }
 
-func New(network string) (*Store, error) {
-	dir := filepath.Join(defaultDataDir, network)
-	if err := os.MkdirAll(dir, 0644); err != nil {
+// New returns a Store keeping the leases of network under dataDir,
+// one file per IP address containing the owning container ID.
+// An empty dataDir selects /var/lib/cni/networks.
+func New(network, dataDir string) (*Store, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	dir := filepath.Join(dataDir, network)
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
 
-	lk, err := NewFileLock(dir)
+	lk, err := NewFileLock(filepath.Join(dir, lockFileName))
 	if err != nil {
 		return nil, err
 	}
@@ -59,9 +77,59 @@ func (s *Store) Reserve(id string, ip net.IP) (bool, error) {
 		os.Remove(f.Name())
 		return false, err
 	}
+	// store the reserved ip in lastIPFile
+	ipfile := s.lastIPFile(ip.To4() == nil)
+	if err := ioutil.WriteFile(ipfile, []byte(ip.String()), 0644); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
+func (s *Store) lastIPFile(v6 bool) string {
+	if v6 {
+		return filepath.Join(s.dataDir, lastIP6FileName)
+	}
+	return filepath.Join(s.dataDir, lastIPFileName)
+}
+
+// LastReservedIP returns the last reserved IP of the family if exists
+func (s *Store) LastReservedIP(v6 bool) (net.IP, error) {
+	ipfile := s.lastIPFile(v6)
+	data, err := ioutil.ReadFile(ipfile)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(string(data))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q in %s", data, ipfile)
+	}
+	return ip, nil
+}
+
+// ReservedIPs returns the IPs of all lease files. It only reads the
+// names, so that it is one pass over the directory however many
+// leases there are.
+func (s *Store) ReservedIPs() ([]net.IP, error) {
+	dir, err := os.Open(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
 func (s *Store) Release(ip net.IP) error {
 	return os.Remove(filepath.Join(s.dataDir, ip.String()))
 }
@@ -70,7 +138,7 @@ func (s *Store) Release(ip net.IP) error {
 // release as much as possible
 func (s *Store) ReleaseByID(id string) error {
 	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
+		if err != nil || info.IsDir() || info.Name() == lockFileName || info.Name() == lastIPFileName || info.Name() == lastIP6FileName {
 			return nil
 		}
 		data, err := ioutil.ReadFile(path)
@@ -86,3 +154,41 @@ func (s *Store) ReleaseByID(id string) error {
 	})
 	return err
 }
+
+// ReapStale removes the lease files whose container ID is not in
+// validIDs and returns their IPs.
+func (s *Store) ReapStale(validIDs []string) ([]net.IP, error) {
+	valid := make(map[string]bool, len(validIDs))
+	for _, id := range validIDs {
+		valid[id] = true
+	}
+
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var reaped []net.IP
+	for _, f := range files {
+		ip := net.ParseIP(f.Name())
+		if f.IsDir() || ip == nil {
+			// the lock, last_reserved_ip or something we don't own
+			continue
+		}
+
+		path := filepath.Join(s.dataDir, f.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return reaped, err
+		}
+		if valid[string(data)] {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			return reaped, err
+		}
+		reaped = append(reaped, ip)
+	}
+	return reaped, nil
+}
@@ -24,9 +24,10 @@ type FileLock struct {
 	f *os.File
 }
 
-// NewFileLock opens file/dir at path and returns unlocked FileLock object
+// NewFileLock opens the file at path, creating it if needed, and
+// returns unlocked FileLock object
 func NewFileLock(path string) (*FileLock, error) {
-	f, err := os.Open(path)
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
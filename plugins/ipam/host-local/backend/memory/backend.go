@@ -0,0 +1,168 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory is a host-local store that keeps leases in the memory of
+// the current process. Leases do not survive the process, so it only suits
+// nodes without writable storage where a long-lived process owns the
+// allocations.
+package memory
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// network holds the leases of one network, keyed by IP.
+type network struct {
+	// lock is what Store.Lock takes, serializing allocations
+	lock sync.Mutex
+
+	mu      sync.Mutex
+	leases  map[string]string
+	lastIP  net.IP
+	lastIP6 net.IP
+}
+
+var (
+	networksMu sync.Mutex
+	networks   = map[string]*network{}
+)
+
+type Store struct {
+	*network
+}
+
+// New returns a Store for the leases of the named network. Stores created
+// for the same network within a process share their leases.
+func New(name string) *Store {
+	networksMu.Lock()
+	defer networksMu.Unlock()
+
+	n, ok := networks[name]
+	if !ok {
+		n = &network{leases: map[string]string{}}
+		networks[name] = n
+	}
+	return &Store{n}
+}
+
+func (s *Store) Lock() error {
+	s.lock.Lock()
+	return nil
+}
+
+func (s *Store) Unlock() error {
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) Close() error {
+	return nil
+}
+
+func (s *Store) Reserve(id string, ip net.IP) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.leases[ip.String()]; ok {
+		return false, nil
+	}
+	s.leases[ip.String()] = id
+	if ip.To4() != nil {
+		s.lastIP = ip
+	} else {
+		s.lastIP6 = ip
+	}
+	return true, nil
+}
+
+// LastReservedIP returns the last reserved IP of the family if exists
+func (s *Store) LastReservedIP(v6 bool) (net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := s.lastIP
+	if v6 {
+		last = s.lastIP6
+	}
+	if last == nil {
+		return nil, fmt.Errorf("no IP reserved yet")
+	}
+	return last, nil
+}
+
+func (s *Store) ReservedIPs() ([]net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ips := make([]net.IP, 0, len(s.leases))
+	for ip := range s.leases {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips, nil
+}
+
+func (s *Store) Release(ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.leases, ip.String())
+	return nil
+}
+
+func (s *Store) ReleaseByID(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ip, owner := range s.leases {
+		if owner == id {
+			delete(s.leases, ip)
+		}
+	}
+	return nil
+}
+
+// ReapStale removes the leases whose container ID is not in validIDs
+// and returns their IPs.
+func (s *Store) ReapStale(validIDs []string) ([]net.IP, error) {
+	valid := make(map[string]bool, len(validIDs))
+	for _, id := range validIDs {
+		valid[id] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reaped []net.IP
+	for ip, owner := range s.leases {
+		if !valid[owner] {
+			delete(s.leases, ip)
+			reaped = append(reaped, net.ParseIP(ip))
+		}
+	}
+	return reaped, nil
+}
+
+// Leases returns a copy of the current leases, mapping IP to container ID.
+func (s *Store) Leases() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	leases := make(map[string]string, len(s.leases))
+	for ip, id := range s.leases {
+		leases[ip] = id
+	}
+	return leases
+}
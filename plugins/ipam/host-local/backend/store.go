@@ -21,6 +21,15 @@ type Store interface {
 	Unlock() error
 	Close() error
 	Reserve(id string, ip net.IP) (bool, error)
+	// LastReservedIP returns the most recently reserved IPv4, or
+	// with v6 set IPv6, address.
+	LastReservedIP(v6 bool) (net.IP, error)
+	// ReservedIPs returns every address that is currently leased,
+	// in no particular order.
+	ReservedIPs() ([]net.IP, error)
 	Release(ip net.IP) error
 	ReleaseByID(id string) error
+	// ReapStale releases every lease not held by one of validIDs and
+	// returns the freed IPs. The caller must hold the lock.
+	ReapStale(validIDs []string) ([]net.IP, error)
 }
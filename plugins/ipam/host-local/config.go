@@ -22,21 +22,35 @@ import (
 	"github.com/appc/cni/pkg/types"
 )
 
+// Allocation strategies for picking the next free address.
+const (
+	// StrategySequential hands out the lowest free address in the range.
+	StrategySequential = "sequential"
+	// StrategyLastUsed resumes scanning after the most recently
+	// reserved address, avoiding immediate reuse of a freed one.
+	StrategyLastUsed = "last-used"
+)
+
 // IPAMConfig represents the IP related network configuration.
 type IPAMConfig struct {
-	Name       string
-	Type       string        `json:"type"`
-	RangeStart net.IP        `json:"rangeStart"`
-	RangeEnd   net.IP        `json:"rangeEnd"`
-	Subnet     types.IPNet   `json:"subnet"`
-	Gateway    net.IP        `json:"gateway"`
-	Routes     []types.Route `json:"routes"`
-	Args       *IPAMArgs     `json:"-"`
+	Name               string
+	Type               string        `json:"type"`
+	RangeStart         net.IP        `json:"rangeStart"`
+	RangeEnd           net.IP        `json:"rangeEnd"`
+	Subnet             types.IPNet   `json:"subnet"`
+	Gateway            net.IP        `json:"gateway"`
+	Routes             []types.Route `json:"routes"`
+	DNS                types.DNS     `json:"dns"`
+	DataDir            string        `json:"dataDir"`
+	AllocationStrategy string        `json:"allocationStrategy"`
+	Ranges             RangeSet      `json:"ranges"`
+	Exclude            []string      `json:"exclude"`
+	Args               *IPAMArgs     `json:"-"`
 }
 
 type IPAMArgs struct {
 	types.CommonArgs
-	IP net.IP `json:"ip,omitempty"`
+	IP net.IP `json:"ip,omitempty" cni:"IP"`
 }
 
 type Net struct {
@@ -51,6 +65,10 @@ func LoadIPAMConfig(bytes []byte, args string) (*IPAMConfig, error) {
 		return nil, err
 	}
 
+	if n.IPAM == nil {
+		return nil, fmt.Errorf("%q missing 'ipam' key", n.Name)
+	}
+
 	if args != "" {
 		n.IPAM.Args = &IPAMArgs{}
 		err := types.LoadArgs(args, n.IPAM.Args)
@@ -59,8 +77,24 @@ func LoadIPAMConfig(bytes []byte, args string) (*IPAMConfig, error) {
 		}
 	}
 
-	if n.IPAM == nil {
-		return nil, fmt.Errorf("%q missing 'ipam' key")
+	switch n.IPAM.AllocationStrategy {
+	case "":
+		n.IPAM.AllocationStrategy = StrategySequential
+	case StrategySequential, StrategyLastUsed:
+	default:
+		return nil, fmt.Errorf("unknown allocationStrategy %q", n.IPAM.AllocationStrategy)
+	}
+
+	rangeSet, err := n.IPAM.rangeSet()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rangeSet.resolve(); err != nil {
+		return nil, err
+	}
+
+	if _, err := parseExclude(n.IPAM.Exclude); err != nil {
+		return nil, err
 	}
 
 	// Copy net name into IPAM so not to drag Net struct around
@@ -68,3 +102,21 @@ func LoadIPAMConfig(bytes []byte, args string) (*IPAMConfig, error) {
 
 	return n.IPAM, nil
 }
+
+// rangeSet returns the ranges to allocate from. Without "ranges", the
+// top-level subnet, rangeStart, rangeEnd and gateway form a single range.
+func (c *IPAMConfig) rangeSet() (RangeSet, error) {
+	if len(c.Ranges) == 0 {
+		return RangeSet{{
+			Subnet:     c.Subnet,
+			RangeStart: c.RangeStart,
+			RangeEnd:   c.RangeEnd,
+			Gateway:    c.Gateway,
+		}}, nil
+	}
+
+	if c.Subnet.IP != nil || c.RangeStart != nil || c.RangeEnd != nil || c.Gateway != nil {
+		return nil, fmt.Errorf("%q cannot be combined with subnet, rangeStart, rangeEnd or gateway", "ranges")
+	}
+	return c.Ranges, nil
+}
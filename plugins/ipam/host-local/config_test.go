@@ -0,0 +1,152 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LoadIPAMConfig", func() {
+	It("defaults to the sequential allocation strategy", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "mynet",
+			"ipam": { "type": "host-local", "subnet": "10.1.2.0/24" }
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Name).To(Equal("mynet"))
+		Expect(conf.AllocationStrategy).To(Equal(StrategySequential))
+	})
+
+	It("parses the range and allocation strategy", func() {
+		conf, err := LoadIPAMConfig([]byte(`{
+			"name": "mynet",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"rangeStart": "10.1.2.10",
+				"rangeEnd": "10.1.2.20",
+				"allocationStrategy": "last-used"
+			}
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.RangeStart.String()).To(Equal("10.1.2.10"))
+		Expect(conf.RangeEnd.String()).To(Equal("10.1.2.20"))
+		Expect(conf.AllocationStrategy).To(Equal(StrategyLastUsed))
+	})
+
+	It("rejects an unknown allocation strategy", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+			"name": "mynet",
+			"ipam": { "type": "host-local", "subnet": "10.1.2.0/24", "allocationStrategy": "random" }
+		}`), "")
+		Expect(err).To(MatchError(`unknown allocationStrategy "random"`))
+	})
+
+	Describe("ranges", func() {
+		It("parses each range", func() {
+			conf, err := LoadIPAMConfig([]byte(`{
+				"name": "mynet",
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						{ "subnet": "10.1.2.0/28", "gateway": "10.1.2.1" },
+						{ "subnet": "10.1.2.16/28", "rangeStart": "10.1.2.20", "rangeEnd": "10.1.2.25" }
+					]
+				}
+			}`), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.Ranges).To(HaveLen(2))
+			Expect(conf.Ranges[0].Gateway.String()).To(Equal("10.1.2.1"))
+			Expect(conf.Ranges[1].RangeStart.String()).To(Equal("10.1.2.20"))
+			Expect(conf.Ranges[1].RangeEnd.String()).To(Equal("10.1.2.25"))
+		})
+
+		It("rejects overlapping ranges", func() {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "mynet",
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						{ "subnet": "10.1.2.0/28" },
+						{ "subnet": "10.1.2.0/24", "rangeStart": "10.1.2.10", "rangeEnd": "10.1.2.20" }
+					]
+				}
+			}`), "")
+			Expect(err).To(MatchError("range 1 (10.1.2.10-10.1.2.20) overlaps range 0 (10.1.2.1-10.1.2.14)"))
+		})
+
+		It("rejects ranges combined with a top-level subnet", func() {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "mynet",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.3.0/24",
+					"ranges": [ { "subnet": "10.1.2.0/28" } ]
+				}
+			}`), "")
+			Expect(err).To(MatchError(`"ranges" cannot be combined with subnet, rangeStart, rangeEnd or gateway`))
+		})
+
+		It("rejects a range outside its subnet", func() {
+			_, err := LoadIPAMConfig([]byte(`{
+				"name": "mynet",
+				"ipam": {
+					"type": "host-local",
+					"ranges": [ { "subnet": "10.1.2.0/28", "rangeEnd": "10.1.2.20" } ]
+				}
+			}`), "")
+			Expect(err).To(MatchError("10.1.2.20 not in network: 10.1.2.0/28"))
+		})
+	})
+
+	Describe("exclude", func() {
+		It("accepts addresses in CIDR and range form", func() {
+			conf, err := LoadIPAMConfig([]byte(`{
+				"name": "mynet",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"exclude": [ "10.1.2.10/32", "10.1.2.20-10.1.2.25" ]
+				}
+			}`), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.Exclude).To(Equal([]string{"10.1.2.10/32", "10.1.2.20-10.1.2.25"}))
+		})
+
+		DescribeTable("rejects a malformed entry",
+			func(entry, msg string) {
+				_, err := LoadIPAMConfig([]byte(fmt.Sprintf(`{
+					"name": "mynet",
+					"ipam": { "type": "host-local", "subnet": "10.1.2.0/24", "exclude": [ %q ] }
+				}`, entry)), "")
+				Expect(err).To(MatchError(fmt.Sprintf("invalid exclude entry %q: %s", entry, msg)))
+			},
+			Entry("not an address", "dns", "invalid CIDR address: dns"),
+			Entry("a bare address", "10.1.2.10", "invalid CIDR address: 10.1.2.10"),
+			Entry("a range of non-addresses", "a-b", "not a range of IP addresses"),
+			Entry("a range of both families", "10.1.2.10-fd00::1", "range mixes IPv4 and IPv6 addresses"),
+			Entry("a backwards range", "10.1.2.25-10.1.2.20", "range ends before it starts"),
+		)
+	})
+
+	It("rejects a config without an ipam section", func() {
+		_, err := LoadIPAMConfig([]byte(`{ "name": "mynet" }`), "")
+		Expect(err).To(MatchError(`"mynet" missing 'ipam' key`))
+	})
+})
@@ -0,0 +1,61 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/appc/cni/plugins/ipam/host-local/backend"
+)
+
+// runGC implements "host-local gc [container-id...]": it reads a network
+// configuration from stdin, frees every lease of that network not held by
+// one of the given containers and prints the freed IPs, one per line.
+func runGC(stdin io.Reader, stdout io.Writer, validIDs []string) error {
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+
+	ipamConf, err := LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	reaped, err := reapStale(store, validIDs)
+	for _, ip := range reaped {
+		fmt.Fprintln(stdout, ip)
+	}
+	return err
+}
+
+// reapStale frees the leases not held by one of validIDs under the store lock.
+func reapStale(store backend.Store, validIDs []string) ([]net.IP, error) {
+	if err := store.Lock(); err != nil {
+		return nil, fmt.Errorf("failed to lock store: %v", err)
+	}
+	defer store.Unlock()
+
+	return store.ReapStale(validIDs)
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/plugins/ipam/host-local/backend/disk"
+	"github.com/onsi/gomega/gexec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("garbage collection", func() {
+	var (
+		dataDir   string
+		conf      *IPAMConfig
+		store     *disk.Store
+		allocator *IPAllocator
+	)
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-gc-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		ipn, err := types.ParseCIDR("10.0.0.0/24")
+		Expect(err).NotTo(HaveOccurred())
+		conf = &IPAMConfig{
+			Name:    "test-net",
+			Type:    "host-local",
+			Subnet:  types.IPNet(*ipn),
+			DataDir: dataDir,
+		}
+
+		store, err = disk.New(conf.Name, conf.DataDir)
+		Expect(err).NotTo(HaveOccurred())
+		allocator, err = NewIPAllocator(conf, store)
+		Expect(err).NotTo(HaveOccurred())
+
+		// container-N gets 10.0.0.(N+1)
+		for i := 1; i <= 4; i++ {
+			_, err := allocator.Get(fmt.Sprintf("container-%d", i))
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	AfterEach(func() {
+		Expect(store.Close()).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	leases := func() []string {
+		files, err := ioutil.ReadDir(filepath.Join(dataDir, "test-net"))
+		Expect(err).NotTo(HaveOccurred())
+
+		var names []string
+		for _, f := range files {
+			if f.Name() != "lock" && f.Name() != "last_reserved_ip" {
+				names = append(names, f.Name())
+			}
+		}
+		return names
+	}
+
+	It("removes only the leases of containers that are not live", func() {
+		reaped, err := reapStale(store, []string{"container-1", "container-3"})
+		Expect(err).NotTo(HaveOccurred())
+
+		var ips []string
+		for _, ip := range reaped {
+			ips = append(ips, ip.String())
+		}
+		Expect(ips).To(ConsistOf("10.0.0.3", "10.0.0.5"))
+		Expect(leases()).To(ConsistOf("10.0.0.2", "10.0.0.4"))
+	})
+
+	It("makes the reclaimed addresses allocatable again", func() {
+		_, err := reapStale(store, []string{"container-1", "container-3"})
+		Expect(err).NotTo(HaveOccurred())
+
+		ipConf, err := allocator.Get("container-5")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipConf.IP.IP.String()).To(Equal("10.0.0.3"))
+
+		ipConf, err = allocator.Get("container-6")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipConf.IP.IP.String()).To(Equal("10.0.0.5"))
+	})
+
+	It("reaps nothing when every lease is live", func() {
+		reaped, err := reapStale(store, []string{"container-1", "container-2", "container-3", "container-4"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reaped).To(BeEmpty())
+		Expect(leases()).To(HaveLen(4))
+	})
+
+	It("is available as the gc subcommand", func() {
+		cmd := exec.Command(pathToHostLocal, "gc", "container-2", "container-4")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(`{
+			"name": "test-net",
+			"ipam": { "type": "host-local", "subnet": "10.0.0.0/24", "dataDir": %q }
+		}`, dataDir))
+
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(0))
+
+		Expect(string(session.Out.Contents())).To(Equal("10.0.0.2\n10.0.0.4\n"))
+		Expect(leases()).To(ConsistOf("10.0.0.3", "10.0.0.5"))
+	})
+})
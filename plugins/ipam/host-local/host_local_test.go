@@ -0,0 +1,209 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/cni/pkg/types"
+	"github.com/onsi/gomega/gexec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("host-local", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	run := func(command, conf string) *gexec.Session {
+		cmd := exec.Command(pathToHostLocal)
+		cmd.Env = []string{
+			"CNI_COMMAND=" + command,
+			"CNI_CONTAINERID=some-container-id",
+			"CNI_NETNS=/some/netns",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+		}
+		cmd.Stdin = strings.NewReader(conf)
+
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(0))
+		return session
+	}
+
+	add := func(conf string) *types.Result010 {
+		session := run("ADD", conf)
+
+		result := &types.Result010{}
+		Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+		return result
+	}
+
+	It("passes the configured routes and DNS through to the result", func() {
+		result := add(fmt.Sprintf(`{
+			"name": "mynet",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": %q,
+				"routes": [
+					{ "dst": "0.0.0.0/0" },
+					{ "dst": "192.168.0.0/16", "gw": "10.1.2.254" }
+				],
+				"dns": {
+					"nameservers": ["10.1.2.53"],
+					"domain": "example.com",
+					"search": ["example.com", "example.org"],
+					"options": ["ndots:2"]
+				}
+			}
+		}`, dataDir))
+
+		Expect(result.IP4).NotTo(BeNil())
+		Expect(result.IP4.IP.String()).To(Equal("10.1.2.2/24"))
+		Expect(result.IP4.Gateway.String()).To(Equal("10.1.2.1"))
+
+		Expect(result.IP4.Routes).To(HaveLen(2))
+		Expect(result.IP4.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+		Expect(result.IP4.Routes[0].GW.String()).To(Equal("10.1.2.1"))
+		Expect(result.IP4.Routes[1].Dst.String()).To(Equal("192.168.0.0/16"))
+		Expect(result.IP4.Routes[1].GW.String()).To(Equal("10.1.2.254"))
+
+		Expect(result.DNS).To(Equal(types.DNS{
+			Nameservers: []string{"10.1.2.53"},
+			Domain:      "example.com",
+			Search:      []string{"example.com", "example.org"},
+			Options:     []string{"ndots:2"},
+		}))
+	})
+
+	It("gives gateway-less routes the configured gateway", func() {
+		result := add(fmt.Sprintf(`{
+			"name": "mynet",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"gateway": "10.1.2.100",
+				"dataDir": %q,
+				"routes": [ { "dst": "0.0.0.0/0" } ]
+			}
+		}`, dataDir))
+
+		Expect(result.IP4.Routes).To(HaveLen(1))
+		Expect(result.IP4.Routes[0].GW.String()).To(Equal("10.1.2.100"))
+		Expect(result.DNS).To(Equal(types.DNS{}))
+	})
+
+	It("hands out IPv6 addresses from an IPv6 subnet", func() {
+		result := add(fmt.Sprintf(`{
+			"name": "mynet",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "fd00:1234::/64",
+				"dataDir": %q,
+				"routes": [ { "dst": "::/0" } ]
+			}
+		}`, dataDir))
+
+		Expect(result.IP4).To(BeNil())
+		Expect(result.IP6).NotTo(BeNil())
+		Expect(result.IP6.IP.String()).To(Equal("fd00:1234::2/64"))
+		Expect(result.IP6.Gateway.String()).To(Equal("fd00:1234::1"))
+		Expect(result.IP6.Routes).To(HaveLen(1))
+		Expect(result.IP6.Routes[0].GW.String()).To(Equal("fd00:1234::1"))
+	})
+
+	It("answers a 0.2.0 config with a 0.2.0 result", func() {
+		session := run("ADD", fmt.Sprintf(`{
+			"cniVersion": "0.2.0",
+			"name": "mynet",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": %q,
+				"routes": [ { "dst": "0.0.0.0/0" } ]
+			}
+		}`, dataDir))
+
+		Expect(session.Out.Contents()).To(MatchJSON(`{
+			"cniVersion": "0.2.0",
+			"ips": [{"version": "4", "address": "10.1.2.2/24", "gateway": "10.1.2.1"}],
+			"routes": [{"dst": "0.0.0.0/0", "gw": "10.1.2.1"}],
+			"dns": {}
+		}`))
+	})
+
+	Context("with an IPv4 and an IPv6 range", func() {
+		var conf string
+
+		BeforeEach(func() {
+			conf = fmt.Sprintf(`{
+				"name": "mynet",
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						{ "subnet": "10.1.2.0/24" },
+						{ "subnet": "fd00:1234::/64" }
+					],
+					"dataDir": %q,
+					"routes": [ { "dst": "0.0.0.0/0" }, { "dst": "::/0" } ]
+				}
+			}`, dataDir)
+		})
+
+		It("allocates an address of each family, each with the routes of its family", func() {
+			result := add(conf)
+
+			Expect(result.IP4).NotTo(BeNil())
+			Expect(result.IP4.IP.String()).To(Equal("10.1.2.2/24"))
+			Expect(result.IP4.Routes).To(HaveLen(1))
+			Expect(result.IP4.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+			Expect(result.IP4.Routes[0].GW.String()).To(Equal("10.1.2.1"))
+
+			Expect(result.IP6).NotTo(BeNil())
+			Expect(result.IP6.IP.String()).To(Equal("fd00:1234::2/64"))
+			Expect(result.IP6.Routes).To(HaveLen(1))
+			Expect(result.IP6.Routes[0].Dst.String()).To(Equal("::/0"))
+			Expect(result.IP6.Routes[0].GW.String()).To(Equal("fd00:1234::1"))
+		})
+
+		It("releases both addresses on DEL", func() {
+			add(conf)
+			Expect(filepath.Join(dataDir, "mynet", "10.1.2.2")).To(BeAnExistingFile())
+			Expect(filepath.Join(dataDir, "mynet", "fd00:1234::2")).To(BeAnExistingFile())
+
+			run("DEL", conf)
+			Expect(filepath.Join(dataDir, "mynet", "10.1.2.2")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(dataDir, "mynet", "fd00:1234::2")).NotTo(BeAnExistingFile())
+		})
+	})
+})
@@ -0,0 +1,63 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+
+	"github.com/appc/cni/pkg/ip"
+)
+
+// usedIndex is the sorted set of leased addresses, in their 16-byte
+// form. Looking for a free address in it saves asking the store about
+// each address in turn, which for the disk store is a failed file
+// creation per lease.
+type usedIndex [][]byte
+
+func newUsedIndex(ips []net.IP) usedIndex {
+	used := make(usedIndex, 0, len(ips))
+	for _, addr := range ips {
+		used = append(used, addr.To16())
+	}
+	sort.Slice(used, func(i, j int) bool { return bytes.Compare(used[i], used[j]) < 0 })
+
+	// drop duplicates, such as the same IPv4 address written in
+	// both forms
+	uniq := used[:0]
+	for i, addr := range used {
+		if i == 0 || !bytes.Equal(addr, used[i-1]) {
+			uniq = append(uniq, addr)
+		}
+	}
+	return uniq
+}
+
+// firstFree returns the lowest address in [from, to) that is not in
+// the index, or nil if there is none.
+func (u usedIndex) firstFree(from, to net.IP) net.IP {
+	cur := from
+	k := sort.Search(len(u), func(i int) bool { return bytes.Compare(u[i], from.To16()) >= 0 })
+	// skip the run of leases starting at from
+	for ; k < len(u) && bytes.Equal(u[k], cur.To16()); k++ {
+		cur = ip.NextIP(cur)
+	}
+
+	if bytes.Compare(cur.To16(), to.To16()) >= 0 {
+		return nil
+	}
+	return cur
+}
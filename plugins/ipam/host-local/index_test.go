@@ -0,0 +1,230 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/plugins/ipam/host-local/backend/disk"
+	"github.com/appc/cni/plugins/ipam/host-local/backend/memory"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// scanGet allocates the way Get did before the lease index, asking the
+// store to reserve each candidate address in turn.
+func scanGet(a *IPAllocator, id string) (net.IP, error) {
+	first, ok := a.scanStart()
+	if !ok {
+		return nil, fmt.Errorf("no IP addresses available in network: %s", a.conf.Name)
+	}
+
+	for cur := first; ; {
+		r := a.ranges[cur.idx]
+		if r.gw == nil || !cur.ip.Equal(r.gw) {
+			reserved, err := a.store.Reserve(id, cur.ip)
+			if err != nil {
+				return nil, err
+			}
+			if reserved {
+				return cur.ip, nil
+			}
+		}
+
+		if cur = a.next(cur); cur.idx == first.idx && cur.ip.Equal(first.ip) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no IP addresses available in network: %s", a.conf.Name)
+}
+
+var _ = Describe("usedIndex", func() {
+	index := newUsedIndex([]net.IP{
+		net.ParseIP("10.0.0.4"),
+		net.ParseIP("10.0.0.2"),
+		net.ParseIP("10.0.0.3"),
+		net.ParseIP("10.0.0.3").To4(),
+		net.ParseIP("10.0.0.7"),
+	})
+
+	It("sorts the addresses and drops duplicates", func() {
+		Expect(index).To(HaveLen(4))
+		Expect(net.IP(index[0]).String()).To(Equal("10.0.0.2"))
+		Expect(net.IP(index[3]).String()).To(Equal("10.0.0.7"))
+	})
+
+	It("returns from itself when it is free", func() {
+		Expect(index.firstFree(net.ParseIP("10.0.0.5"), net.ParseIP("10.0.0.8")).String()).To(Equal("10.0.0.5"))
+	})
+
+	It("skips the run of leased addresses starting at from", func() {
+		Expect(index.firstFree(net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.8")).String()).To(Equal("10.0.0.5"))
+	})
+
+	It("returns nil when the run reaches to", func() {
+		Expect(index.firstFree(net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.5"))).To(BeNil())
+		Expect(index.firstFree(net.ParseIP("10.0.0.7"), net.ParseIP("10.0.0.8"))).To(BeNil())
+	})
+})
+
+var _ = Describe("allocating from the lease index", func() {
+	var networkCount int
+
+	// newPair returns two allocators over separate but identically
+	// leased memory stores, so that Get can be compared with scanGet
+	newPair := func(strategy string, subnets ...string) (*IPAllocator, *IPAllocator) {
+		conf := &IPAMConfig{
+			Name:               "index-test-net",
+			Type:               "host-local",
+			AllocationStrategy: strategy,
+		}
+		for _, subnet := range subnets {
+			ipn, err := types.ParseCIDR(subnet)
+			Expect(err).NotTo(HaveOccurred())
+			conf.Ranges = append(conf.Ranges, Range{Subnet: types.IPNet(*ipn)})
+		}
+
+		var allocators []*IPAllocator
+		for i := 0; i < 2; i++ {
+			networkCount++
+			a, err := NewIPAllocator(conf, memory.New(fmt.Sprintf("index-test-net-%d", networkCount)))
+			Expect(err).NotTo(HaveOccurred())
+			allocators = append(allocators, a)
+		}
+		return allocators[0], allocators[1]
+	}
+
+	for _, strategy := range []string{StrategySequential, StrategyLastUsed} {
+		strategy := strategy
+
+		for _, subnets := range [][]string{
+			{"10.0.0.0/26", "10.0.1.0/28", "10.0.2.0/27"},
+			{"fd00::/121", "fd00:1::/124"},
+		} {
+			subnets := subnets
+
+			It(fmt.Sprintf("allocates the same addresses as scanning with %s from %v", strategy, subnets), func() {
+				indexed, scanned := newPair(strategy, subnets...)
+				rng := rand.New(rand.NewSource(int64(len(subnets))))
+
+				// lease a random share of every range up front
+				for i, r := range indexed.ranges {
+					for addr := r.start; r.contains(addr); addr = ip.NextIP(addr) {
+						if rng.Intn(3) == 0 {
+							id := fmt.Sprintf("initial-%d-%s", i, addr)
+							Expect(indexed.store.Reserve(id, addr)).To(BeTrue())
+							Expect(scanned.store.Reserve(id, addr)).To(BeTrue())
+						}
+					}
+				}
+
+				var ids []string
+				for step := 0; step < 300; step++ {
+					if len(ids) > 0 && rng.Intn(3) == 0 {
+						k := rng.Intn(len(ids))
+						Expect(indexed.Release(ids[k])).To(Succeed())
+						Expect(scanned.Release(ids[k])).To(Succeed())
+						ids = append(ids[:k], ids[k+1:]...)
+						continue
+					}
+
+					id := fmt.Sprintf("container-%d", step)
+					ipConf, err := indexed.Get(id)
+					expected, scanErr := scanGet(scanned, id)
+					if scanErr != nil {
+						Expect(err).To(MatchError(scanErr.Error()))
+						continue
+					}
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ipConf.IP.IP.String()).To(Equal(expected.String()))
+					ids = append(ids, id)
+				}
+			})
+		}
+	}
+})
+
+// BenchmarkGet allocates and releases an address on a /16 that has 10k
+// of its addresses leased, with and without the lease index.
+func BenchmarkGet(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		get  func(a *IPAllocator, id string) (net.IP, error)
+	}{
+		{"index", func(a *IPAllocator, id string) (net.IP, error) {
+			ipConf, err := a.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			return ipConf.IP.IP, nil
+		}},
+		{"scan", scanGet},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			dataDir, err := ioutil.TempDir("", "host-local-bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dataDir)
+
+			ipn, err := types.ParseCIDR("10.10.0.0/16")
+			if err != nil {
+				b.Fatal(err)
+			}
+			conf := &IPAMConfig{
+				Name:    "bench-net",
+				Type:    "host-local",
+				Subnet:  types.IPNet(*ipn),
+				DataDir: dataDir,
+			}
+			store, err := disk.New(conf.Name, conf.DataDir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer store.Close()
+
+			a, err := NewIPAllocator(conf, store)
+			if err != nil {
+				b.Fatal(err)
+			}
+			addr := a.ranges[0].start
+			for i := 0; i < 10000; i++ {
+				if _, err := store.Reserve(fmt.Sprintf("lease-%d", i), addr); err != nil {
+					b.Fatal(err)
+				}
+				addr = ip.NextIP(addr)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				addr, err := bm.get(a, "bench")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := store.Release(addr); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -15,14 +15,25 @@
 package main
 
 import (
+	"log"
+	"os"
+
+	"github.com/appc/cni/plugins/ipam/host-local/backend"
 	"github.com/appc/cni/plugins/ipam/host-local/backend/disk"
 
 	"github.com/appc/cni/pkg/skel"
 	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
 )
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		if err := runGC(os.Stdin, os.Stdout, os.Args[2:]); err != nil {
+			log.Fatalf("gc failed: %v", err)
+		}
+	} else {
+		skel.PluginMain(cmdAdd, cmdDel, nil, version.All)
+	}
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
@@ -30,27 +41,43 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-
-	store, err := disk.New(ipamConf.Name)
+	confVersion, err := version.ConfigVersion(args.StdinData)
 	if err != nil {
 		return err
 	}
-	defer store.Close()
 
-	allocator, err := NewIPAllocator(ipamConf, store)
+	store, err := newStore(ipamConf)
 	if err != nil {
 		return err
 	}
+	defer store.Close()
 
-	ipConf, err := allocator.Get(args.ContainerID)
+	allocators, err := NewIPAllocators(ipamConf, store)
 	if err != nil {
 		return err
 	}
+	if err = checkRequestedIP(ipamConf, allocators); err != nil {
+		return err
+	}
+
+	r := &types.Result010{
+		DNS: ipamConf.DNS,
+	}
+	for _, allocator := range allocators {
+		ipConf, err := allocator.Get(args.ContainerID)
+		if err != nil {
+			// don't keep the address of the other family
+			allocator.Release(args.ContainerID)
+			return err
+		}
 
-	r := &types.Result{
-		IP4: ipConf,
+		if allocator.v6 {
+			r.IP6 = ipConf
+		} else {
+			r.IP4 = ipConf
+		}
 	}
-	return r.Print()
+	return types.PrintResult(r, confVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -59,16 +86,24 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
-	store, err := disk.New(ipamConf.Name)
+	store, err := newStore(ipamConf)
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
-	allocator, err := NewIPAllocator(ipamConf, store)
+	allocators, err := NewIPAllocators(ipamConf, store)
 	if err != nil {
 		return err
 	}
 
-	return allocator.Release(args.ContainerID)
+	// leases are released by container ID, whatever their family
+	return allocators[0].Release(args.ContainerID)
+}
+
+// newStore opens the on-disk lease store of the network. Each invocation
+// of the plugin is a new process, so leases must outlive it; the memory
+// backend is only for processes that embed the allocator.
+func newStore(conf *IPAMConfig) (backend.Store, error) {
+	return disk.New(conf.Name, conf.DataDir)
 }
@@ -0,0 +1,181 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/types"
+)
+
+// Range is a block of addresses within a subnet to allocate from.
+// RangeStart and RangeEnd are inclusive and default to the whole
+// subnet, less the network and broadcast addresses. Gateway defaults
+// to the first usable address of the subnet. The gateway is never
+// allocated, whether configured or derived.
+type Range struct {
+	Subnet     types.IPNet `json:"subnet"`
+	RangeStart net.IP      `json:"rangeStart,omitempty"`
+	RangeEnd   net.IP      `json:"rangeEnd,omitempty"`
+	Gateway    net.IP      `json:"gateway,omitempty"`
+}
+
+// RangeSet is an ordered list of non-overlapping ranges. Addresses are
+// allocated from the first range with a free one.
+type RangeSet []Range
+
+// allocRange is a Range resolved to the addresses [start, end).
+type allocRange struct {
+	start  net.IP
+	end    net.IP
+	subnet *net.IPNet
+	gw     net.IP
+}
+
+func (r *Range) resolve() (*allocRange, error) {
+	subnet := (*net.IPNet)(&r.Subnet)
+	start, end, err := networkRange(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	// skip the network address
+	start = ip.NextIP(start)
+
+	if r.RangeStart != nil {
+		if err := validateRangeIP(r.RangeStart, subnet); err != nil {
+			return nil, err
+		}
+		start = r.RangeStart
+	}
+	if r.RangeEnd != nil {
+		if err := validateRangeIP(r.RangeEnd, subnet); err != nil {
+			return nil, err
+		}
+		// RangeEnd is inclusive
+		end = ip.NextIP(r.RangeEnd)
+	}
+
+	// default to the first usable address, whatever host bits the
+	// subnet was written with
+	gw := r.Gateway
+	if gw == nil {
+		gw = ip.NextIP(ip.Network(subnet).IP)
+	}
+
+	return &allocRange{start: start, end: end, subnet: subnet, gw: gw}, nil
+}
+
+// resolve resolves every range in the set and checks that no two of
+// them share an address.
+func (s RangeSet) resolve() ([]*allocRange, error) {
+	ranges := make([]*allocRange, 0, len(s))
+	for i := range s {
+		r, err := s[i].resolve()
+		if err != nil {
+			return nil, err
+		}
+
+		for j, other := range ranges {
+			if r.overlaps(other) {
+				return nil, fmt.Errorf("range %d (%s) overlaps range %d (%s)", i, r, j, other)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func (r *allocRange) String() string {
+	return fmt.Sprintf("%s-%s", r.start, ip.PrevIP(r.end))
+}
+
+func (r *allocRange) empty() bool {
+	return !r.contains(r.start)
+}
+
+// contains reports whether addr lies within [r.start, r.end)
+func (r *allocRange) contains(addr net.IP) bool {
+	if (addr.To4() == nil) != (r.start.To4() == nil) {
+		return false
+	}
+	return bytes.Compare(addr.To16(), r.start.To16()) >= 0 &&
+		bytes.Compare(addr.To16(), r.end.To16()) < 0
+}
+
+func (r *allocRange) overlaps(other *allocRange) bool {
+	if r.empty() || other.empty() {
+		return false
+	}
+	return r.contains(other.start) || other.contains(r.start)
+}
+
+// ipSpan is the addresses [first, last], both included.
+type ipSpan struct {
+	first net.IP
+	last  net.IP
+}
+
+func (s ipSpan) contains(addr net.IP) bool {
+	if (addr.To4() == nil) != (s.first.To4() == nil) {
+		return false
+	}
+	return bytes.Compare(addr.To16(), s.first.To16()) >= 0 &&
+		bytes.Compare(addr.To16(), s.last.To16()) <= 0
+}
+
+// parseExclude parses the "exclude" entries of the config, each a
+// CIDR such as "10.0.0.10/32" or a range such as "10.0.0.20-10.0.0.25".
+func parseExclude(entries []string) ([]ipSpan, error) {
+	var spans []ipSpan
+	for _, entry := range entries {
+		span, err := parseSpan(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude entry %q: %v", entry, err)
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+func parseSpan(entry string) (ipSpan, error) {
+	if i := strings.Index(entry, "-"); i >= 0 {
+		first := net.ParseIP(strings.TrimSpace(entry[:i]))
+		last := net.ParseIP(strings.TrimSpace(entry[i+1:]))
+		switch {
+		case first == nil || last == nil:
+			return ipSpan{}, fmt.Errorf("not a range of IP addresses")
+		case (first.To4() == nil) != (last.To4() == nil):
+			return ipSpan{}, fmt.Errorf("range mixes IPv4 and IPv6 addresses")
+		case bytes.Compare(first.To16(), last.To16()) > 0:
+			return ipSpan{}, fmt.Errorf("range ends before it starts")
+		}
+		return ipSpan{first, last}, nil
+	}
+
+	_, ipn, err := ip.ParseCIDR(entry)
+	if err != nil {
+		return ipSpan{}, err
+	}
+	first, end, err := networkRange(ipn)
+	if err != nil {
+		return ipSpan{}, err
+	}
+	return ipSpan{first, end}, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/plugins/ipam/host-local/backend"
+	"github.com/appc/cni/plugins/ipam/host-local/backend/memory"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("lease stores", func() {
+	var networkCount int
+
+	// the plugin binary only opens the disk store; open the memory one the
+	// way an embedding process would
+	stores := map[string]func(*IPAMConfig) (backend.Store, error){
+		"disk": newStore,
+		"memory": func(conf *IPAMConfig) (backend.Store, error) {
+			return memory.New(conf.Name), nil
+		},
+	}
+
+	for _, storeType := range []string{"disk", "memory"} {
+		storeType, open := storeType, stores[storeType]
+
+		Describe(storeType, func() {
+			var (
+				dataDir   string
+				conf      *IPAMConfig
+				store     backend.Store
+				allocator *IPAllocator
+			)
+
+			// newAllocator opens a fresh store and allocator on the same
+			// network, as a separate invocation would
+			newAllocator := func() (backend.Store, *IPAllocator) {
+				s, err := open(conf)
+				Expect(err).NotTo(HaveOccurred())
+				a, err := NewIPAllocator(conf, s)
+				Expect(err).NotTo(HaveOccurred())
+				return s, a
+			}
+
+			BeforeEach(func() {
+				var err error
+				dataDir, err = ioutil.TempDir("", "host-local-store-test")
+				Expect(err).NotTo(HaveOccurred())
+
+				ipn, err := types.ParseCIDR("10.0.0.0/29")
+				Expect(err).NotTo(HaveOccurred())
+
+				// memory stores are shared per network within the process
+				networkCount++
+				conf = &IPAMConfig{
+					Name:    fmt.Sprintf("test-net-%d", networkCount),
+					Type:    "host-local",
+					Subnet:  types.IPNet(*ipn),
+					DataDir: dataDir,
+				}
+				store, allocator = newAllocator()
+			})
+
+			AfterEach(func() {
+				Expect(store.Close()).To(Succeed())
+				Expect(os.RemoveAll(dataDir)).To(Succeed())
+			})
+
+			It("allocates addresses in order until the range is exhausted", func() {
+				for _, expected := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+					ipConf, err := allocator.Get("container-" + expected)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ipConf.IP.IP.String()).To(Equal(expected))
+				}
+
+				_, err := allocator.Get("container-7")
+				Expect(err).To(MatchError(fmt.Sprintf("no IP addresses available in network: %s", conf.Name)))
+			})
+
+			It("keeps leases across stores opened on the same network", func() {
+				_, err := allocator.Get("container-1")
+				Expect(err).NotTo(HaveOccurred())
+
+				other, a := newAllocator()
+				defer other.Close()
+
+				ipConf, err := a.Get("container-2")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ipConf.IP.IP.String()).To(Equal("10.0.0.3"))
+			})
+
+			It("frees a released address for reuse", func() {
+				_, err := allocator.Get("container-1")
+				Expect(err).NotTo(HaveOccurred())
+				_, err = allocator.Get("container-2")
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(allocator.Release("container-1")).To(Succeed())
+
+				ipConf, err := allocator.Get("container-3")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ipConf.IP.IP.String()).To(Equal("10.0.0.2"))
+			})
+
+			It("resumes after the last reserved address with the last-used strategy", func() {
+				conf.AllocationStrategy = StrategyLastUsed
+
+				_, err := allocator.Get("container-1")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(allocator.Release("container-1")).To(Succeed())
+
+				ipConf, err := allocator.Get("container-2")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ipConf.IP.IP.String()).To(Equal("10.0.0.3"))
+			})
+
+			It("remembers the last reserved address per family", func() {
+				_, err := store.Reserve("container-1", net.ParseIP("10.0.0.2"))
+				Expect(err).NotTo(HaveOccurred())
+				_, err = store.Reserve("container-1", net.ParseIP("fd00::2"))
+				Expect(err).NotTo(HaveOccurred())
+
+				last, err := store.LastReservedIP(false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(last.String()).To(Equal("10.0.0.2"))
+
+				last, err = store.LastReservedIP(true)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(last.String()).To(Equal("fd00::2"))
+			})
+
+			It("reaps only the leases of containers that are not live", func() {
+				for i := 1; i <= 4; i++ {
+					_, err := allocator.Get(fmt.Sprintf("container-%d", i))
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				reaped, err := reapStale(store, []string{"container-1", "container-3"})
+				Expect(err).NotTo(HaveOccurred())
+
+				var ips []string
+				for _, ip := range reaped {
+					ips = append(ips, ip.String())
+				}
+				Expect(ips).To(ConsistOf("10.0.0.3", "10.0.0.5"))
+
+				ipConf, err := allocator.Get("container-5")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ipConf.IP.IP.String()).To(Equal("10.0.0.3"))
+			})
+		})
+	}
+})
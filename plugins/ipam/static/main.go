@@ -0,0 +1,179 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is an IPAM plugin for fixed addresses: it keeps no state and
+// returns the addresses, routes and DNS settings of its config.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/appc/cni/pkg/skel"
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
+)
+
+// IPAMConfig is the "ipam" block of the network configuration.
+type IPAMConfig struct {
+	Type      string        `json:"type"`
+	Addresses []Address     `json:"addresses"`
+	Routes    []types.Route `json:"routes"`
+	DNS       types.DNS     `json:"dns"`
+}
+
+// Address is an address to assign, in CIDR notation, along with the
+// gateway of its subnet.
+type Address struct {
+	Address string `json:"address"`
+	Gateway net.IP `json:"gateway,omitempty"`
+
+	ipNet *net.IPNet
+}
+
+// StaticArgs are the CNI_ARGS the plugin takes. IP holds one or more
+// comma separated addresses in CIDR notation that replace the
+// configured ones.
+type StaticArgs struct {
+	types.CommonArgs
+	IP string `cni:"IP"`
+}
+
+type Net struct {
+	CNIVersion string      `json:"cniVersion"`
+	Name       string      `json:"name"`
+	IPAM       *IPAMConfig `json:"ipam"`
+}
+
+// LoadIPAMConfig parses the config and applies the IP argument.
+func LoadIPAMConfig(bytes []byte, args string) (*IPAMConfig, string, error) {
+	n := Net{}
+	if err := json.Unmarshal(bytes, &n); err != nil {
+		return nil, "", err
+	}
+	if n.IPAM == nil {
+		return nil, "", fmt.Errorf("%q missing 'ipam' key", n.Name)
+	}
+
+	if args != "" {
+		ipamArgs := &StaticArgs{}
+		if err := types.LoadArgs(args, ipamArgs); err != nil {
+			return nil, "", err
+		}
+		if ipamArgs.IP != "" {
+			addrs, err := overrideAddresses(n.IPAM.Addresses, ipamArgs.IP)
+			if err != nil {
+				return nil, "", err
+			}
+			n.IPAM.Addresses = addrs
+		}
+	}
+
+	if len(n.IPAM.Addresses) == 0 {
+		return nil, "", fmt.Errorf("%q has no addresses", n.Name)
+	}
+	for i := range n.IPAM.Addresses {
+		if err := n.IPAM.Addresses[i].parse(); err != nil {
+			return nil, "", err
+		}
+	}
+
+	confVersion := n.CNIVersion
+	if confVersion == "" {
+		confVersion = "0.1.0"
+	}
+	return n.IPAM, confVersion, nil
+}
+
+// overrideAddresses returns the addresses of the IP argument in place
+// of the configured ones, keeping the gateway configured for the first
+// address of the same family.
+func overrideAddresses(configured []Address, ipArg string) ([]Address, error) {
+	var addrs []Address
+	for _, s := range strings.Split(ipArg, ",") {
+		addr := Address{Address: s}
+		if err := addr.parse(); err != nil {
+			return nil, err
+		}
+
+		for _, c := range configured {
+			if c.Gateway != nil && isV4(c.Gateway) == isV4(addr.ipNet.IP) {
+				addr.Gateway = c.Gateway
+				break
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func isV4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+func (a *Address) parse() error {
+	ipn, err := types.ParseCIDR(a.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", a.Address, err)
+	}
+	if a.Gateway != nil && isV4(a.Gateway) != isV4(ipn.IP) {
+		return fmt.Errorf("gateway %s is not of the same family as address %q", a.Gateway, a.Address)
+	}
+	a.ipNet = ipn
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	ipamConf, confVersion, err := LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	// the 0.2.0 layout holds any number of addresses; converting to an
+	// older version keeps the first of each family
+	r := &types.Result020{
+		CNIVersion: "0.2.0",
+		Routes:     ipamConf.Routes,
+		DNS:        ipamConf.DNS,
+	}
+	for _, addr := range ipamConf.Addresses {
+		ipVersion := "6"
+		if isV4(addr.ipNet.IP) {
+			ipVersion = "4"
+		}
+		r.IPs = append(r.IPs, &types.IPAddress{
+			Version: ipVersion,
+			Address: *addr.ipNet,
+			Gateway: addr.Gateway,
+		})
+	}
+
+	result, err := r.GetAsVersion(confVersion)
+	if err != nil {
+		return err
+	}
+	return result.Print()
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	// nothing was allocated, so there is nothing to release
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel, nil, version.PluginSupports("0.1.0", "0.2.0"))
+}
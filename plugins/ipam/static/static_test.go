@@ -0,0 +1,164 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os/exec"
+	"strings"
+
+	"github.com/appc/cni/pkg/types"
+	"github.com/onsi/gomega/gexec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("static", func() {
+	run := func(command, conf, args string) *gexec.Session {
+		cmd := exec.Command(pathToStatic)
+		cmd.Env = []string{
+			"CNI_COMMAND=" + command,
+			"CNI_CONTAINERID=some-container-id",
+			"CNI_NETNS=/some/netns",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=/some/path",
+			"CNI_ARGS=" + args,
+		}
+		cmd.Stdin = strings.NewReader(conf)
+
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit())
+		return session
+	}
+
+	add := func(conf, args string, result interface{}) {
+		session := run("ADD", conf, args)
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+	}
+
+	const conf = `{
+		"cniVersion": "0.2.0",
+		"name": "mynet",
+		"ipam": {
+			"type": "static",
+			"addresses": [
+				{ "address": "10.10.0.1/24", "gateway": "10.10.0.254" },
+				{ "address": "10.10.1.1/24" },
+				{ "address": "3ffe:ffff:0:1ff::1/64", "gateway": "3ffe:ffff:0:1ff::ffff" }
+			],
+			"routes": [
+				{ "dst": "0.0.0.0/0" },
+				{ "dst": "192.168.0.0/16", "gw": "10.10.0.253" },
+				{ "dst": "::/0" }
+			],
+			"dns": {
+				"nameservers": ["10.10.0.53"],
+				"domain": "example.com",
+				"search": ["example.com"]
+			}
+		}
+	}`
+
+	It("returns every configured address, route and DNS setting", func() {
+		result := &types.Result020{}
+		add(conf, "", result)
+
+		Expect(result.CNIVersion).To(Equal("0.2.0"))
+		Expect(result.IPs).To(HaveLen(3))
+		for i, expected := range []struct {
+			version, address, gateway string
+		}{
+			{"4", "10.10.0.1/24", "10.10.0.254"},
+			{"4", "10.10.1.1/24", "<nil>"},
+			{"6", "3ffe:ffff:0:1ff::1/64", "3ffe:ffff:0:1ff::ffff"},
+		} {
+			Expect(result.IPs[i].Version).To(Equal(expected.version))
+			Expect(result.IPs[i].Address.String()).To(Equal(expected.address))
+			Expect(result.IPs[i].Gateway.String()).To(Equal(expected.gateway))
+		}
+
+		Expect(result.Routes).To(HaveLen(3))
+		Expect(result.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+		Expect(result.Routes[1].Dst.String()).To(Equal("192.168.0.0/16"))
+		Expect(result.Routes[1].GW.String()).To(Equal("10.10.0.253"))
+		Expect(result.Routes[2].Dst.String()).To(Equal("::/0"))
+
+		Expect(result.DNS).To(Equal(types.DNS{
+			Nameservers: []string{"10.10.0.53"},
+			Domain:      "example.com",
+			Search:      []string{"example.com"},
+		}))
+	})
+
+	It("returns the first address of each family to 0.1.0 configs", func() {
+		result := &types.Result010{}
+		add(strings.Replace(conf, `"0.2.0"`, `"0.1.0"`, 1), "", result)
+
+		Expect(result.IP4.IP.String()).To(Equal("10.10.0.1/24"))
+		Expect(result.IP4.Gateway.String()).To(Equal("10.10.0.254"))
+		Expect(result.IP4.Routes).To(HaveLen(2))
+		Expect(result.IP6.IP.String()).To(Equal("3ffe:ffff:0:1ff::1/64"))
+		Expect(result.IP6.Routes).To(HaveLen(1))
+		Expect(result.DNS.Domain).To(Equal("example.com"))
+	})
+
+	It("replaces the configured addresses with those of the IP argument", func() {
+		result := &types.Result020{}
+		add(conf, "IP=10.10.0.9/24,3ffe:ffff:0:1ff::9/64", result)
+
+		Expect(result.IPs).To(HaveLen(2))
+		Expect(result.IPs[0].Address.String()).To(Equal("10.10.0.9/24"))
+		Expect(result.IPs[0].Gateway.String()).To(Equal("10.10.0.254"))
+		Expect(result.IPs[1].Address.String()).To(Equal("3ffe:ffff:0:1ff::9/64"))
+		Expect(result.IPs[1].Gateway.String()).To(Equal("3ffe:ffff:0:1ff::ffff"))
+	})
+
+	It("rejects an invalid configured address", func() {
+		session := run("ADD", `{
+			"name": "mynet",
+			"ipam": { "type": "static", "addresses": [ { "address": "10.10.0.1" } ] }
+		}`, "")
+		Expect(session.ExitCode()).NotTo(Equal(0))
+		Expect(string(session.Out.Contents())).To(ContainSubstring(`invalid address \"10.10.0.1\"`))
+	})
+
+	It("rejects an invalid address in the IP argument", func() {
+		session := run("ADD", conf, "IP=10.10.0.300/24")
+		Expect(session.ExitCode()).NotTo(Equal(0))
+		Expect(string(session.Out.Contents())).To(ContainSubstring(`invalid address \"10.10.0.300/24\"`))
+	})
+
+	It("rejects a gateway of the other family", func() {
+		session := run("ADD", `{
+			"name": "mynet",
+			"ipam": { "type": "static", "addresses": [ { "address": "10.10.0.1/24", "gateway": "3ffe::1" } ] }
+		}`, "")
+		Expect(session.ExitCode()).NotTo(Equal(0))
+		Expect(string(session.Out.Contents())).To(ContainSubstring("is not of the same family"))
+	})
+
+	It("rejects a config without addresses", func() {
+		session := run("ADD", `{ "name": "mynet", "ipam": { "type": "static" } }`, "")
+		Expect(session.ExitCode()).NotTo(Equal(0))
+		Expect(string(session.Out.Contents())).To(ContainSubstring(`\"mynet\" has no addresses`))
+	})
+
+	It("succeeds on DEL without doing anything", func() {
+		Expect(run("DEL", conf, "").ExitCode()).To(Equal(0))
+	})
+})
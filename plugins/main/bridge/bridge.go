@@ -22,6 +22,7 @@ import (
 	"os"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/appc/cni/pkg/ip"
 	"github.com/appc/cni/pkg/ipam"
@@ -29,17 +30,42 @@ import (
 	"github.com/appc/cni/pkg/skel"
 	"github.com/appc/cni/pkg/types"
 	"github.com/appc/cni/pkg/utils"
+	"github.com/appc/cni/pkg/utils/hwaddr"
+	"github.com/appc/cni/pkg/version"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
 )
 
 const defaultBrName = "cni0"
 
+// dadTimeout bounds the wait for IPv6 duplicate address detection.
+const dadTimeout = 10 * time.Second
+
 type NetConf struct {
 	types.NetConf
 	BrName string `json:"bridge"`
 	IsGW   bool   `json:"isGateway"`
 	IPMasq bool   `json:"ipMasq"`
 	MTU    int    `json:"mtu"`
+
+	HairpinMode bool `json:"hairpinMode"`
+	PromiscMode bool `json:"promiscMode"`
+
+	// Vlan, if set, is the untagged VLAN of the container's bridge port.
+	Vlan int `json:"vlan"`
+
+	// CreateBridge is true unless set to false, in which case the
+	// bridge must already exist and is left as it is.
+	CreateBridge *bool `json:"createBridge"`
+
+	// Mac, if set, is the MAC address of the container interface.
+	Mac string `json:"mac"`
+
+	hwAddr net.HardwareAddr
+}
+
+func (n *NetConf) createBridge() bool {
+	return n.CreateBridge == nil || *n.CreateBridge
 }
 
 func init() {
@@ -56,24 +82,45 @@ func loadNetConf(bytes []byte) (*NetConf, error) {
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if err := validateVlan(n.Vlan); err != nil {
+		return nil, err
+	}
+	if n.Mac != "" {
+		hwAddr, err := hwaddr.ParseUnicast(n.Mac)
+		if err != nil {
+			return nil, err
+		}
+		n.hwAddr = hwAddr
+	}
 	return n, nil
 }
 
 func ensureBridgeAddr(br *netlink.Bridge, ipn *net.IPNet) error {
-	addrs, err := netlink.AddrList(br, syscall.AF_INET)
+	family := netlink.FAMILY_V4
+	if ipn.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	addrs, err := netlink.AddrList(br, family)
 	if err != nil && err != syscall.ENOENT {
 		return fmt.Errorf("could not get list of IP addresses: %v", err)
 	}
 
 	// if there're no addresses on the bridge, it's ok -- we'll add one
-	if len(addrs) > 0 {
-		ipnStr := ipn.String()
-		for _, a := range addrs {
-			// string comp is actually easiest for doing IPNet comps
-			if a.IPNet.String() == ipnStr {
-				return nil
-			}
+	var other bool
+	ipnStr := ipn.String()
+	for _, a := range addrs {
+		// the kernel assigns IPv6 link-local addresses by itself
+		if a.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		// string comp is actually easiest for doing IPNet comps
+		if a.IPNet.String() == ipnStr {
+			return nil
 		}
+		other = true
+	}
+	if other {
 		return fmt.Errorf("%q already has an IP address different from %v", br.Name, ipn.String())
 	}
 
@@ -96,11 +143,24 @@ func bridgeByName(name string) (*netlink.Bridge, error) {
 	return br, nil
 }
 
+// setPromiscOn puts link into promiscuous mode.
+func setPromiscOn(link netlink.Link) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Change = syscall.IFF_PROMISC
+	msg.Flags = syscall.IFF_PROMISC
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
 func ensureBridge(brName string, mtu int) (*netlink.Bridge, error) {
 	br := &netlink.Bridge{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: brName,
-			MTU:  mtu,
 		},
 	}
 
@@ -114,44 +174,110 @@ func ensureBridge(brName string, mtu int) (*netlink.Bridge, error) {
 		if err != nil {
 			return nil, err
 		}
+	} else if mtu != 0 {
+		// only a bridge of our own making gets the configured MTU
+		if err = ip.SetMTU(br, mtu); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := netlink.LinkSetUp(br); err != nil {
 		return nil, err
 	}
 
-	return br, nil
+	// refresh so that the MTU is the one the kernel applied
+	return bridgeByName(brName)
 }
 
-func setupVeth(netns string, br *netlink.Bridge, ifName string, mtu int) error {
+// vethMTU validates the configured MTU against the bridge's and returns
+// the MTU to create the veth with; the bridge's MTU is inherited when
+// none is configured. A larger veth MTU would blackhole big packets.
+func vethMTU(mtu int, br *netlink.Bridge) (int, error) {
+	brMTU := br.Attrs().MTU
+	if brMTU <= 0 {
+		return 0, fmt.Errorf("bridge %q has no usable MTU", br.Attrs().Name)
+	}
+
+	switch {
+	case mtu == 0:
+		return brMTU, nil
+	case mtu < 0 || mtu > brMTU:
+		return 0, fmt.Errorf("invalid MTU %d, must be between 1 and the MTU of bridge %q (%d)", mtu, br.Attrs().Name, brMTU)
+	default:
+		return mtu, nil
+	}
+}
+
+// setupVeth connects the container to br with a veth pair and returns
+// the host and container ends for the result. The container end gets
+// the MAC hwAddr unless it is nil.
+func setupVeth(netns string, br *netlink.Bridge, ifName string, mtu int, hwAddr net.HardwareAddr, hairpinMode bool, vlan int) (*types.Interface, *types.Interface, error) {
 	var hostVethName string
+	contIface := &types.Interface{Name: ifName, Sandbox: netns}
 
 	err := ns.WithNetNSPath(netns, false, func(hostNS *os.File) error {
 		// create the veth pair in the container and move host end into host netns
-		hostVeth, _, err := ip.SetupVeth(ifName, mtu, hostNS)
+		hostVeth, contVeth, err := ip.SetupVethWithName(ifName, "", mtu, hwAddr, hostNS)
 		if err != nil {
 			return err
 		}
 
 		hostVethName = hostVeth.Attrs().Name
+		contIface.Mac = contVeth.Attrs().HardwareAddr.String()
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// need to lookup hostVeth again as its index has changed during ns move
 	hostVeth, err := netlink.LinkByName(hostVethName)
 	if err != nil {
-		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+		return nil, nil, fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
 	}
+	hostIface := &types.Interface{Name: hostVethName, Mac: hostVeth.Attrs().HardwareAddr.String()}
 
 	// connect host veth end to the bridge
 	if err = netlink.LinkSetMaster(hostVeth, br); err != nil {
-		return fmt.Errorf("failed to connect %q to bridge %v: %v", hostVethName, br.Attrs().Name, err)
+		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVethName, br.Attrs().Name, err)
 	}
 
-	return nil
+	// let traffic leave through the port it came in on
+	if hairpinMode {
+		if err = netlink.LinkSetHairpin(hostVeth, true); err != nil {
+			return nil, nil, fmt.Errorf("failed to setup hairpin mode for %q: %v", hostVethName, err)
+		}
+	}
+
+	if vlan != 0 {
+		if err = setPortVlan(hostVeth, vlan); err != nil {
+			return nil, nil, fmt.Errorf("failed to set VLAN %d on %q: %v", vlan, hostVethName, err)
+		}
+	}
+
+	return hostIface, contIface, nil
+}
+
+// newResult returns the IPAM result in the layout of cniVersion. From
+// 0.2.0 on it lists the host and container ends of the veth pair, the
+// addresses being on the container end.
+func newResult(cniVersion string, ipamResult *types.Result010, hostIface, contIface *types.Interface) (types.Result, error) {
+	if cniVersion == "" || cniVersion == "0.1.0" {
+		return ipamResult, nil
+	}
+
+	r, err := ipamResult.GetAsVersion("0.2.0")
+	if err != nil {
+		return nil, err
+	}
+	result := r.(*types.Result020)
+
+	result.Interfaces = []*types.Interface{hostIface, contIface}
+	for _, addr := range result.IPs {
+		contIdx := 1
+		addr.Interface = &contIdx
+	}
+	return result.GetAsVersion(cniVersion)
 }
 
 func calcGatewayIP(ipn *net.IPNet) net.IP {
@@ -159,11 +285,42 @@ func calcGatewayIP(ipn *net.IPNet) net.IP {
 	return ip.NextIP(nid)
 }
 
+func hasDefaultRoute(routes []types.Route) bool {
+	for _, r := range routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func setupBridge(n *NetConf) (*netlink.Bridge, error) {
-	// create bridge if necessary
-	br, err := ensureBridge(n.BrName, n.MTU)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+	var br *netlink.Bridge
+	var err error
+	if n.createBridge() {
+		// create bridge if necessary
+		if br, err = ensureBridge(n.BrName, n.MTU); err != nil {
+			return nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+		}
+	} else {
+		if _, err = netlink.LinkByName(n.BrName); err != nil {
+			return nil, fmt.Errorf("bridge %q does not exist and createBridge is false", n.BrName)
+		}
+		if br, err = bridgeByName(n.BrName); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.PromiscMode {
+		if err = setPromiscOn(br); err != nil {
+			return nil, fmt.Errorf("failed to set promiscuous mode on %q: %v", n.BrName, err)
+		}
+	}
+
+	if n.Vlan != 0 {
+		if err = enableVlanFiltering(br); err != nil {
+			return nil, fmt.Errorf("failed to enable VLAN filtering on %q: %v", n.BrName, err)
+		}
 	}
 
 	return br, nil
@@ -180,7 +337,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	if err = setupVeth(args.Netns, br, args.IfName, n.MTU); err != nil {
+	mtu, err := vethMTU(n.MTU, br)
+	if err != nil {
+		return err
+	}
+
+	hostIface, contIface, err := setupVeth(args.Netns, br, args.IfName, mtu, n.hwAddr, n.HairpinMode, n.Vlan)
+	if err != nil {
 		return err
 	}
 
@@ -190,37 +353,80 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	if result.IP4 == nil {
-		return errors.New("IPAM plugin returned missing IPv4 config")
+	ipConfigs := result.IPConfigs()
+	if len(ipConfigs) == 0 {
+		return errors.New("IPAM plugin returned missing IP config")
 	}
 
-	if result.IP4.Gateway == nil && n.IsGW {
-		result.IP4.Gateway = calcGatewayIP(&result.IP4.IP)
+	if n.IsGW {
+		for _, ipc := range ipConfigs {
+			if ipc.Gateway == nil {
+				ipc.Gateway = calcGatewayIP(&ipc.IP)
+			}
+
+			// the bridge is the gateway, so route everything through it
+			// unless IPAM already supplied a default route
+			if !hasDefaultRoute(ipc.Routes) {
+				dst := net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+				if ipc.IP.IP.To4() == nil {
+					dst = net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+				}
+				ipc.Routes = append(ipc.Routes, types.Route{Dst: dst})
+			}
+		}
 	}
 
 	err = ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
-		return ipam.ConfigureIface(args.IfName, result)
+		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+			return err
+		}
+
+		// hand back an IPv6 address only once DAD has let it be used
+		if result.IP6 != nil {
+			return ip.SettleAddresses(args.IfName, dadTimeout)
+		}
+		return nil
 	})
 	if err != nil {
 		return err
 	}
 
 	if n.IsGW {
-		gwn := &net.IPNet{
-			IP:   result.IP4.Gateway,
-			Mask: result.IP4.IP.Mask,
-		}
+		for _, ipc := range ipConfigs {
+			gwn := &net.IPNet{
+				IP:   ipc.Gateway,
+				Mask: ipc.IP.Mask,
+			}
 
-		if err = ensureBridgeAddr(br, gwn); err != nil {
-			return err
-		}
+			// a pre-provisioned bridge keeps whatever addresses it has
+			if n.createBridge() {
+				if err = ensureBridgeAddr(br, gwn); err != nil {
+					return err
+				}
+			}
 
-		if err := ip.EnableIP4Forward(); err != nil {
-			return fmt.Errorf("failed to enable forwarding: %v", err)
+			enableForward := ip.EnableIP4Forward
+			if ipc.IP.IP.To4() == nil {
+				enableForward = ip.EnableIP6Forward
+			}
+			if err := enableForward(); err != nil {
+				return fmt.Errorf("failed to enable forwarding: %v", err)
+			}
 		}
 	}
 
-	if n.IPMasq {
+	// the container's IPs may have been used before with a different MAC;
+	// the entries of the other containers on the bridge stay
+	var ips []net.IP
+	for _, ipc := range result.IPConfigs() {
+		ips = append(ips, ipc.IP.IP)
+	}
+	if err = ip.FlushNeighbors(br.Attrs().Name, ips...); err != nil {
+		return err
+	}
+
+	// masquerading is set up for IPv4 only
+	if n.IPMasq && result.IP4 != nil {
 		chain := utils.FormatChainName(n.Name, args.ContainerID)
 		comment := utils.FormatComment(n.Name, args.ContainerID)
 		if err = ip.SetupIPMasq(ip.Network(&result.IP4.IP), chain, comment); err != nil {
@@ -229,7 +435,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	result.DNS = n.DNS
-	return result.Print()
+
+	versioned, err := newResult(n.CNIVersion, result, hostIface, contIface)
+	if err != nil {
+		return err
+	}
+	return versioned.Print()
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -243,11 +454,196 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
-	return ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
-		return ip.DelLinkByName(args.IfName)
+	var ipn *net.IPNet
+	err = ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
+		var err error
+		ipn, err = ip.DelLinkByNameAddr(args.IfName, netlink.FAMILY_V4)
+		if err == ip.ErrLinkNotFound {
+			// already torn down by an earlier DEL
+			return nil
+		}
+		return err
 	})
+	if err != nil {
+		return err
+	}
+
+	if n.IPMasq && ipn != nil {
+		chain := utils.FormatChainName(n.Name, args.ContainerID)
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = ip.TeardownIPMasq(ip.Network(ipn), chain, comment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cmdCheck verifies, without changing anything, that the container is
+// still wired up the way prevResult says ADD left it: the container
+// veth is up with its MAC, addresses and routes, and its host end is a
+// port of the bridge.
+func cmdCheck(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	prevResult, err := n.ParsePrevResult()
+	if err != nil {
+		return err
+	}
+	if prevResult == nil {
+		return types.NewInvalidNetworkConfigError("prevResult is required to check the network", "")
+	}
+	r, err := prevResult.GetAsVersion("0.2.0")
+	if err != nil {
+		return err
+	}
+	result := r.(*types.Result020)
+
+	// a 0.1.0 result names no interfaces, its addresses are all on
+	// the container end
+	var hostIface, contIface *types.Interface
+	contIdx := -1
+	for i, iface := range result.Interfaces {
+		switch {
+		case iface.Sandbox == "":
+			hostIface = iface
+		case iface.Name == args.IfName:
+			contIface, contIdx = iface, i
+		}
+	}
+
+	var contIPs []*types.IPAddress
+	for _, addr := range result.IPs {
+		if addr.Interface == nil || *addr.Interface == contIdx {
+			contIPs = append(contIPs, addr)
+		}
+	}
+
+	var peerIndex int
+	err = ns.WithNetNSPath(args.Netns, false, func(_ *os.File) error {
+		var err error
+		peerIndex, err = checkContainerVeth(args.IfName, contIface, contIPs, result.Routes)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return checkHostVeth(n.BrName, peerIndex, hostIface)
+}
+
+// checkContainerVeth checks the container end of the veth in the
+// current netns and returns the index of its peer.
+func checkContainerVeth(ifName string, contIface *types.Interface, ips []*types.IPAddress, routes []types.Route) (int, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return 0, fmt.Errorf("container interface %q not found: %v", ifName, err)
+	}
+	if _, ok := link.(*netlink.Veth); !ok {
+		return 0, fmt.Errorf("container interface %q is a %s, not a veth", ifName, link.Type())
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return 0, fmt.Errorf("container interface %q is down", ifName)
+	}
+	if contIface != nil && contIface.Mac != "" {
+		if mac := link.Attrs().HardwareAddr.String(); mac != contIface.Mac {
+			return 0, fmt.Errorf("container interface %q has MAC %s instead of %s", ifName, mac, contIface.Mac)
+		}
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list the addresses of %q: %v", ifName, err)
+	}
+	for _, ip := range ips {
+		if !hasAddr(addrs, &ip.Address) {
+			return 0, fmt.Errorf("container interface %q is missing address %s", ifName, ip.Address.String())
+		}
+	}
+
+	installed, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list the routes of %q: %v", ifName, err)
+	}
+	for _, route := range routes {
+		gw := route.GW
+		if gw == nil {
+			gw = familyGateway(ips, route.Dst.IP)
+		}
+		if !hasRoute(installed, &route.Dst, gw) {
+			return 0, fmt.Errorf("container interface %q is missing route to %s via %v", ifName, route.Dst.String(), gw)
+		}
+	}
+
+	return link.Attrs().ParentIndex, nil
+}
+
+// checkHostVeth checks that the link with index peerIndex in the
+// current netns is the host veth of the result, if it names one, and
+// a port of the bridge brName.
+func checkHostVeth(brName string, peerIndex int, hostIface *types.Interface) error {
+	hostVeth, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return fmt.Errorf("host veth with index %d not found: %v", peerIndex, err)
+	}
+	name := hostVeth.Attrs().Name
+	if hostIface != nil && hostIface.Name != name {
+		return fmt.Errorf("host veth is %q instead of %q", name, hostIface.Name)
+	}
+
+	br, err := bridgeByName(brName)
+	if err != nil {
+		return err
+	}
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return fmt.Errorf("host veth %q is not a port of bridge %q", name, brName)
+	}
+	return nil
+}
+
+func hasAddr(addrs []netlink.Addr, ipn *net.IPNet) bool {
+	for _, addr := range addrs {
+		if addr.IPNet.String() == ipn.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRoute reports whether routes has one to dst via gw, or to dst in
+// any way if gw is nil.
+func hasRoute(routes []netlink.Route, dst *net.IPNet, gw net.IP) bool {
+	dstOnes, _ := dst.Mask.Size()
+	for _, r := range routes {
+		// the kernel reports a default route with a nil Dst
+		if r.Dst == nil {
+			if dstOnes != 0 {
+				continue
+			}
+		} else if r.Dst.String() != dst.String() {
+			continue
+		}
+		if gw == nil || r.Gw.Equal(gw) {
+			return true
+		}
+	}
+	return false
+}
+
+// familyGateway returns the gateway of the first address of the family
+// of ip, which ADD routes through when a route names no gateway.
+func familyGateway(ips []*types.IPAddress, ip net.IP) net.IP {
+	for _, addr := range ips {
+		if (addr.Address.IP.To4() == nil) == (ip.To4() == nil) && addr.Gateway != nil {
+			return addr.Gateway
+		}
+	}
+	return nil
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	skel.PluginMain(cmdAdd, cmdDel, cmdCheck, version.PluginSupports("0.1.0", "0.2.0"))
 }
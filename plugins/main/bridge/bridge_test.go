@@ -0,0 +1,855 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/testutils"
+	"github.com/appc/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+const (
+	bridgeName = "cni-test0"
+	ifName     = "eth0"
+)
+
+// rawLinkFlags returns the IFF_* flags of link, which netlink.LinkAttrs
+// only partially exposes.
+func rawLinkFlags(link netlink.Link) uint32 {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(msgs).To(HaveLen(1))
+	return nl.DeserializeIfInfomsg(msgs[0]).Flags
+}
+
+// portPVID returns the PVID of the bridge port link, or 0 if it has none.
+func portPVID(link netlink.Link) int {
+	const (
+		iflaAfSpec         = 0x1a
+		iflaExtMask        = 0x1d
+		iflaBridgeVlanInfo = 0x2
+		rtextFilterBrvlan  = 0x2
+		bridgeVlanInfoPvid = 0x2
+	)
+
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_BRIDGE))
+	req.AddData(nl.NewRtAttr(iflaExtMask, nl.Uint32Attr(rtextFilterBrvlan)))
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	Expect(err).NotTo(HaveOccurred())
+
+	for _, m := range msgs {
+		if nl.DeserializeIfInfomsg(m).Index != int32(link.Attrs().Index) {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[syscall.SizeofIfInfomsg:])
+		Expect(err).NotTo(HaveOccurred())
+		for _, a := range attrs {
+			if a.Attr.Type&^syscall.NLA_F_NESTED != iflaAfSpec {
+				continue
+			}
+			infos, err := nl.ParseRouteAttr(a.Value)
+			Expect(err).NotTo(HaveOccurred())
+			for _, info := range infos {
+				flags := nl.NativeEndian().Uint16(info.Value[0:2])
+				if info.Attr.Type == iflaBridgeVlanInfo && flags&bridgeVlanInfoPvid != 0 {
+					return int(nl.NativeEndian().Uint16(info.Value[2:4]))
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// bridgePort returns the single port enslaved to br.
+func bridgePort(br netlink.Link) netlink.Link {
+	links, err := netlink.LinkList()
+	Expect(err).NotTo(HaveOccurred())
+
+	var ports []netlink.Link
+	for _, l := range links {
+		if l.Attrs().MasterIndex == br.Attrs().Index {
+			ports = append(ports, l)
+		}
+	}
+	Expect(ports).To(HaveLen(1))
+	return ports[0]
+}
+
+var _ = Describe("bridge", func() {
+	var (
+		hostNSName, contNSName string
+		hostNS, contNS         *os.File
+		dataDir                string
+		conf                   string
+	)
+
+	// runInHostNS runs the plugin from within the fake host namespace
+	runInHostNS := func(command string) *gexec.Session {
+		return testutils.RunPluginInNS(hostNS, pathToBridgePlugin, testutils.PluginArgs{
+			Command:     command,
+			ContainerID: "some-container-id",
+			Netns:       contNS.Name(),
+			IfName:      ifName,
+			Path:        cniPath,
+		}, conf)
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		hostNSName = fmt.Sprintf("test-bridge-host-%d", rand.Int())
+		hostNS, err = ns.CreateNetNS(hostNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		contNSName = fmt.Sprintf("test-bridge-cont-%d", rand.Int())
+		contNS, err = ns.CreateNetNS(contNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "bridge-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		conf = fmt.Sprintf(`{
+			"name": "testnet",
+			"type": "bridge",
+			"bridge": %q,
+			"isGateway": true,
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": %q
+			}
+		}`, bridgeName, dataDir)
+	})
+
+	AfterEach(func() {
+		Expect(contNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(contNSName)).To(Succeed())
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(hostNSName)).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	Describe("ADD", func() {
+		var session *gexec.Session
+
+		BeforeEach(func() {
+			session = runInHostNS("ADD")
+		})
+
+		It("succeeds and prints the IPAM result", func() {
+			Expect(session.ExitCode()).To(Equal(0))
+
+			result := &types.Result010{}
+			Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+			Expect(result.IP4.IP.String()).To(Equal("10.1.2.2/24"))
+			Expect(result.IP4.Gateway.String()).To(Equal("10.1.2.1"))
+		})
+
+		It("passes CHECK with its result as prevResult", func() {
+			conf = strings.Replace(conf, `"type": "bridge",`, fmt.Sprintf(`"type": "bridge", "prevResult": %s,`, session.Out.Contents()), 1)
+
+			Expect(runInHostNS("CHECK").ExitCode()).To(Equal(0))
+		})
+
+		It("configures the container interface with the assigned address and a default route", func() {
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(HaveLen(1))
+				Expect(addrs[0].IPNet.String()).To(Equal("10.1.2.2/24"))
+
+				routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				var defaultGW string
+				for _, r := range routes {
+					if r.Dst == nil && r.Gw != nil {
+						defaultGW = r.Gw.String()
+					}
+				}
+				Expect(defaultGW).To(Equal("10.1.2.1"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("creates the bridge with the gateway address and enslaves the host veth", func() {
+			err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				br, err := netlink.LinkByName(bridgeName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(br).To(BeAssignableToTypeOf(&netlink.Bridge{}))
+
+				addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(HaveLen(1))
+				Expect(addrs[0].IPNet.String()).To(Equal("10.1.2.1/24"))
+
+				links, err := netlink.LinkList()
+				Expect(err).NotTo(HaveOccurred())
+				var enslaved []string
+				for _, l := range links {
+					if _, ok := l.(*netlink.Veth); ok && l.Attrs().MasterIndex == br.Attrs().Index {
+						enslaved = append(enslaved, l.Attrs().Name)
+					}
+				}
+				Expect(enslaved).To(HaveLen(1))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("with cniVersion 0.2.0", func() {
+		BeforeEach(func() {
+			conf = fmt.Sprintf(`{
+				"cniVersion": "0.2.0",
+				"name": "testnet",
+				"type": "bridge",
+				"bridge": %q,
+				"isGateway": true,
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"dataDir": %q
+				}
+			}`, bridgeName, dataDir)
+		})
+
+		It("lists the host and container veths and puts the address on the container's", func() {
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(0))
+
+			result := &types.Result020{}
+			Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+			Expect(result.CNIVersion).To(Equal("0.2.0"))
+			Expect(result.Interfaces).To(HaveLen(2))
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.2/24"))
+			Expect(result.IPs[0].Gateway.String()).To(Equal("10.1.2.1"))
+
+			contIface := result.Interfaces[*result.IPs[0].Interface]
+			Expect(contIface.Name).To(Equal(ifName))
+			Expect(contIface.Sandbox).To(Equal(contNS.Name()))
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contIface.Mac).To(Equal(link.Attrs().HardwareAddr.String()))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			hostIface := result.Interfaces[0]
+			Expect(hostIface.Sandbox).To(BeEmpty())
+			err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				br, err := netlink.LinkByName(bridgeName)
+				Expect(err).NotTo(HaveOccurred())
+				port := bridgePort(br)
+				Expect(hostIface.Name).To(Equal(port.Attrs().Name))
+				Expect(hostIface.Mac).To(Equal(port.Attrs().HardwareAddr.String()))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var raw struct {
+				Interfaces []map[string]interface{} `json:"interfaces"`
+				IPs        []map[string]interface{} `json:"ips"`
+			}
+			Expect(json.Unmarshal(session.Out.Contents(), &raw)).To(Succeed())
+			Expect(raw.Interfaces[0]).To(HaveLen(2))
+			Expect(raw.Interfaces[0]).NotTo(HaveKey("sandbox"))
+			Expect(raw.Interfaces[1]).To(HaveKeyWithValue("sandbox", contNS.Name()))
+			Expect(raw.IPs[0]).To(HaveKeyWithValue("interface", BeNumerically("==", 1)))
+			Expect(raw.IPs[0]).To(HaveKeyWithValue("version", "4"))
+		})
+	})
+
+	It("flushes stale neighbor entries of the container's IP from the bridge", func() {
+		staleMAC, _ := net.ParseMAC("0a:58:0a:01:02:99")
+		otherMAC, _ := net.ParseMAC("0a:58:0a:01:02:32")
+		err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			// The kernel flushes the entries itself when the bridge loses
+			// carrier or changes its MAC, so give it a fixed MAC and a
+			// port of its own before adding the stale entry.
+			brMAC, _ := net.ParseMAC("0a:58:0a:01:02:01")
+			Expect(netlink.LinkAdd(&netlink.Bridge{
+				LinkAttrs: netlink.LinkAttrs{Name: bridgeName},
+			})).To(Succeed())
+			br, err := netlink.LinkByName(bridgeName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetHardwareAddr(br, brMAC)).To(Succeed())
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "other0"},
+				PeerName:  "other1",
+			})).To(Succeed())
+			for _, name := range []string{"other0", "other1"} {
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(link)).To(Succeed())
+				if name == "other0" {
+					Expect(netlink.LinkSetMasterByIndex(link, br.Attrs().Index)).To(Succeed())
+				}
+			}
+			Expect(netlink.LinkSetUp(br)).To(Succeed())
+			const iffLowerUp = 0x10000 // not in syscall
+			Eventually(func() uint32 {
+				return rawLinkFlags(br) & iffLowerUp
+			}).ShouldNot(BeZero())
+
+			// left over from an earlier container with the same IP
+			Expect(netlink.NeighAdd(&netlink.Neigh{
+				LinkIndex:    br.Attrs().Index,
+				State:        netlink.NUD_REACHABLE,
+				IP:           net.ParseIP("10.1.2.2"),
+				HardwareAddr: staleMAC,
+			})).To(Succeed())
+
+			// another container on the bridge, which must not be disturbed
+			return netlink.NeighAdd(&netlink.Neigh{
+				LinkIndex:    br.Attrs().Index,
+				State:        netlink.NUD_PERMANENT,
+				IP:           net.ParseIP("10.1.2.50"),
+				HardwareAddr: otherMAC,
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+
+		err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			br, err := netlink.LinkByName(bridgeName)
+			Expect(err).NotTo(HaveOccurred())
+			neighs, err := netlink.NeighList(br.Attrs().Index, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			var others []string
+			for _, n := range neighs {
+				Expect(n.HardwareAddr.String()).NotTo(Equal(staleMAC.String()))
+				if n.IP.Equal(net.ParseIP("10.1.2.50")) {
+					others = append(others, n.HardwareAddr.String())
+				}
+			}
+			Expect(others).To(ConsistOf(otherMAC.String()))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Context("with a configured MAC", func() {
+		withMac := func(mac string) {
+			conf = strings.Replace(conf, `"isGateway": true,`, fmt.Sprintf(`"isGateway": true, "mac": %q,`, mac), 1)
+		}
+
+		It("gives the container interface the MAC and reports it", func() {
+			withMac("0a:58:0a:01:02:03")
+			conf = strings.Replace(conf, `"name": "testnet",`, `"cniVersion": "0.2.0", "name": "testnet",`, 1)
+
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(0))
+
+			result := &types.Result020{}
+			Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+			Expect(result.Interfaces).To(HaveLen(2))
+			Expect(result.Interfaces[1].Mac).To(Equal("0a:58:0a:01:02:03"))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().HardwareAddr.String()).To(Equal("0a:58:0a:01:02:03"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects a multicast MAC", func() {
+			withMac("33:33:00:00:00:01")
+
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(1))
+
+			cniErr := &types.Error{}
+			Expect(json.Unmarshal(session.Out.Contents(), cniErr)).To(Succeed())
+			Expect(cniErr.Msg).To(Equal(`invalid mac "33:33:00:00:00:01": multicast address`))
+		})
+	})
+
+	Describe("MTU", func() {
+		BeforeEach(func() {
+			err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				return netlink.LinkAdd(&netlink.Bridge{
+					LinkAttrs: netlink.LinkAttrs{Name: bridgeName, MTU: 1450},
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		withMTU := func(mtu int) {
+			conf = strings.Replace(conf, `"isGateway": true,`, fmt.Sprintf(`"isGateway": true, "mtu": %d,`, mtu), 1)
+		}
+
+		contMTU := func() int {
+			var mtu int
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				if err != nil {
+					return err
+				}
+				mtu = link.Attrs().MTU
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return mtu
+		}
+
+		It("rejects a veth MTU larger than the bridge's", func() {
+			withMTU(1500)
+
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(1))
+
+			cniErr := &types.Error{}
+			Expect(json.Unmarshal(session.Out.Contents(), cniErr)).To(Succeed())
+			Expect(cniErr.Msg).To(Equal(fmt.Sprintf(`invalid MTU 1500, must be between 1 and the MTU of bridge %q (1450)`, bridgeName)))
+		})
+
+		It("applies a veth MTU up to the bridge's", func() {
+			withMTU(1400)
+
+			Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+			Expect(contMTU()).To(Equal(1400))
+		})
+
+		It("inherits the bridge's MTU when none is configured", func() {
+			Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+			Expect(contMTU()).To(Equal(1450))
+		})
+	})
+
+	It("creates the bridge and the veth with the configured MTU", func() {
+		conf = strings.Replace(conf, `"isGateway": true,`, `"isGateway": true, "mtu": 1400,`, 1)
+		Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+
+		err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			br, err := netlink.LinkByName(bridgeName)
+			if err != nil {
+				return err
+			}
+			Expect(br.Attrs().MTU).To(Equal(1400))
+			Expect(bridgePort(br).Attrs().MTU).To(Equal(1400))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects a negative MTU for a new bridge", func() {
+		conf = strings.Replace(conf, `"isGateway": true,`, `"isGateway": true, "mtu": -1,`, 1)
+
+		session := runInHostNS("ADD")
+		Expect(session.ExitCode()).To(Equal(1))
+
+		cniErr := &types.Error{}
+		Expect(json.Unmarshal(session.Out.Contents(), cniErr)).To(Succeed())
+		Expect(cniErr.Msg).To(Equal(fmt.Sprintf(`failed to create bridge %q: invalid MTU -1 for %q`, bridgeName, bridgeName)))
+	})
+
+	Context("with a dual-stack IPAM config", func() {
+		BeforeEach(func() {
+			conf = fmt.Sprintf(`{
+				"name": "testnet",
+				"type": "bridge",
+				"bridge": %q,
+				"isGateway": true,
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						{ "subnet": "10.1.2.0/24" },
+						{ "subnet": "fd00:1234::/64" }
+					],
+					"dataDir": %q
+				}
+			}`, bridgeName, dataDir)
+		})
+
+		// globalAddrs lists the addresses of link of the family, less
+		// the IPv6 link-local ones the kernel adds
+		globalAddrs := func(link netlink.Link, family int) []string {
+			addrs, err := netlink.AddrList(link, family)
+			Expect(err).NotTo(HaveOccurred())
+			var global []string
+			for _, a := range addrs {
+				if !a.IP.IsLinkLocalUnicast() {
+					global = append(global, a.IPNet.String())
+				}
+			}
+			return global
+		}
+
+		It("configures an address and a default route of each family", func() {
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(0))
+
+			result := &types.Result010{}
+			Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+			Expect(result.IP4.IP.String()).To(Equal("10.1.2.2/24"))
+			Expect(result.IP6.IP.String()).To(Equal("fd00:1234::2/64"))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+
+				for _, expected := range []struct {
+					family   int
+					addr, gw string
+				}{
+					{netlink.FAMILY_V4, "10.1.2.2/24", "10.1.2.1"},
+					{netlink.FAMILY_V6, "fd00:1234::2/64", "fd00:1234::1"},
+				} {
+					Expect(globalAddrs(link, expected.family)).To(ConsistOf(expected.addr))
+
+					routes, err := netlink.RouteList(link, expected.family)
+					Expect(err).NotTo(HaveOccurred())
+					var defaultGWs []string
+					for _, r := range routes {
+						if r.Dst == nil {
+							defaultGWs = append(defaultGWs, r.Gw.String())
+						}
+					}
+					Expect(defaultGWs).To(ConsistOf(expected.gw))
+				}
+
+				// ADD waits for DAD, so nothing is left tentative
+				return ip.SettleAddresses(ifName, 0)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				br, err := netlink.LinkByName(bridgeName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(globalAddrs(br, netlink.FAMILY_V4)).To(ConsistOf("10.1.2.1/24"))
+				Expect(globalAddrs(br, netlink.FAMILY_V6)).To(ConsistOf("fd00:1234::1/64"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("accepts the bridge's own addresses on a second ADD", func() {
+			Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+			Expect(runInHostNS("DEL").ExitCode()).To(Equal(0))
+			Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+		})
+	})
+
+	Context("with hairpinMode and promiscMode", func() {
+		BeforeEach(func() {
+			conf = strings.Replace(conf, `"isGateway": true,`, `"isGateway": true, "hairpinMode": true, "promiscMode": true,`, 1)
+		})
+
+		It("sets the hairpin flag on the bridge port and puts the bridge in promiscuous mode", func() {
+			Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+
+			err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				br, err := netlink.LinkByName(bridgeName)
+				Expect(err).NotTo(HaveOccurred())
+
+				protinfo, err := netlink.LinkGetProtinfo(bridgePort(br))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(protinfo.Hairpin).To(BeTrue())
+
+				Expect(rawLinkFlags(br) & syscall.IFF_PROMISC).NotTo(BeZero())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	It("leaves hairpin mode off by default", func() {
+		Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+
+		err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			br, err := netlink.LinkByName(bridgeName)
+			Expect(err).NotTo(HaveOccurred())
+
+			protinfo, err := netlink.LinkGetProtinfo(bridgePort(br))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(protinfo.Hairpin).To(BeFalse())
+
+			Expect(rawLinkFlags(br) & syscall.IFF_PROMISC).To(BeZero())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Context("with a vlan", func() {
+		BeforeEach(func() {
+			conf = strings.Replace(conf, `"isGateway": true,`, `"isGateway": true, "vlan": 100,`, 1)
+		})
+
+		It("sets the VLAN as the PVID of the bridge port", func() {
+			session := runInHostNS("ADD")
+			if strings.Contains(string(session.Out.Contents()), syscall.EOPNOTSUPP.Error()) {
+				Skip("kernel does not support bridge VLAN filtering")
+			}
+			Expect(session.ExitCode()).To(Equal(0))
+
+			err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				br, err := netlink.LinkByName(bridgeName)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(portPVID(bridgePort(br))).To(Equal(100))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	DescribeTable("rejects VLAN IDs out of range",
+		func(vlan int) {
+			conf = strings.Replace(conf, `"isGateway": true,`, fmt.Sprintf(`"isGateway": true, "vlan": %d,`, vlan), 1)
+
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(1))
+
+			cniErr := &types.Error{}
+			Expect(json.Unmarshal(session.Out.Contents(), cniErr)).To(Succeed())
+			Expect(cniErr.Msg).To(Equal(fmt.Sprintf("invalid VLAN ID %d, must be between 1 and 4094", vlan)))
+		},
+		Entry("negative", -1),
+		Entry("above 4094", 4095),
+	)
+
+	Context("when createBridge is false", func() {
+		BeforeEach(func() {
+			conf = strings.Replace(conf, `"isGateway": true,`, `"isGateway": true, "createBridge": false,`, 1)
+		})
+
+		It("fails if the bridge does not exist", func() {
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(1))
+
+			cniErr := &types.Error{}
+			Expect(json.Unmarshal(session.Out.Contents(), cniErr)).To(Succeed())
+			Expect(cniErr.Msg).To(Equal(fmt.Sprintf(`bridge %q does not exist and createBridge is false`, bridgeName)))
+
+			err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				_, err := netlink.LinkByName(bridgeName)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("and the bridge exists", func() {
+			BeforeEach(func() {
+				err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+					return netlink.LinkAdd(&netlink.Bridge{
+						LinkAttrs: netlink.LinkAttrs{Name: bridgeName, MTU: 1450},
+					})
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			bridge := func() netlink.Link {
+				var br netlink.Link
+				err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+					var err error
+					br, err = netlink.LinkByName(bridgeName)
+					return err
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return br
+			}
+
+			bridgeAddrs := func() []netlink.Addr {
+				var addrs []netlink.Addr
+				err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+					var err error
+					addrs, err = netlink.AddrList(bridge(), netlink.FAMILY_V4)
+					return err
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return addrs
+			}
+
+			It("attaches the container without reconfiguring the bridge", func() {
+				Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+
+				br := bridge()
+				Expect(br.Attrs().MTU).To(Equal(1450))
+				Expect(br.Attrs().Flags & net.FlagUp).To(BeZero())
+				Expect(bridgeAddrs()).To(BeEmpty())
+
+				err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+					links, err := netlink.LinkList()
+					Expect(err).NotTo(HaveOccurred())
+					var enslaved int
+					for _, l := range links {
+						if _, ok := l.(*netlink.Veth); ok && l.Attrs().MasterIndex == br.Attrs().Index {
+							enslaved++
+						}
+					}
+					Expect(enslaved).To(Equal(1))
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("leaves the bridge in place on DEL", func() {
+				Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+				Expect(runInHostNS("DEL").ExitCode()).To(Equal(0))
+
+				br := bridge()
+				Expect(br).To(BeAssignableToTypeOf(&netlink.Bridge{}))
+				Expect(bridgeAddrs()).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("CHECK", func() {
+		// checkErr runs CHECK and returns the error it reported
+		checkErr := func() *types.Error {
+			session := runInHostNS("CHECK")
+			Expect(session.ExitCode()).To(Equal(1))
+
+			cniErr := &types.Error{}
+			Expect(json.Unmarshal(session.Out.Contents(), cniErr)).To(Succeed())
+			return cniErr
+		}
+
+		BeforeEach(func() {
+			conf = fmt.Sprintf(`{
+				"cniVersion": "0.2.0",
+				"name": "testnet",
+				"type": "bridge",
+				"bridge": %q,
+				"isGateway": true,
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"dataDir": %q
+				}
+			}`, bridgeName, dataDir)
+
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(0))
+			conf = strings.Replace(conf, `"type": "bridge",`, fmt.Sprintf(`"type": "bridge", "prevResult": %s,`, session.Out.Contents()), 1)
+		})
+
+		It("succeeds while the container is wired up as ADD left it", func() {
+			session := runInHostNS("CHECK")
+			Expect(session.ExitCode()).To(Equal(0))
+			Expect(session.Out.Contents()).To(BeEmpty())
+		})
+
+		It("names the address that is missing from the container interface", func() {
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				if err != nil {
+					return err
+				}
+				addr, err := netlink.ParseAddr("10.1.2.2/24")
+				if err != nil {
+					return err
+				}
+				return netlink.AddrDel(link, addr)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(checkErr().Msg).To(Equal(`container interface "eth0" is missing address 10.1.2.2/24`))
+		})
+
+		It("names a missing route", func() {
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				if err != nil {
+					return err
+				}
+				return netlink.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("10.1.2.1")})
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(checkErr().Msg).To(Equal(`container interface "eth0" is missing route to 0.0.0.0/0 via 10.1.2.1`))
+		})
+
+		It("fails once the host veth has left the bridge", func() {
+			var portName string
+			err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				br, err := netlink.LinkByName(bridgeName)
+				if err != nil {
+					return err
+				}
+				port := bridgePort(br)
+				portName = port.Attrs().Name
+				return netlink.LinkSetMasterByIndex(port, 0)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(checkErr().Msg).To(Equal(fmt.Sprintf("host veth %q is not a port of bridge %q", portName, bridgeName)))
+		})
+
+		It("requires a prevResult", func() {
+			conf = fmt.Sprintf(`{ "cniVersion": "0.2.0", "name": "testnet", "type": "bridge", "bridge": %q }`, bridgeName)
+
+			cniErr := checkErr()
+			Expect(cniErr.Code).To(Equal(types.ErrInvalidNetworkConfig))
+			Expect(cniErr.Msg).To(Equal("prevResult is required to check the network"))
+		})
+	})
+
+	Describe("DEL", func() {
+		It("removes the container interface and releases the address", func() {
+			Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+			Expect(runInHostNS("DEL").ExitCode()).To(Equal(0))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				_, err := netlink.LinkByName(ifName)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = os.Stat(fmt.Sprintf("%s/testnet/10.1.2.2", dataDir))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("succeeds when the interface is already gone", func() {
+			Expect(runInHostNS("DEL").ExitCode()).To(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,81 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// netlink attributes and flags for bridge VLAN filtering that neither
+// syscall nor the netlink package define
+const (
+	iflaAfSpec             = 0x1a
+	iflaBrVlanFiltering    = 0x7
+	iflaBridgeVlanInfo     = 0x2
+	bridgeVlanInfoPvid     = 0x2
+	bridgeVlanInfoUntagged = 0x4
+)
+
+func validateVlan(vlan int) error {
+	if vlan < 0 || vlan > 4094 {
+		return fmt.Errorf("invalid VLAN ID %d, must be between 1 and 4094", vlan)
+	}
+	return nil
+}
+
+// enableVlanFiltering turns on vlan_filtering on the bridge so that
+// port VLAN membership is honoured.
+func enableVlanFiltering(br *netlink.Bridge) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated(br.Type()))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, iflaBrVlanFiltering, []byte{1})
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// setPortVlan makes vlan the PVID of the bridge port link and sends its
+// frames out untagged.
+func setPortVlan(link netlink.Link, vlan int) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_SETLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_BRIDGE)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	// struct bridge_vlan_info { __u16 flags; __u16 vid; }
+	info := make([]byte, 4)
+	nl.NativeEndian().PutUint16(info[0:2], bridgeVlanInfoPvid|bridgeVlanInfoUntagged)
+	nl.NativeEndian().PutUint16(info[2:4], uint16(vlan))
+
+	afSpec := nl.NewRtAttr(iflaAfSpec|syscall.NLA_F_NESTED, nil)
+	nl.NewRtAttrChild(afSpec, iflaBridgeVlanInfo, info)
+	req.AddData(afSpec)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
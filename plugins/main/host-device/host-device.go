@@ -0,0 +1,421 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a "host-device" plugin: rather than creating an interface for
+// the container, it moves an existing one, such as a physical NIC or an
+// SR-IOV virtual function, from the host into the container.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/ipam"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/skel"
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultDataDir = "/var/lib/cni/host-device"
+	sysClassNet    = "/sys/class/net"
+)
+
+type NetConf struct {
+	types.NetConf
+	Device     string `json:"device"`
+	HWAddr     string `json:"hwaddr"`
+	KernelPath string `json:"kernelpath"`
+	DataDir    string `json:"dataDir"`
+
+	// PreserveDefaultRoute carries the device's default routes over
+	// into the container, and back to the host on DEL.
+	PreserveDefaultRoute bool `json:"preserveDefaultRoute"`
+}
+
+// defaultRoute is a default route of the device. Routes do not survive
+// a move to another namespace, so it is kept to be added again there.
+type defaultRoute struct {
+	Family int    `json:"family"`
+	Gw     net.IP `json:"gw,omitempty"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{DataDir: defaultDataDir}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	set := 0
+	for _, s := range []string{n.Device, n.HWAddr, n.KernelPath} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf(`exactly one of "device", "hwaddr" and "kernelpath" must be given to specify the host interface`)
+	}
+	return n, nil
+}
+
+// findLink looks up the host interface the config specifies.
+func findLink(n *NetConf) (netlink.Link, error) {
+	switch {
+	case n.Device != "":
+		link, err := netlink.LinkByName(n.Device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup device %q: %v", n.Device, err)
+		}
+		return link, nil
+
+	case n.HWAddr != "":
+		hwAddr, err := net.ParseMAC(n.HWAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hwaddr %q: %v", n.HWAddr, err)
+		}
+		links, err := netlink.LinkList()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list interfaces: %v", err)
+		}
+		for _, link := range links {
+			if link.Attrs().HardwareAddr.String() == hwAddr.String() {
+				return link, nil
+			}
+		}
+		return nil, fmt.Errorf("no interface with hwaddr %q", n.HWAddr)
+
+	default:
+		name, err := nameByKernelPath(n.KernelPath)
+		if err != nil {
+			return nil, err
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup %q: %v", name, err)
+		}
+		return link, nil
+	}
+}
+
+// nameByKernelPath returns the name of the interface of the device at
+// kernelPath, e.g. /sys/devices/pci0000:00/0000:00:19.0.
+func nameByKernelPath(kernelPath string) (string, error) {
+	kernelPath = filepath.Clean(kernelPath)
+
+	entries, err := ioutil.ReadDir(sysClassNet)
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %v", sysClassNet, err)
+	}
+	for _, e := range entries {
+		// /sys/class/net/<name> links to <device path>/net/<name>
+		devPath, err := filepath.EvalSymlinks(filepath.Join(sysClassNet, e.Name()))
+		if err != nil {
+			continue
+		}
+		if filepath.Dir(filepath.Dir(devPath)) == kernelPath {
+			return e.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("no interface for kernel path %q", kernelPath)
+}
+
+// origNamePath is where the host name of the interface moved in as
+// ifName is kept, so DEL can give it back.
+func origNamePath(dataDir, containerID, ifName string) string {
+	return filepath.Join(dataDir, containerID+"-"+ifName)
+}
+
+func saveOrigName(dataDir, containerID, ifName, origName string) error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(origNamePath(dataDir, containerID, ifName), []byte(origName), 0600)
+}
+
+// routesPath is where the default routes of the interface moved in as
+// ifName are kept, so DEL can put them back on the host.
+func routesPath(dataDir, containerID, ifName string) string {
+	return origNamePath(dataDir, containerID, ifName) + ".routes"
+}
+
+func saveRoutes(dataDir, containerID, ifName string, routes []defaultRoute) error {
+	data, err := json.Marshal(routes)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(routesPath(dataDir, containerID, ifName), data, 0600)
+}
+
+// defaultRoutes returns the default routes through link.
+func defaultRoutes(link netlink.Link) ([]defaultRoute, error) {
+	var routes []defaultRoute
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		list, err := netlink.RouteList(link, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routes of %q: %v", link.Attrs().Name, err)
+		}
+		for _, r := range list {
+			if r.Dst == nil {
+				routes = append(routes, defaultRoute{Family: family, Gw: r.Gw})
+			}
+		}
+	}
+	return routes, nil
+}
+
+// addDefaultRoutes adds routes through link in the current namespace,
+// skipping those of a family that already has a default route, e.g.
+// one from IPAM. The addresses of link went with the move, so each
+// gateway is made reachable with a route of its own first.
+func addDefaultRoutes(link netlink.Link, routes []defaultRoute) error {
+	for _, r := range routes {
+		existing, err := netlink.RouteList(nil, r.Family)
+		if err != nil {
+			return fmt.Errorf("failed to list routes: %v", err)
+		}
+		if hasDefaultRoute(existing) {
+			continue
+		}
+
+		bits := 32
+		if r.Family == netlink.FAMILY_V6 {
+			bits = 128
+		}
+		defNet := &net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(0, bits)}
+
+		if r.Gw != nil && !onLink(r.Gw, link) {
+			gwNet := &net.IPNet{IP: r.Gw, Mask: net.CIDRMask(bits, bits)}
+			if err = ip.AddRoute(gwNet, nil, link); err != nil {
+				return fmt.Errorf("failed to add route to gateway %v: %v", r.Gw, err)
+			}
+		}
+		if err = ip.AddRoute(defNet, r.Gw, link); err != nil {
+			return fmt.Errorf("failed to add default route via %v: %v", r.Gw, err)
+		}
+	}
+	return nil
+}
+
+func hasDefaultRoute(routes []netlink.Route) bool {
+	for _, r := range routes {
+		if r.Dst == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// onLink reports whether a route through link already reaches gw.
+func onLink(gw net.IP, link netlink.Link) bool {
+	family := netlink.FAMILY_V4
+	if gw.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteList(link, family)
+	if err != nil {
+		return false
+	}
+	for _, r := range routes {
+		if r.Dst != nil && r.Gw == nil && r.Dst.Contains(gw) {
+			return true
+		}
+	}
+	return false
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := os.Open(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	link, err := findLink(n)
+	if err != nil {
+		return err
+	}
+	origName := link.Attrs().Name
+
+	if err = saveOrigName(n.DataDir, args.ContainerID, args.IfName, origName); err != nil {
+		return fmt.Errorf("failed to record the name of %q: %v", origName, err)
+	}
+
+	var routes []defaultRoute
+	if n.PreserveDefaultRoute {
+		if routes, err = defaultRoutes(link); err != nil {
+			return err
+		}
+		if err = saveRoutes(n.DataDir, args.ContainerID, args.IfName, routes); err != nil {
+			return fmt.Errorf("failed to record the default routes of %q: %v", origName, err)
+		}
+	}
+
+	if err = netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("failed to set %q down: %v", origName, err)
+	}
+	if err = ip.MoveLinkToNS(link, netns); err != nil {
+		return err
+	}
+
+	err = ns.WithNetNS(netns, false, func(_ *os.File) error {
+		if err := ip.RenameLink(origName, args.IfName); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+		if err = netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", args.IfName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	result := &types.Result010{}
+	if n.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		result, err = ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+
+		err = ns.WithNetNS(netns, false, func(_ *os.File) error {
+			return ipam.ConfigureIface(args.IfName, result)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(routes) > 0 {
+		err = ns.WithNetNS(netns, false, func(_ *os.File) error {
+			link, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+			}
+			return addDefaultRoutes(link, routes)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	result.DNS = n.DNS
+	return types.PrintResult(result, n.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		if err = ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	path := origNamePath(n.DataDir, args.ContainerID, args.IfName)
+	origName, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// nothing was moved in, or an earlier DEL moved it out already
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the name of %q: %v", args.IfName, err)
+	}
+
+	err = ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			if ip.IsLinkNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+
+		if err = netlink.LinkSetDown(link); err != nil {
+			return fmt.Errorf("failed to set %q down: %v", args.IfName, err)
+		}
+		if err = ip.RenameLink(args.IfName, string(origName)); err != nil {
+			return err
+		}
+		link, err = netlink.LinkByName(string(origName))
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", origName, err)
+		}
+		return ip.MoveLinkToNS(link, hostNS)
+	})
+	if err != nil {
+		return err
+	}
+
+	restoreDefaultRoutes(routesPath(n.DataDir, args.ContainerID, args.IfName), string(origName))
+
+	return os.Remove(path)
+}
+
+// restoreDefaultRoutes puts the default routes kept at path back on
+// the host interface name, which needs to be up for them. It is best
+// effort: the host may have routed around the device meanwhile.
+func restoreDefaultRoutes(path, name string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	defer os.Remove(path)
+
+	var routes []defaultRoute
+	if err = json.Unmarshal(data, &routes); err != nil || len(routes) == 0 {
+		return
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return
+	}
+	addDefaultRoutes(link, routes)
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel, nil, version.All)
+}
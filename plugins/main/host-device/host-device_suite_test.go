@@ -0,0 +1,50 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"math/rand"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/config"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+
+	"testing"
+)
+
+var pathToHostDevicePlugin, cniPath string
+
+func TestHostDevice(t *testing.T) {
+	rand.Seed(config.GinkgoConfig.RandomSeed)
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "host-device Suite")
+}
+
+var _ = BeforeSuite(func() {
+	var err error
+	pathToHostDevicePlugin, err = gexec.Build("github.com/appc/cni/plugins/main/host-device")
+	Expect(err).NotTo(HaveOccurred())
+
+	pathToHostLocal, err := gexec.Build("github.com/appc/cni/plugins/ipam/host-local")
+	Expect(err).NotTo(HaveOccurred())
+	cniPath = filepath.Dir(pathToHostLocal)
+})
+
+var _ = AfterSuite(func() {
+	gexec.CleanupBuildArtifacts()
+})
@@ -0,0 +1,304 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/testutils"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+const (
+	deviceName = "cni-dev0"
+	ifName     = "eth0"
+)
+
+var _ = Describe("host-device", func() {
+	var (
+		hostNSName, contNSName string
+		hostNS, contNS         *os.File
+		dataDir                string
+		deviceIndex            int
+		deviceMac              string
+	)
+
+	// runInHostNS runs the plugin from within the fake host namespace
+	runInHostNS := func(command, conf string) *gexec.Session {
+		return testutils.RunPluginInNS(hostNS, pathToHostDevicePlugin, testutils.PluginArgs{
+			Command:     command,
+			ContainerID: "some-container-id",
+			Netns:       contNS.Name(),
+			IfName:      ifName,
+			Path:        cniPath,
+		}, conf)
+	}
+
+	makeConf := func(extra string) string {
+		return fmt.Sprintf(`{
+			"name": "testnet",
+			"type": "host-device",
+			%s,
+			"dataDir": %q
+		}`, extra, dataDir)
+	}
+
+	// linkIn returns the interface called name in netNS, or nil
+	linkIn := func(netNS *os.File, name string) netlink.Link {
+		var link netlink.Link
+		err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+			link, _ = netlink.LinkByName(name)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return link
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		hostNSName = fmt.Sprintf("test-hostdev-host-%d", rand.Int())
+		hostNS, err = ns.CreateNetNS(hostNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		contNSName = fmt.Sprintf("test-hostdev-cont-%d", rand.Int())
+		contNS, err = ns.CreateNetNS(contNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "host-device-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		// the dummy driver is not available on every kernel;
+		// one end of a veth pair serves as the device just as well
+		err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: deviceName},
+				PeerName:  deviceName + "p",
+			})
+			if err != nil {
+				return err
+			}
+
+			link, err := netlink.LinkByName(deviceName)
+			if err != nil {
+				return err
+			}
+			deviceIndex = link.Attrs().Index
+			deviceMac = link.Attrs().HardwareAddr.String()
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(contNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(contNSName)).To(Succeed())
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(hostNSName)).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	expectMovedIn := func() {
+		Expect(linkIn(hostNS, deviceName)).To(BeNil())
+
+		link := linkIn(contNS, ifName)
+		Expect(link).NotTo(BeNil())
+		Expect(link.Attrs().HardwareAddr.String()).To(Equal(deviceMac))
+		Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+	}
+
+	Describe("ADD", func() {
+		It("moves the device into the container and renames it", func() {
+			Expect(runInHostNS("ADD", makeConf(fmt.Sprintf(`"device": %q`, deviceName))).ExitCode()).To(Equal(0))
+
+			expectMovedIn()
+		})
+
+		It("finds the device by its hwaddr", func() {
+			Expect(runInHostNS("ADD", makeConf(fmt.Sprintf(`"hwaddr": %q`, deviceMac))).ExitCode()).To(Equal(0))
+
+			expectMovedIn()
+		})
+
+		It("applies the IPAM result to the container interface", func() {
+			conf := makeConf(fmt.Sprintf(`"device": %q,
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"dataDir": %q
+				}`, deviceName, dataDir))
+			session := runInHostNS("ADD", conf)
+			Expect(session.ExitCode()).To(Equal(0))
+			Expect(string(session.Out.Contents())).To(ContainSubstring("10.1.2.2/24"))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(HaveLen(1))
+				Expect(addrs[0].IPNet.String()).To(Equal("10.1.2.2/24"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("requires exactly one way to name the device", func() {
+			conf := makeConf(fmt.Sprintf(`"device": %q, "hwaddr": %q`, deviceName, deviceMac))
+			session := runInHostNS("ADD", conf)
+			Expect(session.ExitCode()).NotTo(Equal(0))
+			Expect(string(session.Out.Contents())).To(ContainSubstring(`exactly one of \"device\", \"hwaddr\" and \"kernelpath\"`))
+			Expect(linkIn(hostNS, deviceName)).NotTo(BeNil())
+		})
+
+		It("fails when the device does not exist", func() {
+			session := runInHostNS("ADD", makeConf(`"device": "missing0"`))
+			Expect(session.ExitCode()).NotTo(Equal(0))
+			Expect(string(session.Out.Contents())).To(ContainSubstring(`failed to lookup device \"missing0\"`))
+		})
+	})
+
+	Describe("DEL", func() {
+		var conf string
+
+		BeforeEach(func() {
+			conf = makeConf(fmt.Sprintf(`"device": %q`, deviceName))
+			Expect(runInHostNS("ADD", conf).ExitCode()).To(Equal(0))
+		})
+
+		It("moves the device back to the host under its original name", func() {
+			Expect(runInHostNS("DEL", conf).ExitCode()).To(Equal(0))
+
+			Expect(linkIn(contNS, ifName)).To(BeNil())
+			link := linkIn(hostNS, deviceName)
+			Expect(link).NotTo(BeNil())
+			Expect(link.Attrs().Index).To(Equal(deviceIndex))
+		})
+
+		It("succeeds when repeated", func() {
+			Expect(runInHostNS("DEL", conf).ExitCode()).To(Equal(0))
+			Expect(runInHostNS("DEL", conf).ExitCode()).To(Equal(0))
+
+			Expect(linkIn(hostNS, deviceName)).NotTo(BeNil())
+		})
+	})
+
+	Context("with preserveDefaultRoute", func() {
+		var conf string
+
+		// defaultRoutesIn returns the default routes through the
+		// interface called name in netNS
+		defaultRoutesIn := func(netNS *os.File, name string) []netlink.Route {
+			var routes []netlink.Route
+			err := ns.WithNetNS(netNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(name)
+				if err != nil {
+					return err
+				}
+				list, err := netlink.RouteList(link, netlink.FAMILY_V4)
+				if err != nil {
+					return err
+				}
+				for _, r := range list {
+					if r.Dst == nil {
+						routes = append(routes, r)
+					}
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return routes
+		}
+
+		BeforeEach(func() {
+			conf = makeConf(fmt.Sprintf(`"device": %q, "preserveDefaultRoute": true`, deviceName))
+
+			err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(deviceName)
+				if err != nil {
+					return err
+				}
+				if err = netlink.LinkSetUp(link); err != nil {
+					return err
+				}
+				addr, err := netlink.ParseAddr("10.9.0.2/24")
+				if err != nil {
+					return err
+				}
+				if err = netlink.AddrAdd(link, addr); err != nil {
+					return err
+				}
+				return netlink.RouteAdd(&netlink.Route{
+					LinkIndex: link.Attrs().Index,
+					Gw:        net.ParseIP("10.9.0.1"),
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("adds the device's default route in the container", func() {
+			Expect(runInHostNS("ADD", conf).ExitCode()).To(Equal(0))
+
+			routes := defaultRoutesIn(contNS, ifName)
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].Gw.String()).To(Equal("10.9.0.1"))
+		})
+
+		It("keeps a default route from IPAM", func() {
+			conf = makeConf(fmt.Sprintf(`"device": %q, "preserveDefaultRoute": true,
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"routes": [ { "dst": "0.0.0.0/0" } ],
+					"dataDir": %q
+				}`, deviceName, dataDir))
+			Expect(runInHostNS("ADD", conf).ExitCode()).To(Equal(0))
+
+			routes := defaultRoutesIn(contNS, ifName)
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].Gw.String()).To(Equal("10.1.2.1"))
+		})
+
+		It("puts the default route back on the host on DEL", func() {
+			Expect(runInHostNS("ADD", conf).ExitCode()).To(Equal(0))
+			Expect(runInHostNS("DEL", conf).ExitCode()).To(Equal(0))
+
+			routes := defaultRoutesIn(hostNS, deviceName)
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].Gw.String()).To(Equal("10.9.0.1"))
+
+			files, err := ioutil.ReadDir(dataDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+
+		It("adds no route without the option", func() {
+			conf = makeConf(fmt.Sprintf(`"device": %q`, deviceName))
+			Expect(runInHostNS("ADD", conf).ExitCode()).To(Equal(0))
+
+			Expect(defaultRoutesIn(contNS, ifName)).To(BeEmpty())
+		})
+	})
+})
@@ -26,6 +26,7 @@ import (
 	"github.com/appc/cni/pkg/ns"
 	"github.com/appc/cni/pkg/skel"
 	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
 	"github.com/vishvananda/netlink"
 )
 
@@ -98,11 +99,7 @@ func createIpvlan(conf *NetConf, ifName string, netns *os.File) error {
 	}
 
 	return ns.WithNetNS(netns, false, func(_ *os.File) error {
-		err := renameLink(tmpName, ifName)
-		if err != nil {
-			return fmt.Errorf("failed to rename ipvlan to %q: %v", ifName, err)
-		}
-		return nil
+		return ip.RenameLink(tmpName, ifName)
 	})
 }
 
@@ -114,7 +111,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	netns, err := os.Open(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -127,8 +124,8 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	if result.IP4 == nil {
-		return errors.New("IPAM plugin returned missing IPv4 config")
+	if len(result.IPConfigs()) == 0 {
+		return errors.New("IPAM plugin returned missing IP config")
 	}
 
 	err = ns.WithNetNS(netns, false, func(_ *os.File) error {
@@ -139,7 +136,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	result.DNS = n.DNS
-	return result.Print()
+	return types.PrintResult(result, n.CNIVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -154,19 +151,13 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 
 	return ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
-		return ip.DelLinkByName(args.IfName)
+		if err := ip.DelLinkByName(args.IfName); err != nil && err != ip.ErrLinkNotFound {
+			return err
+		}
+		return nil
 	})
 }
 
-func renameLink(curName, newName string) error {
-	link, err := netlink.LinkByName(curName)
-	if err != nil {
-		return err
-	}
-
-	return netlink.LinkSetName(link, newName)
-}
-
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	skel.PluginMain(cmdAdd, cmdDel, nil, version.All)
 }
@@ -0,0 +1,190 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"syscall"
+
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/testutils"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+const (
+	masterName = "cni-master0"
+	ifName     = "eth0"
+)
+
+var _ = Describe("ipvlan", func() {
+	var (
+		hostNSName, contNSName string
+		hostNS, contNS         *os.File
+		dataDir                string
+		masterIndex            int
+	)
+
+	// runInHostNS runs the plugin from within the fake host namespace
+	runInHostNS := func(command, conf string) *gexec.Session {
+		return testutils.RunPluginInNS(hostNS, pathToIpvlanPlugin, testutils.PluginArgs{
+			Command:     command,
+			ContainerID: "some-container-id",
+			Netns:       contNS.Name(),
+			IfName:      ifName,
+			Path:        cniPath,
+		}, conf)
+	}
+
+	makeConf := func(mode string) string {
+		return fmt.Sprintf(`{
+			"name": "testnet",
+			"type": "ipvlan",
+			"master": %q,
+			"mode": %q,
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": %q
+			}
+		}`, masterName, mode, dataDir)
+	}
+
+	// inspectIpvlan returns the container interface as an ipvlan
+	inspectIpvlan := func() *netlink.IPVlan {
+		var iv *netlink.IPVlan
+		err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+			link, err := netlink.LinkByName(ifName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(BeAssignableToTypeOf(&netlink.IPVlan{}))
+			iv = link.(*netlink.IPVlan)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return iv
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		hostNSName = fmt.Sprintf("test-ipvlan-host-%d", rand.Int())
+		hostNS, err = ns.CreateNetNS(hostNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		contNSName = fmt.Sprintf("test-ipvlan-cont-%d", rand.Int())
+		contNS, err = ns.CreateNetNS(contNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "ipvlan-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		ipvlanSupported := true
+		err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			// one end of a veth pair serves as the master
+			master := &netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: masterName},
+				PeerName:  masterName + "p",
+			}
+			if err := netlink.LinkAdd(master); err != nil {
+				return err
+			}
+
+			link, err := netlink.LinkByName(masterName)
+			if err != nil {
+				return err
+			}
+			masterIndex = link.Attrs().Index
+
+			probe := &netlink.IPVlan{
+				LinkAttrs: netlink.LinkAttrs{Name: "probe0", ParentIndex: masterIndex},
+			}
+			if err := netlink.LinkAdd(probe); err != nil {
+				if err == syscall.EOPNOTSUPP {
+					ipvlanSupported = false
+					return nil
+				}
+				return err
+			}
+			return netlink.LinkDel(probe)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		if !ipvlanSupported {
+			Skip("kernel does not support ipvlan")
+		}
+	})
+
+	AfterEach(func() {
+		Expect(contNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(contNSName)).To(Succeed())
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(hostNSName)).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	Describe("ADD", func() {
+		It("creates an l2 ipvlan on the master", func() {
+			Expect(runInHostNS("ADD", makeConf("l2")).ExitCode()).To(Equal(0))
+
+			iv := inspectIpvlan()
+			Expect(iv.Attrs().ParentIndex).To(Equal(masterIndex))
+			Expect(iv.Mode).To(Equal(netlink.IPVLAN_MODE_L2))
+		})
+
+		It("creates an l3 ipvlan on the master", func() {
+			Expect(runInHostNS("ADD", makeConf("l3")).ExitCode()).To(Equal(0))
+
+			iv := inspectIpvlan()
+			Expect(iv.Attrs().ParentIndex).To(Equal(masterIndex))
+			Expect(iv.Mode).To(Equal(netlink.IPVLAN_MODE_L3))
+		})
+
+		It("applies the IPAM result to the container interface", func() {
+			Expect(runInHostNS("ADD", makeConf("l2")).ExitCode()).To(Equal(0))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(HaveLen(1))
+				Expect(addrs[0].IPNet.String()).To(Equal("10.1.2.2/24"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("DEL", func() {
+		It("removes the container interface", func() {
+			Expect(runInHostNS("ADD", makeConf("l2")).ExitCode()).To(Equal(0))
+			Expect(runInHostNS("DEL", makeConf("l2")).ExitCode()).To(Equal(0))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				_, err := netlink.LinkByName(ifName)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
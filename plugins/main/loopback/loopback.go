@@ -15,17 +15,48 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"strings"
 
 	"github.com/appc/cni/pkg/ns"
 	"github.com/appc/cni/pkg/skel"
 	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
 	"github.com/vishvananda/netlink"
 )
 
+// openNetNS opens the container's netns up front so that a bad
+// CNI_NETNS is reported as an unknown container rather than a setns failure.
+func openNetNS(args *skel.CmdArgs) (*os.File, error) {
+	if err := ns.IsNSorErr(args.Netns); err != nil {
+		return nil, types.NewError(types.ErrUnknownContainer, fmt.Sprintf("failed to open netns %q: %v", args.Netns, err), "")
+	}
+
+	netns, err := os.Open(args.Netns)
+	if err != nil {
+		return nil, types.NewError(types.ErrUnknownContainer, fmt.Sprintf("failed to open netns %q: %v", args.Netns, err), "")
+	}
+	return netns, nil
+}
+
 func cmdAdd(args *skel.CmdArgs) error {
 	args.IfName = "lo" // ignore config, this only works for loopback
-	err := ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
+	confVersion, err := version.ConfigVersion(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := openNetNS(args)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	result := &types.Result010{}
+	err = ns.WithNetNS(netns, false, func(hostNS *os.File) error {
 		link, err := netlink.LinkByName(args.IfName)
 		if err != nil {
 			return err // not tested
@@ -36,19 +67,46 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return err // not tested
 		}
 
+		// report the addresses the kernel assigned once lo is up
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return err // not tested
+		}
+
+		for _, addr := range addrs {
+			ipc := &types.IPConfig{IP: *addr.IPNet}
+			if addr.IP.To4() != nil {
+				if result.IP4 == nil {
+					result.IP4 = ipc
+				}
+			} else if addr.IP.Equal(net.IPv6loopback) && result.IP6 == nil {
+				result.IP6 = ipc
+			}
+		}
+
 		return nil
 	})
 	if err != nil {
 		return err // not tested
 	}
 
-	result := types.Result{}
-	return result.Print()
+	return types.PrintResult(result, confVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
 	args.IfName = "lo" // ignore config, this only works for loopback
-	err := ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
+	if _, err := os.Stat(args.Netns); os.IsNotExist(err) {
+		// the netns is gone and lo with it; nothing to tear down
+		return nil
+	}
+
+	netns, err := openNetNS(args)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	err = ns.WithNetNS(netns, false, func(hostNS *os.File) error {
 		link, err := netlink.LinkByName(args.IfName)
 		if err != nil {
 			return err // not tested
@@ -68,6 +126,61 @@ func cmdDel(args *skel.CmdArgs) error {
 	return nil
 }
 
+// cmdCheck verifies that lo is still up and has the loopback
+// addresses, without changing anything.
+func cmdCheck(args *skel.CmdArgs) error {
+	args.IfName = "lo" // ignore config, this only works for loopback
+	netns, err := openNetNS(args)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	return ns.WithNetNS(netns, false, func(hostNS *os.File) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return err // not tested
+		}
+
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%s is down", args.IfName)
+		}
+
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return err // not tested
+		}
+
+		expected := []string{"127.0.0.1/8"}
+		if ipv6Enabled(args.IfName) {
+			expected = append(expected, "::1/128")
+		}
+		for _, want := range expected {
+			if !hasAddr(addrs, want) {
+				return fmt.Errorf("%s is missing address %s", args.IfName, want)
+			}
+		}
+
+		return nil
+	})
+}
+
+func hasAddr(addrs []netlink.Addr, cidr string) bool {
+	for _, addr := range addrs {
+		if addr.IPNet.String() == cidr {
+			return true
+		}
+	}
+	return false
+}
+
+// ipv6Enabled reports whether ifName in the current netns takes IPv6
+// addresses, in which case the kernel gives lo ::1 when it comes up.
+func ipv6Enabled(ifName string) bool {
+	disabled, err := ioutil.ReadFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", ifName))
+	return err == nil && strings.TrimSpace(string(disabled)) == "0"
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	skel.PluginMain(cmdAdd, cmdDel, cmdCheck, version.All)
 }
@@ -15,6 +15,7 @@
 package main_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
@@ -22,10 +23,11 @@ import (
 	"strings"
 
 	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/types"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
+	"github.com/vishvananda/netlink"
 )
 
 var _ = Describe("Loopback", func() {
@@ -45,10 +47,10 @@ var _ = Describe("Loopback", func() {
 			fmt.Sprintf("CNI_CONTAINERID=%s", containerID),
 			fmt.Sprintf("CNI_NETNS=%s", networkNS),
 			fmt.Sprintf("CNI_IFNAME=%s", "this is ignored"),
-			fmt.Sprintf("CNI_ARGS=%s", "none"),
+			fmt.Sprintf("CNI_ARGS=%s", "none=1"),
 			fmt.Sprintf("CNI_PATH=%s", "/some/test/path"),
 		}
-		command.Stdin = strings.NewReader("this doesn't matter")
+		command.Stdin = strings.NewReader(`{ "name": "lo", "type": "loopback" }`)
 	})
 
 	AfterEach(func() {
@@ -62,9 +64,15 @@ var _ = Describe("Loopback", func() {
 			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
 			Expect(err).NotTo(HaveOccurred())
 
-			Eventually(session).Should(gbytes.Say(`{.*}`))
 			Eventually(session).Should(gexec.Exit(0))
 
+			result := types.Result010{}
+			Expect(json.Unmarshal(session.Out.Contents(), &result)).To(Succeed())
+			Expect(result.IP4).NotTo(BeNil())
+			Expect(result.IP4.IP.String()).To(Equal("127.0.0.1/8"))
+			Expect(result.IP6).NotTo(BeNil())
+			Expect(result.IP6.IP.String()).To(Equal("::1/128"))
+
 			var lo *net.Interface
 			err = ns.WithNetNSPath(networkNS, true, func(hostNS *os.File) error {
 				var err error
@@ -82,8 +90,8 @@ var _ = Describe("Loopback", func() {
 			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
 			Expect(err).NotTo(HaveOccurred())
 
-			Eventually(session).Should(gbytes.Say(``))
 			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out.Contents()).To(BeEmpty())
 
 			var lo *net.Interface
 			err = ns.WithNetNSPath(networkNS, true, func(hostNS *os.File) error {
@@ -96,4 +104,93 @@ var _ = Describe("Loopback", func() {
 			Expect(lo.Flags & net.FlagUp).NotTo(Equal(net.FlagUp))
 		})
 	})
+
+	Context("when checking", func() {
+		run := func(command string) *gexec.Session {
+			cmd := exec.Command(pathToLoPlugin)
+			cmd.Env = append(environ, "CNI_COMMAND="+command)
+			cmd.Stdin = strings.NewReader(`{ "name": "lo", "type": "loopback" }`)
+
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit())
+			return session
+		}
+
+		It("succeeds when lo is set up", func() {
+			Expect(run("ADD").ExitCode()).To(Equal(0))
+
+			session := run("CHECK")
+			Expect(session.ExitCode()).To(Equal(0))
+			Expect(session.Out.Contents()).To(BeEmpty())
+		})
+
+		It("fails once lo has been brought down", func() {
+			Expect(run("ADD").ExitCode()).To(Equal(0))
+			err := ns.WithNetNSPath(networkNS, true, func(hostNS *os.File) error {
+				lo, err := netlink.LinkByName("lo")
+				if err != nil {
+					return err
+				}
+				return netlink.LinkSetDown(lo)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			session := run("CHECK")
+			Expect(session.ExitCode()).To(Equal(1))
+
+			cniErr := types.Error{}
+			Expect(json.Unmarshal(session.Out.Contents(), &cniErr)).To(Succeed())
+			Expect(cniErr.Msg).To(Equal("lo is down"))
+		})
+
+		It("does not bring lo up", func() {
+			Expect(run("CHECK").ExitCode()).To(Equal(1))
+
+			var lo *net.Interface
+			err := ns.WithNetNSPath(networkNS, true, func(hostNS *os.File) error {
+				var err error
+				lo, err = net.InterfaceByName("lo")
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lo.Flags & net.FlagUp).NotTo(Equal(net.FlagUp))
+		})
+	})
+
+	Context("when the network namespace does not exist", func() {
+		It("fails with an unknown container error", func() {
+			for i, env := range environ {
+				if strings.HasPrefix(env, "CNI_NETNS=") {
+					environ[i] = "CNI_NETNS=/no/such/netns"
+				}
+			}
+			command.Env = append(environ, fmt.Sprintf("CNI_COMMAND=%s", "ADD"))
+
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+
+			cniErr := types.Error{}
+			Expect(json.Unmarshal(session.Out.Contents(), &cniErr)).To(Succeed())
+			Expect(cniErr.Code).To(Equal(types.ErrUnknownContainer))
+			Expect(cniErr.Msg).To(HavePrefix(`failed to open netns "/no/such/netns": `))
+		})
+	})
+
+	Context("when the network namespace has already been deleted", func() {
+		It("succeeds on DEL since there is nothing to tear down", func() {
+			Expect(removeNetworkNS(networkNS)).To(Succeed())
+			defer func() {
+				networkNS = makeNetworkNS(containerID)
+			}()
+
+			command.Env = append(environ, fmt.Sprintf("CNI_COMMAND=%s", "DEL"))
+
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out.Contents()).To(BeEmpty())
+		})
+	})
 })
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"runtime"
 
@@ -26,6 +27,8 @@ import (
 	"github.com/appc/cni/pkg/ns"
 	"github.com/appc/cni/pkg/skel"
 	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/utils/hwaddr"
+	"github.com/appc/cni/pkg/version"
 	"github.com/vishvananda/netlink"
 )
 
@@ -34,6 +37,11 @@ type NetConf struct {
 	Master string `json:"master"`
 	Mode   string `json:"mode"`
 	MTU    int    `json:"mtu"`
+
+	// Mac, if set, is the MAC address of the container interface.
+	Mac string `json:"mac"`
+
+	hwAddr net.HardwareAddr
 }
 
 func init() {
@@ -51,6 +59,13 @@ func loadConf(bytes []byte) (*NetConf, error) {
 	if n.Master == "" {
 		return nil, fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
 	}
+	if n.Mac != "" {
+		hwAddr, err := hwaddr.ParseUnicast(n.Mac)
+		if err != nil {
+			return nil, err
+		}
+		n.hwAddr = hwAddr
+	}
 	return n, nil
 }
 
@@ -69,6 +84,25 @@ func modeFromString(s string) (netlink.MacvlanMode, error) {
 	}
 }
 
+// macvlanMTU validates the configured MTU against the master's and
+// returns the MTU to create the macvlan with; the master's MTU is
+// inherited when none is configured.
+func macvlanMTU(mtu int, master netlink.Link) (int, error) {
+	masterMTU := master.Attrs().MTU
+	if masterMTU <= 0 {
+		return 0, fmt.Errorf("master %q has no usable MTU", master.Attrs().Name)
+	}
+
+	switch {
+	case mtu == 0:
+		return masterMTU, nil
+	case mtu < 0 || mtu > masterMTU:
+		return 0, fmt.Errorf("invalid MTU %d, must be between 1 and the MTU of master %q (%d)", mtu, master.Attrs().Name, masterMTU)
+	default:
+		return mtu, nil
+	}
+}
+
 func createMacvlan(conf *NetConf, ifName string, netns *os.File) error {
 	mode, err := modeFromString(conf.Mode)
 	if err != nil {
@@ -80,6 +114,11 @@ func createMacvlan(conf *NetConf, ifName string, netns *os.File) error {
 		return fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
 	}
 
+	mtu, err := macvlanMTU(conf.MTU, m)
+	if err != nil {
+		return err
+	}
+
 	// due to kernel bug we have to create with tmpname or it might
 	// collide with the name on the host and error out
 	tmpName, err := ip.RandomVethName()
@@ -89,7 +128,7 @@ func createMacvlan(conf *NetConf, ifName string, netns *os.File) error {
 
 	mv := &netlink.Macvlan{
 		LinkAttrs: netlink.LinkAttrs{
-			MTU:         conf.MTU,
+			MTU:         mtu,
 			Name:        tmpName,
 			ParentIndex: m.Attrs().Index,
 			Namespace:   netlink.NsFd(int(netns.Fd())),
@@ -102,9 +141,13 @@ func createMacvlan(conf *NetConf, ifName string, netns *os.File) error {
 	}
 
 	return ns.WithNetNS(netns, false, func(_ *os.File) error {
-		err := renameLink(tmpName, ifName)
-		if err != nil {
-			return fmt.Errorf("failed to rename macvlan to %q: %v", ifName, err)
+		if err := ip.RenameLink(tmpName, ifName); err != nil {
+			return err
+		}
+
+		// the link is still down, IPAM configuration brings it up
+		if conf.hwAddr != nil {
+			return ip.SetHardwareAddr(ifName, conf.hwAddr)
 		}
 		return nil
 	})
@@ -118,7 +161,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	netns, err := os.Open(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -131,8 +174,8 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	if result.IP4 == nil {
-		return errors.New("IPAM plugin returned missing IPv4 config")
+	if len(result.IPConfigs()) == 0 {
+		return errors.New("IPAM plugin returned missing IP config")
 	}
 
 	err = ns.WithNetNS(netns, false, func(_ *os.File) error {
@@ -143,7 +186,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	result.DNS = n.DNS
-	return result.Print()
+	return types.PrintResult(result, n.CNIVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -158,19 +201,13 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 
 	return ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
-		return ip.DelLinkByName(args.IfName)
+		if err := ip.DelLinkByName(args.IfName); err != nil && err != ip.ErrLinkNotFound {
+			return err
+		}
+		return nil
 	})
 }
 
-func renameLink(curName, newName string) error {
-	link, err := netlink.LinkByName(curName)
-	if err != nil {
-		return err
-	}
-
-	return netlink.LinkSetName(link, newName)
-}
-
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	skel.PluginMain(cmdAdd, cmdDel, nil, version.All)
 }
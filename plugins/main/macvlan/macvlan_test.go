@@ -0,0 +1,250 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/testutils"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+const (
+	masterName = "cni-master0"
+	masterMTU  = 1400
+	ifName     = "eth0"
+)
+
+var _ = Describe("macvlan", func() {
+	var (
+		hostNSName, contNSName string
+		hostNS, contNS         *os.File
+		dataDir                string
+		masterIndex            int
+	)
+
+	// runInHostNS runs the plugin from within the fake host namespace
+	runInHostNS := func(command, conf string) *gexec.Session {
+		return testutils.RunPluginInNS(hostNS, pathToMacvlanPlugin, testutils.PluginArgs{
+			Command:     command,
+			ContainerID: "some-container-id",
+			Netns:       contNS.Name(),
+			IfName:      ifName,
+			Path:        cniPath,
+		}, conf)
+	}
+
+	makeConf := func(extra string) string {
+		return fmt.Sprintf(`{
+			"name": "testnet",
+			"type": "macvlan",
+			"master": %q,
+			%s
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": %q
+			}
+		}`, masterName, extra, dataDir)
+	}
+
+	// inspectMacvlan returns the container interface as a macvlan
+	inspectMacvlan := func() *netlink.Macvlan {
+		var mv *netlink.Macvlan
+		err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+			link, err := netlink.LinkByName(ifName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(BeAssignableToTypeOf(&netlink.Macvlan{}))
+			mv = link.(*netlink.Macvlan)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return mv
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		hostNSName = fmt.Sprintf("test-macvlan-host-%d", rand.Int())
+		hostNS, err = ns.CreateNetNS(hostNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		contNSName = fmt.Sprintf("test-macvlan-cont-%d", rand.Int())
+		contNS, err = ns.CreateNetNS(contNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "macvlan-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		// the dummy driver is not available on every kernel;
+		// one end of a veth pair serves as a master just as well
+		err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			master := &netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: masterName, MTU: masterMTU},
+				PeerName:  masterName + "p",
+			}
+			if err := netlink.LinkAdd(master); err != nil {
+				return err
+			}
+
+			link, err := netlink.LinkByName(masterName)
+			if err != nil {
+				return err
+			}
+			masterIndex = link.Attrs().Index
+			return netlink.LinkSetUp(link)
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(contNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(contNSName)).To(Succeed())
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(hostNSName)).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	Describe("ADD", func() {
+		It("creates a bridge mode macvlan on the master by default", func() {
+			Expect(runInHostNS("ADD", makeConf("")).ExitCode()).To(Equal(0))
+
+			mv := inspectMacvlan()
+			Expect(mv.Attrs().ParentIndex).To(Equal(masterIndex))
+			Expect(mv.Mode).To(Equal(netlink.MACVLAN_MODE_BRIDGE))
+		})
+
+		It("uses the configured mode", func() {
+			Expect(runInHostNS("ADD", makeConf(`"mode": "private",`)).ExitCode()).To(Equal(0))
+
+			Expect(inspectMacvlan().Mode).To(Equal(netlink.MACVLAN_MODE_PRIVATE))
+		})
+
+		It("applies the IPAM result to the container interface", func() {
+			Expect(runInHostNS("ADD", makeConf("")).ExitCode()).To(Equal(0))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(HaveLen(1))
+				Expect(addrs[0].IPNet.String()).To(Equal("10.1.2.2/24"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("applies a dual-stack IPAM result with both default routes", func() {
+			conf := fmt.Sprintf(`{
+				"name": "testnet",
+				"type": "macvlan",
+				"master": %q,
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						{ "subnet": "10.1.2.0/24" },
+						{ "subnet": "fd00:1234::/64" }
+					],
+					"routes": [ { "dst": "0.0.0.0/0" }, { "dst": "::/0" } ],
+					"dataDir": %q
+				}
+			}`, masterName, dataDir)
+			Expect(runInHostNS("ADD", conf).ExitCode()).To(Equal(0))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+
+				for _, expected := range []struct {
+					family   int
+					addr, gw string
+				}{
+					{netlink.FAMILY_V4, "10.1.2.2/24", "10.1.2.1"},
+					{netlink.FAMILY_V6, "fd00:1234::2/64", "fd00:1234::1"},
+				} {
+					addrs, err := netlink.AddrList(link, expected.family)
+					Expect(err).NotTo(HaveOccurred())
+					var global []string
+					for _, a := range addrs {
+						if !a.IP.IsLinkLocalUnicast() {
+							global = append(global, a.IPNet.String())
+						}
+					}
+					Expect(global).To(ConsistOf(expected.addr))
+
+					routes, err := netlink.RouteList(link, expected.family)
+					Expect(err).NotTo(HaveOccurred())
+					var defaultGWs []string
+					for _, r := range routes {
+						if r.Dst == nil {
+							defaultGWs = append(defaultGWs, r.Gw.String())
+						}
+					}
+					Expect(defaultGWs).To(ConsistOf(expected.gw))
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("inherits the MTU of the master", func() {
+			Expect(runInHostNS("ADD", makeConf("")).ExitCode()).To(Equal(0))
+
+			Expect(inspectMacvlan().Attrs().MTU).To(Equal(masterMTU))
+		})
+
+		It("honours a smaller configured MTU", func() {
+			Expect(runInHostNS("ADD", makeConf(`"mtu": 1300,`)).ExitCode()).To(Equal(0))
+
+			Expect(inspectMacvlan().Attrs().MTU).To(Equal(1300))
+		})
+
+		It("rejects an MTU larger than the master's", func() {
+			session := runInHostNS("ADD", makeConf(`"mtu": 9000,`))
+			Expect(session.ExitCode()).NotTo(Equal(0))
+			Expect(string(session.Out.Contents())).To(ContainSubstring("invalid MTU 9000"))
+		})
+
+		It("gives the container interface the configured MAC", func() {
+			Expect(runInHostNS("ADD", makeConf(`"mac": "0a:58:0a:01:02:03",`)).ExitCode()).To(Equal(0))
+
+			Expect(inspectMacvlan().Attrs().HardwareAddr.String()).To(Equal("0a:58:0a:01:02:03"))
+		})
+
+		It("rejects a multicast MAC", func() {
+			session := runInHostNS("ADD", makeConf(`"mac": "01:00:5e:00:00:01",`))
+			Expect(session.ExitCode()).NotTo(Equal(0))
+			Expect(string(session.Out.Contents())).To(ContainSubstring(`invalid mac \"01:00:5e:00:00:01\": multicast address`))
+		})
+
+		It("fails cleanly when the master does not exist", func() {
+			conf := strings.Replace(makeConf(""), masterName, "missing0", 1)
+			session := runInHostNS("ADD", conf)
+			Expect(session.ExitCode()).NotTo(Equal(0))
+			Expect(string(session.Out.Contents())).To(ContainSubstring(`failed to lookup master \"missing0\"`))
+		})
+	})
+})
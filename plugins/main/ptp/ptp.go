@@ -21,6 +21,7 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/vishvananda/netlink"
 
@@ -30,6 +31,8 @@ import (
 	"github.com/appc/cni/pkg/skel"
 	"github.com/appc/cni/pkg/types"
 	"github.com/appc/cni/pkg/utils"
+	"github.com/appc/cni/pkg/utils/hwaddr"
+	"github.com/appc/cni/pkg/version"
 )
 
 func init() {
@@ -39,13 +42,36 @@ func init() {
 	runtime.LockOSThread()
 }
 
+// dadTimeout bounds the wait for IPv6 duplicate address detection.
+const dadTimeout = 10 * time.Second
+
 type NetConf struct {
 	types.NetConf
 	IPMasq bool `json:"ipMasq"`
 	MTU    int  `json:"mtu"`
+
+	// Mac, if set, is the MAC address of the container interface.
+	Mac string `json:"mac"`
+
+	hwAddr net.HardwareAddr
+}
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(bytes, conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if conf.Mac != "" {
+		hwAddr, err := hwaddr.ParseUnicast(conf.Mac)
+		if err != nil {
+			return nil, err
+		}
+		conf.hwAddr = hwAddr
+	}
+	return conf, nil
 }
 
-func setupContainerVeth(netns, ifName string, mtu int, pr *types.Result) (string, error) {
+func setupContainerVeth(netns, ifName string, mtu int, hwAddr net.HardwareAddr, pr *types.Result010) (string, error) {
 	// The IPAM result will be something like IP=192.168.3.5/24, GW=192.168.3.1.
 	// What we want is really a point-to-point link but veth does not support IFF_POINTOPONT.
 	// Next best thing would be to let it ARP but set interface to 192.168.3.5/32 and
@@ -59,7 +85,7 @@ func setupContainerVeth(netns, ifName string, mtu int, pr *types.Result) (string
 
 	var hostVethName string
 	err := ns.WithNetNSPath(netns, false, func(hostNS *os.File) error {
-		hostVeth, _, err := ip.SetupVeth(ifName, mtu, hostNS)
+		hostVeth, _, err := ip.SetupVethWithName(ifName, "", mtu, hwAddr, hostNS)
 		if err != nil {
 			return err
 		}
@@ -68,48 +94,22 @@ func setupContainerVeth(netns, ifName string, mtu int, pr *types.Result) (string
 			return err
 		}
 
+		// the routes below use the IPv6 address as their source, which
+		// it can only be once DAD is done
+		if pr.IP6 != nil {
+			if err = ip.SettleAddresses(ifName, dadTimeout); err != nil {
+				return err
+			}
+		}
+
 		contVeth, err := netlink.LinkByName(ifName)
 		if err != nil {
 			return fmt.Errorf("failed to look up %q: %v", ifName, err)
 		}
 
-		// Delete the route that was automatically added
-		route := netlink.Route{
-			LinkIndex: contVeth.Attrs().Index,
-			Dst: &net.IPNet{
-				IP:   pr.IP4.IP.IP.Mask(pr.IP4.IP.Mask),
-				Mask: pr.IP4.IP.Mask,
-			},
-			Scope: netlink.SCOPE_NOWHERE,
-		}
-
-		if err := netlink.RouteDel(&route); err != nil {
-			return fmt.Errorf("failed to delete route %v: %v", route, err)
-		}
-
-		for _, r := range []netlink.Route{
-			netlink.Route{
-				LinkIndex: contVeth.Attrs().Index,
-				Dst: &net.IPNet{
-					IP:   pr.IP4.Gateway,
-					Mask: net.CIDRMask(32, 32),
-				},
-				Scope: netlink.SCOPE_LINK,
-				Src:   pr.IP4.IP.IP,
-			},
-			netlink.Route{
-				LinkIndex: contVeth.Attrs().Index,
-				Dst: &net.IPNet{
-					IP:   pr.IP4.IP.IP.Mask(pr.IP4.IP.Mask),
-					Mask: pr.IP4.IP.Mask,
-				},
-				Scope: netlink.SCOPE_UNIVERSE,
-				Gw:    pr.IP4.Gateway,
-				Src:   pr.IP4.IP.IP,
-			},
-		} {
-			if err := netlink.RouteAdd(&r); err != nil {
-				return fmt.Errorf("failed to add route %v: %v", r, err)
+		for _, ipc := range pr.IPConfigs() {
+			if err = setupContainerRoutes(contVeth, ipc); err != nil {
+				return err
 			}
 		}
 
@@ -120,6 +120,52 @@ func setupContainerVeth(netns, ifName string, mtu int, pr *types.Result) (string
 	return hostVethName, err
 }
 
+// setupContainerRoutes replaces the subnet route of ipc with one via
+// the gateway, reachable through a host route of its own.
+func setupContainerRoutes(contVeth netlink.Link, ipc *types.IPConfig) error {
+	subnet := &net.IPNet{
+		IP:   ipc.IP.IP.Mask(ipc.IP.Mask),
+		Mask: ipc.IP.Mask,
+	}
+	_, bits := ipc.IP.Mask.Size()
+
+	// Delete the route that was automatically added
+	route := netlink.Route{
+		LinkIndex: contVeth.Attrs().Index,
+		Dst:       subnet,
+		Scope:     netlink.SCOPE_NOWHERE,
+	}
+
+	if err := netlink.RouteDel(&route); err != nil {
+		return fmt.Errorf("failed to delete route %v: %v", route, err)
+	}
+
+	for _, r := range []netlink.Route{
+		netlink.Route{
+			LinkIndex: contVeth.Attrs().Index,
+			Dst: &net.IPNet{
+				IP:   ipc.Gateway,
+				Mask: net.CIDRMask(bits, bits),
+			},
+			Scope: netlink.SCOPE_LINK,
+			Src:   ipc.IP.IP,
+		},
+		netlink.Route{
+			LinkIndex: contVeth.Attrs().Index,
+			Dst:       subnet,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Gw:        ipc.Gateway,
+			Src:       ipc.IP.IP,
+		},
+	} {
+		if err := netlink.RouteAdd(&r); err != nil {
+			return fmt.Errorf("failed to add route %v: %v", r, err)
+		}
+	}
+
+	return nil
+}
+
 func setupHostVeth(vethName string, ipConf *types.IPConfig) error {
 	// hostVeth moved namespaces and may have a new ifindex
 	veth, err := netlink.LinkByName(vethName)
@@ -127,10 +173,10 @@ func setupHostVeth(vethName string, ipConf *types.IPConfig) error {
 		return fmt.Errorf("failed to lookup %q: %v", vethName, err)
 	}
 
-	// TODO(eyakubovich): IPv6
+	_, bits := ipConf.IP.Mask.Size()
 	ipn := &net.IPNet{
 		IP:   ipConf.Gateway,
-		Mask: net.CIDRMask(32, 32),
+		Mask: net.CIDRMask(bits, bits),
 	}
 	addr := &netlink.Addr{IPNet: ipn, Label: ""}
 	if err = netlink.AddrAdd(veth, addr); err != nil {
@@ -139,24 +185,75 @@ func setupHostVeth(vethName string, ipConf *types.IPConfig) error {
 
 	ipn = &net.IPNet{
 		IP:   ipConf.IP.IP,
-		Mask: net.CIDRMask(32, 32),
+		Mask: net.CIDRMask(bits, bits),
 	}
 	// dst happens to be the same as IP/net of host veth
 	if err = ip.AddHostRoute(ipn, nil, veth); err != nil && !os.IsExist(err) {
 		return fmt.Errorf("failed to add route on host: %v", err)
 	}
 
+	// answer ARP for the container's network on its behalf, so the
+	// container is reachable through the host's routing
+	if ipConf.IP.IP.To4() != nil {
+		if err = ip.SetProxyArp(vethName, true); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
-	conf := NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to load netconf: %v", err)
+// teardownHostVeth undoes what setupHostVeth did to the host veth: it
+// removes the routes to the container's addresses and turns proxy ARP
+// off. These would go away with the veth pair, but DEL undoes them
+// explicitly rather than rely on that.
+func teardownHostVeth(netns, ifName string) error {
+	var hostVethIndex int
+	var dsts []*net.IPNet
+	err := ns.WithNetNSPath(netns, false, func(hostNS *os.File) error {
+		contVeth, err := netlink.LinkByName(ifName)
+		if err != nil {
+			// already torn down, or the DEL of the link reports it
+			return nil
+		}
+		hostVethIndex = contVeth.Attrs().ParentIndex
+
+		addrs, err := netlink.AddrList(contVeth, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			_, bits := addr.Mask.Size()
+			dsts = append(dsts, &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(bits, bits)})
+		}
+		return nil
+	})
+	if err != nil || hostVethIndex == 0 {
+		return err
+	}
+
+	hostVeth, err := netlink.LinkByIndex(hostVethIndex)
+	if err != nil {
+		return fmt.Errorf("failed to lookup host veth of %q: %v", ifName, err)
 	}
+	for _, dst := range dsts {
+		if err = ip.DeleteRoute(dst, nil, hostVeth); err != nil {
+			return fmt.Errorf("failed to delete route on host: %v", err)
+		}
+	}
+
+	// best effort; the veth may be going away already
+	ip.SetProxyArp(hostVeth.Attrs().Name, false)
+	return nil
+}
 
-	if err := ip.EnableIP4Forward(); err != nil {
-		return fmt.Errorf("failed to enable forwarding: %v", err)
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
 	}
 
 	// run the IPAM plugin and get back the config to apply
@@ -164,20 +261,39 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	if result.IP4 == nil {
-		return errors.New("IPAM plugin returned missing IPv4 config")
+	if len(result.IPConfigs()) == 0 {
+		return errors.New("IPAM plugin returned missing IP config")
+	}
+
+	if result.IP4 != nil {
+		if err := ip.EnableIP4Forward(); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+	}
+	if result.IP6 != nil {
+		if err := ip.EnableIP6Forward(); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %v", err)
+		}
 	}
 
-	hostVethName, err := setupContainerVeth(args.Netns, args.IfName, conf.MTU, result)
+	hostVethName, err := setupContainerVeth(args.Netns, args.IfName, conf.MTU, conf.hwAddr, result)
 	if err != nil {
 		return err
 	}
 
-	if err = setupHostVeth(hostVethName, result.IP4); err != nil {
+	for _, ipc := range result.IPConfigs() {
+		if err = setupHostVeth(hostVethName, ipc); err != nil {
+			return err
+		}
+	}
+
+	// the container may have had its IP before with a different MAC
+	if err = ip.FlushNeighbors(hostVethName); err != nil {
 		return err
 	}
 
-	if conf.IPMasq {
+	// masquerading is set up for IPv4 only
+	if conf.IPMasq && result.IP4 != nil {
 		chain := utils.FormatChainName(conf.Name, args.ContainerID)
 		comment := utils.FormatComment(conf.Name, args.ContainerID)
 		if err = ip.SetupIPMasq(&result.IP4.IP, chain, comment); err != nil {
@@ -186,26 +302,34 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	result.DNS = conf.DNS
-	return result.Print()
+	return types.PrintResult(result, conf.CNIVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	conf := NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to load netconf: %v", err)
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err = teardownHostVeth(args.Netns, args.IfName); err != nil {
+		return err
 	}
 
 	var ipn *net.IPNet
-	err := ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
+	err = ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
 		var err error
 		ipn, err = ip.DelLinkByNameAddr(args.IfName, netlink.FAMILY_V4)
+		if err == ip.ErrLinkNotFound {
+			// already torn down by an earlier DEL
+			return nil
+		}
 		return err
 	})
 	if err != nil {
 		return err
 	}
 
-	if conf.IPMasq {
+	if conf.IPMasq && ipn != nil {
 		chain := utils.FormatChainName(conf.Name, args.ContainerID)
 		comment := utils.FormatComment(conf.Name, args.ContainerID)
 		if err = ip.TeardownIPMasq(ipn, chain, comment); err != nil {
@@ -217,5 +341,5 @@ func cmdDel(args *skel.CmdArgs) error {
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	skel.PluginMain(cmdAdd, cmdDel, nil, version.All)
 }
@@ -0,0 +1,391 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/testutils"
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+const ifName = "eth0"
+
+// ping sends a single ICMP echo request to dst and waits for the reply.
+func ping(dst net.IP) error {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := rand.Intn(0xffff)
+	msg := []byte{8, 0, 0, 0, byte(id >> 8), byte(id), 0, 1, 'c', 'n', 'i'}
+	var sum uint32
+	for i := 0; i < len(msg)-1; i += 2 {
+		sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	sum = (sum >> 16) + (sum & 0xffff)
+	sum += sum >> 16
+	msg[2], msg[3] = byte(^sum>>8), byte(^sum)
+
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: dst}); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(reply)
+		if err != nil {
+			return err
+		}
+		// echo reply with our identifier from the pinged host
+		if n >= 8 && reply[0] == 0 && int(reply[4])<<8|int(reply[5]) == id &&
+			from.(*net.IPAddr).IP.Equal(dst) {
+			return nil
+		}
+	}
+}
+
+var _ = Describe("ptp", func() {
+	var (
+		hostNSName, contNSName string
+		hostNS, contNS         *os.File
+		dataDir                string
+		conf                   string
+	)
+
+	// runInHostNS runs the plugin from within the fake host namespace
+	runInHostNS := func(command string) *gexec.Session {
+		return testutils.RunPluginInNS(hostNS, pathToPtpPlugin, testutils.PluginArgs{
+			Command:     command,
+			ContainerID: "some-container-id",
+			Netns:       contNS.Name(),
+			IfName:      ifName,
+			Path:        cniPath,
+		}, conf)
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		hostNSName = fmt.Sprintf("test-ptp-host-%d", rand.Int())
+		hostNS, err = ns.CreateNetNS(hostNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		contNSName = fmt.Sprintf("test-ptp-cont-%d", rand.Int())
+		contNS, err = ns.CreateNetNS(contNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "ptp-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		conf = fmt.Sprintf(`{
+			"name": "testnet",
+			"type": "ptp",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": %q
+			}
+		}`, dataDir)
+	})
+
+	AfterEach(func() {
+		Expect(contNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(contNSName)).To(Succeed())
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(hostNSName)).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	Describe("ADD", func() {
+		var result *types.Result010
+
+		BeforeEach(func() {
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(0))
+
+			result = &types.Result010{}
+			Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+		})
+
+		It("configures the container interface with the IPAM address", func() {
+			Expect(result.IP4.IP.String()).To(Equal("10.1.2.2/24"))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(HaveLen(1))
+				Expect(addrs[0].IPNet.String()).To(Equal("10.1.2.2/24"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("makes the container reachable from the host", func() {
+			err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				return ping(result.IP4.IP.IP)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("enables proxy ARP on the host veth", func() {
+			var hostVethIndex int
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+				hostVethIndex = link.Attrs().ParentIndex
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				hostVeth, err := netlink.LinkByIndex(hostVethIndex)
+				Expect(err).NotTo(HaveOccurred())
+
+				name := fmt.Sprintf("net.ipv4.conf.%s.proxy_arp", hostVeth.Attrs().Name)
+				Expect(sysctl.Sysctl(name)).To(Equal("1"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("with a 0.2.0 config", func() {
+		BeforeEach(func() {
+			conf = strings.Replace(conf, `"name": "testnet",`, `"cniVersion": "0.2.0", "name": "testnet",`, 1)
+		})
+
+		It("gets its address from host-local and answers with a 0.2.0 result", func() {
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(0))
+
+			result, err := types.NewResult("0.2.0", session.Out.Contents())
+			Expect(err).NotTo(HaveOccurred())
+			r := result.(*types.Result020)
+			Expect(r.CNIVersion).To(Equal("0.2.0"))
+			Expect(r.IPs).To(HaveLen(1))
+			Expect(r.IPs[0].Address.String()).To(Equal("10.1.2.2/24"))
+		})
+	})
+
+	Context("with a configured MAC", func() {
+		withMac := func(mac string) {
+			conf = strings.Replace(conf, `"type": "ptp",`, fmt.Sprintf(`"type": "ptp", "mac": %q,`, mac), 1)
+		}
+
+		It("gives the container interface the MAC and keeps it reachable", func() {
+			withMac("0a:58:0a:01:02:03")
+
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(0))
+			result := &types.Result010{}
+			Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().HardwareAddr.String()).To(Equal("0a:58:0a:01:02:03"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				return ping(result.IP4.IP.IP)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects a multicast MAC before allocating an address", func() {
+			withMac("ff:ff:ff:ff:ff:ff")
+
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(1))
+
+			cniErr := &types.Error{}
+			Expect(json.Unmarshal(session.Out.Contents(), cniErr)).To(Succeed())
+			Expect(cniErr.Msg).To(Equal(`invalid mac "ff:ff:ff:ff:ff:ff": multicast address`))
+
+			files, err := ioutil.ReadDir(filepath.Join(dataDir, "testnet"))
+			if !os.IsNotExist(err) {
+				Expect(err).NotTo(HaveOccurred())
+			}
+			for _, f := range files {
+				Expect(f.Name()).NotTo(HavePrefix("10.1.2."))
+			}
+		})
+	})
+
+	Context("with a dual-stack IPAM config", func() {
+		BeforeEach(func() {
+			conf = fmt.Sprintf(`{
+				"name": "testnet",
+				"type": "ptp",
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						{ "subnet": "10.1.2.0/24" },
+						{ "subnet": "fd00:1234::/64" }
+					],
+					"routes": [ { "dst": "0.0.0.0/0" }, { "dst": "::/0" } ],
+					"dataDir": %q
+				}
+			}`, dataDir)
+		})
+
+		It("configures an address and a default route of each family", func() {
+			session := runInHostNS("ADD")
+			Expect(session.ExitCode()).To(Equal(0))
+
+			result := &types.Result010{}
+			Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+			Expect(result.IP4.IP.String()).To(Equal("10.1.2.2/24"))
+			Expect(result.IP6.IP.String()).To(Equal("fd00:1234::2/64"))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+
+				for _, expected := range []struct {
+					family   int
+					addr, gw string
+				}{
+					{netlink.FAMILY_V4, "10.1.2.2/24", "10.1.2.1"},
+					{netlink.FAMILY_V6, "fd00:1234::2/64", "fd00:1234::1"},
+				} {
+					addrs, err := netlink.AddrList(link, expected.family)
+					Expect(err).NotTo(HaveOccurred())
+					var global []string
+					for _, a := range addrs {
+						if !a.IP.IsLinkLocalUnicast() {
+							global = append(global, a.IPNet.String())
+						}
+					}
+					Expect(global).To(ConsistOf(expected.addr))
+
+					routes, err := netlink.RouteList(link, expected.family)
+					Expect(err).NotTo(HaveOccurred())
+					var defaultGWs []string
+					for _, r := range routes {
+						if r.Dst == nil {
+							defaultGWs = append(defaultGWs, r.Gw.String())
+						}
+					}
+					Expect(defaultGWs).To(ConsistOf(expected.gw))
+				}
+
+				// the gateway route uses the settled IPv6 address as source
+				routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+				Expect(err).NotTo(HaveOccurred())
+				var gwRoute *netlink.Route
+				for i, r := range routes {
+					if r.Dst != nil && r.Dst.String() == "fd00:1234::1/128" {
+						gwRoute = &routes[i]
+					}
+				}
+				Expect(gwRoute).NotTo(BeNil())
+				Expect(gwRoute.Src.String()).To(Equal("fd00:1234::2"))
+				return ip.SettleAddresses(ifName, 0)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				routes, err := netlink.RouteList(nil, netlink.FAMILY_V6)
+				Expect(err).NotTo(HaveOccurred())
+				var dsts []string
+				for _, r := range routes {
+					if r.Dst != nil {
+						dsts = append(dsts, r.Dst.String())
+					}
+				}
+				Expect(dsts).To(ContainElement("fd00:1234::2/128"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("removes the container link on DEL", func() {
+			Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+			Expect(runInHostNS("DEL").ExitCode()).To(Equal(0))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				_, err := netlink.LinkByName(ifName)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("DEL", func() {
+		It("removes the container link and the host route", func() {
+			Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+			Expect(runInHostNS("DEL").ExitCode()).To(Equal(0))
+
+			err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+				_, err := netlink.LinkByName(ifName)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+				routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				for _, r := range routes {
+					if r.Dst != nil {
+						Expect(r.Dst.IP.String()).NotTo(Equal("10.1.2.2"))
+					}
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("succeeds when the interface is already gone", func() {
+			Expect(runInHostNS("DEL").ExitCode()).To(Equal(0))
+		})
+
+		It("succeeds when repeated", func() {
+			Expect(runInHostNS("ADD").ExitCode()).To(Equal(0))
+			Expect(runInHostNS("DEL").ExitCode()).To(Equal(0))
+			Expect(runInHostNS("DEL").ExitCode()).To(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,331 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a "meta-plugin" that limits the bandwidth of a container. It
+// runs after the plugin that set up the container's interface, and
+// shapes the traffic on the host side of it with tbf qdiscs.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/appc/cni/pkg/ip"
+	"github.com/appc/cni/pkg/skel"
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultDataDir = "/var/lib/cni/bandwidth"
+	// latencyInMillis is how long a packet may wait in a tbf qdisc
+	// before it is dropped
+	latencyInMillis = 25
+)
+
+// BandwidthEntry holds the limits for one container. Rates are in bits
+// per second, bursts in bits. A direction is limited only if its rate
+// and burst are both set.
+type BandwidthEntry struct {
+	IngressRate  int `json:"ingressRate"`
+	IngressBurst int `json:"ingressBurst"`
+	EgressRate   int `json:"egressRate"`
+	EgressBurst  int `json:"egressBurst"`
+}
+
+func (e *BandwidthEntry) ingress() bool {
+	return e.IngressRate > 0 || e.IngressBurst > 0
+}
+
+func (e *BandwidthEntry) egress() bool {
+	return e.EgressRate > 0 || e.EgressBurst > 0
+}
+
+type PluginConf struct {
+	types.NetConf
+	DataDir string `json:"dataDir"`
+
+	RuntimeConfig struct {
+		Bandwidth *BandwidthEntry `json:"bandwidth,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+}
+
+func loadConf(bytes []byte) (*PluginConf, error) {
+	conf := &PluginConf{DataDir: defaultDataDir}
+	if err := json.Unmarshal(bytes, conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if bw := conf.RuntimeConfig.Bandwidth; bw != nil {
+		for _, limit := range []struct {
+			name        string
+			rate, burst int
+		}{
+			{"ingress", bw.IngressRate, bw.IngressBurst},
+			{"egress", bw.EgressRate, bw.EgressBurst},
+		} {
+			if limit.rate < 0 || limit.burst < 0 {
+				return nil, fmt.Errorf("invalid %s limit: rate %d and burst %d must not be negative", limit.name, limit.rate, limit.burst)
+			}
+			if (limit.rate == 0) != (limit.burst == 0) {
+				return nil, fmt.Errorf("invalid %s limit: rate and burst must be set together", limit.name)
+			}
+		}
+	}
+	return conf, nil
+}
+
+// hostInterface returns the name of the first interface of the
+// preceding plugin's result that is not in a sandbox.
+func hostInterface(conf *PluginConf) (string, error) {
+	prevResult, err := conf.ParsePrevResult()
+	if err != nil {
+		return "", err
+	}
+	if prevResult != nil {
+		result, err := prevResult.GetAsVersion("0.2.0")
+		if err != nil {
+			return "", err
+		}
+		for _, iface := range result.(*types.Result020).Interfaces {
+			if iface.Sandbox == "" {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("prevResult does not name a host interface to limit the bandwidth on")
+}
+
+// ifbName returns the name of the ifb device that egress traffic of the
+// container is redirected to and shaped on.
+func ifbName(containerID, ifName string) string {
+	return fmt.Sprintf("bwp%x", sha1.Sum([]byte(containerID+"-"+ifName)))[:15]
+}
+
+// hostIfacePath is where the name of the host interface limited for
+// ifName is kept, so that DEL, which has no prevResult, can find it.
+func hostIfacePath(dataDir, containerID, ifName string) string {
+	return filepath.Join(dataDir, containerID+"-"+ifName)
+}
+
+func time2Tick(time uint32) uint32 {
+	return uint32(float64(time) * float64(netlink.TickInUsec()))
+}
+
+func buffer(rate uint64, burst uint32) uint32 {
+	return time2Tick(uint32(float64(burst) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rate)))
+}
+
+func limit(rate uint64, latency float64, buffer uint32) uint32 {
+	return uint32(float64(rate)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + buffer
+}
+
+// createTBF adds a root tbf qdisc to the link.
+// Equivalent to: `tc qdisc add dev $link root tbf rate $rate burst $burst latency 25ms`
+func createTBF(rateInBits, burstInBits int, link netlink.Link) error {
+	rateInBytes := uint64(rateInBits / 8)
+	burstInBytes := uint32(burstInBits / 8)
+	if rateInBytes == 0 || burstInBytes == 0 {
+		return fmt.Errorf("invalid limit: rate %d and burst %d must be at least 8 bits", rateInBits, burstInBits)
+	}
+
+	latency := float64(netlink.TIME_UNITS_PER_SEC) * latencyInMillis / 1000
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rateInBytes,
+		Limit:  limit(rateInBytes, latency, burstInBytes),
+		Buffer: buffer(rateInBytes, burstInBytes),
+	}
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		return fmt.Errorf("failed to add tbf qdisc to %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// createEgressQdisc shapes the traffic the container sends, which
+// arrives on the host interface, by redirecting it to an ifb device
+// with a tbf qdisc.
+func createEgressQdisc(rateInBits, burstInBits int, hostLink netlink.Link, ifbDevice string) error {
+	ifb := &netlink.Ifb{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: ifbDevice,
+			MTU:  hostLink.Attrs().MTU,
+		},
+	}
+	if err := netlink.LinkAdd(ifb); err != nil {
+		return fmt.Errorf("failed to add ifb device %q: %v", ifbDevice, err)
+	}
+	ifbLink, err := netlink.LinkByName(ifbDevice)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifbDevice, err)
+	}
+	if err = netlink.LinkSetUp(ifbLink); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", ifbDevice, err)
+	}
+
+	// tc qdisc add dev $host ingress
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: hostLink.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err = netlink.QdiscAdd(ingress); err != nil {
+		return fmt.Errorf("failed to add ingress qdisc to %q: %v", hostLink.Attrs().Name, err)
+	}
+
+	// tc filter add dev $host parent ffff: protocol all u32 match u32 0 0 \
+	//     action mirred egress redirect dev $ifb
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostLink.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		RedirIndex: ifbLink.Attrs().Index,
+	}
+	if err = netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to redirect %q to %q: %v", hostLink.Attrs().Name, ifbDevice, err)
+	}
+
+	return createTBF(rateInBits, burstInBits, ifbLink)
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if bw := conf.RuntimeConfig.Bandwidth; bw != nil && (bw.ingress() || bw.egress()) {
+		hostIface, err := hostInterface(conf)
+		if err != nil {
+			return err
+		}
+		hostLink, err := netlink.LinkByName(hostIface)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", hostIface, err)
+		}
+
+		// record the interface first, so that DEL cleans up whatever
+		// part of the setup was done
+		if err = os.MkdirAll(conf.DataDir, 0700); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(hostIfacePath(conf.DataDir, args.ContainerID, args.IfName), []byte(hostIface), 0600); err != nil {
+			return fmt.Errorf("failed to record the host interface %q: %v", hostIface, err)
+		}
+
+		// traffic to the container leaves through the host interface
+		if bw.ingress() {
+			if err = createTBF(bw.IngressRate, bw.IngressBurst, hostLink); err != nil {
+				return err
+			}
+		}
+		if bw.egress() {
+			if err = createEgressQdisc(bw.EgressRate, bw.EgressBurst, hostLink, ifbName(args.ContainerID, args.IfName)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Pass the result of the preceding plugin through unchanged
+	result, err := conf.ParsePrevResult()
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		result = &types.Result010{}
+	}
+	return result.Print()
+}
+
+// deleteQdiscs removes the root tbf and the ingress qdisc, along with
+// its filters, from the link.
+func deleteQdiscs(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", link.Attrs().Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		_, isTBF := qdisc.(*netlink.Tbf)
+		_, isIngress := qdisc.(*netlink.Ingress)
+		if (isTBF && qdisc.Attrs().Parent == netlink.HANDLE_ROOT) || isIngress {
+			if err := netlink.QdiscDel(qdisc); err != nil {
+				return fmt.Errorf("failed to delete %s qdisc of %q: %v", qdisc.Type(), link.Attrs().Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	path := hostIfacePath(conf.DataDir, args.ContainerID, args.IfName)
+	hostIface, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// no limits were set, or an earlier DEL removed them already
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the host interface of %q: %v", args.IfName, err)
+	}
+
+	// the host interface may be gone already with the container
+	hostLink, err := netlink.LinkByName(string(hostIface))
+	switch {
+	case ip.IsLinkNotFound(err):
+	case err != nil:
+		return fmt.Errorf("failed to lookup %q: %v", hostIface, err)
+	default:
+		if err = deleteQdiscs(hostLink); err != nil {
+			return err
+		}
+	}
+
+	ifbDevice := ifbName(args.ContainerID, args.IfName)
+	ifbLink, err := netlink.LinkByName(ifbDevice)
+	switch {
+	case ip.IsLinkNotFound(err):
+	case err != nil:
+		return fmt.Errorf("failed to lookup %q: %v", ifbDevice, err)
+	default:
+		if err = netlink.LinkDel(ifbLink); err != nil {
+			return fmt.Errorf("failed to delete %q: %v", ifbDevice, err)
+		}
+	}
+
+	return os.Remove(path)
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel, nil, version.PluginSupports("0.1.0", "0.2.0"))
+}
@@ -0,0 +1,224 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/testutils"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+const (
+	hostIfName = "bw-host0"
+	ifName     = "eth0"
+)
+
+var _ = Describe("bandwidth", func() {
+	var (
+		hostNSName string
+		hostNS     *os.File
+		dataDir    string
+	)
+
+	// runInHostNS runs the plugin from within the fake host namespace
+	runInHostNS := func(command, conf string) *gexec.Session {
+		return testutils.RunPluginInNS(hostNS, pathToBandwidthPlugin, testutils.PluginArgs{
+			Command:     command,
+			ContainerID: "some-container-id",
+			Netns:       "/some/netns",
+			IfName:      ifName,
+			Path:        "/some/bin/path",
+		}, conf)
+	}
+
+	// tc runs tc with args in the fake host namespace
+	tc := func(args ...string) string {
+		var out []byte
+		err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			var err error
+			out, err = exec.Command("tc", args...).CombinedOutput()
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred(), string(out))
+		return string(out)
+	}
+
+	linkExists := func(name string) bool {
+		var link netlink.Link
+		err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			link, _ = netlink.LinkByName(name)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return link != nil
+	}
+
+	ifbName := func() string {
+		var name string
+		err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			links, err := netlink.LinkList()
+			for _, link := range links {
+				if strings.HasPrefix(link.Attrs().Name, "bwp") {
+					name = link.Attrs().Name
+				}
+			}
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return name
+	}
+
+	prevResult := fmt.Sprintf(`{
+		"cniVersion": "0.2.0",
+		"interfaces": [
+			{ "name": %q },
+			{ "name": %q, "sandbox": "/some/netns" }
+		],
+		"ips": [ { "version": "4", "interface": 1, "address": "10.0.0.2/24" } ],
+		"dns": {}
+	}`, hostIfName, ifName)
+
+	makeConf := func(bandwidth, prevResult string) string {
+		return fmt.Sprintf(`{
+			"cniVersion": "0.2.0",
+			"name": "testnet",
+			"type": "bandwidth",
+			"dataDir": %q,
+			"runtimeConfig": { "bandwidth": %s },
+			"prevResult": %s
+		}`, dataDir, bandwidth, prevResult)
+	}
+
+	BeforeEach(func() {
+		if _, err := exec.LookPath("tc"); err != nil {
+			Skip("tc is not available")
+		}
+
+		var err error
+		hostNSName = fmt.Sprintf("test-bandwidth-host-%d", rand.Int())
+		hostNS, err = ns.CreateNetNS(hostNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "bandwidth-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		// stands in for the host end of the container's veth pair
+		err = ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: hostIfName},
+				PeerName:  hostIfName + "p",
+			})
+			if err != nil {
+				return err
+			}
+			link, err := netlink.LinkByName(hostIfName)
+			if err != nil {
+				return err
+			}
+			return netlink.LinkSetUp(link)
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(hostNSName)).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("shapes the traffic to the container with a tbf on the host interface", func() {
+		conf := makeConf(`{"ingressRate": 1000000, "ingressBurst": 80000}`, prevResult)
+
+		session := runInHostNS("ADD", conf)
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Out.Contents()).To(MatchJSON(prevResult))
+
+		qdiscs := tc("qdisc", "show", "dev", hostIfName)
+		Expect(qdiscs).To(MatchRegexp(`qdisc tbf 1: root .*rate 1Mbit`))
+		Expect(qdiscs).NotTo(ContainSubstring("ingress"))
+		Expect(ifbName()).To(BeEmpty())
+
+		session = runInHostNS("DEL", conf)
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(tc("qdisc", "show", "dev", hostIfName)).NotTo(ContainSubstring("tbf"))
+	})
+
+	It("shapes the traffic from the container on an ifb device", func() {
+		conf := makeConf(`{"egressRate": 2000000, "egressBurst": 80000}`, prevResult)
+
+		session := runInHostNS("ADD", conf)
+		Expect(session.ExitCode()).To(Equal(0))
+
+		qdiscs := tc("qdisc", "show", "dev", hostIfName)
+		Expect(qdiscs).To(ContainSubstring("qdisc ingress ffff:"))
+		Expect(qdiscs).NotTo(ContainSubstring("tbf"))
+
+		ifb := ifbName()
+		Expect(ifb).NotTo(BeEmpty())
+		Expect(tc("filter", "show", "dev", hostIfName, "parent", "ffff:")).To(ContainSubstring("Redirect to device " + ifb))
+		Expect(tc("qdisc", "show", "dev", ifb)).To(MatchRegexp(`qdisc tbf 1: root .*rate 2Mbit`))
+
+		session = runInHostNS("DEL", conf)
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(tc("qdisc", "show", "dev", hostIfName)).NotTo(ContainSubstring("ingress"))
+		Expect(linkExists(ifb)).To(BeFalse())
+	})
+
+	It("passes prevResult through without touching the host interface when there are no limits", func() {
+		session := runInHostNS("ADD", makeConf(`null`, prevResult))
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Out.Contents()).To(MatchJSON(prevResult))
+		Expect(tc("qdisc", "show", "dev", hostIfName)).NotTo(ContainSubstring("tbf"))
+	})
+
+	It("fails when prevResult does not name a host interface", func() {
+		sandboxed := fmt.Sprintf(`{
+			"cniVersion": "0.2.0",
+			"interfaces": [ { "name": %q, "sandbox": "/some/netns" } ]
+		}`, ifName)
+		session := runInHostNS("ADD", makeConf(`{"ingressRate": 1000000, "ingressBurst": 80000}`, sandboxed))
+		Expect(session.ExitCode()).To(Equal(1))
+		Expect(session.Out.Contents()).To(ContainSubstring("prevResult does not name a host interface"))
+		Expect(tc("qdisc", "show", "dev", hostIfName)).NotTo(ContainSubstring("tbf"))
+	})
+
+	It("fails when there is no prevResult", func() {
+		session := runInHostNS("ADD", makeConf(`{"ingressRate": 1000000, "ingressBurst": 80000}`, `null`))
+		Expect(session.ExitCode()).To(Equal(1))
+		Expect(session.Out.Contents()).To(ContainSubstring("prevResult does not name a host interface"))
+	})
+
+	It("refuses a rate without a burst", func() {
+		session := runInHostNS("ADD", makeConf(`{"egressRate": 1000000}`, prevResult))
+		Expect(session.ExitCode()).To(Equal(1))
+		Expect(session.Out.Contents()).To(ContainSubstring("invalid egress limit: rate and burst must be set together"))
+	})
+
+	It("succeeds on DEL when no limits were set", func() {
+		session := runInHostNS("DEL", makeConf(`null`, `null`))
+		Expect(session.ExitCode()).To(Equal(0))
+	})
+})
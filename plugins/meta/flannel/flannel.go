@@ -22,26 +22,26 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/appc/cni/pkg/invoke"
 	"github.com/appc/cni/pkg/skel"
 	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
 )
 
 const (
 	defaultSubnetFile = "/run/flannel/subnet.env"
-	stateDir          = "/var/lib/cni/flannel"
+	defaultDataDir    = "/var/lib/cni/flannel"
 )
 
 type NetConf struct {
 	types.NetConf
 	SubnetFile string                 `json:"subnetFile"`
+	DataDir    string                 `json:"dataDir"`
 	Delegate   map[string]interface{} `json:"delegate"`
 }
 
@@ -73,6 +73,7 @@ func (se *subnetEnv) missing() string {
 func loadFlannelNetConf(bytes []byte) (*NetConf, error) {
 	n := &NetConf{
 		SubnetFile: defaultSubnetFile,
+		DataDir:    defaultDataDir,
 	}
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
@@ -129,29 +130,14 @@ func loadFlannelSubnetEnv(fn string) (*subnetEnv, error) {
 	return se, nil
 }
 
-func saveScratchNetConf(containerID string, netconf []byte) error {
-	if err := os.MkdirAll(stateDir, 0700); err != nil {
-		return err
-	}
-	path := filepath.Join(stateDir, containerID)
-	return ioutil.WriteFile(path, netconf, 0600)
-}
-
-func consumeScratchNetConf(containerID string) ([]byte, error) {
-	path := filepath.Join(stateDir, containerID)
-	defer os.Remove(path)
-
-	return ioutil.ReadFile(path)
-}
-
-func delegateAdd(cid string, netconf map[string]interface{}) error {
+func delegateAdd(cid, dataDir, cniVersion string, netconf map[string]interface{}) error {
 	netconfBytes, err := json.Marshal(netconf)
 	if err != nil {
 		return fmt.Errorf("error serializing delegate netconf: %v", err)
 	}
 
 	// save the rendered netconf for cmdDel
-	if err = saveScratchNetConf(cid, netconfBytes); err != nil {
+	if err = invoke.SaveDelegateConf(cid, dataDir, netconfBytes); err != nil {
 		return err
 	}
 
@@ -160,7 +146,7 @@ func delegateAdd(cid string, netconf map[string]interface{}) error {
 		return err
 	}
 
-	return result.Print()
+	return types.PrintResult(result, cniVersion)
 }
 
 func hasKey(m map[string]interface{}, k string) bool {
@@ -200,6 +186,11 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	n.Delegate["name"] = n.Name
 
+	if !hasKey(n.Delegate, "cniVersion") && n.CNIVersion != "" {
+		// have the delegate answer in the version flannel was asked for
+		n.Delegate["cniVersion"] = n.CNIVersion
+	}
+
 	if !hasKey(n.Delegate, "type") {
 		n.Delegate["type"] = "bridge"
 	}
@@ -231,15 +222,24 @@ func cmdAdd(args *skel.CmdArgs) error {
 		},
 	}
 
-	return delegateAdd(args.ContainerID, n.Delegate)
+	return delegateAdd(args.ContainerID, n.DataDir, n.CNIVersion, n.Delegate)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	netconfBytes, err := consumeScratchNetConf(args.ContainerID)
+	nc, err := loadFlannelNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
+	netconfBytes, err := invoke.ConsumeDelegateConf(args.ContainerID, nc.DataDir)
+	if err != nil {
+		return err
+	}
+	if netconfBytes == nil {
+		// already deleted, or never added
+		return nil
+	}
+
 	n := &types.NetConf{}
 	if err = json.Unmarshal(netconfBytes, n); err != nil {
 		return fmt.Errorf("failed to parse netconf: %v", err)
@@ -249,5 +249,5 @@ func cmdDel(args *skel.CmdArgs) error {
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	skel.PluginMain(cmdAdd, cmdDel, nil, version.All)
 }
@@ -0,0 +1,56 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/onsi/gomega/gexec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+var pathToFlannelPlugin, cniPath string
+
+func TestFlannel(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Flannel Suite")
+}
+
+var _ = BeforeSuite(func() {
+	var err error
+	pathToFlannelPlugin, err = gexec.Build("github.com/appc/cni/plugins/meta/flannel")
+	Expect(err).NotTo(HaveOccurred())
+
+	pathToNoopPlugin, err := gexec.Build("github.com/appc/cni/plugins/test/noop")
+	Expect(err).NotTo(HaveOccurred())
+
+	// the delegates, bridge included, are all the noop plugin
+	cniPath, err = ioutil.TempDir("", "flannel-cni-path")
+	Expect(err).NotTo(HaveOccurred())
+	for _, name := range []string{"noop", "bridge"} {
+		Expect(os.Symlink(pathToNoopPlugin, filepath.Join(cniPath, name))).To(Succeed())
+	}
+})
+
+var _ = AfterSuite(func() {
+	os.RemoveAll(cniPath)
+	gexec.CleanupBuildArtifacts()
+})
@@ -0,0 +1,193 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/cni/plugins/test/noop/debug"
+	"github.com/onsi/gomega/gexec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("flannel", func() {
+	var (
+		dir        string
+		subnetFile string
+		dataDir    string
+		debugFile  string
+	)
+
+	writeSubnetEnv := func(contents string) {
+		Expect(ioutil.WriteFile(subnetFile, []byte(contents), 0644)).To(Succeed())
+	}
+
+	// makeConf returns a flannel config whose delegate has the given
+	// extra fields and records its invocations
+	makeConf := func(delegate string) string {
+		return fmt.Sprintf(`{
+			"name": "mynet",
+			"type": "flannel",
+			"subnetFile": %q,
+			"dataDir": %q,
+			"delegate": { %s "debugFile": %q }
+		}`, subnetFile, dataDir, delegate, debugFile)
+	}
+
+	run := func(command, conf string) *gexec.Session {
+		cmd := exec.Command(pathToFlannelPlugin)
+		cmd.Env = []string{
+			"CNI_COMMAND=" + command,
+			"CNI_CONTAINERID=some-container-id",
+			"CNI_NETNS=/some/netns",
+			"CNI_IFNAME=eth0",
+			"CNI_PATH=" + cniPath,
+		}
+		cmd.Stdin = strings.NewReader(conf)
+
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit())
+		return session
+	}
+
+	// delegated returns the command and netconf the delegate last received
+	delegated := func() (string, string) {
+		d, err := debug.ReadDebug(debugFile)
+		Expect(err).NotTo(HaveOccurred())
+		return d.Command, string(d.CmdArgs.StdinData)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "flannel-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		subnetFile = filepath.Join(dir, "subnet.env")
+		dataDir = filepath.Join(dir, "data")
+		debugFile = filepath.Join(dir, "debug.json")
+
+		writeSubnetEnv(`FLANNEL_NETWORK=10.1.0.0/16
+FLANNEL_SUBNET=10.1.17.1/24
+FLANNEL_MTU=1472
+FLANNEL_IPMASQ=true
+`)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("delegates ADD to bridge with the subnet, MTU and ipMasq of the subnet file", func() {
+		Expect(run("ADD", makeConf("")).ExitCode()).To(Equal(0))
+
+		command, netconf := delegated()
+		Expect(command).To(Equal("ADD"))
+		Expect(netconf).To(MatchJSON(fmt.Sprintf(`{
+			"name": "mynet",
+			"type": "bridge",
+			"mtu": 1472,
+			"ipMasq": false,
+			"isGateway": true,
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.17.0/24",
+				"routes": [ { "dst": "10.1.0.0/16" } ]
+			},
+			"debugFile": %q
+		}`, debugFile)))
+	})
+
+	It("has the delegate masquerade when flannel does not", func() {
+		writeSubnetEnv(`FLANNEL_NETWORK=10.1.0.0/16
+FLANNEL_SUBNET=10.1.17.1/24
+FLANNEL_MTU=1472
+FLANNEL_IPMASQ=false
+`)
+		Expect(run("ADD", makeConf("")).ExitCode()).To(Equal(0))
+
+		_, netconf := delegated()
+		Expect(netconf).To(ContainSubstring(`"ipMasq":true`))
+	})
+
+	It("keeps the MTU and ipMasq given in the delegate", func() {
+		Expect(run("ADD", makeConf(`"mtu": 1400, "ipMasq": true,`)).ExitCode()).To(Equal(0))
+
+		_, netconf := delegated()
+		Expect(netconf).To(ContainSubstring(`"mtu":1400`))
+		Expect(netconf).To(ContainSubstring(`"ipMasq":true`))
+	})
+
+	It("sets isGateway only for the bridge plugin", func() {
+		Expect(run("ADD", makeConf(`"type": "noop",`)).ExitCode()).To(Equal(0))
+
+		_, netconf := delegated()
+		Expect(netconf).To(ContainSubstring(`"type":"noop"`))
+		Expect(netconf).NotTo(ContainSubstring("isGateway"))
+	})
+
+	It("passes its cniVersion to the delegate and answers in that version", func() {
+		conf := strings.Replace(makeConf(""), `"name": "mynet",`, `"cniVersion": "0.2.0", "name": "mynet",`, 1)
+		session := run("ADD", conf)
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Out.Contents()).To(MatchJSON(`{"cniVersion": "0.2.0", "dns": {}}`))
+
+		_, netconf := delegated()
+		Expect(netconf).To(ContainSubstring(`"cniVersion":"0.2.0"`))
+	})
+
+	It("delegates DEL with the config generated on ADD, even after the subnet file changed", func() {
+		Expect(run("ADD", makeConf("")).ExitCode()).To(Equal(0))
+		_, added := delegated()
+
+		writeSubnetEnv(`FLANNEL_NETWORK=10.2.0.0/16
+FLANNEL_SUBNET=10.2.5.1/24
+FLANNEL_MTU=1400
+FLANNEL_IPMASQ=false
+`)
+		Expect(run("DEL", makeConf("")).ExitCode()).To(Equal(0))
+
+		command, deleted := delegated()
+		Expect(command).To(Equal("DEL"))
+		Expect(deleted).To(MatchJSON(added))
+		Expect(filepath.Join(dataDir, "some-container-id")).NotTo(BeAnExistingFile())
+	})
+
+	It("succeeds on a repeated DEL without calling the delegate again", func() {
+		Expect(run("ADD", makeConf("")).ExitCode()).To(Equal(0))
+		Expect(run("DEL", makeConf("")).ExitCode()).To(Equal(0))
+		Expect(os.Remove(debugFile)).To(Succeed())
+
+		Expect(run("DEL", makeConf("")).ExitCode()).To(Equal(0))
+		Expect(debugFile).NotTo(BeAnExistingFile())
+	})
+
+	It("fails when the subnet file lacks a variable", func() {
+		writeSubnetEnv(`FLANNEL_NETWORK=10.1.0.0/16
+FLANNEL_SUBNET=10.1.17.1/24
+`)
+		session := run("ADD", makeConf(""))
+		Expect(session.ExitCode()).To(Equal(1))
+		Expect(string(session.Out.Contents())).To(ContainSubstring(
+			fmt.Sprintf("%s is missing FLANNEL_MTU, FLANNEL_IPMASQ", subnetFile)))
+	})
+})
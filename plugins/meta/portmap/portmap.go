@@ -0,0 +1,271 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a "meta-plugin" that forwards ports of the host to the
+// container. It runs after the plugin that gave the container its
+// address, and DNATs the host ports of the runtime's portMappings to
+// that address with iptables.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/appc/cni/pkg/skel"
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/utils"
+	"github.com/appc/cni/pkg/utils/iptables"
+	"github.com/appc/cni/pkg/version"
+)
+
+// hostportChain is jumped to from PREROUTING and OUTPUT for traffic to
+// a local address, and jumps to the DNAT chain of every container. It
+// is shared by all containers and left in place.
+const hostportChain = "CNI-HOSTPORT-DNAT"
+
+type PortMapConf struct {
+	types.NetConf
+	// SNAT masquerades connections a container makes to its own host
+	// ports, which would otherwise be answered straight from the
+	// container's address. Defaults to true.
+	SNAT *bool `json:"snat,omitempty"`
+}
+
+// containerChains are the chains holding the rules of one container.
+type containerChains struct {
+	// dnat rewrites the host ports to the container
+	dnat string
+	// snat masquerades hairpin connections
+	snat string
+	// comment marks the jumps to the chains
+	comment string
+}
+
+func newContainerChains(name, containerID string) containerChains {
+	// both are derived from the chain name that other plugins use for
+	// the container, so they are as unique
+	hash := utils.FormatChainName(name, containerID)[len("CNI-"):]
+	return containerChains{
+		dnat:    "CNI-DN-" + hash[:len(hash)-len("DN-")],
+		snat:    "CNI-SN-" + hash[:len(hash)-len("SN-")],
+		comment: utils.FormatComment(name, containerID),
+	}
+}
+
+func loadConf(bytes []byte) (*PortMapConf, []types.PortMapping, error) {
+	conf := &PortMapConf{}
+	if err := json.Unmarshal(bytes, conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	mappings, err := types.ParsePortMappings(bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, m := range mappings {
+		if m.HostIP != "" && net.ParseIP(m.HostIP).To4() == nil {
+			return nil, nil, fmt.Errorf("invalid port mapping %d: hostIP %s is not an IPv4 address", i, m.HostIP)
+		}
+	}
+	return conf, mappings, nil
+}
+
+// containerIP returns the first IPv4 address of the preceding plugin's
+// result, preferring one on an interface inside a sandbox.
+func containerIP(conf *PortMapConf) (net.IP, error) {
+	prevResult, err := conf.ParsePrevResult()
+	if err != nil {
+		return nil, err
+	}
+	if prevResult == nil {
+		return nil, fmt.Errorf("prevResult is required to know the container IP to forward ports to")
+	}
+	res, err := prevResult.GetAsVersion("0.2.0")
+	if err != nil {
+		return nil, err
+	}
+	result := res.(*types.Result020)
+
+	var found net.IP
+	for _, addr := range result.IPs {
+		ip4 := addr.Address.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		if addr.Interface != nil && *addr.Interface < len(result.Interfaces) && result.Interfaces[*addr.Interface].Sandbox != "" {
+			return ip4, nil
+		}
+		if found == nil {
+			found = ip4
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("prevResult has no IPv4 address to forward ports to")
+	}
+	return found, nil
+}
+
+// dnatRules returns the rules of the DNAT chain, one per mapping.
+func dnatRules(mappings []types.PortMapping, contIP net.IP) [][]string {
+	var rules [][]string
+	for _, m := range mappings {
+		rule := []string{"-p", m.Protocol}
+		if m.HostIP != "" {
+			rule = append(rule, "-d", m.HostIP)
+		}
+		rule = append(rule,
+			"--dport", strconv.Itoa(m.HostPort),
+			"-j", "DNAT",
+			"--to-destination", net.JoinHostPort(contIP.String(), strconv.Itoa(m.ContainerPort)))
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// snatRules returns the rules of the SNAT chain: a connection from the
+// container to one of its own forwarded ports is masqueraded, so that
+// the reply goes back through the host and is un-DNATed.
+func snatRules(mappings []types.PortMapping, contIP net.IP) [][]string {
+	var rules [][]string
+	for _, m := range mappings {
+		rules = append(rules, []string{
+			"-p", m.Protocol,
+			"-s", contIP.String(),
+			"-d", contIP.String(),
+			"--dport", strconv.Itoa(m.ContainerPort),
+			"-j", "MASQUERADE",
+		})
+	}
+	return rules
+}
+
+// jumpRule is the rule jumping to chain from the chain it hangs off.
+func jumpRule(chain, comment string) []string {
+	return []string{"-j", chain, "-m", "comment", "--comment", comment}
+}
+
+// fillChain creates chain with rules in it.
+func fillChain(chain string, rules [][]string) error {
+	if err := iptables.EnsureChain("nat", chain); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := iptables.EnsureRule("nat", chain, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureHostportChain creates the shared chain and the jumps to it.
+func ensureHostportChain() error {
+	if err := iptables.EnsureChain("nat", hostportChain); err != nil {
+		return err
+	}
+	for _, chain := range []string{"PREROUTING", "OUTPUT"} {
+		if err := iptables.EnsureRule("nat", chain, []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", hostportChain}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func forwardPorts(conf *PortMapConf, chains containerChains, mappings []types.PortMapping, contIP net.IP) error {
+	if err := ensureHostportChain(); err != nil {
+		return err
+	}
+
+	// start over, so that the chains hold exactly the mappings given
+	// even if ADD runs again with others
+	if err := unforwardPorts(chains); err != nil {
+		return err
+	}
+
+	if err := fillChain(chains.dnat, dnatRules(mappings, contIP)); err != nil {
+		return err
+	}
+	if err := iptables.EnsureRule("nat", hostportChain, jumpRule(chains.dnat, chains.comment)); err != nil {
+		return err
+	}
+
+	if conf.SNAT != nil && !*conf.SNAT {
+		return nil
+	}
+	if err := fillChain(chains.snat, snatRules(mappings, contIP)); err != nil {
+		return err
+	}
+	return iptables.EnsureRule("nat", "POSTROUTING", jumpRule(chains.snat, chains.comment))
+}
+
+// unforwardPorts removes the chains of the container and the jumps to
+// them. It is safe to call again once they are gone.
+func unforwardPorts(chains containerChains) error {
+	for _, c := range []struct{ from, chain string }{
+		{hostportChain, chains.dnat},
+		{"POSTROUTING", chains.snat},
+	} {
+		if err := iptables.DeleteRule("nat", c.from, jumpRule(c.chain, chains.comment)); err != nil {
+			return err
+		}
+		if err := iptables.DeleteChain("nat", c.chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, mappings, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if len(mappings) > 0 {
+		contIP, err := containerIP(conf)
+		if err != nil {
+			return err
+		}
+		if err = forwardPorts(conf, newContainerChains(conf.Name, args.ContainerID), mappings, contIP); err != nil {
+			return err
+		}
+	}
+
+	// Pass the result of the preceding plugin through unchanged
+	result, err := conf.ParsePrevResult()
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		result = &types.Result010{}
+	}
+	return result.Print()
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// the mappings of DEL need not match those of ADD, so the chains
+	// are removed whatever they are
+	return unforwardPorts(newContainerChains(conf.Name, args.ContainerID))
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel, nil, version.PluginSupports("0.1.0", "0.2.0"))
+}
@@ -0,0 +1,241 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/testutils"
+	"github.com/appc/cni/pkg/types"
+	"github.com/coreos/go-iptables/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("portmap rules", func() {
+	mappings := []types.PortMapping{
+		{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+		{HostPort: 5353, ContainerPort: 53, Protocol: "udp", HostIP: "192.168.1.1"},
+	}
+	contIP := net.ParseIP("10.0.0.2")
+
+	It("DNATs every host port to the container", func() {
+		Expect(dnatRules(mappings, contIP)).To(Equal([][]string{
+			{"-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.0.0.2:80"},
+			{"-p", "udp", "-d", "192.168.1.1", "--dport", "5353", "-j", "DNAT", "--to-destination", "10.0.0.2:53"},
+		}))
+	})
+
+	It("masquerades the container reaching its own ports", func() {
+		Expect(snatRules(mappings, contIP)).To(Equal([][]string{
+			{"-p", "tcp", "-s", "10.0.0.2", "-d", "10.0.0.2", "--dport", "80", "-j", "MASQUERADE"},
+			{"-p", "udp", "-s", "10.0.0.2", "-d", "10.0.0.2", "--dport", "53", "-j", "MASQUERADE"},
+		}))
+	})
+
+	It("names per-container chains within the iptables limit", func() {
+		chains := newContainerChains("testnet", "some-container-id")
+		Expect(chains.dnat).To(HavePrefix("CNI-DN-"))
+		Expect(chains.snat).To(HavePrefix("CNI-SN-"))
+		Expect(len(chains.dnat)).To(BeNumerically("<=", 28))
+		Expect(len(chains.snat)).To(BeNumerically("<=", 28))
+
+		other := newContainerChains("testnet", "other-container-id")
+		Expect(other.dnat).NotTo(Equal(chains.dnat))
+		Expect(other.snat).NotTo(Equal(chains.snat))
+	})
+
+	It("forwards to the sandboxed interface's IPv4 address", func() {
+		conf, _, err := loadConf([]byte(`{
+			"name": "testnet",
+			"cniVersion": "0.2.0",
+			"prevResult": {
+				"cniVersion": "0.2.0",
+				"interfaces": [ { "name": "veth0" }, { "name": "eth0", "sandbox": "/some/netns" } ],
+				"ips": [
+					{ "version": "4", "interface": 0, "address": "10.0.0.1/24" },
+					{ "version": "6", "interface": 1, "address": "fd00::2/64" },
+					{ "version": "4", "interface": 1, "address": "10.0.0.2/24" }
+				]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(containerIP(conf)).To(Equal(net.ParseIP("10.0.0.2").To4()))
+	})
+
+	It("refuses an IPv6 host IP", func() {
+		_, _, err := loadConf([]byte(`{
+			"name": "testnet",
+			"runtimeConfig": { "portMappings": [
+				{ "hostPort": 8080, "containerPort": 80, "protocol": "tcp", "hostIP": "fd00::1" }
+			] }
+		}`))
+		Expect(err).To(MatchError("invalid port mapping 0: hostIP fd00::1 is not an IPv4 address"))
+	})
+})
+
+var _ = Describe("portmap", func() {
+	var (
+		hostNSName string
+		hostNS     *os.File
+	)
+
+	// runInHostNS runs the plugin from within the fake host namespace
+	runInHostNS := func(command, containerID, conf string) *gexec.Session {
+		return testutils.RunPluginInNS(hostNS, pathToPortMapPlugin, testutils.PluginArgs{
+			Command:     command,
+			ContainerID: containerID,
+			Netns:       "/some/netns",
+			IfName:      "eth0",
+			Path:        "/some/bin/path",
+		}, conf)
+	}
+
+	// listChain returns the rules of a nat chain in the fake host
+	// namespace, or nil if the chain does not exist
+	listChain := func(chain string) []string {
+		var rules []string
+		err := ns.WithNetNS(hostNS, true, func(_ *os.File) error {
+			ipt, err := iptables.New()
+			if err != nil {
+				return err
+			}
+			rules, _ = ipt.List("nat", chain)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return rules
+	}
+
+	prevResult := func(addr string) string {
+		return fmt.Sprintf(`{
+			"cniVersion": "0.2.0",
+			"interfaces": [ { "name": "eth0", "sandbox": "/some/netns" } ],
+			"ips": [ { "version": "4", "interface": 0, "address": %q } ],
+			"dns": {}
+		}`, addr)
+	}
+
+	makeConf := func(mappings, prevResult string) string {
+		return fmt.Sprintf(`{
+			"cniVersion": "0.2.0",
+			"name": "testnet",
+			"type": "portmap",
+			"runtimeConfig": { "portMappings": %s },
+			"prevResult": %s
+		}`, mappings, prevResult)
+	}
+
+	BeforeEach(func() {
+		if _, err := exec.LookPath("iptables"); err != nil {
+			Skip("iptables not available")
+		}
+
+		var err error
+		hostNSName = fmt.Sprintf("test-portmap-host-%d", rand.Int())
+		hostNS, err = ns.CreateNetNS(hostNSName)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if hostNS == nil {
+			return
+		}
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(hostNSName)).To(Succeed())
+		hostNS = nil
+	})
+
+	It("DNATs the host ports to the container on ADD and removes the chain on DEL", func() {
+		result := prevResult("10.0.0.2/24")
+		conf := makeConf(`[
+			{ "hostPort": 8080, "containerPort": 80, "protocol": "tcp" },
+			{ "hostPort": 5353, "containerPort": 53, "protocol": "udp", "hostIP": "192.168.1.1" }
+		]`, result)
+		chains := newContainerChains("testnet", "some-container-id")
+
+		session := runInHostNS("ADD", "some-container-id", conf)
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Out.Contents()).To(MatchJSON(result))
+
+		dnat := strings.Join(listChain(chains.dnat), "\n")
+		Expect(dnat).To(ContainSubstring(`-p tcp -m tcp --dport 8080 -m comment --comment "generated by CNI" -j DNAT --to-destination 10.0.0.2:80`))
+		Expect(dnat).To(ContainSubstring(`-d 192.168.1.1/32 -p udp -m udp --dport 5353 -m comment --comment "generated by CNI" -j DNAT --to-destination 10.0.0.2:53`))
+		Expect(strings.Join(listChain(hostportChain), "\n")).To(ContainSubstring("-j " + chains.dnat))
+		Expect(strings.Join(listChain(chains.snat), "\n")).To(ContainSubstring("-j MASQUERADE"))
+		Expect(strings.Join(listChain("PREROUTING"), "\n")).To(ContainSubstring("-j " + hostportChain))
+
+		session = runInHostNS("DEL", "some-container-id", conf)
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(listChain(chains.dnat)).To(BeEmpty())
+		Expect(listChain(chains.snat)).To(BeEmpty())
+		Expect(strings.Join(listChain(hostportChain), "\n")).NotTo(ContainSubstring(chains.dnat))
+		Expect(strings.Join(listChain("POSTROUTING"), "\n")).NotTo(ContainSubstring(chains.snat))
+	})
+
+	It("leaves the rules of other containers in place on DEL", func() {
+		mapping := `[ { "hostPort": 8080, "containerPort": 80, "protocol": "tcp" } ]`
+		confA := makeConf(mapping, prevResult("10.0.0.2/24"))
+		confB := makeConf(`[ { "hostPort": 8081, "containerPort": 80, "protocol": "tcp" } ]`, prevResult("10.0.0.3/24"))
+
+		Expect(runInHostNS("ADD", "container-a", confA).ExitCode()).To(Equal(0))
+		Expect(runInHostNS("ADD", "container-b", confB).ExitCode()).To(Equal(0))
+		Expect(runInHostNS("DEL", "container-a", confA).ExitCode()).To(Equal(0))
+
+		chainsB := newContainerChains("testnet", "container-b")
+		Expect(strings.Join(listChain(chainsB.dnat), "\n")).To(ContainSubstring("--to-destination 10.0.0.3:80"))
+		Expect(strings.Join(listChain(hostportChain), "\n")).To(ContainSubstring("-j " + chainsB.dnat))
+	})
+
+	It("does not masquerade when snat is disabled", func() {
+		conf := `{
+			"cniVersion": "0.2.0",
+			"name": "testnet",
+			"type": "portmap",
+			"snat": false,
+			"runtimeConfig": { "portMappings": [ { "hostPort": 8080, "containerPort": 80, "protocol": "tcp" } ] },
+			"prevResult": ` + prevResult("10.0.0.2/24") + `
+		}`
+		Expect(runInHostNS("ADD", "some-container-id", conf).ExitCode()).To(Equal(0))
+		Expect(listChain(newContainerChains("testnet", "some-container-id").snat)).To(BeEmpty())
+	})
+
+	It("passes prevResult through when there are no mappings", func() {
+		result := prevResult("10.0.0.2/24")
+		session := runInHostNS("ADD", "some-container-id", makeConf(`[]`, result))
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Out.Contents()).To(MatchJSON(result))
+		Expect(listChain(newContainerChains("testnet", "some-container-id").dnat)).To(BeEmpty())
+	})
+
+	It("fails without a container IP in prevResult", func() {
+		session := runInHostNS("ADD", "some-container-id", makeConf(`[ { "hostPort": 8080, "containerPort": 80, "protocol": "tcp" } ]`, `null`))
+		Expect(session.ExitCode()).To(Equal(1))
+		Expect(session.Out.Contents()).To(ContainSubstring("prevResult is required"))
+	})
+
+	It("succeeds on DEL when nothing was added", func() {
+		session := runInHostNS("DEL", "some-container-id", makeConf(`[]`, `null`))
+		Expect(session.ExitCode()).To(Equal(0))
+	})
+})
@@ -13,62 +13,176 @@
 // limitations under the License.
 
 // This is a "meta-plugin". It reads in its own netconf, it does not create
-// any network interface but just changes the network sysctl.
+// any network interface but just changes the network sysctl and some
+// attributes of the interface set up by a preceding plugin.
 
 package main
 
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
-	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
 
+	"github.com/appc/cni/pkg/ip"
 	"github.com/appc/cni/pkg/ns"
 	"github.com/appc/cni/pkg/skel"
 	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/utils/sysctl"
+	"github.com/appc/cni/pkg/version"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
 )
 
+// ifNamePlaceholder may be used as a component of a sysctl key to refer
+// to the container interface, e.g. "net.ipv4.conf.IFNAME.arp_filter".
+const ifNamePlaceholder = "IFNAME"
+
 // TuningConf represents the network tuning configuration.
 type TuningConf struct {
 	types.NetConf
-	SysCtl map[string]string `json:"sysctl"`
+	SysCtl     map[string]string `json:"sysctl"`
+	Mac        string            `json:"mac"`
+	MTU        int               `json:"mtu"`
+	TxQueueLen int               `json:"txQueueLen"`
+
+	hwAddr net.HardwareAddr
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*TuningConf, error) {
+	conf := &TuningConf{}
+	if err := json.Unmarshal(bytes, conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if conf.Mac != "" {
+		hwAddr, err := net.ParseMAC(conf.Mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mac %q: %v", conf.Mac, err)
+		}
+		conf.hwAddr = hwAddr
+	}
+	if conf.MTU < 0 {
+		return nil, fmt.Errorf("invalid mtu %d", conf.MTU)
+	}
+	if conf.TxQueueLen < 0 {
+		return nil, fmt.Errorf("invalid txQueueLen %d", conf.TxQueueLen)
+	}
+	return conf, nil
+}
+
+// sysctlName substitutes the container interface name for the IFNAME
+// placeholder in a sysctl key. Keys that do not belong to the network
+// subsystem are refused: only /proc/sys/net is per network namespace,
+// anything else would leak out of the container.
+func sysctlName(key, ifName string) (string, error) {
+	parts := strings.Split(key, ".")
+	for i, p := range parts {
+		if p == ifNamePlaceholder {
+			// dots in interface names are written as slashes
+			parts[i] = strings.Replace(ifName, ".", "/", -1)
+		}
+	}
+	name := strings.Join(parts, ".")
+
+	if !strings.HasPrefix(sysctl.Path(name), "/proc/sys/net/") {
+		return "", fmt.Errorf("invalid net sysctl key: %q", key)
+	}
+	return name, nil
+}
+
+// setTxQueueLen sets the transmit queue length of the link.
+// Equivalent to: `ip link set $link txqueuelen $qlen`
+func setTxQueueLen(link netlink.Link, qlen int) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_SETLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(syscall.IFLA_TXQLEN, nl.Uint32Attr(uint32(qlen))))
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+func configureIface(ifName string, conf *TuningConf) error {
+	if conf.hwAddr == nil && conf.MTU == 0 && conf.TxQueueLen == 0 {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	if conf.hwAddr != nil {
+		if err = netlink.LinkSetHardwareAddr(link, conf.hwAddr); err != nil {
+			return fmt.Errorf("failed to set %q mac to %v: %v", ifName, conf.hwAddr, err)
+		}
+	}
+	if conf.MTU != 0 {
+		if err = ip.SetMTU(link, conf.MTU); err != nil {
+			return err
+		}
+	}
+	if conf.TxQueueLen != 0 {
+		if err = setTxQueueLen(link, conf.TxQueueLen); err != nil {
+			return fmt.Errorf("failed to set %q txqueuelen to %d: %v", ifName, conf.TxQueueLen, err)
+		}
+	}
+	return nil
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
-	tuningConf := TuningConf{}
-	if err := json.Unmarshal(args.StdinData, &tuningConf); err != nil {
-		return fmt.Errorf("failed to load netconf: %v", err)
+	tuningConf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// Validate all keys before touching anything
+	names := make(map[string]string, len(tuningConf.SysCtl))
+	for key := range tuningConf.SysCtl {
+		name, err := sysctlName(key, args.IfName)
+		if err != nil {
+			return err
+		}
+		names[key] = name
 	}
 
 	// The directory /proc/sys/net is per network namespace. Enter in the
 	// network namespace before writing on it.
 
-	err := ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
+	err = ns.WithNetNSPath(args.Netns, false, func(hostNS *os.File) error {
 		for key, value := range tuningConf.SysCtl {
-			fileName := filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
-			fileName = filepath.Clean(fileName)
-
-			// Refuse to modify sysctl parameters that don't belong
-			// to the network subsystem.
-			if !strings.HasPrefix(fileName, "/proc/sys/net/") {
-				return fmt.Errorf("invalid net sysctl key: %q", key)
-			}
-			content := []byte(value)
-			err := ioutil.WriteFile(fileName, content, 0644)
-			if err != nil {
+			if _, err := sysctl.Sysctl(names[key], value); err != nil {
 				return err
 			}
 		}
-		return nil
+		return configureIface(args.IfName, tuningConf)
 	})
 	if err != nil {
 		return err
 	}
 
-	result := types.Result{}
-	return result.Print()
+	// Pass the result of the preceding plugin through unchanged
+	result, err := tuningConf.ParsePrevResult()
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		result = &types.Result010{}
+	}
+	return types.PrintResult(result, tuningConf.CNIVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -79,5 +193,5 @@ func cmdDel(args *skel.CmdArgs) error {
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	skel.PluginMain(cmdAdd, cmdDel, nil, version.All)
 }
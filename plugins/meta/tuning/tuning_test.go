@@ -0,0 +1,188 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/appc/cni/pkg/ns"
+	"github.com/appc/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+const ifName = "eth0"
+
+var _ = Describe("tuning", func() {
+	var (
+		contNSName string
+		contNS     *os.File
+	)
+
+	run := func(conf string) *gexec.Session {
+		cmd := exec.Command(pathToTuningPlugin)
+		cmd.Env = append(os.Environ(),
+			"CNI_COMMAND=ADD",
+			"CNI_CONTAINERID=some-container-id",
+			"CNI_NETNS="+contNS.Name(),
+			"CNI_IFNAME="+ifName,
+			"CNI_PATH=/some/bin/path",
+		)
+		cmd.Stdin = strings.NewReader(conf)
+
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session, "10s").Should(gexec.Exit())
+		return session
+	}
+
+	// readSysctl reads a file under /proc/sys/net as seen from the container
+	readSysctl := func(path string) string {
+		var value []byte
+		err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+			var err error
+			value, err = ioutil.ReadFile(path)
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return strings.TrimSpace(string(value))
+	}
+
+	inspectLink := func() netlink.Link {
+		var link netlink.Link
+		err := ns.WithNetNS(contNS, true, func(_ *os.File) error {
+			var err error
+			link, err = netlink.LinkByName(ifName)
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return link
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		contNSName = fmt.Sprintf("test-tuning-cont-%d", rand.Int())
+		contNS, err = ns.CreateNetNS(contNSName)
+		Expect(err).NotTo(HaveOccurred())
+
+		// stands in for the interface configured by the main plugin
+		err = ns.WithNetNS(contNS, true, func(_ *os.File) error {
+			return netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: ifName, MTU: 1500},
+				PeerName:  ifName + "p",
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(contNS.Close()).To(Succeed())
+		Expect(ns.DeleteNetNS(contNSName)).To(Succeed())
+	})
+
+	It("sets sysctls inside the container network namespace", func() {
+		hostSomaxconn, err := ioutil.ReadFile("/proc/sys/net/core/somaxconn")
+		Expect(err).NotTo(HaveOccurred())
+
+		session := run(`{
+			"name": "testnet",
+			"type": "tuning",
+			"sysctl": {
+				"net.core.somaxconn": "500",
+				"net.ipv4.conf.IFNAME.arp_filter": "1"
+			}
+		}`)
+		Expect(session.ExitCode()).To(Equal(0))
+
+		Expect(readSysctl("/proc/sys/net/core/somaxconn")).To(Equal("500"))
+		Expect(readSysctl("/proc/sys/net/ipv4/conf/eth0/arp_filter")).To(Equal("1"))
+
+		after, err := ioutil.ReadFile("/proc/sys/net/core/somaxconn")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(after).To(Equal(hostSomaxconn))
+	})
+
+	It("sets the MTU, MAC and transmit queue length of the interface", func() {
+		session := run(`{
+			"name": "testnet",
+			"type": "tuning",
+			"mtu": 1400,
+			"mac": "c2:11:22:33:44:55",
+			"txQueueLen": 2000
+		}`)
+		Expect(session.ExitCode()).To(Equal(0))
+
+		attrs := inspectLink().Attrs()
+		Expect(attrs.MTU).To(Equal(1400))
+		Expect(attrs.HardwareAddr.String()).To(Equal("c2:11:22:33:44:55"))
+		Expect(attrs.TxQLen).To(Equal(2000))
+	})
+
+	It("passes the result of the preceding plugin through unchanged", func() {
+		session := run(`{
+			"name": "testnet",
+			"type": "tuning",
+			"prevResult": {
+				"ip4": {
+					"ip": "10.1.2.3/24",
+					"gateway": "10.1.2.1"
+				},
+				"dns": {
+					"nameservers": ["10.1.2.1"]
+				}
+			}
+		}`)
+		Expect(session.ExitCode()).To(Equal(0))
+
+		result := types.Result010{}
+		Expect(json.Unmarshal(session.Out.Contents(), &result)).To(Succeed())
+		Expect(result.IP4).NotTo(BeNil())
+		Expect(result.IP4.IP.String()).To(Equal("10.1.2.3/24"))
+		Expect(result.IP4.Gateway.String()).To(Equal("10.1.2.1"))
+		Expect(result.DNS.Nameservers).To(Equal([]string{"10.1.2.1"}))
+	})
+
+	DescribeTable("rejects sysctls outside of the network namespace",
+		func(key string) {
+			session := run(fmt.Sprintf(`{
+				"name": "testnet",
+				"type": "tuning",
+				"sysctl": {
+					"net.core.somaxconn": "500",
+					%q: "1"
+				}
+			}`, key))
+			Expect(session.ExitCode()).To(Equal(1))
+			Expect(session.Out.Contents()).To(ContainSubstring("invalid net sysctl key"))
+
+			// nothing is applied if any key is invalid
+			Expect(readSysctl("/proc/sys/net/core/somaxconn")).NotTo(Equal("500"))
+		},
+		Entry("a kernel sysctl", "kernel.hostname"),
+		Entry("a file system sysctl", "fs.file-max"),
+		Entry("a bare net prefix", "net"),
+	)
+})
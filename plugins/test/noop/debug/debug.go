@@ -0,0 +1,55 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package debug is the record the noop test plugin keeps of how it was
+// invoked, for tests to read back.
+package debug
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/appc/cni/pkg/skel"
+)
+
+// Debug is the last invocation of the noop plugin.
+type Debug struct {
+	// Command is the CNI_COMMAND it was run with
+	Command string
+	// CmdArgs holds the remaining CNI_* variables and stdin
+	CmdArgs skel.CmdArgs
+}
+
+// ReadDebug reads the record written to path.
+func ReadDebug(path string) (*Debug, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Debug{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WriteDebug writes the record to path, replacing any earlier one.
+func (d *Debug) WriteDebug(path string) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
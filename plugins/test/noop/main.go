@@ -0,0 +1,130 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// noop is a plugin for tests. It records each invocation to the
+// debugFile of its config and answers with the configured result or
+// error, so that callers can check exactly what a plugin receives.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/appc/cni/pkg/skel"
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/pkg/version"
+	"github.com/appc/cni/plugins/test/noop/debug"
+)
+
+type NetConf struct {
+	types.NetConf
+	// DebugFile, if set, receives the record of the invocation
+	DebugFile string `json:"debugFile"`
+	// Result is printed as is on a successful ADD, in whatever
+	// version's layout it is written
+	Result json.RawMessage `json:"result"`
+	// Error, if set, fails the command
+	Error *types.Error `json:"error"`
+	// LogFile, if set, has a line appended when the command starts and
+	// one when it ends, Delay apart, to show if invocations overlap
+	LogFile string `json:"logFile"`
+	Delay   string `json:"delay"`
+}
+
+func appendLine(path, line string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, line)
+	return err
+}
+
+// logRun writes the start and end lines of the invocation to LogFile.
+func (c *NetConf) logRun(command string) error {
+	var delay time.Duration
+	if c.Delay != "" {
+		var err error
+		if delay, err = time.ParseDuration(c.Delay); err != nil {
+			return fmt.Errorf("invalid delay %q: %v", c.Delay, err)
+		}
+	}
+
+	if err := appendLine(c.LogFile, command+" start"); err != nil {
+		return fmt.Errorf("failed to write log file: %v", err)
+	}
+	time.Sleep(delay)
+	if err := appendLine(c.LogFile, command+" end"); err != nil {
+		return fmt.Errorf("failed to write log file: %v", err)
+	}
+	return nil
+}
+
+// record loads the config and writes the invocation to its debug file.
+func record(command string, args *skel.CmdArgs) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(args.StdinData, conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if conf.DebugFile != "" {
+		d := &debug.Debug{Command: command, CmdArgs: *args}
+		if err := d.WriteDebug(conf.DebugFile); err != nil {
+			return nil, fmt.Errorf("failed to write debug file: %v", err)
+		}
+	}
+
+	if conf.LogFile != "" {
+		if err := conf.logRun(command); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := record("ADD", args)
+	if err != nil {
+		return err
+	}
+
+	if conf.Error != nil {
+		return conf.Error
+	}
+
+	if conf.Result == nil {
+		return (&types.Result010{}).Print()
+	}
+	_, err = os.Stdout.Write(conf.Result)
+	return err
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := record("DEL", args)
+	if err != nil {
+		return err
+	}
+
+	if conf.Error != nil {
+		return conf.Error
+	}
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel, nil, version.PluginSupports("0.1.0", "0.2.0"))
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/cni/pkg/skel"
+	"github.com/appc/cni/pkg/types"
+	"github.com/appc/cni/plugins/test/noop/debug"
+	"github.com/onsi/gomega/gexec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("noop", func() {
+	var (
+		dir       string
+		debugFile string
+	)
+
+	run := func(command, conf string) *gexec.Session {
+		cmd := exec.Command(pathToNoopPlugin)
+		cmd.Env = []string{
+			"CNI_COMMAND=" + command,
+			"CNI_CONTAINERID=some-container-id",
+			"CNI_NETNS=/some/netns",
+			"CNI_IFNAME=eth7",
+			"CNI_ARGS=FOO=bar;IgnoreUnknown=1",
+			"CNI_PATH=/some/bin:/other/bin",
+		}
+		cmd.Stdin = strings.NewReader(conf)
+
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit())
+		return session
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "noop-test")
+		Expect(err).NotTo(HaveOccurred())
+		debugFile = filepath.Join(dir, "debug.json")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("records the command, the CNI_* variables and stdin of each invocation", func() {
+		conf := fmt.Sprintf(`{ "name": "testnet", "type": "noop", "debugFile": %q }`, debugFile)
+
+		for _, command := range []string{"ADD", "DEL"} {
+			Expect(run(command, conf).ExitCode()).To(Equal(0))
+
+			d, err := debug.ReadDebug(debugFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(d.Command).To(Equal(command))
+			Expect(d.CmdArgs).To(Equal(skel.CmdArgs{
+				ContainerID: "some-container-id",
+				Netns:       "/some/netns",
+				IfName:      "eth7",
+				Args:        "FOO=bar;IgnoreUnknown=1",
+				Path:        "/some/bin:/other/bin",
+				StdinData:   []byte(conf),
+			}))
+		}
+	})
+
+	It("prints the configured result on ADD", func() {
+		session := run("ADD", fmt.Sprintf(`{
+			"name": "testnet",
+			"type": "noop",
+			"debugFile": %q,
+			"result": { "ip4": { "ip": "10.1.2.3/24", "gateway": "10.1.2.1" } }
+		}`, debugFile))
+		Expect(session.ExitCode()).To(Equal(0))
+
+		result := &types.Result010{}
+		Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+		Expect(result.IP4.IP.String()).To(Equal("10.1.2.3/24"))
+		Expect(result.IP4.Gateway.String()).To(Equal("10.1.2.1"))
+	})
+
+	It("prints an empty result when none is configured", func() {
+		session := run("ADD", `{ "name": "testnet", "type": "noop" }`)
+		Expect(session.ExitCode()).To(Equal(0))
+
+		result := &types.Result010{}
+		Expect(json.Unmarshal(session.Out.Contents(), result)).To(Succeed())
+		Expect(result.IP4).To(BeNil())
+		Expect(result.IP6).To(BeNil())
+	})
+
+	It("fails with the configured error after recording the invocation", func() {
+		conf := fmt.Sprintf(`{
+			"name": "testnet",
+			"type": "noop",
+			"debugFile": %q,
+			"error": { "code": 11, "msg": "canned failure", "details": "from the config" }
+		}`, debugFile)
+
+		for _, command := range []string{"ADD", "DEL"} {
+			session := run(command, conf)
+			Expect(session.ExitCode()).To(Equal(1))
+
+			cniErr := &types.Error{}
+			Expect(json.Unmarshal(session.Out.Contents(), cniErr)).To(Succeed())
+			Expect(cniErr).To(Equal(&types.Error{Code: 11, Msg: "canned failure", Details: "from the config"}))
+
+			d, err := debug.ReadDebug(debugFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(d.Command).To(Equal(command))
+		}
+	})
+
+	It("logs the start and end of each invocation to the log file", func() {
+		logFile := filepath.Join(dir, "log")
+		conf := fmt.Sprintf(`{ "name": "testnet", "type": "noop", "logFile": %q, "delay": "10ms" }`, logFile)
+
+		Expect(run("ADD", conf).ExitCode()).To(Equal(0))
+		Expect(run("DEL", conf).ExitCode()).To(Equal(0))
+
+		log, err := ioutil.ReadFile(logFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(log)).To(Equal("ADD start\nADD end\nDEL start\nDEL end\n"))
+	})
+})